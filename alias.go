@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/Masterminds/log-go"
+	"github.com/tidwall/gjson"
+)
+
+// loadAliases reads the alias_parameter of each host.  An alias that's empty, contains whitespace or is already the
+// name of another host is ignored, as the inventory can't contain two hosts of the same name.
+func (inv *inventory) loadAliases(hosts gjson.Result) {
+	inv.aliases = make(map[string]string)
+	if cfg.AliasParameter == "" {
+		return
+	}
+	taken := make(map[string]bool)
+	results := hosts.Get("results").Array()
+	for _, h := range results {
+		if h.Get("name").Exists() {
+			taken[inventoryHostname(h.Get("name").String())] = true
+		}
+	}
+	for _, h := range results {
+		if !h.Get("name").Exists() {
+			continue
+		}
+		name := inventoryHostname(h.Get("name").String())
+		value, ok := inv.hostParameter(h, cfg.AliasParameter)
+		alias := strings.TrimSpace(value)
+		switch {
+		case !ok || alias == name:
+			continue
+		case alias == "" || strings.ContainsAny(alias, " \t\r\n"):
+			log.Warnf("Ignoring invalid %s %q of host %s", cfg.AliasParameter, value, name)
+			continue
+		case taken[alias]:
+			log.Warnf("Ignoring %s %q of host %s: Another host is already named %s", cfg.AliasParameter, alias, name, alias)
+			continue
+		}
+		log.Debugf("Host %s is aliased to %s", name, alias)
+		inv.aliases[name] = alias
+		taken[alias] = true
+	}
+}
+
+// hostname returns the name of a host in the output inventory, given its inventory hostname: Its alias, if it has one.
+func (inv *inventory) hostname(hostNameShort string) string {
+	if alias, ok := inv.aliases[hostNameShort]; ok {
+		return alias
+	}
+	return hostNameShort
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	"github.com/crooks/satinv/rules"
+)
+
+// assertCommand checks the inventory against a file of rules and returns an error if any rule is violated.
+func assertCommand(args []string) error {
+	fs := flag.NewFlagSet("assert", flag.ContinueOnError)
+	rulesFile := fs.String("rules", "", "YAML file of inventory rules")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *rulesFile == "" {
+		return errors.New("assert requires a rules file (--rules)")
+	}
+	r, err := rules.ParseRules(*rulesFile)
+	if err != nil {
+		return fmt.Errorf("unable to parse rules: %v", err)
+	}
+	inv, err := newInventory()
+	if err != nil {
+		return err
+	}
+	defer inv.close()
+	if err := inv.load(); err != nil {
+		return err
+	}
+	violations := r.Check(inv.json)
+	for _, v := range violations {
+		fmt.Printf("FAIL: %s\n", v)
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("%d of %d rules violated", len(violations), len(r.Rules))
+	}
+	fmt.Printf("PASS: %d rules satisfied\n", len(r.Rules))
+	return nil
+}
@@ -0,0 +1,124 @@
+// atomicfile writes files via a temporary file in the same directory, which is renamed into place once it's
+// complete.  Readers of a file never see partial content and a failed write leaves the previous content intact.
+package atomicfile
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// defaultMode is the mode of new files when no Mode is given.  It's restricted by the umask.
+const defaultMode os.FileMode = 0644
+
+// Perms are the permissions and ownership applied to written files
+type Perms struct {
+	Mode os.FileMode // Zero applies defaultMode, restricted by the umask.  Otherwise, the mode is applied exactly.
+	UID  int         // -1 retains the owner of the writing process
+	GID  int         // -1 retains the group of the writing process
+}
+
+// DefaultPerms are the Perms of files written without any configured permissions or ownership
+var DefaultPerms = Perms{UID: -1, GID: -1}
+
+// ParsePerms returns the Perms described by an octal mode (e.g. 0640) and the names, or numeric IDs, of an owner and
+// group.  Any of them may be empty to retain the default.
+func ParsePerms(mode, owner, group string) (Perms, error) {
+	p := DefaultPerms
+	if mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0777 {
+			return p, fmt.Errorf("mode %q is not an octal file mode", mode)
+		}
+		p.Mode = os.FileMode(m)
+	}
+	if owner != "" {
+		uid, err := strconv.Atoi(owner)
+		if err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return p, fmt.Errorf("unknown owner %q: %v", owner, err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		p.UID = uid
+	}
+	if group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return p, fmt.Errorf("unknown group %q: %v", group, err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		p.GID = gid
+	}
+	return p, nil
+}
+
+// CreateTemp creates a temporary file in the same directory as filename, for content that will replace it when
+// passed to Commit.  Unlike os.CreateTemp, the file is created with the default mode (restricted by the umask)
+// rather than 0600.
+func CreateTemp(filename string) (*os.File, error) {
+	dir, base := filepath.Split(filename)
+	for i := 0; i < 100; i++ {
+		suffix := make([]byte, 6)
+		if _, err := rand.Read(suffix); err != nil {
+			return nil, err
+		}
+		name := filepath.Join(dir, "."+base+".tmp"+hex.EncodeToString(suffix))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, defaultMode)
+		if os.IsExist(err) {
+			continue
+		}
+		return f, err
+	}
+	return nil, fmt.Errorf("unable to create a temporary file for %s", filename)
+}
+
+// Commit completes a temporary file created by CreateTemp: Its content is flushed to disk, the Perms are applied and
+// it's renamed to filename.  The temporary file is removed if any of these fail.
+func Commit(tmp *os.File, filename string, p Perms) error {
+	defer os.Remove(tmp.Name())
+	// The content must reach the disk before the rename, or a crash could leave an empty file in its place
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if p.Mode != 0 {
+		if err := os.Chmod(tmp.Name(), p.Mode); err != nil {
+			return err
+		}
+	}
+	if p.UID != -1 || p.GID != -1 {
+		if err := os.Chown(tmp.Name(), p.UID, p.GID); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return fmt.Errorf("unable to replace %s: %v", filename, err)
+	}
+	return nil
+}
+
+// Write replaces the content of a file, applying the given Perms.
+func Write(filename string, b []byte, p Perms) error {
+	tmp, err := CreateTemp(filename)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	return Commit(tmp, filename, p)
+}
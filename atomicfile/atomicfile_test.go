@@ -0,0 +1,80 @@
+package atomicfile
+
+import (
+	"os"
+	"path"
+	"syscall"
+	"testing"
+)
+
+func TestParsePerms(t *testing.T) {
+	p, err := ParsePerms("", "", "")
+	if err != nil {
+		t.Fatalf("ParsePerms failed: %v", err)
+	}
+	if p != DefaultPerms {
+		t.Errorf("Unexpected default Perms: %+v", p)
+	}
+	p, err = ParsePerms("0640", "0", "root")
+	if err != nil {
+		t.Fatalf("ParsePerms failed: %v", err)
+	}
+	if p.Mode != 0640 || p.UID != 0 || p.GID != 0 {
+		t.Errorf("Unexpected Perms: %+v", p)
+	}
+	for _, mode := range []string{"0999", "1777", "rw-r--r--"} {
+		if _, err := ParsePerms(mode, "", ""); err == nil {
+			t.Errorf("Expected mode %q to be rejected", mode)
+		}
+	}
+	if _, err := ParsePerms("", "no-such-user-satinv", ""); err == nil {
+		t.Error("Expected an unknown owner to be rejected")
+	}
+	if _, err := ParsePerms("", "", "no-such-group-satinv"); err == nil {
+		t.Error("Expected an unknown group to be rejected")
+	}
+}
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	filename := path.Join(dir, "inventory.json")
+	old := syscall.Umask(0027)
+	defer syscall.Umask(old)
+	// The default mode is restricted by the umask
+	if err := Write(filename, []byte("first"), DefaultPerms); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Unable to stat %s: %v", filename, err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("Unexpected default mode: Expected=0640, Got=%#o", fi.Mode().Perm())
+	}
+	// An explicit mode is applied regardless of the umask
+	if err := Write(filename, []byte("second"), Perms{Mode: 0604, UID: -1, GID: os.Getgid()}); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	fi, err = os.Stat(filename)
+	if err != nil {
+		t.Fatalf("Unable to stat %s: %v", filename, err)
+	}
+	if fi.Mode().Perm() != 0604 {
+		t.Errorf("Unexpected mode: Expected=0604, Got=%#o", fi.Mode().Perm())
+	}
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Unable to read %s: %v", filename, err)
+	}
+	if string(b) != "second" {
+		t.Errorf("Unexpected content: %q", b)
+	}
+	// No temporary files are left behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("Unable to read %s: %v", dir, err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected a single file in %s, got %d", dir, len(entries))
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/cidrs"
+	"github.com/crooks/satinv/config"
+)
+
+// serverAuth restricts access to the serve command's endpoints.  The inventory reveals the estate's hosts and network
+// topology, so it shouldn't be available to anyone who can reach the daemon.
+type serverAuth struct {
+	tokens     []string
+	viewTokens map[string][]string    // Tokens accepted by each view, in addition to tokens
+	allow      map[string]cidrs.Cidrs // Permitted client networks, keyed by endpoint.  Endpoints without an entry are open.
+}
+
+// newServerAuth returns the authentication configured for the serve command by c.  View tokens are refused without
+// server tokens, as the full inventory would then be open to anyone, including the holders of view tokens.
+func newServerAuth(c *config.Config) (*serverAuth, error) {
+	tokens, err := c.ServerTokens()
+	if err != nil {
+		return nil, err
+	}
+	a := &serverAuth{tokens: tokens, viewTokens: make(map[string][]string), allow: make(map[string]cidrs.Cidrs)}
+	for name, v := range c.Server.Views {
+		if len(v.Tokens) > 0 && len(tokens) == 0 {
+			return nil, fmt.Errorf("server views %s has tokens, but there are no server tokens to protect the full inventory", name)
+		}
+		a.viewTokens[name] = v.Tokens
+	}
+	for endpoint, nets := range c.Server.Allow {
+		a.allow[endpoint] = make(cidrs.Cidrs)
+		for _, n := range nets {
+			if err := a.allow[endpoint].AddCIDR(n, n); err != nil {
+				return nil, fmt.Errorf("server allow %s: %v", endpoint, err)
+			}
+		}
+	}
+	return a, nil
+}
+
+// endpointName returns the name of the endpoint of a request path, as used by server allow.
+func endpointName(path string) string {
+	switch {
+	case path == "/inventory" || strings.HasPrefix(path, "/inventory/"):
+		return "inventory"
+	case path == "/rpc":
+		return "rpc"
+	case strings.HasPrefix(path, "/debug/pprof/"):
+		return "pprof"
+	}
+	return ""
+}
+
+// clientIP returns the IP address of a request's client, or "" if it doesn't have one (e.g. over a unix socket).
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// allowed returns true if a client is permitted to use an endpoint.  When an endpoint has an allowlist, clients
+// without an IP address are refused.
+func (a *serverAuth) allowed(endpoint, ip string) bool {
+	nets, ok := a.allow[endpoint]
+	if !ok {
+		return true
+	}
+	return len(nets.ParseCIDRs(ip)) > 0
+}
+
+// bearerToken returns the token of a request's Authorization header.
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(h[7:])
+}
+
+// validToken returns true if token is one of tokens.  Every token is compared, in constant time, so the time taken
+// doesn't reveal how much of a token was correct.
+func validToken(token string, tokens []string) bool {
+	valid := false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+			valid = true
+		}
+	}
+	return token != "" && valid
+}
+
+// requestTokens returns the tokens that authenticate a request to a path: The server tokens and, for a view, its own
+// tokens.
+func (a *serverAuth) requestTokens(path string) []string {
+	if !strings.HasPrefix(path, "/inventory/") {
+		return a.tokens
+	}
+	return append(append([]string{}, a.tokens...), a.viewTokens[strings.TrimPrefix(path, "/inventory/")]...)
+}
+
+// handler wraps a handler with the endpoint allowlists and, if any tokens are configured for the request's path,
+// bearer token authentication.
+func (a *serverAuth) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint := endpointName(r.URL.Path)
+		if !a.allowed(endpoint, clientIP(r)) {
+			log.Warnf("Refused %s request from %s: Not in the %s allowlist", r.URL.Path, r.RemoteAddr, endpoint)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if tokens := a.requestTokens(r.URL.Path); len(tokens) > 0 && !validToken(bearerToken(r), tokens) {
+			log.Warnf("Refused %s request from %s: Invalid or missing bearer token", r.URL.Path, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="satinv"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serverTLS returns the TLS config of the serve command, or nil if TLS isn't configured.  With a client_ca_file,
+// clients must present a certificate signed by one of its CAs.
+func serverTLS() (*tls.Config, error) {
+	c := cfg.Server.TLS
+	if c.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load server certificate: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.ClientCAFile == "" {
+		return config, nil
+	}
+	pem, err := os.ReadFile(c.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read server client_ca_file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("server client_ca_file contains no certificates")
+	}
+	config.ClientCAs = pool
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+	return config, nil
+}
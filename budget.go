@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/notifier"
+)
+
+// buildBudget limits the time taken to refresh the inventory.  The refresh reports each phase it enters so that, if the
+// budget is exceeded, the phase responsible can be identified.  When the timer fires, it only cancels the build's
+// Context; the fallback runs on the build's own goroutine, when it next reports to the budget, so it never races with
+// the build.
+type buildBudget struct {
+	mu           sync.Mutex
+	timeout      time.Duration
+	start        time.Time
+	phase        string
+	phaseStart   time.Time
+	timer        *time.Timer
+	cancel       context.CancelFunc
+	finished     bool                                      // The build completed within the budget
+	expired      bool                                      // The budget has been exceeded and the build cancelled
+	expiredPhase string                                    // The phase in progress when the budget was exceeded
+	expiredAfter time.Duration                             // The time spent in that phase
+	onExpire     func(phase string, elapsed time.Duration) // Called, once, when the build sees the budget is exceeded
+}
+
+// newBuildBudget returns a budget that, once begun, cancels the returned Context, derived from parent, when the timeout
+// is exceeded, abandoning any outstanding work.  onExpire is then called by the build, which it's expected to end.
+func newBuildBudget(parent context.Context, timeout time.Duration, onExpire func(phase string, elapsed time.Duration)) (*buildBudget, context.Context) {
+	ctx, cancel := context.WithCancel(parent)
+	return &buildBudget{timeout: timeout, cancel: cancel, onExpire: onExpire}, ctx
+}
+
+// begin starts the budget's timer, at the start of the build.  Time spent before then, such as reading an inventory
+// that's still valid in the cache, isn't counted.  A nil budget imposes no limit.
+func (b *buildBudget) begin() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timer != nil {
+		return
+	}
+	b.start = time.Now()
+	b.phaseStart = b.start
+	b.timer = time.AfterFunc(b.timeout, b.expire)
+}
+
+// enter records the start of a new phase of the build.  A nil budget imposes no limit.  If the budget has been
+// exceeded, the build is abandoned instead.
+func (b *buildBudget) enter(phase string) {
+	if b == nil {
+		return
+	}
+	b.check()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endPhase()
+	b.phase = phase
+	b.phaseStart = time.Now()
+}
+
+// finish stops the budget on completion of the build.  If the budget has already been exceeded, the build is abandoned
+// instead.
+func (b *buildBudget) finish() {
+	if b == nil {
+		return
+	}
+	b.check()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endPhase()
+	b.finished = true
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	log.Debugf("Inventory build took %s of its %s budget", time.Since(b.start), b.timeout)
+}
+
+// check abandons the build, by calling onExpire, if the budget has been exceeded.  It must be called by the build, not
+// the timer.
+func (b *buildBudget) check() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	if !b.expired || b.onExpire == nil {
+		b.mu.Unlock()
+		return
+	}
+	onExpire, phase, elapsed := b.onExpire, b.expiredPhase, b.expiredAfter
+	b.onExpire = nil
+	b.mu.Unlock()
+	onExpire(phase, elapsed)
+}
+
+// endPhase logs the duration of the current phase.  It must be called with mu held.
+func (b *buildBudget) endPhase() {
+	if b.phase != "" {
+		log.Debugf("Build phase %s took %s", b.phase, time.Since(b.phaseStart))
+	}
+}
+
+// expire is called by the timer when the budget is exceeded.  It records the phase responsible and cancels the build,
+// so that outstanding API requests and enrichment return promptly.
+func (b *buildBudget) expire() {
+	b.mu.Lock()
+	if b.finished {
+		// The build finished just as the timer fired
+		b.mu.Unlock()
+		return
+	}
+	b.expired = true
+	b.expiredPhase = b.phase
+	b.expiredAfter = time.Since(b.phaseStart)
+	b.mu.Unlock()
+	b.cancel()
+}
+
+// buildTimeout returns the configured limit on the time taken to refresh the inventory, or zero if there's no limit.
+func buildTimeout() time.Duration {
+	return time.Duration(cfg.Build.Timeout) * time.Second
+}
+
+// limitBuild imposes the build.timeout budget on subsequent inventory refreshes, timed from the start of each.  If the budget is exceeded, the
+// refresh is abandoned and, depending on the on_timeout option, either the previous inventory is output in its place
+// or satinv exits with an error.
+func (inv *inventory) limitBuild() {
+	timeout := buildTimeout()
+	if timeout <= 0 {
+		return
+	}
+	inv.budget, inv.ctx = newBuildBudget(inv.ctx, timeout, func(phase string, elapsed time.Duration) {
+		msg := fmt.Sprintf("inventory build exceeded its %s timeout during the %s phase (after %s in that phase)", timeout, phase, elapsed.Round(time.Millisecond))
+		log.Error(msg)
+		inv.notify(notifier.KindAlert, "inventory build timed out", msg)
+		previous := inv.previousInventory()
+		if cfg.Build.OnTimeout == "error" || previous == "" {
+			inv.close()
+			exitf(exitRefused, "Abandoned inventory build: %s", msg)
+		}
+		log.Warn("Abandoned inventory build.  Using the previous inventory instead.")
+		inv.outputStale(previous)
+	})
+	inv.cache.SetContext(inv.ctx)
+}
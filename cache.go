@@ -0,0 +1,210 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/cacher"
+)
+
+// cacheCommand executes the "cache" subcommands.
+func cacheCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("cache requires a subcommand: invalidate, prune, status")
+	}
+	inv, err := newInventory()
+	if err != nil {
+		return err
+	}
+	// Subcommands may alter the cache content so the expiry file needs to be written on completion.
+	defer inv.cache.WriteExpiryFile()
+	switch args[0] {
+	case "invalidate":
+		if len(args) < 2 {
+			return errors.New("cache invalidate requires one or more items: hosts, collections or a key shown by cache status")
+		}
+		for _, item := range args[1:] {
+			keys, err := inv.invalidateItem(item)
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				fmt.Printf("Invalidated %s\n", k)
+			}
+		}
+	case "prune":
+		pruned, err := inv.pruneCache()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Pruned %d cache files\n", len(pruned))
+		for _, f := range pruned {
+			fmt.Printf("  %s\n", f)
+		}
+	case "status":
+		inv.cacheStatus()
+	default:
+		return fmt.Errorf("unknown cache subcommand: %s", args[0])
+	}
+	return nil
+}
+
+// cacheItemKeys returns the keys of the cache items named by item: "hosts" is the Satellite hosts, "collections" is
+// the list of Host Collections and every Collection's members, and anything else is a key as shown by cache status.
+func (inv *inventory) cacheItemKeys(item string) []string {
+	switch item {
+	case "hosts":
+		keys := []string{hostsURL()}
+		for _, k := range inv.cache.Keys() {
+			if hostsPageKey(k) {
+				keys = append(keys, k)
+			}
+		}
+		return keys
+	case "collections":
+		var keys []string
+		for _, k := range inv.cache.Keys() {
+			if _, ok := collectionHostsID(k); ok || strings.HasPrefix(k, cacher.NormalizeKey(collectionsBaseURL())) {
+				keys = append(keys, k)
+			}
+		}
+		return keys
+	}
+	return []string{item}
+}
+
+// hostsPageKey returns true if a cache key is that of a page of the hosts after the first (see hostsPageURL).
+func hostsPageKey(key string) bool {
+	u, err := url.Parse(key)
+	if err != nil {
+		return false
+	}
+	q := u.Query()
+	if q.Get("page") == "" || q.Get("page") == "1" {
+		return false
+	}
+	q.Del("page")
+	u.RawQuery = q.Encode()
+	return cacher.NormalizeKey(u.String()) == cacher.NormalizeKey(hostsURL())
+}
+
+// collectionHostsID returns the Host Collection ID of a cache key, and true, if it's the key of a Collection's hosts
+// search (see collectionHostsURL).  Keys are normalized, so the search isn't necessarily the last query parameter.
+func collectionHostsID(key string) (string, bool) {
+	u, err := url.Parse(key)
+	if err != nil {
+		return "", false
+	}
+	q := u.Query()
+	search := q.Get("search")
+	if !strings.HasPrefix(search, "host_collection_id=") {
+		return "", false
+	}
+	q.Del("search")
+	u.RawQuery = q.Encode()
+	if cacher.NormalizeKey(u.String()) != cacher.NormalizeKey(hostsURL()) {
+		return "", false
+	}
+	return strings.TrimPrefix(search, "host_collection_id="), true
+}
+
+// invalidateItem marks the cache items named by item (see cacheItemKeys) as expired, along with the inventory built
+// from them, so that only they're fetched afresh on the next run.  It returns the keys that were invalidated.
+func (inv *inventory) invalidateItem(item string) ([]string, error) {
+	keys := inv.cacheItemKeys(item)
+	for _, k := range keys {
+		if err := inv.cache.Invalidate(k); err != nil {
+			return nil, fmt.Errorf("unable to invalidate %s: %v", k, err)
+		}
+	}
+	if item != inventoryName {
+		if err := inv.cache.Invalidate(inventoryName); err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// pruneCache removes cache items for Host Collections that no longer exist in Satellite and then deletes any files in
+// the cache dir that are no longer referenced by the cache.
+func (inv *inventory) pruneCache() ([]string, error) {
+	if err := inv.initAPI(); err != nil {
+		return nil, err
+	}
+	collections, err := inv.getCollections()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read host collections: %v", err)
+	}
+	ids := make(map[string]bool)
+	for _, c := range collections.Get("results").Array() {
+		id := c.Get("id").String()
+		ids[id] = true
+		// Ensure current collections are registered, otherwise their files would be considered unreferenced.
+		inv.registerCollection(id)
+		if cfg.HostCollections.Mode == "search" {
+			inv.registerCollectionHosts(id)
+		}
+	}
+	// Both the Host Collection details and the hosts search are keyed by the Collection's ID
+	prefix := cacher.NormalizeKey(collectionURL(""))
+	for _, k := range inv.cache.Keys() {
+		id, ok := collectionHostsID(k)
+		if !ok && strings.HasPrefix(k, prefix) {
+			id, ok = strings.TrimPrefix(k, prefix), true
+		}
+		if !ok || ids[id] {
+			continue
+		}
+		log.Infof("Host Collection %s no longer exists.  Removing it from the cache.", id)
+		if err := inv.cache.Forget(k); err != nil {
+			return nil, err
+		}
+	}
+	return inv.cache.Prune()
+}
+
+// cacheStatus writes a table describing each cache item, followed by the hit/miss counters from the last run.
+func (inv *inventory) cacheStatus() {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ITEM\tTYPE\tFILE\tSIZE\tFETCH\tEXPIRY\tSTALE")
+	for _, s := range inv.cache.Status() {
+		itemType := "file"
+		if s.URL {
+			itemType = "url"
+		}
+		file := "-"
+		if s.File != "" {
+			file = s.File
+			if !s.Exists {
+				file += " (missing)"
+			}
+		}
+		expiry := "never fetched"
+		if s.Expiry.Unix() > 0 {
+			expiry = s.Expiry.Format(shortDate)
+		}
+		fetch := "-"
+		if s.Fetch > 0 {
+			fetch = s.Fetch.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%t\n", s.Key, itemType, file, s.Size, fetch, expiry, s.Stale)
+	}
+	w.Flush()
+	stats, err := inv.cache.LastStats()
+	if err != nil {
+		fmt.Printf("\nNo statistics available from a previous run: %v\n", err)
+		return
+	}
+	total := stats.Hits + stats.Misses
+	var ratio float64
+	if total > 0 {
+		ratio = float64(stats.Hits) / float64(total) * 100
+	}
+	fmt.Printf("\nLast run at %s: hits=%d, misses=%d (%.1f%% hit rate)\n", stats.Time.Format(shortDate), stats.Hits, stats.Misses, ratio)
+}
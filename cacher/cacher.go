@@ -1,72 +1,184 @@
-// cacher provides disk caching of json retrieved from APIs
+// cacher provides disk (or memory) caching of json retrieved from APIs
 package cacher
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
 	"os"
-	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/atomicfile"
 	"github.com/crooks/satinv/cacher/satapi"
+	"github.com/crooks/satinv/tracing"
 	"github.com/tidwall/gjson"
-	"github.com/tidwall/sjson"
 )
 
 const (
 	cacheExpiryFile string = "expire.json"
+	cacheStatsFile  string = "stats.json"
+	cacheLockFile   string = "refresh.lock"
 	iso8601         string = "2006-01-02T15:04:05Z"
 	shortDate       string = "2006-01-02 15:04:05 MST"
+	// defaultValidity is the validity period (in seconds) of ad-hoc queries, unless overridden by SetDefaultValidity.
+	defaultValidity int64 = 60 * 60
 )
 
 var (
 	errAPIInit = errors.New("API is not initialised")
 	errNoItem  = errors.New("requested item not in content cache")
+	// ErrChecksum indicates the content of a cache file doesn't match the checksum recorded when it was written.
+	ErrChecksum = errors.New("cache file checksum mismatch")
 )
 
+// FetchError is returned when an item can't be fetched from the API.  The API's error is retained, so it can be
+// examined with errors.As.
+type FetchError struct {
+	URL string
+	Err error
+}
+
+func (e *FetchError) Error() string {
+	return fmt.Sprintf("unable to parse %s: %v", e.URL, e.Err)
+}
+
+func (e *FetchError) Unwrap() error {
+	return e.Err
+}
+
 // Item contains variables relating to each item stored in the cache
 type Item struct {
-	url      bool   // If it's not a URL, it's a file
-	expiry   int64  // Epoch expiry time
-	file     string // Filename associated with the cached content
-	validity int64  // Validity period in seconds
+	url      bool          // If it's not a URL, it's a file
+	expiry   int64         // Epoch expiry time
+	file     string        // Filename associated with the cached content
+	validity int64         // Validity period in seconds
+	checksum string        // SHA-256 of the file content, recorded when the file was written
+	size     int64         // Size of the file content in bytes
+	etag     string        // ETag of the API response the content was fetched from
+	fetched  int64         // Epoch time the file was written
+	used     int64         // Epoch time the file was last read or written
+	duration time.Duration // Time taken to fetch the content from the API
 }
 
+// entry returns the record of an item in the expiry file.
+func (i Item) entry() expiryEntry {
+	e := expiryEntry{
+		Type:          "file",
+		Expiry:        i.expiry,
+		Checksum:      i.checksum,
+		Size:          i.size,
+		ETag:          i.etag,
+		Fetched:       i.fetched,
+		Used:          i.used,
+		FetchDuration: i.duration.Milliseconds(),
+	}
+	if i.url {
+		e.Type = "url"
+	}
+	if i.file != "" {
+		e.File = filepath.Base(i.file)
+	}
+	return e
+}
+
+// Cache manages the content map and expiry data of cached items.  It's safe for concurrent use.
 type Cache struct {
+	mu           sync.Mutex // Guards content and writeExpiry
 	api          *satapi.AuthClient
 	apiInit      bool // Test if the API has been initialised
 	cacheDir     string
 	content      map[string]Item // A cache of Item structs
 	cacheRefresh bool            // Ignore the cache and grab new URLs
+	refreshAhead float64         // Items within this percentage of their validity of expiring are treated as expired
 	writeExpiry  bool            // Write expiry data to disk
+	validity     int64           // Validity period of ad-hoc queries
+	stats        Stats           // Hit/Miss counters for the current run
+	dryRun       bool            // Nothing is written to disk
+	jitter       float64         // Maximum percentage by which validity periods are randomly adjusted
+	rng          *rand.Rand      // Source of jitter, guarded by mu
+	ctx          context.Context // Applied to API requests
+	aead         cipher.AEAD     // Encrypts cache files, when set by SetEncryptionKey
+	store        store           // Where cache files are kept
+}
+
+// Stats contains aggregate counters of cache usage during a run
+type Stats struct {
+	Hits   int64     `json:"hits"`   // Items served from the cache
+	Misses int64     `json:"misses"` // Items that had to be fetched from the API
+	Time   time.Time `json:"time"`   // When the counters were written
+}
+
+// ItemStatus describes the state of a single cache item
+type ItemStatus struct {
+	Key    string
+	URL    bool
+	File   string
+	Exists bool // The item's file exists
+	Size   int64
+	Expiry time.Time
+	Stale  bool // The item has expired or its file doesn't exist
+	// Fetch is the time taken by the last fetch of the item from the API, or 0 if it was written locally
+	Fetch time.Duration
 }
 
 // NewCacher creates and returns a new instance of Cache.  It takes a
 // directory name where cache files will be stored and will attempt to create
-// that directory if it doesn't exist.
-func NewCacher(cacheDir string) *Cache {
-	c := new(Cache)
+// that directory (and its parents) if it doesn't exist.
+func NewCacher(cacheDir string) (*Cache, error) {
 	if _, err := os.Stat(cacheDir); os.IsNotExist(err) {
-		err := os.Mkdir(cacheDir, 0755)
+		err := os.MkdirAll(cacheDir, 0755)
 		if err != nil {
-			log.Fatalf("Cannot create Cache dir: %s", cacheDir)
-			panic(err)
+			return nil, fmt.Errorf("cannot create cache dir: %v", err)
 		}
 		log.Debugf("Created cache dir: %s", cacheDir)
 	}
+	log.Infof("Cache dir set to: %s", cacheDir)
+	return newCache(cacheDir, diskStore{perms: atomicfile.DefaultPerms})
+}
+
+// NewMemoryCacher creates and returns a new instance of Cache that keeps its files, and expiry data, in memory instead
+// of on disk.  Content persists between instances that share the same Memory.
+func NewMemoryCacher(m *Memory) (*Cache, error) {
+	log.Info("Cache held in memory")
+	return newCache("", m)
+}
+
+// newCache returns a Cache that keeps its files in a store, populated with the expiry data it contains.
+func newCache(cacheDir string, s store) (*Cache, error) {
+	c := new(Cache)
 	c.cacheDir = cacheDir
-	log.Infof("Cache dir set to: %s", c.cacheDir)
+	c.store = s
 	c.content = make(map[string]Item)
+	c.validity = defaultValidity
+	c.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
 	// This is the only time the expire JSON is read from file.  After this, it resides in memory and only gets written
-	// to file.  If the read fails, the Cache is assumed to be empty.
-	c.importExpiry()
-	return c
+	// to file.  If the file doesn't exist, the Cache is assumed to be empty.
+	if err := c.importExpiry(); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
 
 // getItem returns a requested item from the content cache
 func (c *Cache) getItem(itemKey string) (Item, error) {
+	itemKey = NormalizeKey(itemKey)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	item, ok := c.content[itemKey]
 	if !ok {
 		return item, errNoItem
@@ -84,8 +196,31 @@ func (c *Cache) GetFilename(itemKey string) (string, error) {
 }
 
 // InitAPI constructs a new instance of the Satellite API
-func (c *Cache) InitAPI(username, password, cert string) {
-	c.api = satapi.NewBasicAuthClient(username, password, cert)
+func (c *Cache) InitAPI(username, password string, opts satapi.Options) error {
+	api, err := satapi.NewBasicAuthClient(username, password, opts)
+	if err != nil {
+		return err
+	}
+	c.setAPI(api)
+	return nil
+}
+
+// InitNegotiateAPI constructs a new instance of the Satellite API that authenticates with SPNEGO (Kerberos)
+func (c *Cache) InitNegotiateAPI(n satapi.Negotiate, opts satapi.Options) error {
+	api, err := satapi.NewNegotiateClient(n, opts)
+	if err != nil {
+		return err
+	}
+	c.setAPI(api)
+	return nil
+}
+
+// setAPI makes an API client the source of URL items.
+func (c *Cache) setAPI(api *satapi.AuthClient) {
+	if c.ctx != nil {
+		api.SetContext(c.ctx)
+	}
+	c.api = api
 	c.apiInit = true
 }
 
@@ -95,8 +230,74 @@ func (c *Cache) SetRefresh() {
 	log.Info("Forcing cache refresh")
 }
 
+// SetContext associates a Context with API requests made by the cache.  When it's cancelled, outstanding requests are
+// abandoned and return an error.
+func (c *Cache) SetContext(ctx context.Context) {
+	c.ctx = ctx
+	if c.api != nil {
+		c.api.SetContext(ctx)
+	}
+}
+
+// context returns the Context set by SetContext.
+func (c *Cache) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// SetDefaultValidity sets the validity period (in seconds) applied to ad-hoc queries made with Query.
+func (c *Cache) SetDefaultValidity(validity int64) {
+	c.validity = validity
+}
+
+// SetDryRun prevents the cache writing anything to disk.  Content fetched from the API is returned to the caller but
+// not stored, and expiry data is not updated.
+func (c *Cache) SetDryRun() {
+	c.dryRun = true
+	log.Info("Dry run: the cache will not be written")
+}
+
+// SetJitter randomly adjusts the validity period of items by up to the given percentage (in either direction) each time
+// their expiry is reset.  This spreads out refreshes when many hosts share identical validity settings.
+func (c *Cache) SetJitter(percent float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if percent < 0 {
+		percent = 0
+	}
+	c.jitter = percent
+}
+
+// SetPerms sets the permissions and ownership of cache files written to disk.  It has no effect on a Cache held in
+// memory.
+func (c *Cache) SetPerms(p atomicfile.Perms) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, onDisk := c.store.(diskStore); onDisk {
+		c.store = diskStore{perms: p}
+	}
+}
+
+// jitteredValidity returns a validity period, randomly adjusted by the configured jitter.  It must be called with mu
+// held.
+func (c *Cache) jitteredValidity(validity int64) int64 {
+	if c.jitter == 0 {
+		return validity
+	}
+	maxAdjust := float64(validity) * c.jitter / 100
+	// Adjust by a random amount in the range -maxAdjust to +maxAdjust
+	adjusted := validity + int64((c.rng.Float64()*2-1)*maxAdjust)
+	if adjusted < 0 {
+		return 0
+	}
+	return adjusted
+}
+
 // HasExpired takes a cache item and determines if it needs refreshing
 func (c *Cache) HasExpired(itemKey string) (refresh bool, err error) {
+	itemKey = NormalizeKey(itemKey)
 	// Test if the cache content map contains this item
 	item, err := c.getItem(itemKey)
 	if err != nil {
@@ -106,7 +307,7 @@ func (c *Cache) HasExpired(itemKey string) (refresh bool, err error) {
 		// Instructed to force a refresh
 		log.Debugf("Forced refresh of %s", itemKey)
 		refresh = true
-	} else if _, existErr := os.Stat(item.file); os.IsNotExist(existErr) {
+	} else if !exists(c.store, item.file) {
 		// File associated with the URL doesn't exist
 		log.Infof("Cache file for URL %s does not exist", itemKey)
 		refresh = true
@@ -114,6 +315,9 @@ func (c *Cache) HasExpired(itemKey string) (refresh bool, err error) {
 		// The Cache entry has expired
 		log.Debugf("Cache for %s has expired", itemKey)
 		refresh = true
+	} else if c.refreshAhead > 0 && expiresWithin(item, c.refreshAhead) {
+		log.Debugf("Cache for %s expires at %s.  Refreshing it ahead of expiry.", itemKey, timeEpoch(item.expiry))
+		refresh = true
 	} else {
 		log.Debugf("Cache for %s is valid until %s", itemKey, timeEpoch(item.expiry))
 		refresh = false
@@ -121,26 +325,95 @@ func (c *Cache) HasExpired(itemKey string) (refresh bool, err error) {
 	return
 }
 
-func (c *Cache) addItem(itemKey string, expireEpoch int64, isURL bool) (err error) {
+// expiresWithin returns true if an item will expire within the given percentage of its validity period.
+func expiresWithin(item Item, percent float64) bool {
+	remaining := item.expiry - time.Now().Unix()
+	return float64(remaining) <= float64(item.validity)*percent/100
+}
+
+// SetRefreshAhead instructs HasExpired to treat items that will expire within the given percentage of their validity
+// period as expired, so that they're refreshed ahead of expiry.
+func (c *Cache) SetRefreshAhead(percent float64) {
+	c.refreshAhead = percent
+}
+
+// ExpiresSoon returns true if an item, which may still be valid, will expire within the given percentage of its
+// validity period.
+func (c *Cache) ExpiresSoon(itemKey string, percent float64) (bool, error) {
+	item, err := c.getItem(itemKey)
+	if err != nil {
+		return false, err
+	}
+	return expiresWithin(item, percent), nil
+}
+
+// LockRefresh takes the lock that prevents concurrent background refreshes of the cache.  It returns false if
+// another process holds the lock, unless the lock is older than maxAge and so presumed to have been abandoned.  A
+// Cache held in memory is never locked.
+func (c *Cache) LockRefresh(maxAge time.Duration) (bool, error) {
+	if _, onDisk := c.store.(diskStore); !onDisk {
+		return false, nil
+	}
+	lock := filepath.Join(c.cacheDir, cacheLockFile)
+	if fi, err := os.Stat(lock); err == nil && time.Since(fi.ModTime()) > maxAge {
+		log.Warnf("Removing abandoned refresh lock, created at %s", fi.ModTime().Format(shortDate))
+		os.Remove(lock)
+	}
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	fmt.Fprintln(f, os.Getpid())
+	return true, f.Close()
+}
+
+// UnlockRefresh releases the lock taken by LockRefresh.
+func (c *Cache) UnlockRefresh() error {
+	err := os.Remove(filepath.Join(c.cacheDir, cacheLockFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (c *Cache) addItem(itemKey string, e expiryEntry) (err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	item, ok := c.content[itemKey]
 	if ok {
 		// Cache item already exists.  Why?
 		log.Errorf("Cache item %s should not exist prior to addItem", itemKey)
 	}
-	item.expiry = expireEpoch
-	item.url = isURL
+	item.expiry = e.Expiry
+	item.url = e.Type == "url"
+	item.checksum = e.Checksum
+	item.size = e.Size
+	item.etag = e.ETag
+	item.fetched = e.Fetched
+	item.used = e.Used
+	item.duration = time.Duration(e.FetchDuration) * time.Millisecond
+	if e.File != "" {
+		item.file = filepath.Join(c.cacheDir, e.File)
+	}
 	c.content[itemKey] = item
 	return
 }
 
 // ResetExpire resets the expiry field of a cache Item to current time + the defined validity period
 func (c *Cache) ResetExpire(itemKey string) (err error) {
-	item, err := c.getItem(itemKey)
-	if err != nil {
+	itemKey = NormalizeKey(itemKey)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.content[itemKey]
+	if !ok {
+		err = errNoItem
 		return
 	}
-	item.expiry = time.Now().Unix() + item.validity
-	log.Debugf("Expiry for item %s extended by %d seconds to %s", itemKey, item.validity, timeEpoch(item.expiry))
+	validity := c.jitteredValidity(item.validity)
+	item.expiry = time.Now().Unix() + validity
+	log.Debugf("Expiry for item %s extended by %d seconds to %s", itemKey, validity, timeEpoch(item.expiry))
 	c.content[itemKey] = item
 	// Setting WriteExpire indicates the cache file needs to be rewritten (something has changed).
 	c.writeExpiry = true
@@ -150,10 +423,13 @@ func (c *Cache) ResetExpire(itemKey string) (err error) {
 // AddURL registers a URL with a filename to contain its cached data.  If the URL has no expiry associated with it, a
 // new entry is created in the expiry cache and immediately set to expired.
 func (c *Cache) AddURL(itemKey, fileName string, validity int64) {
+	itemKey = NormalizeKey(itemKey)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	item, ok := c.content[itemKey]
 	item.url = true
 	item.validity = validity
-	item.file = path.Join(c.cacheDir, fileName)
+	item.file = filepath.Join(c.cacheDir, fileName)
 	if !ok {
 		// If the item was imported from the expiry file, this will already be set
 		log.Debugf("Cache item %s is unknown.  Marking it as expired.", itemKey)
@@ -164,81 +440,254 @@ func (c *Cache) AddURL(itemKey, fileName string, validity int64) {
 
 // AddFile registers a file into the content cache.
 func (c *Cache) AddFile(itemKey, fileName string, validity int64) {
+	itemKey = NormalizeKey(itemKey)
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	item, ok := c.content[itemKey]
 	item.url = false
 	item.validity = validity
-	item.file = path.Join(c.cacheDir, fileName)
+	item.file = filepath.Join(c.cacheDir, fileName)
 	if !ok {
 		item.expiry = 0
 	}
 	c.content[itemKey] = item
 }
 
-// importExpiry reads the Expiry Cache File and populates the cacheExpiry map.  Entries over 7 days old are ignored.
-func (c *Cache) importExpiry() {
-	expiryFilePath := path.Join(c.cacheDir, cacheExpiryFile)
-	j, err := c.jsonFromFile(expiryFilePath)
+// Keys returns a sorted list of all the items in the content cache.
+func (c *Cache) Keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.content))
+	for k := range c.content {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Invalidate marks an item as expired, so it's refreshed the next time it's requested.  Unlike Forget, the item
+// remains registered and its file is retained.
+func (c *Cache) Invalidate(itemKey string) error {
+	itemKey = NormalizeKey(itemKey)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.content[itemKey]
+	if !ok {
+		return errNoItem
+	}
+	item.expiry = 0
+	c.content[itemKey] = item
+	c.writeExpiry = true
+	log.Debugf("Invalidated cache item %s", itemKey)
+	return nil
+}
+
+// Forget removes an item from the content cache and deletes its associated file.
+func (c *Cache) Forget(itemKey string) error {
+	itemKey = NormalizeKey(itemKey)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.content[itemKey]
+	if !ok {
+		return errNoItem
+	}
+	delete(c.content, itemKey)
+	c.writeExpiry = true
+	if item.file == "" || c.dryRun {
+		return nil
+	}
+	err := c.store.remove(item.file)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	log.Debugf("Removed cache item %s and its file %s", itemKey, item.file)
+	return nil
+}
+
+// Prune deletes files in the cache dir that aren't associated with any item in the content cache.  It returns the
+// names of the deleted files.
+func (c *Cache) Prune() (pruned []string, err error) {
+	c.mu.Lock()
+	referenced := make(map[string]bool)
+	for _, item := range c.content {
+		if item.file != "" {
+			referenced[filepath.Base(item.file)] = true
+		}
+	}
+	c.mu.Unlock()
+	names, err := c.store.list(c.cacheDir)
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			log.Debugf("%s: Cache file does not exist.  Treating as empty cache", expiryFilePath)
-		} else {
-			log.Fatalf("%s: Failed to read Cache file: %v", expiryFilePath, err)
+		return
+	}
+	for _, name := range names {
+		if name == cacheExpiryFile || name == cacheStatsFile || name == cacheLockFile || referenced[name] {
+			continue
+		}
+		if c.dryRun {
+			pruned = append(pruned, name)
+			continue
+		}
+		err = c.store.remove(filepath.Join(c.cacheDir, name))
+		if err != nil {
+			return
+		}
+		log.Debugf("Pruned unreferenced cache file: %s", name)
+		pruned = append(pruned, name)
+	}
+	return
+}
+
+// Status returns the state of every item in the content cache, sorted by key.
+func (c *Cache) Status() []ItemStatus {
+	now := time.Now()
+	var status []ItemStatus
+	for _, k := range c.Keys() {
+		item, err := c.getItem(k)
+		if err != nil {
+			continue
+		}
+		s := ItemStatus{
+			Key:    k,
+			URL:    item.url,
+			File:   item.file,
+			Expiry: time.Unix(item.expiry, 0),
+			Fetch:  item.duration,
+		}
+		if item.file != "" {
+			if size, err := c.store.size(item.file); err == nil {
+				s.Exists = true
+				s.Size = size
+			}
 		}
+		s.Stale = !s.Exists || now.After(s.Expiry)
+		status = append(status, s)
+	}
+	return status
+}
+
+// countHit increments the counter of items served from the cache.
+func (c *Cache) countHit() {
+	c.mu.Lock()
+	c.stats.Hits++
+	c.mu.Unlock()
+}
+
+// countMiss increments the counter of items that had to be fetched.
+func (c *Cache) countMiss() {
+	c.mu.Lock()
+	c.stats.Misses++
+	c.mu.Unlock()
+}
+
+// Stats returns the hit/miss counters for the current run.
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// WriteStats writes the hit/miss counters for the current run to the stats file.
+func (c *Cache) WriteStats() error {
+	if c.dryRun {
+		return nil
+	}
+	stats := c.Stats()
+	stats.Time = time.Now()
+	b, err := json.Marshal(stats)
+	if err != nil {
+		return err
+	}
+	return c.store.writeFile(filepath.Join(c.cacheDir, cacheStatsFile), append(b, '\n'))
+}
+
+// LastStats returns the hit/miss counters written by a previous run.
+func (c *Cache) LastStats() (stats Stats, err error) {
+	b, err := c.store.readFile(filepath.Join(c.cacheDir, cacheStatsFile))
+	if err != nil {
 		return
 	}
+	err = json.Unmarshal(b, &stats)
+	return
+}
+
+// importExpiry reads the Expiry Cache File and populates the cacheExpiry map.  Entries over 7 days old are ignored.
+func (c *Cache) importExpiry() error {
+	expiryFilePath := filepath.Join(c.cacheDir, cacheExpiryFile)
+	j, err := c.jsonFromFile(expiryFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Debugf("%s: Cache file does not exist.  Treating as empty cache", expiryFilePath)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("%s: failed to read cache file: %v", expiryFilePath, err)
+	}
+	j, migrated, err := migrateExpiry(j)
+	if err != nil {
+		log.Warnf("%s: %v.  Treating as empty cache", expiryFilePath, err)
+		return nil
+	}
+	if migrated {
+		log.Infof("%s: Migrated to schema version %d", expiryFilePath, expiryVersion)
+		c.writeExpiry = true
+	}
 	// Populate the cacheExpiry map
 	// ageLimit is used to prune out old entries from the Cache File.
 	// The hard limit it set to 7 days.
 	ageLimit := time.Now().Unix() - (7 * 24 * 60 * 60)
-	for k, v := range j.Get("urls").Map() {
-		epochExpiry := v.Int()
-		if epochExpiry > ageLimit {
-			log.Debugf("Importing Cache entry: url=%s, expiry=%s", k, timeEpoch(epochExpiry))
-			c.addItem(k, epochExpiry, true)
+	j.Get("items").ForEach(func(k, v gjson.Result) bool {
+		var e expiryEntry
+		if err := json.Unmarshal([]byte(v.Raw), &e); err != nil {
+			log.Warnf("%s: Ignoring invalid entry for %s: %v", expiryFilePath, k.String(), err)
+			return true
 		}
-	}
-	for k, v := range j.Get("files").Map() {
-		epochExpiry := v.Int()
-		if epochExpiry > ageLimit {
-			log.Debugf("Importing Cache entry: file=%s, expiry=%s", k, timeEpoch(epochExpiry))
-			c.addItem(k, epochExpiry, false)
+		if e.Expiry <= ageLimit {
+			return true
 		}
-	}
+		// Files written before keys were normalized may have several entries for equivalent URLs.  The latest to
+		// expire is kept and the others' files are left to be pruned.
+		key := NormalizeKey(k.String())
+		if key != k.String() {
+			c.writeExpiry = true
+		}
+		if item, err := c.getItem(key); err == nil {
+			if item.expiry >= e.Expiry {
+				return true
+			}
+			c.mu.Lock()
+			delete(c.content, key)
+			c.mu.Unlock()
+		}
+		log.Debugf("Importing Cache entry: %s=%s, expiry=%s", e.Type, key, timeEpoch(e.Expiry))
+		c.addItem(key, e)
+		return true
+	})
+	return nil
 }
 
 // WriteExpiryFile writes the cache expiry map to a file in JSON format.
 func (c *Cache) WriteExpiryFile() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.dryRun {
+		log.Debugf("Dry run: not writing Expiry File")
+		return nil
+	}
 	if !c.writeExpiry {
 		log.Debugf("Not writing Expiry File, nothing has changed")
 		return nil
 	}
-	sj, err := sjson.Set("", "write_time", timestamp())
-	if err != nil {
-		return err
-	}
-	// expireMap creates a simple map of item->expireTime (epoch)
-	expireMapURLs := make(map[string]int64)
-	expireMapFiles := make(map[string]int64)
+	items := make(map[string]expiryEntry)
 	for k, v := range c.content {
-		if v.url {
-			expireMapURLs[k] = v.expiry
-		} else {
-			expireMapFiles[k] = v.expiry
-		}
-	}
-	sj, err = sjson.Set(sj, "urls", expireMapURLs)
-	if err != nil {
-		return err
+		items[k] = v.entry()
 	}
-	sj, err = sjson.Set(sj, "files", expireMapFiles)
+	sj, err := marshalExpiry(timestamp(), items)
 	if err != nil {
 		return err
 	}
 	// Add a LF to the end of the file
 	sj += "\n"
 	// The cacheDir is defined in NewCacher so it's consistent, all be it real or a tempDir created by Unit Tests.
-	filename := path.Join(c.cacheDir, cacheExpiryFile)
-	err = os.WriteFile(filename, []byte(sj), 0644)
+	filename := filepath.Join(c.cacheDir, cacheExpiryFile)
+	err = c.store.writeFile(filename, []byte(sj))
 	if err != nil {
 		return err
 	}
@@ -248,28 +697,49 @@ func (c *Cache) WriteExpiryFile() error {
 }
 
 // getURLFromAPI is called when a cache item has expired and a new copy needs to be grabbed from the API.
-func (c *Cache) getURLFromAPI(itemKey string) (gj gjson.Result, err error) {
+func (c *Cache) getURLFromAPI(ctx context.Context, itemKey string) (gj gjson.Result, err error) {
 	if !c.apiInit {
 		err = errAPIInit
 		return
 	}
 	log.Infof("Requested retreival of: %s", itemKey)
-	bytes, err := c.api.GetJSON(itemKey)
+	item, err := c.getItem(itemKey)
 	if err != nil {
-		err = fmt.Errorf("unable to parse %s: %v", itemKey, err)
-		return
-	}
-	gj = gjson.ParseBytes(bytes)
-	item, ok := c.content[itemKey]
-	if !ok {
 		err = fmt.Errorf("item %s not in cache content", itemKey)
 		return
 	}
-	err = c.jsonToFile(item.file, gj)
-	if err != nil {
-		err = fmt.Errorf("unable to read JSON: %v", err)
-		return
+	var sum string
+	var size int64
+	var header http.Header
+	start := time.Now()
+	if _, onDisk := c.store.(diskStore); c.dryRun || c.aead != nil || !onDisk {
+		// The response is buffered in memory when it isn't written to disk, or has to be encrypted before it is
+		var buf bytes.Buffer
+		if header, err = c.api.GetJSONWithHeader(ctx, itemKey, &buf); err != nil {
+			err = &FetchError{URL: itemKey, Err: err}
+			return
+		}
+		if gj, err = parseJSON(itemKey, buf.Bytes()); err != nil {
+			return
+		}
+		if c.dryRun {
+			log.Debugf("Dry run: not writing %s", item.file)
+			return
+		}
+		b := []byte(gj.Raw)
+		if err = c.writeItem(item.file, b); err != nil {
+			return
+		}
+		sum, size = checksum(b), int64(len(b))
+	} else {
+		if header, sum, size, err = c.streamToFile(ctx, itemKey, item.file); err != nil {
+			return
+		}
+		if gj, err = fileToJSON(item.file, size); err != nil {
+			return
+		}
 	}
+	c.setContent(itemKey, sum, size, header.Get("ETag"), time.Since(start))
 	// We have successfully retreived a URL so update its cache expiry time.
 	err = c.ResetExpire(itemKey)
 	if err != nil {
@@ -281,6 +751,13 @@ func (c *Cache) getURLFromAPI(itemKey string) (gj gjson.Result, err error) {
 // GetURL returns the file content associated with a cache key.  If the cache has expired, the content will instead be
 // grabbed from the API.
 func (c *Cache) GetURL(itemKey string) (gj gjson.Result, err error) {
+	itemKey = NormalizeKey(itemKey)
+	ctx, span := tracing.Start(c.context(), "cache.GetURL", tracing.KindInternal)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	span.SetAttribute("cache.item", itemKey)
 	item, err := c.getItem(itemKey)
 	if err != nil {
 		return
@@ -295,21 +772,83 @@ func (c *Cache) GetURL(itemKey string) (gj gjson.Result, err error) {
 	if err != nil {
 		return
 	}
+	span.SetAttribute("cache.hit", !refresh)
 	if refresh {
-		gj, err = c.getURLFromAPI(itemKey)
+		c.countMiss()
+		gj, err = c.getURLFromAPI(ctx, itemKey)
 		return
 	}
 	// Try and get the requested json from the Cache File
-	gj, err = c.jsonFromFile(item.file)
+	b, err := c.readItem(itemKey, item)
 	if err != nil {
 		// Failed to read the Cache File, get it from the API instead
-		gj, err = c.getURLFromAPI(itemKey)
+		log.Warnf("Unable to read cache for %s, fetching it instead: %v", itemKey, err)
+		c.countMiss()
+		span.SetAttribute("cache.read_error", err.Error())
+		gj, err = c.getURLFromAPI(ctx, itemKey)
+		return
 	}
+	c.countHit()
+	gj = gjson.ParseBytes(b)
 	return
 }
 
+// Query returns the content of an arbitrary API URL.  Unlike GetURL, the URL doesn't need to be registered first; it's
+// automatically cached using the default validity period and a filename derived from the full URL (including its
+// query string).
+func (c *Cache) Query(url string) (gjson.Result, error) {
+	url = NormalizeKey(url)
+	c.mu.Lock()
+	item, ok := c.content[url]
+	if !ok || item.validity == 0 {
+		// Either the item is unknown or it was imported from the expiry file but has not yet been registered.
+		item.url = true
+		item.validity = c.validity
+		item.file = filepath.Join(c.cacheDir, queryFilename(url))
+		c.content[url] = item
+		log.Debugf("Registered ad-hoc query %s with validity of %d seconds", url, c.validity)
+	}
+	c.mu.Unlock()
+	return c.GetURL(url)
+}
+
+// queryFilename returns the cache filename associated with an ad-hoc query URL.
+func queryFilename(url string) string {
+	return fmt.Sprintf("query_%s.json", checksum([]byte(url))[:16])
+}
+
+// Get returns the content of an API URL.  Like Post, the response is never cached.
+func (c *Cache) Get(url string) (gjson.Result, error) {
+	if !c.apiInit {
+		return gjson.Result{}, errAPIInit
+	}
+	b, err := c.api.GetJSON(url)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return parseJSON(url, b)
+}
+
+// Post sends a JSON payload to an API URL.  The response is returned but is never cached.
+func (c *Cache) Post(url string, payload []byte) (gjson.Result, error) {
+	if !c.apiInit {
+		return gjson.Result{}, errAPIInit
+	}
+	b, err := c.api.PostJSON(url, payload)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return parseJSON(url, b)
+}
+
 // GetFile reads a cache item's file from disk and returns it as a byte slice.
 func (c *Cache) GetFile(itemKey string) (b []byte, err error) {
+	_, span := tracing.Start(c.context(), "cache.GetFile", tracing.KindInternal)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	span.SetAttribute("cache.item", itemKey)
 	item, err := c.getItem(itemKey)
 	if err != nil {
 		return
@@ -318,33 +857,239 @@ func (c *Cache) GetFile(itemKey string) (b []byte, err error) {
 		err = errors.New("requested file is a URL")
 		return
 	}
-	b, err = os.ReadFile(item.file)
+	b, err = c.readItem(itemKey, item)
+	if err == nil {
+		c.countHit()
+	}
+	return
+}
+
+// PutFile writes content to a cache item's file, records its checksum and resets its expiry.
+func (c *Cache) PutFile(itemKey string, b []byte) error {
+	item, err := c.getItem(itemKey)
+	if err != nil {
+		return err
+	}
+	if c.dryRun {
+		log.Debugf("Dry run: not writing %s", item.file)
+		return nil
+	}
+	err = c.writeItem(item.file, b)
 	if err != nil {
+		return err
+	}
+	c.setContent(itemKey, checksum(b), int64(len(b)), "", 0)
+	return c.ResetExpire(itemKey)
+}
+
+// setContent records the metadata of a cache item's file content when it's written: Its checksum, size and, if it was
+// fetched from the API, the response's ETag and the time taken to fetch it.
+func (c *Cache) setContent(itemKey, sum string, size int64, etag string, took time.Duration) {
+	itemKey = NormalizeKey(itemKey)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.content[itemKey]
+	if !ok {
 		return
 	}
-	return
+	item.checksum = sum
+	item.size = size
+	item.etag = etag
+	item.fetched = time.Now().Unix()
+	item.used = item.fetched
+	item.duration = took
+	c.content[itemKey] = item
+	c.writeExpiry = true
+}
+
+// readItem reads (and if necessary decrypts) a cache item's file and verifies its content against the recorded
+// checksum.  Items without a recorded checksum are not verified.
+func (c *Cache) readItem(itemKey string, item Item) ([]byte, error) {
+	b, err := c.store.readFile(item.file)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = c.open(item.file, b); err != nil {
+		return nil, err
+	}
+	if item.checksum != "" && checksum(b) != item.checksum {
+		log.Warnf("Cache file %s for %s does not match its checksum", item.file, itemKey)
+		return nil, ErrChecksum
+	}
+	c.touch(itemKey)
+	return b, nil
 }
 
 // jsonFromFile takes the filename for a file containing json formatted content
 // and returns a gjson Result of the file content.
 func (c *Cache) jsonFromFile(filename string) (gjson.Result, error) {
-	b, err := os.ReadFile(filename)
+	b, err := c.store.readFile(filename)
 	if err != nil {
 		return gjson.Result{}, err
 	}
 	return gjson.ParseBytes(b), nil
 }
 
-// jsonToFile takes a gjson Result object and writes it to a file.
-func (c *Cache) jsonToFile(filename string, gj gjson.Result) (err error) {
+// jsonToFile takes a gjson Result object and writes it to a file.  It returns the checksum of the written content.
+func (c *Cache) jsonToFile(filename string, gj gjson.Result) (sum string, err error) {
 	jBytes, err := json.MarshalIndent(gj.Value(), "", "  ")
 	if err != nil {
 		return
 	}
-	err = os.WriteFile(filename, jBytes, 0644)
+	err = c.writeItem(filename, jBytes)
+	if err != nil {
+		return
+	}
+	sum = checksum(jBytes)
 	return
 }
 
+// streamToFile fetches a URL directly into a cache file.  The content is validated incrementally, its UTF-8 as it's
+// written and its JSON as it's read back from the file, so the response is never held in memory by the fetch.  The file is only renamed into place once the content
+// is known to be valid (or has been repaired).  It returns the response headers and the checksum and size of the file;
+// the caller reads the content from the file when it's needed.
+func (c *Cache) streamToFile(ctx context.Context, url, filename string) (header http.Header, sum string, size int64, err error) {
+	tmp, err := atomicfile.CreateTemp(filename)
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	counter := &countWriter{}
+	utf8w := &utf8Writer{}
+	if header, err = c.api.GetJSONWithHeader(ctx, url, io.MultiWriter(tmp, h, counter, utf8w)); err != nil {
+		tmp.Close()
+		err = &FetchError{URL: url, Err: err}
+		return
+	}
+	if _, err = tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return
+	}
+	if !utf8w.valid() || !validJSONStream(bufio.NewReader(tmp)) {
+		tmp.Close()
+		// The response needs repairing, so write the repaired content instead of the original.  Repairs are rare, so
+		// holding a malformed response in memory is acceptable.
+		var b []byte
+		if b, err = os.ReadFile(tmp.Name()); err != nil {
+			return
+		}
+		var gj gjson.Result
+		if gj, err = parseJSON(url, b); err != nil {
+			return
+		}
+		b = []byte(gj.Raw)
+		if err = c.store.writeFile(filename, b); err != nil {
+			return
+		}
+		return header, checksum(b), int64(len(b)), nil
+	}
+	if err = atomicfile.Commit(tmp, filename, c.store.(diskStore).perms); err != nil {
+		return
+	}
+	return header, hex.EncodeToString(h.Sum(nil)), counter.n, nil
+}
+
+// countWriter counts the bytes written to it.
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// utf8Writer checks the content written to it is valid UTF-8, which json.Decoder doesn't.  A sequence split between
+// writes is held over until the next write completes it.
+type utf8Writer struct {
+	pending []byte
+	invalid bool
+}
+
+func (w *utf8Writer) Write(p []byte) (int, error) {
+	if w.invalid {
+		return len(p), nil
+	}
+	b := p
+	if len(w.pending) > 0 {
+		b = append(w.pending, p...)
+	}
+	// Hold back an incomplete sequence at the end of the write
+	end := len(b)
+	for i := len(b) - 1; i >= 0 && i > len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	w.invalid = !utf8.Valid(b[:end])
+	w.pending = append([]byte{}, b[end:]...)
+	return len(p), nil
+}
+
+// valid returns true if everything written was valid UTF-8.
+func (w *utf8Writer) valid() bool {
+	return !w.invalid && len(w.pending) == 0
+}
+
+// validJSONStream returns true if a reader contains a single JSON value (or only whitespace, which parseJSON also
+// accepts).  The value is tokenized as it's read, rather than being decoded into memory.
+func validJSONStream(r io.Reader) bool {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	depth := 0
+	values := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return depth == 0
+		}
+		if err != nil {
+			return false
+		}
+		if depth == 0 {
+			if values > 0 {
+				// A second top-level value
+				return false
+			}
+			values++
+		}
+		if d, ok := tok.(json.Delim); ok {
+			switch d {
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+		}
+	}
+}
+
+// fileToJSON reads a cache file that was written unencrypted to disk by streamToFile.  The content is read straight
+// into the string that gjson parses, so only the one copy of it is held in memory.
+func fileToJSON(filename string, size int64) (gjson.Result, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer f.Close()
+	var sb strings.Builder
+	sb.Grow(int(size))
+	if _, err := io.Copy(&sb, f); err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.Parse(sb.String()), nil
+}
+
+// checksum returns the hex encoded SHA-256 of a byte slice.
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
 // timestamp returns a string representation of the current time in ISO 8601 format.
 func timestamp() string {
 	t := time.Now()
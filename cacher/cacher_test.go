@@ -2,23 +2,39 @@ package cacher
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/crooks/satinv/cacher/satapi"
 	"github.com/tidwall/gjson"
 )
 
 func mkTempDir() string {
-	tempDir, err := os.MkdirTemp("/tmp", "sat")
+	tempDir, err := os.MkdirTemp("", "sat")
 	if err != nil {
 		log.Fatalf("Unable to create TempDir: %v", err)
 	}
 	return tempDir
 }
 
+// newTestCacher returns a Cache using the given directory, failing the test if it can't be created.
+func newTestCacher(t *testing.T, cacheDir string) *Cache {
+	t.Helper()
+	c, err := NewCacher(cacheDir)
+	if err != nil {
+		t.Fatalf("NewCacher returned: %v", err)
+	}
+	return c
+}
+
 func TestCacher(t *testing.T) {
 	tempDir := mkTempDir()
 	defer os.RemoveAll(tempDir)
@@ -27,7 +43,7 @@ func TestCacher(t *testing.T) {
 	if _, err := os.Stat(cacheDir); err == nil {
 		t.Errorf("%s: Cache Dir exists before NewCacher constructor runs", cacheDir)
 	}
-	c := NewCacher(cacheDir)
+	c := newTestCacher(t, cacheDir)
 	if c.cacheDir != cacheDir {
 		t.Errorf("Unexpected cacheDir.  Expected=%s, Got=%s", tempDir, c.cacheDir)
 	}
@@ -39,7 +55,7 @@ func TestCacher(t *testing.T) {
 func TestExpire(t *testing.T) {
 	tempDir := mkTempDir()
 	defer os.RemoveAll(tempDir)
-	c := NewCacher(tempDir)
+	c := newTestCacher(t, tempDir)
 	testURL := "https://fake.url"
 	testFile := "testfile.json"
 	c.AddURL(testURL, testFile, 2)
@@ -56,10 +72,12 @@ func TestWriteRead(t *testing.T) {
 	tempDir := mkTempDir()
 	defer os.RemoveAll(tempDir)
 	testFile := path.Join(tempDir, "testfile.json")
-	c := NewCacher(tempDir)
+	c := newTestCacher(t, tempDir)
 	sample := `{"results": ["a","b","c"]}`
 	outJson := gjson.Parse(sample)
-	c.jsonToFile(testFile, outJson)
+	if _, err := c.jsonToFile(testFile, outJson); err != nil {
+		t.Fatalf("Failed to write json: %v", err)
+	}
 	inJson, err := c.jsonFromFile(testFile)
 	if err != nil {
 		t.Errorf("Failed to fetch json: %v", err)
@@ -76,7 +94,7 @@ func TestWriteRead(t *testing.T) {
 func TestGetURL(t *testing.T) {
 	tempDir := mkTempDir()
 	defer os.RemoveAll(tempDir)
-	c := NewCacher(tempDir)
+	c := newTestCacher(t, tempDir)
 	testURL := "http://fakeurl.fake"
 	testFile := "test.json"
 	_, err := c.GetURL(testURL)
@@ -93,7 +111,7 @@ func TestGetURL(t *testing.T) {
 func TestGetFile(t *testing.T) {
 	tempDir := mkTempDir()
 	defer os.RemoveAll(tempDir)
-	c := NewCacher(tempDir)
+	c := newTestCacher(t, tempDir)
 	testItem := "filename.fake"
 	testFile := "test.txt"
 	testString := "Hello World!"
@@ -124,7 +142,7 @@ func TestGetFile(t *testing.T) {
 func TestAddURL(t *testing.T) {
 	tempDir := mkTempDir()
 	defer os.RemoveAll(tempDir)
-	c := NewCacher(tempDir)
+	c := newTestCacher(t, tempDir)
 	testItem := "http://fakeurl.fake"
 	testFile := "test.json"
 	var testValidity int64 = 2
@@ -151,7 +169,7 @@ func TestAddURL(t *testing.T) {
 func TestExportExpiry(t *testing.T) {
 	tempDir := mkTempDir()
 	defer os.RemoveAll(tempDir)
-	c := NewCacher(tempDir)
+	c := newTestCacher(t, tempDir)
 	testItem := "http://fakeurl.fake"
 	testFile := "test.json"
 	var testValidity int64 = 2
@@ -197,7 +215,7 @@ func TestExportExpiry(t *testing.T) {
 	emptyFile.Close()
 
 	// Create a new Cacher object to reimport expiry data
-	d := NewCacher(tempDir)
+	d := newTestCacher(t, tempDir)
 	if err != nil {
 		t.Errorf("%s: %v", testItem, err)
 	}
@@ -212,3 +230,591 @@ func TestExportExpiry(t *testing.T) {
 		t.Error("Item cache should not be expired")
 	}
 }
+
+func TestMigrateExpiry(t *testing.T) {
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	expiry := time.Now().Unix() + 60
+	v1 := fmt.Sprintf(`{"write_time": "2021-01-01T00:00:00Z", "urls": {"https://sat/api/hosts?page=1&per_page=2": %d},
+		"files": {"inventory": %d}, "checksums": {"inventory": "abc"}, "filenames": {"inventory": "inventory.json"}}`, expiry, expiry)
+	expiryFile := path.Join(tempDir, cacheExpiryFile)
+	if err := os.WriteFile(expiryFile, []byte(v1), 0644); err != nil {
+		t.Fatalf("Cannot write test file: %v", err)
+	}
+	c := newTestCacher(t, tempDir)
+	if !c.writeExpiry {
+		t.Error("A migrated expiry file should be rewritten")
+	}
+	url, err := c.getItem("https://sat/api/hosts?page=1&per_page=2")
+	if err != nil || !url.url || url.expiry != expiry {
+		t.Errorf("URL not migrated: %+v, %v", url, err)
+	}
+	file, err := c.getItem("inventory")
+	if err != nil || file.url || file.checksum != "abc" || file.file != path.Join(tempDir, "inventory.json") {
+		t.Errorf("File not migrated: %+v, %v", file, err)
+	}
+	if err := c.WriteExpiryFile(); err != nil {
+		t.Fatalf("WriteExpiryFile returned: %v", err)
+	}
+	b, err := os.ReadFile(expiryFile)
+	if err != nil {
+		t.Fatalf("Unable to read expiry file: %v", err)
+	}
+	j := gjson.ParseBytes(b)
+	if j.Get("version").Int() != expiryVersion || j.Get("urls").Exists() || j.Get("items.inventory.checksum").String() != "abc" {
+		t.Errorf("Unexpected expiry file: %s", b)
+	}
+	// A file written by a newer version is treated as an empty cache
+	if err := os.WriteFile(expiryFile, []byte(`{"version": 99, "items": {"inventory": {"type": "file"}}}`), 0644); err != nil {
+		t.Fatalf("Cannot write test file: %v", err)
+	}
+	d := newTestCacher(t, tempDir)
+	if len(d.Keys()) != 0 {
+		t.Errorf("Expected an empty cache, got: %v", d.Keys())
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	tests := map[string]string{
+		"https://SAT.example.com/api/hosts?per_page=1000&include%5B%5D=all_parameters": "https://sat.example.com/api/hosts?include%5B%5D=all_parameters&per_page=1000",
+		"HTTPS://sat/api/hosts?search=name+%3D+web01&page=2#top":                       "https://sat/api/hosts?page=2&search=name+%3D+web01",
+		"https://sat/api/hosts?b=2&a=1&b=1":                                            "https://sat/api/hosts?a=1&b=2&b=1",
+		"https://sat/API/hosts":                                                        "https://sat/API/hosts",
+		"inventory":                                                                    "inventory",
+	}
+	for key, want := range tests {
+		if got := NormalizeKey(key); got != want {
+			t.Errorf("Unexpected normalization of %s.  Expected=%q, Got=%q", key, want, got)
+		}
+	}
+	// Equivalent URLs in an expiry file are merged into a single item, keeping the latest expiry
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	expiry := time.Now().Unix() + 60
+	items := fmt.Sprintf(`{"version": %d, "items": {
+		"https://sat/api/hosts?page=1&per_page=2": {"type": "url", "expiry": %d, "file": "a.json"},
+		"https://sat/api/hosts?per_page=2&page=1": {"type": "url", "expiry": %d, "file": "b.json"}}}`, expiryVersion, expiry, expiry+10)
+	if err := os.WriteFile(path.Join(tempDir, cacheExpiryFile), []byte(items), 0644); err != nil {
+		t.Fatalf("Cannot write test file: %v", err)
+	}
+	c := newTestCacher(t, tempDir)
+	if keys := c.Keys(); len(keys) != 1 || keys[0] != "https://sat/api/hosts?page=1&per_page=2" {
+		t.Fatalf("Expected a single normalized key, got %v", keys)
+	}
+	if !c.writeExpiry {
+		t.Error("An expiry file with unnormalized keys should be rewritten")
+	}
+	item, err := c.getItem("https://sat/api/hosts?per_page=2&page=1")
+	if err != nil || item.expiry != expiry+10 || item.file != path.Join(tempDir, "b.json") {
+		t.Errorf("Expected the latest expiry to be kept, got %+v, %v", item, err)
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	c := newTestCacher(t, tempDir)
+	testItem := "inventory"
+	testFile := "inventory.json"
+	c.AddFile(testItem, testFile, 60)
+	if err := c.PutFile(testItem, []byte(`{"all": {}}`)); err != nil {
+		t.Fatalf("%s: %v", testItem, err)
+	}
+	if _, err := c.GetFile(testItem); err != nil {
+		t.Fatalf("%s: %v", testItem, err)
+	}
+	c.WriteExpiryFile()
+	// Simulate a partially written file
+	if err := os.WriteFile(path.Join(tempDir, testFile), []byte(`{"all": `), 0644); err != nil {
+		t.Fatalf("Cannot write test file: %v", err)
+	}
+	// The checksum should survive an export and reimport of the expiry data
+	d := newTestCacher(t, tempDir)
+	d.AddFile(testItem, testFile, 60)
+	if _, err := d.GetFile(testItem); !errors.Is(err, ErrChecksum) {
+		t.Errorf("Expected a checksum error for a corrupt file, got: %v", err)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	c := newTestCacher(t, tempDir)
+	var testValidity int64 = 600
+	c.SetDefaultValidity(testValidity)
+	testURL := "http://fakeurl.fake/api/v2/subnets?per_page=100"
+	// The API isn't initialised so the query can't succeed, but it should register the item regardless
+	if _, err := c.Query(testURL); !errors.Is(err, errAPIInit) {
+		t.Fatalf("Expected API initialisation error, got: %v", err)
+	}
+	item, err := c.getItem(testURL)
+	if err != nil {
+		t.Fatalf("%s: %v", testURL, err)
+	}
+	if !item.url {
+		t.Errorf("%s: Ad-hoc queries should be URL items", testURL)
+	}
+	if item.validity != testValidity {
+		t.Errorf("Unexpected validity: Expected=%d, Got=%d", testValidity, item.validity)
+	}
+	if item.file != path.Join(tempDir, queryFilename(testURL)) {
+		t.Errorf("Unexpected filename: %s", item.file)
+	}
+	if queryFilename(testURL) == queryFilename("http://fakeurl.fake/api/v2/subnets?per_page=200") {
+		t.Error("Different query strings should produce different filenames")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	c := newTestCacher(t, tempDir)
+	c.AddFile("keep", "keep.json", 60)
+	c.AddFile("forget", "forget.json", 60)
+	for _, f := range []string{"keep.json", "forget.json", "orphan.json"} {
+		if err := os.WriteFile(path.Join(tempDir, f), []byte("{}"), 0644); err != nil {
+			t.Fatalf("Cannot write test file: %v", err)
+		}
+	}
+	c.ResetExpire("keep")
+	c.WriteExpiryFile()
+	if err := c.Forget("forget"); err != nil {
+		t.Fatalf("Forget returned: %v", err)
+	}
+	if _, err := os.Stat(path.Join(tempDir, "forget.json")); !errors.Is(err, os.ErrNotExist) {
+		t.Error("Forgotten item's file should have been deleted")
+	}
+	// A new Cacher knows about items only through the expiry file, it should still know keep.json is referenced.
+	d := newTestCacher(t, tempDir)
+	pruned, err := d.Prune()
+	if err != nil {
+		t.Fatalf("Prune returned: %v", err)
+	}
+	if len(pruned) != 1 || pruned[0] != "orphan.json" {
+		t.Errorf("Unexpected pruned files: %v", pruned)
+	}
+	if _, err := os.Stat(path.Join(tempDir, "keep.json")); err != nil {
+		t.Errorf("Referenced file should not have been pruned: %v", err)
+	}
+	if _, err := os.Stat(path.Join(tempDir, cacheExpiryFile)); err != nil {
+		t.Errorf("Expiry file should not have been pruned: %v", err)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	c := newTestCacher(t, tempDir)
+	content := []byte(strings.Repeat("x", 100))
+	for _, name := range []string{"inventory", "old", "recent", "unused"} {
+		c.AddFile(name, name+".json", 60)
+		if err := c.PutFile(name, content); err != nil {
+			t.Fatalf("PutFile returned: %v", err)
+		}
+	}
+	now := time.Now().Unix()
+	for name, used := range map[string]int64{"inventory": now - 300, "old": now - 200, "recent": now, "unused": now - 100} {
+		item, _ := c.getItem(name)
+		item.used = used
+		c.content[name] = item
+	}
+	if evicted, err := c.Evict(400, "inventory"); err != nil || len(evicted) != 0 {
+		t.Errorf("Nothing should be evicted within the maximum size, got %v, %v", evicted, err)
+	}
+	// The inventory is the least recently used but is kept
+	evicted, err := c.Evict(250, "inventory")
+	if err != nil {
+		t.Fatalf("Evict returned: %v", err)
+	}
+	if strings.Join(evicted, ",") != "old,unused" {
+		t.Errorf("Unexpected evicted items: %v", evicted)
+	}
+	if exists(c.store, path.Join(tempDir, "old.json")) || !exists(c.store, path.Join(tempDir, "recent.json")) {
+		t.Error("Expected the files of only the evicted items to be deleted")
+	}
+	if refresh, err := c.HasExpired("old"); err != nil || !refresh {
+		t.Errorf("An evicted item should remain registered and be expired, got %v, %v", refresh, err)
+	}
+	// Reading an item records its use
+	c.content["recent"] = Item{file: path.Join(tempDir, "recent.json"), validity: 60}
+	if _, err := c.GetFile("recent"); err != nil {
+		t.Fatalf("GetFile returned: %v", err)
+	}
+	if item, _ := c.getItem("recent"); item.used < now {
+		t.Errorf("Expected the use of recent to be recorded, got %d", item.used)
+	}
+}
+
+func TestInvalidate(t *testing.T) {
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	c := newTestCacher(t, tempDir)
+	c.AddFile("item", "item.json", 60)
+	if err := c.PutFile("item", []byte("{}")); err != nil {
+		t.Fatalf("PutFile returned: %v", err)
+	}
+	if expired, _ := c.HasExpired("item"); expired {
+		t.Fatal("Item should not have expired after being written")
+	}
+	if err := c.Invalidate("item"); err != nil {
+		t.Fatalf("Invalidate returned: %v", err)
+	}
+	if expired, _ := c.HasExpired("item"); !expired {
+		t.Error("Item should have expired after being invalidated")
+	}
+	if _, err := os.Stat(path.Join(tempDir, "item.json")); err != nil {
+		t.Errorf("Invalidated item's file should be retained: %v", err)
+	}
+	if err := c.Invalidate("unknown"); err == nil {
+		t.Error("Expected an error invalidating an unknown item")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	c := newTestCacher(t, tempDir)
+	c.AddFile("fresh", "fresh.json", 60)
+	c.AddFile("missing", "missing.json", 60)
+	if err := c.PutFile("fresh", []byte("{}")); err != nil {
+		t.Fatalf("PutFile returned: %v", err)
+	}
+	if _, err := c.GetFile("fresh"); err != nil {
+		t.Fatalf("GetFile returned: %v", err)
+	}
+	status := c.Status()
+	if len(status) != 2 {
+		t.Fatalf("Expected status for 2 items, got %d", len(status))
+	}
+	// Status is sorted by key
+	if status[0].Key != "fresh" || status[0].Stale || !status[0].Exists || status[0].Size != 2 {
+		t.Errorf("Unexpected status for fresh item: %+v", status[0])
+	}
+	if status[1].Key != "missing" || !status[1].Stale || status[1].Exists {
+		t.Errorf("Unexpected status for missing item: %+v", status[1])
+	}
+	if err := c.WriteStats(); err != nil {
+		t.Fatalf("WriteStats returned: %v", err)
+	}
+	stats, err := newTestCacher(t, tempDir).LastStats()
+	if err != nil {
+		t.Fatalf("LastStats returned: %v", err)
+	}
+	if stats.Hits != 1 || stats.Misses != 0 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestJitter(t *testing.T) {
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	c := newTestCacher(t, tempDir)
+	c.SetJitter(10)
+	testItem := "jitter"
+	var testValidity int64 = 10000
+	c.AddFile(testItem, "jitter.json", testValidity)
+	expiries := make(map[int64]bool)
+	for i := 0; i < 20; i++ {
+		now := time.Now().Unix()
+		if err := c.ResetExpire(testItem); err != nil {
+			t.Fatalf("%s: %v", testItem, err)
+		}
+		item, _ := c.getItem(testItem)
+		validity := item.expiry - now
+		if validity < 9000 || validity > 11001 {
+			t.Fatalf("Jittered validity out of range: %d", validity)
+		}
+		expiries[item.expiry] = true
+	}
+	if len(expiries) == 1 {
+		t.Error("Jitter produced identical expiry times")
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	c := newTestCacher(t, tempDir)
+	c.AddFile("ahead", "ahead.json", 1000)
+	if err := c.PutFile("ahead", []byte(`{}`)); err != nil {
+		t.Fatalf("PutFile returned: %v", err)
+	}
+	// 10% of the validity remains
+	c.mu.Lock()
+	item := c.content["ahead"]
+	item.expiry = time.Now().Unix() + 100
+	c.content["ahead"] = item
+	c.mu.Unlock()
+	if soon, _ := c.ExpiresSoon("ahead", 5); soon {
+		t.Error("Item should not expire within 5% of its validity")
+	}
+	if soon, _ := c.ExpiresSoon("ahead", 20); !soon {
+		t.Error("Item should expire within 20% of its validity")
+	}
+	if expired, _ := c.HasExpired("ahead"); expired {
+		t.Error("Item should not have expired")
+	}
+	c.SetRefreshAhead(20)
+	if expired, _ := c.HasExpired("ahead"); !expired {
+		t.Error("Item near expiry should be refreshed ahead of expiry")
+	}
+
+	// Only one process can hold the refresh lock, until it's abandoned
+	if ok, err := c.LockRefresh(time.Hour); !ok || err != nil {
+		t.Fatalf("Unable to take the refresh lock: %v", err)
+	}
+	if ok, _ := c.LockRefresh(time.Hour); ok {
+		t.Error("The refresh lock should already be held")
+	}
+	if pruned, _ := c.Prune(); len(pruned) > 0 {
+		t.Errorf("The refresh lock should not be pruned: %v", pruned)
+	}
+	if ok, _ := c.LockRefresh(-time.Second); !ok {
+		t.Error("An abandoned refresh lock should be replaced")
+	}
+	if err := c.UnlockRefresh(); err != nil {
+		t.Errorf("UnlockRefresh returned: %v", err)
+	}
+	if ok, _ := c.LockRefresh(time.Hour); !ok {
+		t.Error("The refresh lock should be free after unlocking")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	c := newTestCacher(t, tempDir)
+	c.SetDryRun()
+	c.AddFile("inventory", "inventory.json", 60)
+	if err := c.PutFile("inventory", []byte("{}")); err != nil {
+		t.Fatalf("PutFile returned: %v", err)
+	}
+	c.WriteExpiryFile()
+	c.WriteStats()
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatalf("Unable to read cache dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("Dry run should not write any files, found %d", len(entries))
+	}
+}
+
+func TestStreamToFile(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			w.Write([]byte(`{"load": NaN}`))
+			return
+		}
+		if r.URL.Path == "/utf8" {
+			w.Write([]byte("{\"name\": \"host\xff1\"}"))
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(`{"results": ["a","b"]}`))
+	}))
+	defer ts.Close()
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	c := newTestCacher(t, tempDir)
+	if err := c.InitAPI("user", "password", satapi.Options{}); err != nil {
+		t.Fatalf("InitAPI returned: %v", err)
+	}
+	c.AddURL(ts.URL+"/good", "good.json", 60)
+	c.AddURL(ts.URL+"/bad", "bad.json", 60)
+	c.AddURL(ts.URL+"/utf8", "utf8.json", 60)
+	gj, err := c.GetURL(ts.URL + "/good")
+	if err != nil {
+		t.Fatalf("GetURL returned: %v", err)
+	}
+	if len(gj.Get("results").Array()) != 2 {
+		t.Errorf("Unexpected content: %s", gj.Raw)
+	}
+	// The response should have been written to the cache file unchanged, with a matching checksum
+	b, err := os.ReadFile(path.Join(tempDir, "good.json"))
+	if err != nil {
+		t.Fatalf("Unable to read cache file: %v", err)
+	}
+	if string(b) != `{"results": ["a","b"]}` {
+		t.Errorf("Unexpected cache file content: %s", b)
+	}
+	item, _ := c.getItem(ts.URL + "/good")
+	if item.checksum != checksum(b) {
+		t.Error("Checksum does not match the cache file")
+	}
+	if item.size != int64(len(b)) || item.etag != `"v1"` || item.fetched == 0 {
+		t.Errorf("Unexpected item metadata: size=%d, etag=%s, fetched=%d", item.size, item.etag, item.fetched)
+	}
+	// Invalid responses are repaired before they're written
+	gj, err = c.GetURL(ts.URL + "/bad")
+	if err != nil {
+		t.Fatalf("GetURL returned: %v", err)
+	}
+	if gj.Get("load").Type != gjson.Null {
+		t.Errorf("Expected a repaired response, got: %s", gj.Raw)
+	}
+	b, err = os.ReadFile(path.Join(tempDir, "bad.json"))
+	if err != nil || !gjson.ValidBytes(b) {
+		t.Errorf("Cache file should contain the repaired response: %s", b)
+	}
+	// As is invalid UTF-8, which json.Decoder accepts
+	if gj, err = c.GetURL(ts.URL + "/utf8"); err != nil {
+		t.Fatalf("GetURL returned: %v", err)
+	}
+	if gj.Get("name").String() != "host\ufffd1" {
+		t.Errorf("Expected invalid UTF-8 to be replaced, got: %q", gj.Get("name").String())
+	}
+	if b, err = os.ReadFile(path.Join(tempDir, "utf8.json")); err != nil || !utf8.Valid(b) {
+		t.Errorf("Cache file should contain the repaired response: %q", b)
+	}
+	entries, _ := os.ReadDir(tempDir)
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp") {
+			t.Errorf("Temporary file %s was not removed", e.Name())
+		}
+	}
+}
+
+func TestNewCacherErrors(t *testing.T) {
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	// Missing parents are created, but not in place of a file
+	if _, err := NewCacher(path.Join(tempDir, "missing", "cacheDir")); err != nil {
+		t.Errorf("Expected the cache dir to be created with its parents: %v", err)
+	}
+	if err := os.WriteFile(path.Join(tempDir, "file"), nil, 0644); err != nil {
+		t.Fatalf("Unable to create test file: %v", err)
+	}
+	if _, err := NewCacher(path.Join(tempDir, "file", "cacheDir")); err == nil {
+		t.Error("Expected an error when the cache dir can't be created")
+	}
+	// An expiry file that can't be read is an error, rather than an empty cache
+	if err := os.Mkdir(path.Join(tempDir, cacheExpiryFile), 0755); err != nil {
+		t.Fatalf("Unable to create test dir: %v", err)
+	}
+	if _, err := NewCacher(tempDir); err == nil {
+		t.Error("Expected an error when the expiry file can't be read")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	tempDir := mkTempDir()
+	defer os.RemoveAll(tempDir)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	c := newTestCacher(t, tempDir)
+	if err := c.SetEncryptionKey(key[:10]); err == nil {
+		t.Error("Expected an error for an invalid key length")
+	}
+	if err := c.SetEncryptionKey(key); err != nil {
+		t.Fatalf("SetEncryptionKey returned: %v", err)
+	}
+	c.AddFile("item", "item.json", 60)
+	content := []byte(`{"host": "secret.example.com"}`)
+	if err := c.PutFile("item", content); err != nil {
+		t.Fatalf("PutFile returned: %v", err)
+	}
+	b, err := os.ReadFile(path.Join(tempDir, "item.json"))
+	if err != nil {
+		t.Fatalf("Unable to read cache file: %v", err)
+	}
+	if strings.Contains(string(b), "secret") || !strings.HasPrefix(string(b), string(encryptedPrefix)) {
+		t.Errorf("Cache file should be encrypted: %q", b)
+	}
+	if got, err := c.GetFile("item"); err != nil || string(got) != string(content) {
+		t.Errorf("Unexpected decrypted content: %s (%v)", got, err)
+	}
+	if err := c.WriteExpiryFile(); err != nil {
+		t.Fatalf("WriteExpiryFile returned: %v", err)
+	}
+	// The file can't be read without the key, or with a different one
+	c = newTestCacher(t, tempDir)
+	c.AddFile("item", "item.json", 60)
+	if _, err := c.GetFile("item"); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("Expected ErrDecrypt reading an encrypted file without a key, got: %v", err)
+	}
+	c.SetEncryptionKey([]byte("fedcba9876543210fedcba9876543210"))
+	if _, err := c.GetFile("item"); err == nil {
+		t.Error("Expected an error reading an encrypted file with the wrong key")
+	}
+	// Encrypted content is bound to its filename
+	c.SetEncryptionKey(key)
+	if _, err := c.open(path.Join(tempDir, "other.json"), b); err == nil {
+		t.Error("Expected an error decrypting a file under a different name")
+	}
+}
+
+func TestMemoryCacher(t *testing.T) {
+	m := NewMemory()
+	c, err := NewMemoryCacher(m)
+	if err != nil {
+		t.Fatalf("NewMemoryCacher returned: %v", err)
+	}
+	c.AddFile("item", "item.json", 60)
+	if expired, _ := c.HasExpired("item"); !expired {
+		t.Error("Item should have expired before being written")
+	}
+	if err := c.PutFile("item", []byte(`{"a": 1}`)); err != nil {
+		t.Fatalf("PutFile returned: %v", err)
+	}
+	if err := c.WriteExpiryFile(); err != nil {
+		t.Fatalf("WriteExpiryFile returned: %v", err)
+	}
+	if _, err := os.Stat("item.json"); !os.IsNotExist(err) {
+		t.Errorf("Nothing should be written to disk: %v", err)
+	}
+	// A new Cache sharing the Memory sees the content and expiry data of the previous one
+	c, err = NewMemoryCacher(m)
+	if err != nil {
+		t.Fatalf("NewMemoryCacher returned: %v", err)
+	}
+	c.AddFile("item", "item.json", 60)
+	if expired, _ := c.HasExpired("item"); expired {
+		t.Error("Item should not have expired after being written")
+	}
+	if b, err := c.GetFile("item"); err != nil || string(b) != `{"a": 1}` {
+		t.Errorf("Unexpected content: %s (%v)", b, err)
+	}
+	m.writeFile("orphan.json", []byte("{}"))
+	if pruned, err := c.Prune(); err != nil || len(pruned) != 1 || pruned[0] != "orphan.json" {
+		t.Errorf("Expected orphan.json to be pruned, got %v (%v)", pruned, err)
+	}
+	if s := c.Status(); len(s) != 1 || !s[0].Exists || s[0].Size != 8 {
+		t.Errorf("Unexpected status: %+v", s)
+	}
+}
+
+func TestValidJSONStream(t *testing.T) {
+	valid := []string{`{"results": [{"name": "a"}, {"name": "b", "n": 1.5e3}]}`, `[]`, `"x"`, ``, " \n"}
+	invalid := []string{`{"load": NaN}`, `{"results": [`, `{} {}`, `{"a": 1,}`, `]`}
+	for _, s := range valid {
+		if !validJSONStream(strings.NewReader(s)) {
+			t.Errorf("Expected %q to be valid", s)
+		}
+	}
+	for _, s := range invalid {
+		if validJSONStream(strings.NewReader(s)) {
+			t.Errorf("Expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestUTF8Writer(t *testing.T) {
+	// A valid sequence split between writes
+	w := &utf8Writer{}
+	w.Write([]byte("host\xe2\x82"))
+	w.Write([]byte("\xac1"))
+	if !w.valid() {
+		t.Error("A sequence split between writes should be valid")
+	}
+	w = &utf8Writer{}
+	w.Write([]byte("host\xe2\x82"))
+	if w.valid() {
+		t.Error("An incomplete sequence at the end should be invalid")
+	}
+	w = &utf8Writer{}
+	w.Write([]byte("host\xff1"))
+	w.Write([]byte("more"))
+	if w.valid() {
+		t.Error("An invalid byte should be invalid")
+	}
+}
@@ -0,0 +1,85 @@
+package cacher
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/Masterminds/log-go"
+)
+
+// encryptedPrefix identifies a cache file encrypted by satinv.  It's followed by the GCM nonce and the sealed content.
+var encryptedPrefix = []byte("satinv-aes-gcm-v1\n")
+
+// ErrDecrypt indicates a cache file couldn't be decrypted, or wasn't encrypted as expected.
+var ErrDecrypt = errors.New("cache file cannot be decrypted")
+
+// SetEncryptionKey enables encryption of cache files with AES-GCM.  The key must be 16, 24 or 32 bytes long, selecting
+// AES-128, AES-192 or AES-256.  The expiry and stats files contain no API content and remain unencrypted.
+func (c *Cache) SetEncryptionKey(key []byte) error {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("invalid cache encryption key: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	c.aead = aead
+	return nil
+}
+
+// seal returns the encrypted form of a cache file's content, or the content unchanged if encryption isn't enabled.
+// The file's name is authenticated with the content so that encrypted files can't be substituted for one another.
+func (c *Cache) seal(filename string, b []byte) ([]byte, error) {
+	if c.aead == nil {
+		return b, nil
+	}
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(append([]byte{}, encryptedPrefix...), nonce...)
+	return c.aead.Seal(sealed, nonce, b, []byte(filepath.Base(filename))), nil
+}
+
+// open returns the decrypted content of a cache file.  Files must be encrypted if, and only if, encryption is enabled.
+func (c *Cache) open(filename string, b []byte) ([]byte, error) {
+	encrypted := bytes.HasPrefix(b, encryptedPrefix)
+	switch {
+	case c.aead == nil && !encrypted:
+		return b, nil
+	case c.aead == nil:
+		log.Warnf("Cache file %s is encrypted but no encryption key is configured", filename)
+		return nil, ErrDecrypt
+	case !encrypted:
+		log.Warnf("Cache file %s is not encrypted", filename)
+		return nil, ErrDecrypt
+	}
+	b = b[len(encryptedPrefix):]
+	if len(b) < c.aead.NonceSize() {
+		log.Warnf("Cache file %s is too short to be encrypted", filename)
+		return nil, ErrDecrypt
+	}
+	nonce := b[:c.aead.NonceSize()]
+	plain, err := c.aead.Open(nil, nonce, b[len(nonce):], []byte(filepath.Base(filename)))
+	if err != nil {
+		log.Warnf("Unable to decrypt cache file %s: %v", filename, err)
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+// writeItem writes the content of a cache item's file, encrypting it if encryption is enabled.
+func (c *Cache) writeItem(filename string, b []byte) error {
+	sealed, err := c.seal(filename, b)
+	if err != nil {
+		return err
+	}
+	return c.store.writeFile(filename, sealed)
+}
@@ -0,0 +1,111 @@
+package cacher
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Masterminds/log-go"
+)
+
+// usedResolution is the precision with which the last use of an item is recorded in the expiry file.  Recording every
+// read would rewrite the file on every run, even when nothing has been fetched.
+const usedResolution = time.Hour
+
+// touch records that an item's file has been used.
+func (c *Cache) touch(itemKey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.content[itemKey]
+	if !ok {
+		return
+	}
+	now := time.Now().Unix()
+	if now-item.used >= int64(usedResolution.Seconds()) {
+		c.writeExpiry = true
+	}
+	item.used = now
+	c.content[itemKey] = item
+}
+
+// Evict deletes the files of the least recently used items until those remaining total no more than maxSize bytes.
+// The items named by keep are never evicted, though their files are counted.  Evicted items remain registered but are
+// marked as expired, so they're fetched afresh when they're next requested.  It returns the keys of the evicted items.
+func (c *Cache) Evict(maxSize int64, keep ...string) (evicted []string, err error) {
+	if c.dryRun {
+		return nil, nil
+	}
+	type candidate struct {
+		key  string
+		used int64
+		size int64
+	}
+	kept := make(map[string]bool)
+	for _, k := range keep {
+		kept[NormalizeKey(k)] = true
+	}
+	var total int64
+	var candidates []candidate
+	for _, k := range c.Keys() {
+		item, err := c.getItem(k)
+		if err != nil || item.file == "" {
+			continue
+		}
+		size, err := c.store.size(item.file)
+		if err != nil {
+			continue
+		}
+		total += size
+		if kept[k] {
+			continue
+		}
+		// Items imported from an expiry file that predates the used time were last used no later than they were written
+		used := item.used
+		if used == 0 {
+			used = item.fetched
+		}
+		candidates = append(candidates, candidate{key: k, used: used, size: size})
+	}
+	if total <= maxSize {
+		return nil, nil
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].used < candidates[j].used
+	})
+	for _, cand := range candidates {
+		if total <= maxSize {
+			break
+		}
+		if err := c.evict(cand.key); err != nil {
+			return evicted, err
+		}
+		total -= cand.size
+		evicted = append(evicted, cand.key)
+		log.Debugf("Evicted cache item %s (%d bytes, last used %s)", cand.key, cand.size, timeEpoch(cand.used))
+	}
+	if total > maxSize {
+		log.Warnf("Cache size of %d bytes exceeds the maximum of %d bytes, but no further items can be evicted", total, maxSize)
+	}
+	return evicted, nil
+}
+
+// evict deletes an item's file and marks it as expired.
+func (c *Cache) evict(itemKey string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.content[itemKey]
+	if !ok {
+		return errNoItem
+	}
+	if err := c.store.remove(item.file); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	item.expiry = 0
+	item.checksum = ""
+	item.size = 0
+	item.etag = ""
+	c.content[itemKey] = item
+	c.writeExpiry = true
+	return nil
+}
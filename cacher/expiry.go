@@ -0,0 +1,84 @@
+package cacher
+
+import (
+	"fmt"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// expiryVersion is the schema version of the expiry file.  Version 1 files, written before the schema was versioned,
+// have no version field.
+const expiryVersion int64 = 2
+
+// expiryEntry is the record of a cache item in the expiry file.
+type expiryEntry struct {
+	Type          string `json:"type"` // "url" or "file"
+	Expiry        int64  `json:"expiry"`
+	File          string `json:"file,omitempty"` // Base name of the item's file
+	Checksum      string `json:"checksum,omitempty"`
+	Size          int64  `json:"size,omitempty"`
+	ETag          string `json:"etag,omitempty"`
+	Fetched       int64  `json:"fetched,omitempty"`           // Epoch time the content was written
+	Used          int64  `json:"used,omitempty"`              // Epoch time the content was last read or written
+	FetchDuration int64  `json:"fetch_duration_ms,omitempty"` // Time taken to fetch the content from the API
+}
+
+// expiryMigrations upgrade the expiry file from the version they're indexed by to the next.  A change to the schema
+// increments expiryVersion and adds a migration from the previous version, so that existing caches survive upgrades.
+var expiryMigrations = map[int64]func(gjson.Result) (string, error){
+	1: migrateExpiryV1,
+}
+
+// migrateExpiry upgrades the content of an expiry file to expiryVersion, returning true if it needed upgrading.  A file
+// written by a newer version of satinv can't be downgraded, so it's an error.
+func migrateExpiry(j gjson.Result) (gjson.Result, bool, error) {
+	version := j.Get("version").Int()
+	if version == 0 {
+		version = 1
+	}
+	if version > expiryVersion {
+		return j, false, fmt.Errorf("schema version %d is newer than the supported version %d", version, expiryVersion)
+	}
+	migrated := version < expiryVersion
+	for ; version < expiryVersion; version++ {
+		s, err := expiryMigrations[version](j)
+		if err != nil {
+			return j, false, fmt.Errorf("unable to migrate from schema version %d: %v", version, err)
+		}
+		j = gjson.Parse(s)
+	}
+	return j, migrated, nil
+}
+
+// migrateExpiryV1 converts the flat maps of version 1 (urls, files, checksums and filenames, each keyed by item) to the
+// items object of version 2.
+func migrateExpiryV1(j gjson.Result) (string, error) {
+	checksums := j.Get("checksums").Map()
+	fileNames := j.Get("filenames").Map()
+	items := make(map[string]expiryEntry)
+	for _, itemType := range []string{"url", "file"} {
+		for k, v := range j.Get(itemType + "s").Map() {
+			items[k] = expiryEntry{
+				Type:     itemType,
+				Expiry:   v.Int(),
+				File:     fileNames[k].String(),
+				Checksum: checksums[k].String(),
+			}
+		}
+	}
+	return marshalExpiry(j.Get("write_time").String(), items)
+}
+
+// marshalExpiry returns the content of an expiry file recording a set of items.
+func marshalExpiry(writeTime string, items map[string]expiryEntry) (string, error) {
+	sj, err := sjson.Set("", "version", expiryVersion)
+	if err != nil {
+		return "", err
+	}
+	sj, err = sjson.Set(sj, "write_time", writeTime)
+	if err != nil {
+		return "", err
+	}
+	return sjson.Set(sj, "items", items)
+}
@@ -0,0 +1,25 @@
+package cacher
+
+import (
+	"net/url"
+	"strings"
+)
+
+// NormalizeKey returns the canonical form of a cache key, so that equivalent URLs share a single cache item: The
+// scheme and host are lowercased, the query parameters are sorted by name and any fragment is removed.  The values of
+// a repeated parameter retain their order, as it may be significant.  Keys that aren't absolute URLs, such as those of
+// file items, are returned unchanged.
+func NormalizeKey(itemKey string) string {
+	u, err := url.Parse(itemKey)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return itemKey
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	u.Fragment = ""
+	u.RawFragment = ""
+	if q, err := url.ParseQuery(u.RawQuery); err == nil {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
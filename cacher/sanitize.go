@@ -0,0 +1,98 @@
+package cacher
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/Masterminds/log-go"
+	"github.com/tidwall/gjson"
+)
+
+// maxRepairLogs limits the number of individual repairs logged for a single response
+const maxRepairLogs int = 10
+
+// nonStandardLiterals are JavaScript numeric literals that are invalid JSON.  Longer literals come first so that
+// -Infinity isn't mistaken for a minus sign followed by Infinity.
+var nonStandardLiterals = [][]byte{[]byte("-Infinity"), []byte("Infinity"), []byte("NaN")}
+
+// sanitizeJSON repairs the kinds of malformed JSON that Satellite has been known to return.  Invalid UTF-8 sequences
+// are replaced with the Unicode replacement character, unescaped control characters within strings are escaped and
+// NaN, Infinity and -Infinity literals are replaced with null.  It returns the repaired JSON and a description of each
+// repair, including its byte offset in the original.
+func sanitizeJSON(b []byte) ([]byte, []string) {
+	var out bytes.Buffer
+	var repairs []string
+	out.Grow(len(b))
+	var inString, escaped bool
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			repairs = append(repairs, fmt.Sprintf("invalid UTF-8 byte 0x%02x at offset %d", b[i], i))
+			out.WriteRune(utf8.RuneError)
+			escaped = false
+			i++
+			continue
+		}
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\':
+				escaped = true
+			case r == '"':
+				inString = false
+			case r < 0x20:
+				repairs = append(repairs, fmt.Sprintf("unescaped control character 0x%02x at offset %d", r, i))
+				fmt.Fprintf(&out, "\\u%04x", r)
+				i += size
+				continue
+			}
+			out.Write(b[i : i+size])
+			i += size
+			continue
+		}
+		if r == '"' {
+			inString = true
+		} else if lit := literalAt(b, i); lit != nil {
+			repairs = append(repairs, fmt.Sprintf("%s replaced with null at offset %d", lit, i))
+			out.WriteString("null")
+			i += len(lit)
+			continue
+		}
+		out.Write(b[i : i+size])
+		i += size
+	}
+	return out.Bytes(), repairs
+}
+
+// literalAt returns the non-standard literal that starts at offset i of b, or nil if there isn't one.
+func literalAt(b []byte, i int) []byte {
+	for _, lit := range nonStandardLiterals {
+		if bytes.HasPrefix(b[i:], lit) {
+			return lit
+		}
+	}
+	return nil
+}
+
+// parseJSON parses an API response.  Malformed JSON is repaired (with each repair logged) rather than producing an
+// empty result.  An empty response is not considered malformed.  An error is returned if the response can't be
+// repaired.  gjson accepts invalid UTF-8, so it's checked separately.
+func parseJSON(url string, b []byte) (gjson.Result, error) {
+	if (gjson.ValidBytes(b) && utf8.Valid(b)) || len(bytes.TrimSpace(b)) == 0 {
+		return gjson.ParseBytes(b), nil
+	}
+	b, repairs := sanitizeJSON(b)
+	for i, r := range repairs {
+		if i == maxRepairLogs {
+			log.Warnf("%s: %d further repairs not shown", url, len(repairs)-maxRepairLogs)
+			break
+		}
+		log.Warnf("%s: Malformed JSON: %s", url, r)
+	}
+	if !gjson.ValidBytes(b) {
+		return gjson.Result{}, fmt.Errorf("%s returned invalid JSON", url)
+	}
+	return gjson.ParseBytes(b), nil
+}
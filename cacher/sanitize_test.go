@@ -0,0 +1,50 @@
+package cacher
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestSanitizeJSON(t *testing.T) {
+	bad := []byte("{\"name\": \"host\xff1\", \"load\": NaN, \"max\": -Infinity, \"note\": \"NaN\", \"text\": \"a\tb\"}")
+	if gjson.ValidBytes(bad) {
+		t.Fatal("Test JSON should be invalid")
+	}
+	fixed, repairs := sanitizeJSON(bad)
+	if !gjson.ValidBytes(fixed) {
+		t.Fatalf("Sanitized JSON is invalid: %s", fixed)
+	}
+	if len(repairs) != 4 {
+		t.Errorf("Expected 4 repairs, got %d: %v", len(repairs), repairs)
+	}
+	gj := gjson.ParseBytes(fixed)
+	if gj.Get("load").Type != gjson.Null || gj.Get("max").Type != gjson.Null {
+		t.Errorf("NaN and -Infinity should be null: %s", fixed)
+	}
+	if gj.Get("note").String() != "NaN" {
+		t.Errorf("Strings containing NaN should be unchanged, got: %s", gj.Get("note").String())
+	}
+	if gj.Get("name").String() != "host�1" {
+		t.Errorf("Invalid UTF-8 should be replaced, got: %q", gj.Get("name").String())
+	}
+	if gj.Get("text").String() != "a\tb" {
+		t.Errorf("Control characters should be escaped, got: %q", gj.Get("text").String())
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	if _, err := parseJSON("fake", []byte(`{"valid": true}`)); err != nil {
+		t.Errorf("Valid JSON returned: %v", err)
+	}
+	// Invalid UTF-8 is repaired, even though it's the only defect
+	gj, err := parseJSON("fake", []byte("{\"name\": \"host\xff1\"}"))
+	if err != nil {
+		t.Errorf("Invalid UTF-8 returned: %v", err)
+	} else if gj.Get("name").String() != "host\ufffd1" {
+		t.Errorf("Invalid UTF-8 should be replaced, got: %q", gj.Get("name").String())
+	}
+	if _, err := parseJSON("fake", []byte(`{"truncated": `)); err == nil {
+		t.Error("Expected an error for irreparable JSON")
+	}
+}
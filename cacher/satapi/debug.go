@@ -0,0 +1,103 @@
+package satapi
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// redacted replaces sensitive values in debug output
+const redacted = "[REDACTED]"
+
+// sensitiveHeaders are the request headers whose values are never logged
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+}
+
+// sensitiveFieldRE matches JSON string fields whose names suggest a secret, such as a password or token.  A value cut
+// short by truncation is also matched.
+var sensitiveFieldRE = regexp.MustCompile(`(?i)("[^"]*(?:pass|secret|token)[^"]*"\s*:\s*)"(?:[^"\\]|\\.)*(?:"|\\?$)`)
+
+// redactBody replaces the values of sensitive fields in a JSON body.
+func redactBody(b string) string {
+	return sensitiveFieldRE.ReplaceAllString(b, `$1"`+redacted+`"`)
+}
+
+// redactHeaders returns the headers of a request as a sorted list of "Name: value" strings, with sensitive values
+// replaced.
+func redactHeaders(h http.Header) string {
+	var headers []string
+	for name, values := range h {
+		value := strings.Join(values, ", ")
+		if sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			value = redacted
+		}
+		headers = append(headers, name+": "+value)
+	}
+	sort.Strings(headers)
+	return strings.Join(headers, "; ")
+}
+
+// bodyCapture records the start of a body as it's read, up to a limit.  A negative limit records the whole body.
+type bodyCapture struct {
+	limit int
+	buf   []byte
+	total int64
+}
+
+func (c *bodyCapture) Write(p []byte) (int, error) {
+	c.total += int64(len(p))
+	keep := p
+	if room := c.limit - len(c.buf); c.limit >= 0 && len(keep) > room {
+		keep = keep[:room]
+	}
+	c.buf = append(c.buf, keep...)
+	return len(p), nil
+}
+
+// String returns the recorded body, redacted and marked if it was truncated.
+func (c *bodyCapture) String() string {
+	s := redactBody(string(c.buf))
+	if int64(len(c.buf)) < c.total {
+		s += "...(truncated)"
+	}
+	return s
+}
+
+// debugRequest logs a request, including the start of its body, before it's sent.
+func (s *AuthClient) debugRequest(req *http.Request, retry int) {
+	var attempt string
+	if retry > 0 {
+		attempt = fmt.Sprintf(" (retry %d)", retry)
+	}
+	s.debugf("API request: %s %s%s headers=[%s]", req.Method, req.URL.Redacted(), attempt, redactHeaders(req.Header))
+	if s.debugBody == 0 || req.GetBody == nil {
+		return
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return
+	}
+	defer body.Close()
+	c := &bodyCapture{limit: s.debugBody}
+	io.Copy(c, body)
+	s.debugf("API request body: %s", c)
+}
+
+// debugResponse returns a Reader of a response body that records its start, and a function that logs the response
+// once the body has been read.
+func (s *AuthClient) debugResponse(req *http.Request, resp *http.Response, start time.Time, body io.Reader) (io.Reader, func()) {
+	c := &bodyCapture{limit: s.debugBody}
+	return io.TeeReader(body, c), func() {
+		s.debugf("API response: %s %s returned %s in %s (%d bytes)", req.Method, req.URL.Redacted(), resp.Status, time.Since(start).Round(time.Millisecond), c.total)
+		if s.debugBody != 0 {
+			s.debugf("API response body: %s", c)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package satapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// StatusError is returned for a response with an unsuccessful status
+type StatusError struct {
+	StatusCode int
+	Msg        string // The start of the response body
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("Status error: %s\n", e.Msg)
+}
+
+// IsAuthFailure returns true if an error is a response refusing the client's credentials, or the client had none to
+// offer.
+func IsAuthFailure(err error) bool {
+	var ne *NegotiateError
+	if errors.As(err, &ne) {
+		return true
+	}
+	var se *StatusError
+	return errors.As(err, &se) && (se.StatusCode == http.StatusUnauthorized || se.StatusCode == http.StatusForbidden)
+}
+
+// IsUnavailable returns true if an error shows that the API couldn't be reached: The request failed to connect or
+// timed out, a gateway in front of the API couldn't reach it, or it was still throttled after every retry.  A request
+// cancelled by its Context is not a failure of the API.
+func IsUnavailable(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var te *throttleError
+	if errors.As(err, &te) {
+		return true
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode == http.StatusBadGateway || se.StatusCode == http.StatusGatewayTimeout
+	}
+	var ue *url.Error
+	return errors.As(err, &ue)
+}
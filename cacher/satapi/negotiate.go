@@ -0,0 +1,126 @@
+package satapi
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jcmturner/gokrb5/v8/client"
+	krbconfig "github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/credentials"
+	"github.com/jcmturner/gokrb5/v8/spnego"
+)
+
+// Negotiate contains the settings of SPNEGO (Kerberos) authentication.  Requests are authenticated with the ticket
+// granting ticket in a credential cache, obtained by kinit or a ticket manager such as k5start, so no credential is
+// stored by satinv.
+type Negotiate struct {
+	Krb5Conf string // Kerberos configuration.  If empty, KRB5_CONFIG or /etc/krb5.conf.
+	// CCache is the credential cache.  If empty, KRB5CCNAME or /tmp/krb5cc_<uid>.  Only file caches are supported.
+	CCache string
+	SPN    string // Service principal of the API.  If empty, HTTP/<host of the request URL>.
+}
+
+// NegotiateError is returned when a request can't be given a SPNEGO token, such as when there's no ticket granting
+// ticket in the credential cache.
+type NegotiateError struct {
+	Err error
+}
+
+func (e *NegotiateError) Error() string {
+	return fmt.Sprintf("unable to authenticate with Kerberos: %v", e.Err)
+}
+
+func (e *NegotiateError) Unwrap() error {
+	return e.Err
+}
+
+// negotiator sets the SPNEGO token of requests.  The Kerberos client is reused for as long as the credential cache is
+// unchanged, so service tickets aren't requested afresh for every request, and reloaded when a ticket manager renews
+// the ticket granting ticket.
+type negotiator struct {
+	Negotiate
+	mu       sync.Mutex
+	client   *client.Client
+	modified time.Time // Of the credential cache, when client was loaded
+}
+
+// krb5Conf returns the path of the Kerberos configuration.
+func (n *negotiator) krb5Conf() string {
+	switch {
+	case n.Krb5Conf != "":
+		return n.Krb5Conf
+	case os.Getenv("KRB5_CONFIG") != "":
+		return strings.Split(os.Getenv("KRB5_CONFIG"), ":")[0]
+	}
+	return "/etc/krb5.conf"
+}
+
+// ccache returns the path of the credential cache.
+func (n *negotiator) ccache() (string, error) {
+	name := n.CCache
+	if name == "" {
+		name = os.Getenv("KRB5CCNAME")
+	}
+	if name == "" {
+		return "/tmp/krb5cc_" + strconv.Itoa(os.Getuid()), nil
+	}
+	if i := strings.Index(name, ":"); i > 1 {
+		if name[:i] != "FILE" {
+			return "", fmt.Errorf("credential cache %s is not a file cache", name)
+		}
+		name = name[i+1:]
+	}
+	return name, nil
+}
+
+// kerberosClient returns a Kerberos client using the ticket granting ticket in the credential cache.
+func (n *negotiator) kerberosClient() (*client.Client, error) {
+	path, err := n.ccache()
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.client != nil && fi.ModTime().Equal(n.modified) {
+		return n.client, nil
+	}
+	conf, err := krbconfig.Load(n.krb5Conf())
+	if err != nil {
+		return nil, err
+	}
+	cc, err := credentials.LoadCCache(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read credential cache %s: %v", path, err)
+	}
+	cl, err := client.NewFromCCache(cc, conf, client.DisablePAFXFAST(true))
+	if err != nil {
+		return nil, err
+	}
+	if n.client != nil {
+		n.client.Destroy()
+	}
+	n.client = cl
+	n.modified = fi.ModTime()
+	return cl, nil
+}
+
+// authenticate sets the Authorization header of a request to a new SPNEGO token.
+func (n *negotiator) authenticate(req *http.Request) error {
+	cl, err := n.kerberosClient()
+	if err == nil {
+		err = spnego.SetSPNEGOHeader(cl, req, n.SPN)
+	}
+	if err != nil {
+		return &NegotiateError{Err: err}
+	}
+	return nil
+}
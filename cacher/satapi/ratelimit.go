@@ -0,0 +1,130 @@
+package satapi
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket.  Tokens accumulate at a fixed rate up to the burst size and each request consumes one.
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64 // Maximum number of tokens the bucket can hold
+	tokens float64
+	last   time.Time // When tokens were last added
+}
+
+// rateLimit is shared by every AuthClient so the combined request rate never exceeds the configured budget.  When nil,
+// requests are not limited.
+var (
+	rateLimit   *limiter
+	rateLimitMu sync.Mutex
+)
+
+// inFlight is a semaphore, shared by every AuthClient, that caps the number of concurrent requests.  When nil, the
+// number of concurrent requests is unlimited.
+var (
+	inFlight   chan struct{}
+	inFlightMu sync.Mutex
+)
+
+// SetRateLimit configures the token bucket shared by all API requests.  A rate of zero (or less) disables limiting.
+// The burst size is the number of requests that can be made in immediate succession; it defaults to 1.
+func SetRateLimit(rps float64, burst int) {
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+	if rps <= 0 {
+		rateLimit = nil
+		return
+	}
+	rateLimit = newLimiter(rps, burst)
+}
+
+// newLimiter returns a token bucket that starts full.
+func newLimiter(rps float64, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{
+		rate:   rps,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// waitRateLimit blocks until the shared token bucket permits another request, or the Context is done.
+func waitRateLimit(ctx context.Context) error {
+	rateLimitMu.Lock()
+	l := rateLimit
+	rateLimitMu.Unlock()
+	if l == nil {
+		return nil
+	}
+	return l.wait(ctx)
+}
+
+// reserve refills the bucket and attempts to take a token.  If no token is available, it returns how long the caller
+// should wait before trying again.
+func (l *limiter) reserve() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// wait blocks until a token can be taken from the bucket, or the Context is done.  A cancelled wait takes no token.
+func (l *limiter) wait(ctx context.Context) error {
+	for {
+		delay := l.reserve()
+		if delay == 0 {
+			return nil
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// SetMaxInFlight caps the number of API requests that can be outstanding at once.  A maximum of zero (or less) removes
+// the cap.
+func SetMaxInFlight(max int) {
+	inFlightMu.Lock()
+	defer inFlightMu.Unlock()
+	if max <= 0 {
+		inFlight = nil
+		return
+	}
+	inFlight = make(chan struct{}, max)
+}
+
+// acquireInFlight blocks until fewer than the maximum number of requests are outstanding, or the Context is done.  On
+// success, it returns a function that must be called when the request completes.
+func acquireInFlight(ctx context.Context) (func(), error) {
+	inFlightMu.Lock()
+	sem := inFlight
+	inFlightMu.Unlock()
+	if sem == nil {
+		return func() {}, nil
+	}
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
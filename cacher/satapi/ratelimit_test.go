@@ -0,0 +1,80 @@
+package satapi
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(50, 2)
+	// The bucket starts full so the burst should be available immediately
+	for i := 0; i < 2; i++ {
+		if delay := l.reserve(); delay != 0 {
+			t.Fatalf("Request %d within burst should not be delayed, got %s", i, delay)
+		}
+	}
+	// The bucket is now empty so the next request needs to wait for a token (1/50th of a second)
+	delay := l.reserve()
+	if delay <= 0 || delay > 20*time.Millisecond {
+		t.Errorf("Unexpected delay for request beyond burst: %s", delay)
+	}
+	start := time.Now()
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatalf("wait returned: %v", err)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("wait took too long: %s", time.Since(start))
+	}
+	// A wait for a token can be cancelled
+	l = newLimiter(0.01, 1)
+	l.reserve()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	if err := l.wait(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the wait to be cancelled, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Cancelled wait took too long: %s", time.Since(start))
+	}
+}
+
+func TestSetRateLimit(t *testing.T) {
+	SetRateLimit(10, 0)
+	if rateLimit == nil {
+		t.Fatal("Rate limit should be set")
+	}
+	if rateLimit.burst != 1 {
+		t.Errorf("Burst should default to 1, got %f", rateLimit.burst)
+	}
+	SetRateLimit(0, 5)
+	if rateLimit != nil {
+		t.Error("A zero rate should disable limiting")
+	}
+}
+
+func TestMaxInFlight(t *testing.T) {
+	SetMaxInFlight(1)
+	defer SetMaxInFlight(0)
+	release, err := acquireInFlight(context.Background())
+	if err != nil {
+		t.Fatalf("First request should not be blocked: %v", err)
+	}
+	// A second request must wait for the first to complete
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := acquireInFlight(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected the second request to be blocked, got %v", err)
+	}
+	release()
+	release, err = acquireInFlight(context.Background())
+	if err != nil {
+		t.Fatalf("Request should proceed after release: %v", err)
+	}
+	release()
+	SetMaxInFlight(0)
+	if inFlight != nil {
+		t.Error("A zero maximum should remove the cap")
+	}
+}
@@ -0,0 +1,75 @@
+package satapi
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// firstBackoff is the wait before retrying a throttled request that doesn't say how long to wait.  Each subsequent
+// retry waits twice as long.
+const firstBackoff = time.Second
+
+// throttled returns true if a response status indicates that the server is temporarily unable to handle the request.
+func throttled(status int) bool {
+	return status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable
+}
+
+// parseRetryAfter returns the delay requested by a Retry-After header, given either as a number of seconds or as an
+// HTTP date.  ok is false if the header is missing or invalid.
+func parseRetryAfter(h string, now time.Time) (delay time.Duration, ok bool) {
+	h = strings.TrimSpace(h)
+	if h == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(h); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(h)
+	if err != nil {
+		return 0, false
+	}
+	if delay = t.Sub(now); delay < 0 {
+		delay = 0
+	}
+	return delay, true
+}
+
+// retryDelay returns how long to wait before the given retry (counting from 1) of a throttled request.  The server's
+// Retry-After is honoured when present, in which case explicit is true; otherwise the delay doubles with each retry.
+func retryDelay(resp *http.Response, retry int) (delay time.Duration, explicit bool) {
+	if delay, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+		return delay, true
+	}
+	return firstBackoff << uint(retry-1), false
+}
+
+// sleepContext waits for the given duration, or until the Context is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// resend returns a copy of a request that can be sent again, with a fresh copy of its body.
+func resend(req *http.Request) (*http.Request, error) {
+	r := req.Clone(req.Context())
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		r.Body = body
+	}
+	return r, nil
+}
@@ -2,35 +2,103 @@
 package satapi
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
+	"time"
+
+	"github.com/crooks/satinv/tracing"
 )
 
+// maxErrorBody is the maximum number of bytes of an error response included in the returned error
+const maxErrorBody int64 = 64 * 1024
+
 // AuthClient contains the HTTP client components
 type AuthClient struct {
 	Username   string
 	Password   string
 	HTTPClient *http.Client
+	negotiate  *negotiator     // If set, requests are authenticated by SPNEGO in place of the username and password
+	ctx        context.Context // Requests are abandoned when it's cancelled
+	retries    int
+	maxWait    time.Duration
+	logf       func(format string, v ...interface{})
+	debugf     func(format string, v ...interface{})
+	debugBody  int
+}
+
+// Options contains optional settings for the HTTP client
+type Options struct {
+	CertFile string // File containing additional root certificates
+	ProxyURL string // Proxy for all requests.  If empty, the HTTPS_PROXY and NO_PROXY environment variables are honoured.
+	// Retries is the number of times a request is retried after a 429 (Too Many Requests) or 503 (Service Unavailable)
+	// response.  MaxRetryWait is the longest Retry-After that's honoured; zero honours any.
+	Retries      int
+	MaxRetryWait time.Duration
+	// Logf, if set, is called to report each retry so that throttling is visible
+	Logf func(format string, v ...interface{})
+	// Debugf, if set, is called to log every request and response, with credentials redacted.  DebugBody is the number
+	// of bytes of each request and response body that are logged; zero logs none and a negative number logs them whole.
+	Debugf    func(format string, v ...interface{})
+	DebugBody int
 }
 
 // NewBasicAuthClient returns an instance of AuthClient
-func NewBasicAuthClient(username, password, certFile string) *AuthClient {
+func NewBasicAuthClient(username, password string, opts Options) (*AuthClient, error) {
+	client, err := httpAuthClient(opts)
+	if err != nil {
+		return nil, err
+	}
 	return &AuthClient{
 		Username:   username,
 		Password:   password,
-		HTTPClient: httpAuthClient(certFile),
+		HTTPClient: client,
+		retries:    opts.Retries,
+		maxWait:    opts.MaxRetryWait,
+		logf:       opts.Logf,
+		debugf:     opts.Debugf,
+		debugBody:  opts.DebugBody,
+	}, nil
+}
+
+// NewNegotiateClient returns an instance of AuthClient that authenticates with SPNEGO (Kerberos).
+func NewNegotiateClient(n Negotiate, opts Options) (*AuthClient, error) {
+	s, err := NewBasicAuthClient("", "", opts)
+	if err != nil {
+		return nil, err
+	}
+	s.negotiate = &negotiator{Negotiate: n}
+	return s, nil
+}
+
+// SetContext associates a Context with all subsequent requests.  When it's cancelled or its deadline passes, outstanding
+// requests are abandoned.
+func (s *AuthClient) SetContext(ctx context.Context) {
+	s.ctx = ctx
+}
+
+// context returns the Context associated with requests.
+func (s *AuthClient) context() context.Context {
+	if s.ctx == nil {
+		return context.Background()
 	}
+	return s.ctx
 }
 
 // GetJSON takes a URL relating to a Rest API and returns the resulting JSON as a byte slice.
 func (s *AuthClient) GetJSON(url string) ([]byte, error) {
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(s.context(), "GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -41,22 +109,53 @@ func (s *AuthClient) GetJSON(url string) ([]byte, error) {
 	return bytes, nil
 }
 
+// GetJSONTo takes a URL relating to a Rest API and copies the resulting JSON to a Writer as it's received, without
+// holding the whole response in memory.
+func (s *AuthClient) GetJSONTo(url string, w io.Writer) error {
+	return s.GetJSONToContext(s.context(), url, w)
+}
+
+// GetJSONToContext is GetJSONTo with a Context specific to the request, in place of the one set by SetContext.
+func (s *AuthClient) GetJSONToContext(ctx context.Context, url string, w io.Writer) error {
+	_, err := s.GetJSONWithHeader(ctx, url, w)
+	return err
+}
+
+// GetJSONWithHeader is GetJSONToContext, also returning the headers of the response (such as its ETag).
+func (s *AuthClient) GetJSONWithHeader(ctx context.Context, url string, w io.Writer) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.stream(req, w)
+}
+
+// PostJSON sends a JSON payload to a Rest API URL and returns the resulting JSON as a byte slice.
+func (s *AuthClient) PostJSON(url string, payload []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(s.context(), "POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return s.doRequest(req)
+}
+
 // httpAuthClient creates a new instance of http.Client with support for
 // additional rootCAs.  As XClarity is frequently installed as an appliance,
 // with a self-signed cert, this appears to be quite useful.
-func httpAuthClient(certFile string) *http.Client {
+func httpAuthClient(opts Options) (*http.Client, error) {
 	rootCAs, err := x509.SystemCertPool()
 	if err != nil {
-		log.Fatal(err)
+		return nil, fmt.Errorf("unable to load system certificates: %v", err)
 	}
 	if rootCAs == nil {
 		rootCAs = x509.NewCertPool()
 	}
-	certs, err := ioutil.ReadFile(certFile)
+	certs, err := ioutil.ReadFile(opts.CertFile)
 	if errors.Is(err, os.ErrNotExist) {
 		//log.Println("No additional certificates imported")
 	} else if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("unable to read certificates: %v", err)
 	} else if ok := rootCAs.AppendCertsFromPEM(certs); !ok {
 		log.Println("Cert import failed.  Proceeding with system CAs.")
 	}
@@ -64,24 +163,162 @@ func httpAuthClient(certFile string) *http.Client {
 		InsecureSkipVerify: false,
 		RootCAs:            rootCAs,
 	}
-	tr := &http.Transport{TLSClientConfig: config}
-	return &http.Client{Transport: tr}
+	tr := &http.Transport{
+		TLSClientConfig: config,
+		Proxy:           http.ProxyFromEnvironment,
+	}
+	if opts.ProxyURL != "" {
+		proxy, err := url.Parse(opts.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		tr.Proxy = http.ProxyURL(proxy)
+	}
+	return &http.Client{Transport: tr}, nil
 }
 
 // doRequest does an HTTP URL request and returns it as a byte array
 func (s *AuthClient) doRequest(req *http.Request) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := s.stream(req, &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// throttleError is returned for a response that may succeed if the request is retried later
+type throttleError struct {
+	status   string
+	msg      string
+	delay    time.Duration // Before retrying
+	explicit bool          // The delay was requested by the server
+}
+
+func (e *throttleError) Error() string {
+	return fmt.Sprintf("Status error: %s\n", e.msg)
+}
+
+// stream does an HTTP URL request and copies the response body to a Writer as it's received.  Responses are requested
+// with gzip compression and decompressed transparently.  Requests that are throttled, with a 429 or 503 response, are
+// retried after the delay given by the Retry-After header, up to the configured number of retries.  The headers of the
+// successful response are returned.
+func (s *AuthClient) stream(req *http.Request, w io.Writer) (http.Header, error) {
+	// Setting Accept-Encoding disables the Transport's own decompression, so gzip is handled by responseBody.
+	req.Header.Set("Accept-Encoding", "gzip")
+	attempt := req
+	for retry := 0; ; retry++ {
+		// Servers reject a replayed SPNEGO token, so each attempt is authenticated afresh
+		if err := s.authenticate(attempt); err != nil {
+			return nil, err
+		}
+		header, err := s.send(attempt, w, retry)
+		var te *throttleError
+		if !errors.As(err, &te) || retry >= s.retries {
+			return header, err
+		}
+		delay := te.delay
+		if s.maxWait > 0 && delay > s.maxWait {
+			if te.explicit {
+				s.log("%s %s returned %s: Not retrying, as Retry-After of %s exceeds the maximum of %s", req.Method, req.URL.Redacted(), te.status, delay, s.maxWait)
+				return nil, err
+			}
+			delay = s.maxWait
+		}
+		s.log("%s %s returned %s: Retrying in %s (retry %d of %d)", req.Method, req.URL.Redacted(), te.status, delay, retry+1, s.retries)
+		if err := sleepContext(req.Context(), delay); err != nil {
+			return nil, err
+		}
+		if attempt, err = resend(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authenticate sets the credentials of a request.
+func (s *AuthClient) authenticate(req *http.Request) error {
+	if s.negotiate != nil {
+		return s.negotiate.authenticate(req)
+	}
 	req.SetBasicAuth(s.Username, s.Password)
+	return nil
+}
+
+// log reports a retry, if the client has a Logf function.
+func (s *AuthClient) log(format string, v ...interface{}) {
+	if s.logf != nil {
+		s.logf(format, v...)
+	}
+}
+
+// send makes a single attempt at a request, counting from zero.  When tracing is enabled, each attempt is recorded as
+// a span and carries a traceparent header.  The response's headers are returned if it succeeds.
+func (s *AuthClient) send(req *http.Request, w io.Writer, retry int) (header http.Header, err error) {
+	release, err := acquireInFlight(req.Context())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	if err := waitRateLimit(req.Context()); err != nil {
+		return nil, err
+	}
+	ctx, span := tracing.Start(req.Context(), "HTTP "+req.Method, tracing.KindClient)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.url", req.URL.Redacted())
+	if retry > 0 {
+		span.SetAttribute("http.resend_count", retry)
+	}
+	req = req.WithContext(ctx)
+	tracing.Inject(ctx, req.Header)
+	if s.debugf != nil {
+		s.debugRequest(req, retry)
+	}
+	start := time.Now()
 	resp, err := s.HTTPClient.Do(req)
 	if err != nil {
+		if s.debugf != nil {
+			s.debugf("API request: %s %s failed after %s: %v", req.Method, req.URL.Redacted(), time.Since(start).Round(time.Millisecond), err)
+		}
 		return nil, err
 	}
 	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	span.SetAttribute("http.status_code", resp.StatusCode)
+	rc, err := responseBody(resp)
 	if err != nil {
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("Status error: %s\n", string(body))
+	defer rc.Close()
+	var body io.Reader = rc
+	if s.debugf != nil {
+		var logResponse func()
+		body, logResponse = s.debugResponse(req, resp, start, rc)
+		defer logResponse()
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(body, maxErrorBody))
+		if throttled(resp.StatusCode) {
+			delay, explicit := retryDelay(resp, retry+1)
+			return nil, &throttleError{status: resp.Status, msg: string(msg), delay: delay, explicit: explicit}
+		}
+		return nil, &StatusError{StatusCode: resp.StatusCode, Msg: string(msg)}
+	}
+	if _, err = io.Copy(w, body); err != nil {
+		return nil, err
+	}
+	return resp.Header, nil
+}
+
+// responseBody returns a Reader of the response body, decompressing it if the server applied gzip encoding.
+func responseBody(resp *http.Response) (io.ReadCloser, error) {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return ioutil.NopCloser(resp.Body), nil
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gzip response: %v", err)
 	}
-	return body, nil
+	return gz, nil
 }
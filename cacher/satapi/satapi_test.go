@@ -0,0 +1,266 @@
+package satapi
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProxy(t *testing.T) {
+	proxyURL := "http://proxy.fake:3128"
+	s, err := NewBasicAuthClient("user", "password", Options{ProxyURL: proxyURL})
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	req, err := http.NewRequest("GET", "https://satellite.fake/api/v2/hosts", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	proxy, err := s.HTTPClient.Transport.(*http.Transport).Proxy(req)
+	if err != nil {
+		t.Fatalf("Proxy func returned: %v", err)
+	}
+	if proxy == nil || proxy.String() != proxyURL {
+		t.Errorf("Unexpected proxy: Expected=%s, Got=%v", proxyURL, proxy)
+	}
+	_, err = NewBasicAuthClient("user", "password", Options{ProxyURL: "http://bad url:port"})
+	if err == nil {
+		t.Error("Expected an error for an invalid proxy URL")
+	}
+}
+
+func TestContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+	s, err := NewBasicAuthClient("user", "password", Options{})
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	if _, err := s.GetJSON(ts.URL); err != nil {
+		t.Fatalf("Unexpected error without a context: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.SetContext(ctx)
+	cancel()
+	if _, err := s.GetJSON(ts.URL); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled request, got: %v", err)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept-Encoding") != "gzip" {
+			t.Errorf("Expected Accept-Encoding: gzip, got %q", r.Header.Get("Accept-Encoding"))
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		gz := gzip.NewWriter(w)
+		if r.URL.Path == "/missing" {
+			gz.Write([]byte(`{"error":"not found"}`))
+		} else {
+			gz.Write([]byte(`{"results":[]}`))
+		}
+		gz.Close()
+	}))
+	defer ts.Close()
+	s, err := NewBasicAuthClient("user", "password", Options{})
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	b, err := s.GetJSON(ts.URL + "/hosts")
+	if err != nil {
+		t.Fatalf("GetJSON returned: %v", err)
+	}
+	if string(b) != `{"results":[]}` {
+		t.Errorf("Unexpected response: %s", b)
+	}
+	// Compressed error responses should also be decoded
+	_, err = s.GetJSON(ts.URL + "/missing")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("Expected a decoded status error, got: %v", err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	var attempts int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.Method == "POST" && string(body) != `{"search":"x"}` {
+			t.Errorf("Attempt %d: Unexpected request body: %q", attempts, body)
+		}
+		switch {
+		case r.URL.Path == "/long":
+			w.Header().Set("Retry-After", "3600")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case attempts < 3:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error":"slow down"}`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+	defer ts.Close()
+	var logged []string
+	s, err := NewBasicAuthClient("user", "password", Options{
+		Retries:      2,
+		MaxRetryWait: time.Minute,
+		Logf: func(format string, v ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, v...))
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	if _, err := s.PostJSON(ts.URL+"/hosts", []byte(`{"search":"x"}`)); err != nil {
+		t.Fatalf("Expected success after retries, got: %v", err)
+	}
+	if attempts != 3 || len(logged) != 2 {
+		t.Errorf("Expected 3 attempts and 2 logged retries, got %d and %q", attempts, logged)
+	}
+	if len(logged) > 0 && !strings.Contains(logged[0], "429 Too Many Requests") {
+		t.Errorf("Unexpected retry message: %s", logged[0])
+	}
+	// The retries are exhausted, so the last error is returned
+	attempts = 0
+	s.retries = 1
+	if _, err := s.GetJSON(ts.URL + "/hosts"); err == nil || !strings.Contains(err.Error(), "slow down") {
+		t.Errorf("Expected a status error after exhausting retries, got: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("Expected 2 attempts, got %d", attempts)
+	}
+	// A Retry-After longer than the maximum isn't honoured
+	attempts = 0
+	if _, err := s.GetJSON(ts.URL + "/long"); err == nil {
+		t.Error("Expected an error for a Retry-After exceeding the maximum")
+	}
+	if attempts != 1 {
+		t.Errorf("Expected a single attempt, got %d", attempts)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		header string
+		delay  time.Duration
+		ok     bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"-1", 0, false},
+		{"Wed, 01 Jun 2022 12:00:30 GMT", 30 * time.Second, true},
+		{"Wed, 01 Jun 2022 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		delay, ok := parseRetryAfter(tt.header, now)
+		if delay != tt.delay || ok != tt.ok {
+			t.Errorf("%q: Expected %s/%v, got %s/%v", tt.header, tt.delay, tt.ok, delay, ok)
+		}
+	}
+}
+
+func TestDebug(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"results":[{"name":"web01","root_pass":"hunter2"}]}`))
+	}))
+	defer ts.Close()
+	var logged []string
+	s, err := NewBasicAuthClient("user", "s3cret", Options{
+		DebugBody: 48,
+		Debugf: func(format string, v ...interface{}) {
+			logged = append(logged, fmt.Sprintf(format, v...))
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	b, err := s.PostJSON(ts.URL+"/hosts", []byte(`{"password":"s3cret","search":"x"}`))
+	if err != nil {
+		t.Fatalf("PostJSON returned: %v", err)
+	}
+	if !strings.Contains(string(b), "hunter2") {
+		t.Errorf("The response body was altered: %s", b)
+	}
+	all := strings.Join(logged, "\n")
+	for _, secret := range []string{"s3cret", "hunter2", "Basic "} {
+		if strings.Contains(all, secret) {
+			t.Errorf("Debug log contains %q:\n%s", secret, all)
+		}
+	}
+	for _, want := range []string{"Authorization: [REDACTED]", `"password":"[REDACTED]"`, "200 OK", "(52 bytes)", "...(truncated)"} {
+		if !strings.Contains(all, want) {
+			t.Errorf("Debug log doesn't contain %q:\n%s", want, all)
+		}
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	tests := map[string]string{
+		`{"name":"x"}`:                      `{"name":"x"}`,
+		`{"password": "a\"b", "n": 1}`:      `{"password": "[REDACTED]", "n": 1}`,
+		`{"api_token":"t","Secret_Key":""}`: `{"api_token":"[REDACTED]","Secret_Key":"[REDACTED]"}`,
+		`{"root_pass":"hun`:                 `{"root_pass":"[REDACTED]"`,
+	}
+	for in, want := range tests {
+		if got := redactBody(in); got != want {
+			t.Errorf("%s: Expected %s, got %s", in, want, got)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`{}`))
+	}))
+	defer ts.Close()
+	dir, err := os.MkdirTemp("", "satapi")
+	if err != nil {
+		t.Fatalf("Unable to create TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	// Without a ticket, the request isn't sent
+	s, err := NewNegotiateClient(Negotiate{CCache: filepath.Join(dir, "krb5cc")}, Options{})
+	if err != nil {
+		t.Fatalf("Unable to create client: %v", err)
+	}
+	if _, err := s.GetJSON(ts.URL); !IsAuthFailure(err) {
+		t.Errorf("Expected an authentication failure without a credential cache, got: %v", err)
+	}
+	if requests != 0 {
+		t.Errorf("Expected no requests without a credential cache, got %d", requests)
+	}
+	tests := map[string]string{
+		"FILE:/tmp/krb5cc_satinv": "/tmp/krb5cc_satinv",
+		"/tmp/krb5cc_satinv":      "/tmp/krb5cc_satinv",
+		`C:\krb5cc`:               `C:\krb5cc`,
+		"KEYRING:persistent:1000": "",
+	}
+	for name, want := range tests {
+		n := &negotiator{Negotiate: Negotiate{CCache: name}}
+		got, err := n.ccache()
+		if want == "" && err == nil {
+			t.Errorf("Expected an error for credential cache %s, got %q", name, got)
+		} else if got != want {
+			t.Errorf("Unexpected path of credential cache %s.  Expected=%q, Got=%q", name, want, got)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package cacher
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/crooks/satinv/atomicfile"
+)
+
+// store holds the content of cache files.  Files are identified by their full path.
+type store interface {
+	readFile(filename string) ([]byte, error)
+	writeFile(filename string, b []byte) error
+	size(filename string) (int64, error) // Returns an error satisfying os.ErrNotExist if the file doesn't exist
+	remove(filename string) error
+	list(dir string) ([]string, error) // Names of the files in a directory
+}
+
+// diskStore keeps cache files on disk
+type diskStore struct {
+	perms atomicfile.Perms // Applied to each file written
+}
+
+func (diskStore) readFile(filename string) ([]byte, error) {
+	return os.ReadFile(filename)
+}
+
+func (d diskStore) writeFile(filename string, b []byte) error {
+	return atomicfile.Write(filename, b, d.perms)
+}
+
+func (diskStore) size(filename string) (int64, error) {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	return fi.Size(), nil
+}
+
+func (diskStore) remove(filename string) error {
+	return os.Remove(filename)
+}
+
+func (diskStore) list(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+// Memory keeps cache files in memory, so nothing is written to disk.  The content lasts for the lifetime of the
+// process, so a single Memory should be shared by every Cache that needs to see it.  It's safe for concurrent use.
+type Memory struct {
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+// NewMemory returns an empty in-memory cache store.
+func NewMemory() *Memory {
+	return &Memory{files: make(map[string][]byte)}
+}
+
+func (m *Memory) readFile(filename string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.files[filename]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: filename, Err: os.ErrNotExist}
+	}
+	return b, nil
+}
+
+func (m *Memory) writeFile(filename string, b []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// The caller may reuse its slice, so the content is copied
+	m.files[filename] = append([]byte{}, b...)
+	return nil
+}
+
+func (m *Memory) size(filename string) (int64, error) {
+	b, err := m.readFile(filename)
+	return int64(len(b)), err
+}
+
+func (m *Memory) remove(filename string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.files[filename]; !ok {
+		return &os.PathError{Op: "remove", Path: filename, Err: os.ErrNotExist}
+	}
+	delete(m.files, filename)
+	return nil
+}
+
+func (m *Memory) list(dir string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for filename := range m.files {
+		if filepath.Dir(filename) == filepath.Clean(dir) {
+			names = append(names, filepath.Base(filename))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// exists returns true if a file is present in a store.
+func exists(s store, filename string) bool {
+	_, err := s.size(filename)
+	return !errors.Is(err, os.ErrNotExist)
+}
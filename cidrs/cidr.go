@@ -3,20 +3,20 @@ package cidrs
 
 import (
 	"fmt"
-	"log"
 	"net"
+	"sort"
 )
 
 // Cidrs contains a map of desired inventory groups and the subnets associated with them
 type Cidrs map[string]*net.IPNet
 
 // parseCIDRs compares an IP address to a range of subnets.  If the address is in the subnet, the name of the subnet
-// is appended to a subnets list and returned
+// is appended to a subnets list and returned.  An invalid address is a member of no subnets.
 func (c Cidrs) ParseCIDRs(ipAddr string) (memberOf []string) {
 	cidrString := fmt.Sprintf("%s/32", ipAddr)
 	ip, _, err := net.ParseCIDR(cidrString)
 	if err != nil {
-		log.Print("Invalid CIDR address")
+		return
 	}
 
 	// Iterate through each defined subnet and test if the address is a member of it.
@@ -29,17 +29,27 @@ func (c Cidrs) ParseCIDRs(ipAddr string) (memberOf []string) {
 }
 
 // AddCIDR adds a CIDR name and subnet to the members list.
-func (c Cidrs) AddCIDR(name, subnet string) {
+func (c Cidrs) AddCIDR(name, subnet string) error {
 	_, cidr, err := net.ParseCIDR(subnet)
 	if err != nil {
-		log.Printf("Invalid subnet: %v", err)
+		return fmt.Errorf("invalid subnet for %s: %v", name, err)
 	}
 	c[name] = cidr
+	return nil
 }
 
-// AddCIDRMap is a helper function for adding multiple subnets to the members list.
-func (c Cidrs) AddCIDRMap(cidrMap map[string]string) {
-	for name, cidr := range cidrMap {
-		c.AddCIDR(name, cidr)
+// AddCIDRMap is a helper function for adding multiple subnets to the members list.  Subnets are added in name order
+// and the first invalid subnet is returned as an error.
+func (c Cidrs) AddCIDRMap(cidrMap map[string]string) error {
+	var names []string
+	for name := range cidrMap {
+		names = append(names, name)
 	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := c.AddCIDR(name, cidrMap[name]); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -15,10 +15,13 @@ func contains(sl []string, st string) bool {
 
 func TestCIDR(t *testing.T) {
 	c := make(Cidrs)
-	c.AddCIDRMap(map[string]string{
+	err := c.AddCIDRMap(map[string]string{
 		"test1": "192.168.0.0/24",
 		"test2": "192.168.1.0/24",
 	})
+	if err != nil {
+		t.Fatalf("AddCIDRMap returned: %v", err)
+	}
 	testAddr := "192.168.0.5"
 	memberOf := c.ParseCIDRs(testAddr)
 	if !contains(memberOf, "test1") {
@@ -37,3 +40,16 @@ func TestCIDR(t *testing.T) {
 		t.Fatalf("%s should not be a member of test1", testAddr)
 	}
 }
+
+func TestInvalidCIDR(t *testing.T) {
+	c := make(Cidrs)
+	if err := c.AddCIDR("bad", "192.168.0.0/33"); err == nil {
+		t.Error("Expected an error for an invalid subnet")
+	}
+	if _, ok := c["bad"]; ok {
+		t.Error("An invalid subnet should not be added")
+	}
+	if memberOf := c.ParseCIDRs("not.an.ip"); len(memberOf) != 0 {
+		t.Errorf("An invalid address should not be a member of any subnet, got %v", memberOf)
+	}
+}
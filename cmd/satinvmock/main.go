@@ -0,0 +1,23 @@
+// satinvmock serves a mock Red Hat Satellite API, populated with a small demonstration estate, for trying out satinv
+// without access to a real Satellite.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/crooks/satinv/satinvmock"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8080", "Address to listen on")
+	username := flag.String("username", "", "Username required by the API (default none)")
+	password := flag.String("password", "", "Password required by the API")
+	flag.Parse()
+	s := satinvmock.Demo()
+	s.Username = *username
+	s.Password = *password
+	log.Printf("Serving mock Satellite API on http://%s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, s))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/cacher"
+	"github.com/crooks/satinv/cacher/satapi"
+)
+
+// Exit statuses, so that wrapper scripts can tell why satinv failed.  Any other failure exits with 1.
+const (
+	exitConfig      = 2 // The config is invalid
+	exitAuth        = 3 // Satellite refused the API credentials
+	exitStale       = 4 // Satellite couldn't be reached (or the build timed out) and the previous inventory was output
+	exitCache       = 5 // The cache couldn't be read
+	exitOutput      = 6 // The inventory couldn't be written
+	exitUnreachable = 7 // Satellite couldn't be reached and there was no previous inventory to output
+	exitRefused     = 8 // The inventory was refused by a safeguard, or its build timed out, and not published
+	exitCancelled   = 9 // satinv was asked to stop (by SIGINT or SIGTERM) before the inventory was built
+)
+
+// exitError is returned by commands that end with a specific exit status, rather than the usual 1
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// exitCode returns the exit status for an error: That of an exitError, or a classification of API and cache errors.
+func exitCode(err error) int {
+	var e *exitError
+	switch {
+	case errors.As(err, &e):
+		return e.code
+	case satapi.IsAuthFailure(err):
+		return exitAuth
+	case satapi.IsUnavailable(err):
+		return exitUnreachable
+	case errors.Is(err, cacher.ErrChecksum) || errors.Is(err, cacher.ErrDecrypt):
+		return exitCache
+	}
+	return 1
+}
+
+// exitf logs an error, and repeats it on stderr, then exits with a specific status.  It's log.Fatalf for failures that
+// have their own exit status.
+func exitf(code int, format string, v ...interface{}) {
+	log.Errorf(format, v...)
+	fmt.Fprintf(os.Stderr, "satinv: "+format+"\n", v...)
+	os.Exit(code)
+}
+
+// runCommand executes a satinv subcommand.  Subcommands are provided as positional arguments following any flags.
+func runCommand(args []string) error {
+	switch args[0] {
+	case "assert":
+		return assertCommand(args[1:])
+	case "cache":
+		return cacheCommand(args[1:])
+	case "explain":
+		return explainCommand(args[1:])
+	case "export":
+		return exportCommand(args[1:])
+	case "healthcheck":
+		return healthcheckCommand(args[1:])
+	case "history":
+		return historyCommand(args[1:])
+	case "report":
+		return reportCommand(args[1:])
+	case "selftest":
+		return selftestCommand(args[1:])
+	case "serve":
+		return serveCommand(args[1:])
+	case "verify":
+		return verifyCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
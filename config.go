@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/crooks/satinv/config"
+)
+
+// configCommand executes the "config" subcommands.  Unlike other commands, they run before the config file is parsed so
+// that they can be used with config files that are invalid.
+func configCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("config requires a subcommand: init, validate")
+	}
+	switch args[0] {
+	case "init":
+		return configInit(args[1:])
+	case "validate":
+		return configValidate(args[1:])
+	default:
+		return fmt.Errorf("unknown config subcommand: %s", args[0])
+	}
+}
+
+// configInit writes a commented example config file.  An existing file is never overwritten.
+func configInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	filename := fs.String("path", flags.Config, "Config file to create")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// The example contains credentials so it's only readable by its owner
+	f, err := os.OpenFile(*filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists; not overwriting it", *filename)
+	} else if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(config.Example); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote example config to %s\n", *filename)
+	return nil
+}
+
+// configValidate checks a config file (by default, the one satinv would use) and prints every problem found.
+func configValidate(args []string) error {
+	if len(args) > 1 {
+		return errors.New("config validate takes at most one filename")
+	}
+	filename := flags.Config
+	if len(args) == 1 {
+		filename = args[0]
+	}
+	problems := config.Validate(filename, flags.ConfigFormat)
+	if len(problems) == 0 {
+		fmt.Printf("%s: OK\n", filename)
+		return nil
+	}
+	for _, p := range problems {
+		fmt.Printf("%s: %v\n", filename, p)
+	}
+	return fmt.Errorf("%s has %d problems", filename, len(problems))
+}
@@ -2,12 +2,15 @@
 package config
 
 import (
+	"encoding/hex"
 	"flag"
+	"fmt"
+	"net/url"
 	"os"
-	"os/user"
-	"path"
+	"path/filepath"
 	"strings"
 
+	"github.com/crooks/satinv/atomicfile"
 	"gopkg.in/yaml.v2"
 )
 
@@ -15,43 +18,403 @@ const (
 	defaultSatValidHours            int   = 48
 	defaultCacheValiditySeconds     int64 = 8 * 60 * 60 // 8 Hours
 	defaultInventoryValiditySeconds int64 = 2 * 60 * 60 // 2 Hours
+	defaultEnricherConcurrency      int   = 2
+	defaultRemediationMaxHosts      int   = 50
+	defaultRemediationCooldown      int64 = 24 * 60 * 60 // 24 Hours
+	defaultSchemaValidation               = "warn"
+	defaultGroupNameReplacement           = "_"
+	defaultOnTruncation                   = "error"
+	defaultCollectionsPerPage       int   = 100
+	defaultCollectionsMode                = "ids"
+	defaultSCA                            = "off"
+	defaultDNSConcurrency           int   = 16
+	defaultDNSTimeout               int   = 5
+	defaultBuildOnTimeout                 = "stale"
+	defaultBuildOnUnreachable             = "stale"
+	defaultHistoryKeep              int   = 30
+	defaultServerListen                   = "127.0.0.1:8086"
+	defaultServerProtocol                 = "http"
+	defaultHostnameStyle                  = "short"
+	defaultMergePrecedence                = "satinv"
+	defaultSubnetsMode                    = "off"
+	defaultSubnetsPrefix                  = "subnet_"
+	defaultTracingServiceName             = "satinv"
+	defaultTracingTimeout           int   = 10
+	defaultAPIRetries               int   = 3
+	defaultAPIRetryMaxWait          int   = 300
+	defaultOutputHostvars                 = "inline"
+	defaultSystemConfig                   = "/etc/ansible/satinv.yml"
+	defaultExcludeParameterScope          = "valid"
+	defaultAPIAuth                        = "basic"
 )
 
+// Group families that can be toggled by groups.enable
+const (
+	GroupValid        = "valid"        // The valid group and its variants
+	GroupStale        = "stale"        // Hosts that only fail the valid group's check-in age
+	GroupCIDRs        = "cidrs"        // CIDRs and Satellite subnets
+	GroupCollections  = "collections"  // Host Collections
+	GroupTags         = "tags"         // The tag_parameter
+	GroupParameter    = "parameter"    // The groups_parameter
+	GroupNetBox       = "netbox"       // NetBox sites, tenants and roles
+	GroupBuilders     = "builders"     // Registered and external group builders
+	GroupExpressions  = "expressions"  // group_expressions
+	GroupDNS          = "dns"          // The dns_check mismatch group
+	GroupSubscription = "subscription" // Subscription status
+	GroupOS           = "os"           // Operating System and major version
+	GroupCapsule      = "capsule"      // Content source (Capsule or Smart Proxy)
+	GroupVirtual      = "virtual"      // Virtual and physical hosts, hypervisors and clusters
+	GroupSources      = "sources"      // custom_sources
+)
+
+// GroupFamilies lists every group family, in the order they're generated
+var GroupFamilies = []string{GroupValid, GroupStale, GroupCIDRs, GroupSubscription, GroupOS, GroupCapsule, GroupVirtual,
+	GroupCollections, GroupSources, GroupTags, GroupParameter, GroupNetBox, GroupBuilders, GroupDNS, GroupExpressions}
+
+// optInGroupFamilies are only generated when enabled in groups.enable, so they don't change existing inventories
+var optInGroupFamilies = map[string]bool{GroupSubscription: true, GroupOS: true, GroupCapsule: true, GroupVirtual: true}
+
+// Enricher contains the settings for a single source of additional hostvars
+type Enricher struct {
+	Enabled     bool  `yaml:"enabled"`
+	Validity    int64 `yaml:"validity"`
+	Concurrency int   `yaml:"concurrency"`
+}
+
+// ExternalEnricher contains the settings for a command or HTTP endpoint that provides additional hostvars
+type ExternalEnricher struct {
+	Name      string   `yaml:"name"`
+	Command   []string `yaml:"command"`
+	URL       string   `yaml:"url"`
+	BatchSize int      `yaml:"batch_size"`
+	Timeout   int      `yaml:"timeout"` // Seconds
+}
+
+// GroupBuilder contains the settings for an external executable that assigns hosts to custom groups
+type GroupBuilder struct {
+	Name    string   `yaml:"name"`
+	Command []string `yaml:"command"`
+	Timeout int      `yaml:"timeout"` // Seconds
+}
+
+// CustomSource contains the settings for an API endpoint whose response is mapped into groups
+type CustomSource struct {
+	Name     string `yaml:"name"`
+	URL      string `yaml:"url"`      // Relative to the api baseurl if it begins with a slash
+	Validity int64  `yaml:"validity"` // Seconds.  Zero uses the cache validity_default.
+	// Path is a gjson path that selects an array of group and host pairs from the response
+	Path string `yaml:"path"`
+}
+
+// View is a subset of the inventory served by the serve command at /inventory/<name>
+type View struct {
+	// A host is in the view if it's in any of the Groups and any of the Organizations (by name or ID).  An empty list
+	// doesn't restrict the view.
+	Groups        []string `yaml:"groups"`
+	Organizations []string `yaml:"organizations"`
+	Tokens        []string `yaml:"tokens"` // Bearer tokens accepted by the view, in addition to the server tokens
+}
+
+// Notifier contains the settings for a single notification sink
+type Notifier struct {
+	Type   string   `yaml:"type"`   // smtp, slack or exec
+	Events []string `yaml:"events"` // Kinds of event to deliver (alert, change).  Default: all
+	// SMTP settings
+	Server   string   `yaml:"server"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	// Slack settings
+	WebhookURL string `yaml:"webhook_url"`
+	// Exec settings
+	Command []string `yaml:"command"`
+	Timeout int      `yaml:"timeout"` // Seconds
+}
+
+// Profile defines a subset of the inventory suitable for export
+type Profile struct {
+	Hostvars []string `yaml:"hostvars"` // gjson paths of the hostvars retained for each host
+}
+
+// FieldRegex matches a Regular Expression against a field of a host's Satellite record
+type FieldRegex struct {
+	Field string `yaml:"field"` // gjson path, or one of the aliases fqdn and location
+	Regex string `yaml:"regex"`
+}
+
+// ValidOverride replaces conditions of the principal valid group for the members of a Host Collection or CIDR
+type ValidOverride struct {
+	Hours      int   `yaml:"hours"`              // Zero retains the hours of the valid group
+	Unlicensed *bool `yaml:"include_unlicensed"` // Unset retains the setting of the valid group
+}
+
+// Valid contains the conditions a host must satisfy to be a member of a valid group
+type Valid struct {
+	Hours         int          `yaml:"hours"`
+	Unlicensed    bool         `yaml:"include_unlicensed"`
+	IncludeHosts  []string     `yaml:"include_hosts"`
+	IncludeRegex  []string     `yaml:"include_regex"`
+	ExcludeHosts  []string     `yaml:"exclude_hosts"`
+	ExcludeRegex  []string     `yaml:"exclude_regex"`
+	ExcludeFields []FieldRegex `yaml:"exclude_fields"`
+}
+
 // Config contains all the configuration settings
 type Config struct {
 	API struct {
 		BaseURL  string `yaml:"baseurl"`
 		CertFile string `yaml:"certfile"`
 		Password string `yaml:"password"`
+		ProxyURL string `yaml:"proxy_url"`
 		User     string `yaml:"user"`
+		// Auth is the authentication method: basic (user and password) or negotiate (SPNEGO, with a Kerberos ticket)
+		Auth     string `yaml:"auth"`
+		Kerberos struct {
+			Config string `yaml:"config"` // krb5.conf
+			CCache string `yaml:"ccache"` // Credential cache file
+			SPN    string `yaml:"spn"`    // Service principal of the API
+		} `yaml:"kerberos"`
+		RateLimit struct {
+			RequestsPerSecond float64 `yaml:"requests_per_second"`
+			Burst             int     `yaml:"burst"`
+			MaxInFlight       int     `yaml:"max_in_flight"`
+		} `yaml:"rate_limit"`
+		// Debug logs every request and response.  DebugBody is the number of bytes of each body logged; -1 is unlimited.
+		Debug     bool `yaml:"debug"`
+		DebugBody int  `yaml:"debug_body"`
+		Retry     struct {
+			Retries *int `yaml:"retries"`  // Unset is equivalent to defaultAPIRetries
+			MaxWait int  `yaml:"max_wait"` // Seconds.  The longest Retry-After that's honoured.
+		} `yaml:"retry"`
 	} `yaml:"api"`
+	Build struct {
+		Timeout int `yaml:"timeout"` // Seconds.  Zero imposes no limit on the time taken to refresh the inventory.
+		// OnTimeout determines what happens when the timeout is exceeded: stale (use the previous inventory) or error
+		OnTimeout string `yaml:"on_timeout"`
+		// OnUnreachable determines what happens when Satellite can't be reached during a refresh: stale or error
+		OnUnreachable string `yaml:"on_unreachable"`
+		// Workers is the number of hosts built concurrently.  Zero uses every available CPU.
+		Workers int `yaml:"workers"`
+	} `yaml:"build"`
 	Cache struct {
-		Dir                 string `yaml:"dir"`
-		ValidityHosts       int64  `yaml:"validity_hosts"`
-		ValidityCollections int64  `yaml:"validity_collections"`
-		ValidityInventory   int64  `yaml:"validity_inventory"`
+		Dir       string `yaml:"dir"`
+		AutoPrune bool   `yaml:"auto_prune"`
+		Derived   bool   `yaml:"derived"`
+		Disk      *bool  `yaml:"disk"` // Unset is equivalent to true
+		// EncryptionKey is a hex encoded AES key (16, 24 or 32 bytes) used to encrypt cache files
+		EncryptionKey     string `yaml:"encryption_key"`
+		EncryptionKeyFile string `yaml:"encryption_key_file"` // A file containing the encryption_key
+		// Mode, Owner and Group set the permissions and ownership of cache files.  Unset values retain the defaults.
+		Mode          string  `yaml:"mode"`
+		Owner         string  `yaml:"owner"`
+		Group         string  `yaml:"group"`
+		JitterPercent float64 `yaml:"jitter_percent"`
+		// MaxSizeMB limits the total size of cache files, evicting the least recently used.  Zero is unlimited.
+		MaxSizeMB int64 `yaml:"max_size_mb"`
+		// RefreshAheadPercent starts a background refresh when the cached inventory has less than this percentage of
+		// its validity remaining
+		RefreshAheadPercent float64 `yaml:"refresh_ahead_percent"`
+		ValidityDefault     int64   `yaml:"validity_default"`
+		ValidityHosts       int64   `yaml:"validity_hosts"`
+		ValidityCollections int64   `yaml:"validity_collections"`
+		ValidityInventory   int64   `yaml:"validity_inventory"`
+		// Validities contains per-endpoint validity periods, keyed by logical name (e.g. hosts, collections, facts)
+		Validities map[string]int64 `yaml:"validities"`
 	} `yaml:"cache"`
-	CIDRs           map[string]string `yaml:"cidrs"`
-	InventoryPrefix string            `yaml:"inventory_prefix"`
-	Logging         struct {
+	CIDRs map[string]string `yaml:"cidrs"`
+	// CustomSources map the responses of arbitrary API endpoints into groups
+	CustomSources []CustomSource `yaml:"custom_sources"`
+	DNSCheck      struct {
+		Enabled     bool `yaml:"enabled"`
+		Forward     bool `yaml:"forward"`
+		Reverse     bool `yaml:"reverse"`
+		Concurrency int  `yaml:"concurrency"`
+		Timeout     int  `yaml:"timeout"` // Seconds
+	} `yaml:"dns_check"`
+	Enrichers         map[string]*Enricher `yaml:"enrichers"`
+	ExternalEnrichers []ExternalEnricher   `yaml:"external_enrichers"`
+	// FromFile is a Satellite hosts export that the inventory is built from, instead of the API
+	FromFile string `yaml:"from_file"`
+	// ForceValidGroupNames applies Ansible's own group name transformation, including to the inventory_prefix
+	ForceValidGroupNames bool `yaml:"force_valid_group_names"`
+	// GroupNameReplacement replaces characters in Host Collection and CIDR names that are invalid in group names
+	GroupNameReplacement string         `yaml:"group_name_replacement"`
+	GroupBuilders        []GroupBuilder `yaml:"group_builders"`
+	// GroupExpressions defines composite groups, keyed by group name, as set expressions over other groups
+	GroupExpressions map[string]string `yaml:"group_expressions"`
+	Groups           struct {
+		// Enable toggles each family of groups, keyed by family name.  See GroupEnabled for those that aren't listed.
+		Enable map[string]bool `yaml:"enable"`
+		// Prefixes overrides the inventory_prefix of each family of groups, keyed by family name
+		Prefixes map[string]string `yaml:"prefixes"`
+		// OSNames maps Satellite Operating System names (without the version) to the names used in OS groups
+		OSNames map[string]string `yaml:"os_names"`
+	} `yaml:"groups"`
+	History struct {
+		Enabled bool   `yaml:"enabled"`
+		Dir     string `yaml:"dir"`
+		Keep    int    `yaml:"keep"`    // Maximum number of snapshots retained
+		MaxAge  int    `yaml:"max_age"` // Days.  Zero retains snapshots regardless of age.
+	} `yaml:"history"`
+	// HostnameStyle determines how hosts are named in the inventory: short (the host part of the name) or fqdn
+	HostnameStyle   string `yaml:"hostname_style"`
+	HostCollections struct {
+		// Mode determines how Collection members are found: ids (resolve each host ID) or search (a hosts search)
+		Mode           string `yaml:"mode"`
+		OrganizationID int    `yaml:"organization_id"`
+		PerPage        int    `yaml:"per_page"`
+	} `yaml:"host_collections"`
+	// HostvarsIgnore contains the paths of fields that are removed from every host's hostvars
+	HostvarsIgnore  []string `yaml:"hostvars_ignore"`
+	InventoryPrefix string   `yaml:"inventory_prefix"`
+	NetBox          struct {
+		Enabled     bool   `yaml:"enabled"`
+		URL         string `yaml:"url"`
+		Token       string `yaml:"token"`
+		Concurrency int    `yaml:"concurrency"`
+		Timeout     int    `yaml:"timeout"` // Seconds
+	} `yaml:"netbox"`
+	Notifiers []Notifier `yaml:"notifiers"`
+	Output    struct {
+		// File is written with the inventory each time it's produced, in addition to any output to stdout
+		File string `yaml:"file"`
+		// Mode, Owner and Group set the permissions and ownership of the file and inventory history snapshots
+		Mode  string `yaml:"mode"`
+		Owner string `yaml:"owner"`
+		Group string `yaml:"group"`
+		// Hostvars determines where the hostvars are output: inline (in _meta), file (HostvarsFile) or omit
+		Hostvars     string `yaml:"hostvars"`
+		HostvarsFile string `yaml:"hostvars_file"`
+		// SatinvMeta adds the _satinv_meta object, describing the refresh, to the inventory
+		SatinvMeta bool `yaml:"satinv_meta"`
+		// Signing writes a detached signature alongside each output file, so consumers can verify it
+		Signing struct {
+			Method    string `yaml:"method"`     // ssh or gpg.  If empty, output isn't signed.
+			Key       string `yaml:"key"`        // SSH private key file or GPG key ID
+			PublicKey string `yaml:"public_key"` // authorized_keys file (ssh) or keyring (gpg) of trusted keys
+		} `yaml:"signing"`
+	} `yaml:"output"`
+	// OnTruncation determines how truncated Satellite API responses are handled: error or mark
+	OnTruncation string             `yaml:"on_truncation"`
+	Profiles     map[string]Profile `yaml:"profiles"`
+	// Safety guards against publishing an inventory that has lost most of its hosts
+	Safety struct {
+		MinHosts         int     `yaml:"min_hosts"`
+		MaxShrinkPercent float64 `yaml:"max_shrink_percent"` // Compared with the previous inventory
+	} `yaml:"safety"`
+	// SCA determines how Simple Content Access is detected: auto (per Organization), on or off
+	SCA string `yaml:"sca"`
+	// SchemaValidation determines how inventories that Ansible would reject are handled: error, warn or off
+	SchemaValidation string `yaml:"schema_validation"`
+	Server           struct {
+		Listen   string `yaml:"listen"`
+		Interval int    `yaml:"interval"` // Seconds between inventory refreshes
+		// Protocol is how requests are received: http, fastcgi or cgi (a single request, with no daemon)
+		Protocol string `yaml:"protocol"`
+		// SocketMode and SocketGroup set the permissions and ownership of a unix socket
+		SocketMode  string `yaml:"socket_mode"`
+		SocketGroup string `yaml:"socket_group"`
+		// Tokens are the bearer tokens accepted by the server.  TokenFile contains further tokens, one per line.
+		Tokens    []string `yaml:"tokens"`
+		TokenFile string   `yaml:"token_file"`
+		TLS       struct {
+			CertFile string `yaml:"cert_file"`
+			KeyFile  string `yaml:"key_file"`
+			// ClientCAFile enables mutual TLS: Clients must present a certificate signed by one of its CAs
+			ClientCAFile string `yaml:"client_ca_file"`
+		} `yaml:"tls"`
+		// Allow contains the CIDRs permitted to use each endpoint, keyed by endpoint name
+		Allow map[string][]string `yaml:"allow"`
+		Views map[string]View     `yaml:"views"`
+		// Pprof serves the Go runtime profiling endpoints under /debug/pprof/
+		Pprof bool `yaml:"pprof"`
+	} `yaml:"server"`
+	SSHConfig struct {
+		// ProxyJump contains the jump host used to reach the hosts in each CIDR, keyed by CIDR name
+		ProxyJump map[string]string `yaml:"proxy_jump"`
+		User      string            `yaml:"user"`
+	} `yaml:"ssh_config"`
+	Subnets struct {
+		// Mode determines how Satellite subnets contribute CIDR groups: off, merge (with cidrs) or replace (cidrs)
+		Mode   string `yaml:"mode"`
+		Prefix string `yaml:"prefix"` // Prepended to each subnet name to form its CIDR name
+	} `yaml:"subnets"`
+	// TagParameter is the name of a Satellite host parameter containing a comma-separated list of tags
+	TagParameter string `yaml:"tag_parameter"`
+	// AliasParameter is the name of a Satellite host parameter that overrides the host's inventory hostname
+	AliasParameter string `yaml:"alias_parameter"`
+	// GroupsParameter is the name of a Satellite host parameter containing a comma-separated list of extra groups
+	GroupsParameter  string `yaml:"groups_parameter"`
+	ExcludeParameter struct {
+		// Name is the name of a boolean Satellite host parameter that excludes the host when true
+		Name string `yaml:"name"`
+		// Scope is what the host is excluded from: valid (every valid group) or all (the entire inventory)
+		Scope string `yaml:"scope"`
+	} `yaml:"exclude_parameter"`
+	// TimestampLayout is a Go time layout for Satellite timestamps, tried before the known Satellite formats
+	TimestampLayout string `yaml:"timestamp_layout"`
+	Remediation     struct {
+		Enabled     bool              `yaml:"enabled"`
+		JobTemplate string            `yaml:"job_template"`
+		Group       string            `yaml:"group"`
+		Inputs      map[string]string `yaml:"inputs"`
+		MaxHosts    int               `yaml:"max_hosts"`
+		// Cooldown is the number of seconds before a host is remediated again
+		Cooldown int64 `yaml:"cooldown"`
+	} `yaml:"remediation"`
+	Logging struct {
 		Journal  bool   `yaml:"journal"`
 		LevelStr string `yaml:"level"`
 		Filename string `yaml:"filename"`
 	} `yaml:"logging"`
-	Valid struct {
-		Hours        int      `yaml:"hours"`
-		Unlicensed   bool     `yaml:"include_unlicensed"`
-		ExcludeHosts []string `yaml:"exclude_hosts"`
-		ExcludeRegex []string `yaml:"exclude_regex"`
-	} `yaml:"valid"`
+	Merge struct {
+		// InventoryFile is a static inventory whose groups and hostvars are merged into the generated inventory
+		InventoryFile string `yaml:"inventory_file"`
+		// Precedence determines whose hostvars and group vars win when both define them: satinv or file
+		Precedence string `yaml:"precedence"`
+	} `yaml:"merge"`
+	Tower struct {
+		Enabled           bool   `yaml:"enabled"` // Equivalent to --tower
+		URL               string `yaml:"url"`
+		Token             string `yaml:"token"`
+		InventorySourceID int    `yaml:"inventory_source_id"`
+	} `yaml:"tower"`
+	Tracing struct {
+		// Endpoint is the OTLP/HTTP URL spans are exported to.  Tracing is disabled when it's empty.
+		Endpoint    string            `yaml:"endpoint"`
+		ServiceName string            `yaml:"service_name"`
+		Headers     map[string]string `yaml:"headers"` // Added to export requests, e.g. for authentication
+		Timeout     int               `yaml:"timeout"` // Seconds
+	} `yaml:"tracing"`
+	Valid          Valid                    `yaml:"valid"`
+	ValidOverrides map[string]ValidOverride `yaml:"valid_overrides"` // Keyed by Host Collection or CIDR name
+	ValidVariants  map[string]Valid         `yaml:"valid_variants"`
 }
 
 // Flags are the command line flags
 type Flags struct {
-	Config  string
-	Debug   bool
-	List    bool
-	Refresh bool
+	Args         []string // Positional arguments (subcommands) that follow the flags
+	Config       string
+	ConfigFormat string // Format of the config file.  If empty, it's determined by the file extension.
+	Debug        bool   // Deprecated alias of LogStderr
+	DryRun       bool
+	ExitStale    bool // Exit with status 4, rather than success, when the previous inventory is output
+	FromFile     string
+	Host         string // Host whose hostvars are written to stdout
+	List         bool
+	LogStderr    bool   // Log to stderr, in place of the logging filename or journal
+	Output       string // File the inventory is written to, overriding output.file
+	PprofCPU     string // File a CPU profile is written to
+	PprofMem     string // File a heap profile is written to on exit
+	Profile      string
+	Refresh      bool
+	RefreshAhead bool // Refresh cache items near expiry in the background, without output
+	// RefreshHosts and RefreshCollections force a refresh of only the hosts or Host Collections
+	RefreshHosts       bool
+	RefreshCollections bool
+	Tower              bool
+	Trace              string // File a Go execution trace is written to
 }
 
 // WriteConfig will create a YAML formatted config file from a Config struct
@@ -67,21 +430,172 @@ func (c *Config) WriteConfig(filename string) error {
 	return nil
 }
 
+// Validity returns the cache validity period (in seconds) for a logical endpoint name.  Entries in the validities map
+// take precedence, followed by the dedicated validity_<name> options and finally validity_default.
+func (c *Config) Validity(name string) int64 {
+	if v, ok := c.Cache.Validities[name]; ok && v > 0 {
+		return v
+	}
+	switch name {
+	case "hosts":
+		if c.Cache.ValidityHosts > 0 {
+			return c.Cache.ValidityHosts
+		}
+	case "collections":
+		if c.Cache.ValidityCollections > 0 {
+			return c.Cache.ValidityCollections
+		}
+	case "inventory":
+		if c.Cache.ValidityInventory > 0 {
+			return c.Cache.ValidityInventory
+		}
+		// The inventory is cheap to rebuild from cached endpoints so it has its own, shorter, default.
+		return defaultInventoryValiditySeconds
+	}
+	if c.Cache.ValidityDefault > 0 {
+		return c.Cache.ValidityDefault
+	}
+	return defaultCacheValiditySeconds
+}
+
+// GroupEnabled returns true if a family of groups is generated.  Families that aren't in groups.enable are generated
+// unless they're opt-in.
+func (c *Config) GroupEnabled(family string) bool {
+	if enabled, ok := c.Groups.Enable[family]; ok {
+		return enabled
+	}
+	return !optInGroupFamilies[family]
+}
+
+// GroupPrefix returns the prefix of a family's group names: Its entry in groups.prefixes, if it has one, or else the
+// inventory_prefix.
+func (c *Config) GroupPrefix(family string) string {
+	if prefix, ok := c.Groups.Prefixes[family]; ok {
+		return prefix
+	}
+	return c.InventoryPrefix
+}
+
+// HostParameters returns true if any host parameters are read from the Satellite hosts.
+func (c *Config) HostParameters() bool {
+	return c.TagParameter != "" || c.AliasParameter != "" || c.GroupsParameter != "" || c.ExcludeParameter.Name != ""
+}
+
+// APIRetries returns the number of times a throttled API request is retried.
+func (c *Config) APIRetries() int {
+	if c.API.Retry.Retries == nil {
+		return defaultAPIRetries
+	}
+	return *c.API.Retry.Retries
+}
+
+// CacheOnDisk returns true if cache files are kept in the cache dir, rather than in memory.
+func (c *Config) CacheOnDisk() bool {
+	return c.Cache.Disk == nil || *c.Cache.Disk
+}
+
+// SocketPerms returns the permissions and ownership applied to the unix socket of the serve command.
+func (c *Config) SocketPerms() (atomicfile.Perms, error) {
+	return atomicfile.ParsePerms(c.Server.SocketMode, "", c.Server.SocketGroup)
+}
+
+// CachePerms returns the permissions and ownership applied to cache files.
+func (c *Config) CachePerms() (atomicfile.Perms, error) {
+	return atomicfile.ParsePerms(c.Cache.Mode, c.Cache.Owner, c.Cache.Group)
+}
+
+// OutputPerms returns the permissions and ownership applied to inventory files written by satinv.
+func (c *Config) OutputPerms() (atomicfile.Perms, error) {
+	return atomicfile.ParsePerms(c.Output.Mode, c.Output.Owner, c.Output.Group)
+}
+
+// ServerEndpoints are the names of the serve command's endpoints, as used by server allow
+var ServerEndpoints = []string{"inventory", "rpc", "pprof"}
+
+// ServerTokens returns the bearer tokens accepted by the serve command, from both tokens and token_file.  Blank lines
+// and lines beginning with # are ignored in the file.
+func (c *Config) ServerTokens() ([]string, error) {
+	tokens := append([]string{}, c.Server.Tokens...)
+	if c.Server.TokenFile == "" {
+		return tokens, nil
+	}
+	b, err := os.ReadFile(c.Server.TokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read server token_file: %v", err)
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			tokens = append(tokens, line)
+		}
+	}
+	return tokens, nil
+}
+
+// CacheKey returns the key used to encrypt cache files, from either encryption_key or encryption_key_file, or nil if
+// cache encryption isn't configured.
+func (c *Config) CacheKey() ([]byte, error) {
+	key := c.Cache.EncryptionKey
+	if c.Cache.EncryptionKeyFile != "" {
+		b, err := os.ReadFile(c.Cache.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read cache encryption_key_file: %v", err)
+		}
+		key = string(b)
+	}
+	if key == "" {
+		return nil, nil
+	}
+	return DecodeKey(key)
+}
+
+// DecodeKey decodes a hex encoded AES key, which must be 16, 24 or 32 bytes long.
+func DecodeKey(s string) ([]byte, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("key is not hex encoded: %v", err)
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return key, nil
+	}
+	return nil, fmt.Errorf("key must be 16, 24 or 32 bytes, not %d", len(key))
+}
+
 // ParseFlags transcribes command line flags into a struct
 func ParseFlags() *Flags {
 	f := new(Flags)
 	// Config file
-	flag.StringVar(&f.Config, "config", "", "Config file")
-	flag.BoolVar(&f.Debug, "debug", false, "Write logoutput to stderr")
+	flag.StringVar(&f.Config, "config", "", "Config files, directories or patterns, comma-separated")
+	flag.StringVar(&f.ConfigFormat, "config-format", "", "Config file format: yaml, json or toml (default from the file extension)")
+	flag.BoolVar(&f.Debug, "debug", false, "Deprecated: an alias of --log-stderr")
+	flag.BoolVar(&f.DryRun, "dry-run", false, "Refresh the inventory in memory and summarise it, without writing any files")
+	flag.BoolVar(&f.ExitStale, "exit-stale", false, "Exit with status 4 when the previous inventory is output in place of a refresh")
+	flag.StringVar(&f.FromFile, "from-file", "", "Build the inventory from a Satellite hosts export instead of the API")
+	flag.StringVar(&f.Host, "host", "", "Produce the hostvars of a single host to stdout")
 	flag.BoolVar(&f.List, "list", false, "Produce a full inventory to stdout")
+	flag.BoolVar(&f.LogStderr, "log-stderr", false, "Log to stderr instead of the logging filename or journal")
+	flag.StringVar(&f.Output, "output", "", "Write the inventory to this file (default output.file in the config)")
+	flag.StringVar(&f.PprofCPU, "pprof-cpu", "", "Write a CPU profile to this file")
+	flag.StringVar(&f.PprofMem, "pprof-mem", "", "Write a heap profile to this file on exit")
+	flag.StringVar(&f.Profile, "profile", "", "Export profile to apply to the inventory")
 	flag.BoolVar(&f.Refresh, "refresh", false, "Force a cache refresh")
+	flag.BoolVar(&f.RefreshHosts, "refresh-hosts", false, "Force a refresh of the Satellite hosts, but not of other cached items")
+	flag.BoolVar(&f.RefreshCollections, "refresh-collections", false, "Force a refresh of the Host Collections, but not of other cached items")
+	flag.BoolVar(&f.RefreshAhead, "refresh-ahead", false, "Refresh cache items near expiry, without output (used by refresh_ahead_percent)")
+	flag.BoolVar(&f.Tower, "tower", false, "Adapt the inventory for AWX/Tower")
+	flag.StringVar(&f.Trace, "trace", "", "Write a Go execution trace to this file")
 	flag.Parse()
+	f.Args = flag.Args()
+	if f.Debug {
+		f.LogStderr = true
+	}
 
 	// If a "--config" flag has been provided, it should be honoured (even if it's invalid or doesn't exist).
 	if f.Config == "" {
 		if os.Getenv("SATINVCFG") == "" {
 			// Environment variable hasn't been set.  No options left so take a bold guess at a config location.
-			f.Config = "/etc/ansible/satinv.yml"
+			f.Config = defaultConfigFile()
 		} else {
 			// Assume the SATINVCFG variable contains something meaningful and valid.
 			f.Config = os.Getenv("SATINVCFG")
@@ -90,53 +604,317 @@ func ParseFlags() *Flags {
 	return f
 }
 
-// ParseConfig expects a YAML formatted config file and populates a Config struct
-func ParseConfig(filename string) (*Config, error) {
-	file, err := os.Open(filename)
+// defaultConfigFile returns the config file used when none is given: satinv/satinv.yml in the user's config dir
+// ($XDG_CONFIG_HOME, or ~/.config, on Linux) if it exists, otherwise the system-wide defaultSystemConfig.
+func defaultConfigFile() string {
+	if dir, err := os.UserConfigDir(); err == nil {
+		filename := filepath.Join(dir, "satinv", "satinv.yml")
+		if _, err := os.Stat(filename); err == nil {
+			return filename
+		}
+	}
+	return defaultSystemConfig
+}
+
+// defaultCacheDir returns the cache dir used when none is configured: satinv in the user's cache dir
+// ($XDG_CACHE_HOME, or ~/.cache, on Linux).
+func defaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("cache dir is not configured and there is no default: %v", err)
 	}
-	defer file.Close()
+	return filepath.Join(dir, "satinv"), nil
+}
+
+// ParseConfig expects a YAML, JSON or TOML formatted config file, identified by its extension, and populates a Config
+// struct.  Multiple files can be given, as described by Files, in which case they're merged.
+func ParseConfig(spec string) (*Config, error) {
+	return ParseConfigFormat(spec, "")
+}
 
-	y := yaml.NewDecoder(file)
+// ParseConfigFormat populates a Config struct from config files in the given format (yaml, json or toml).  If no
+// format is given, it's determined by the extension of each file.
+func ParseConfigFormat(spec, format string) (*Config, error) {
+	files, err := Files(spec)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readConfigs(files, format)
+	if err != nil {
+		return nil, err
+	}
 	config := new(Config)
 	// Read the config file
-	if err := y.Decode(&config); err != nil {
+	if err := yaml.Unmarshal(b, config); err != nil {
 		return nil, err
 	}
+	if problems := config.applyDefaults(); len(problems) > 0 {
+		return nil, problems[0]
+	}
+	return config, nil
+}
+
+// checkSources returns the problems with custom_sources that make them unsafe to fetch, so they're refused by
+// ParseConfig as well as by config validate: A name that isn't safe in a cache filename, or a URL outside the Satellite,
+// which would be sent the api credentials.
+func (config *Config) checkSources() (problems []error) {
+	sources := make(map[string]bool)
+	for i, s := range config.CustomSources {
+		switch {
+		case !sourceNameRE.MatchString(s.Name):
+			problems = append(problems, fmt.Errorf("custom_sources entry %d needs a name of letters, digits, underscores and dashes, not %q", i+1, s.Name))
+			continue
+		case sources[s.Name]:
+			problems = append(problems, fmt.Errorf("custom_sources %s is defined more than once", s.Name))
+		}
+		sources[s.Name] = true
+		if s.URL != "" && !strings.HasPrefix(s.URL, "/") && !sameHost(s.URL, config.API.BaseURL) {
+			problems = append(problems, fmt.Errorf("custom_sources %s url must be on the api baseurl host, as it's fetched with the api credentials: %s", s.Name, s.URL))
+		}
+	}
+	return
+}
+
+// sameHost returns true if two URLs have the same scheme, host and port.
+func sameHost(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil || ua.Host == "" {
+		return false
+	}
+	ub, err := url.Parse(b)
+	if err != nil || ub.Host == "" {
+		return false
+	}
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// applyDefaults sets the defaults of options that haven't been configured and returns any invalid values found.
+func (config *Config) applyDefaults() (problems []error) {
 	// Set config defaults here
 	if config.Valid.Hours == 0 {
 		config.Valid.Hours = defaultSatValidHours
 	}
-	if config.Cache.ValidityHosts == 0 {
-		config.Cache.ValidityHosts = defaultCacheValiditySeconds
+	// Valid variants inherit the check-in window of the principal valid group, unless they define their own
+	for name, v := range config.ValidVariants {
+		if v.Hours == 0 {
+			v.Hours = config.Valid.Hours
+			config.ValidVariants[name] = v
+		}
+	}
+	if config.Cache.ValidityDefault == 0 {
+		config.Cache.ValidityDefault = defaultCacheValiditySeconds
+	}
+	// Resolve the validity of the principal endpoints so they account for per-endpoint overrides and defaults
+	config.Cache.ValidityHosts = config.Validity("hosts")
+	config.Cache.ValidityCollections = config.Validity("collections")
+	config.Cache.ValidityInventory = config.Validity("inventory")
+	switch config.Build.OnTimeout {
+	case "":
+		config.Build.OnTimeout = defaultBuildOnTimeout
+	case "stale", "error":
+	default:
+		problems = append(problems, fmt.Errorf("build on_timeout must be one of stale or error, not %q", config.Build.OnTimeout))
+	}
+	switch config.Build.OnUnreachable {
+	case "":
+		config.Build.OnUnreachable = defaultBuildOnUnreachable
+	case "stale", "error":
+	default:
+		problems = append(problems, fmt.Errorf("build on_unreachable must be one of stale or error, not %q", config.Build.OnUnreachable))
+	}
+	switch config.HostCollections.Mode {
+	case "":
+		config.HostCollections.Mode = defaultCollectionsMode
+	case "ids", "search":
+	default:
+		problems = append(problems, fmt.Errorf("host_collections mode must be one of ids or search, not %q", config.HostCollections.Mode))
+	}
+	if config.HostCollections.PerPage <= 0 {
+		config.HostCollections.PerPage = defaultCollectionsPerPage
+	}
+	if config.GroupNameReplacement == "" {
+		config.GroupNameReplacement = defaultGroupNameReplacement
+	}
+	switch config.OnTruncation {
+	case "":
+		config.OnTruncation = defaultOnTruncation
+	case "error", "mark":
+	default:
+		problems = append(problems, fmt.Errorf("on_truncation must be one of error or mark, not %q", config.OnTruncation))
 	}
-	if config.Cache.ValidityCollections == 0 {
-		config.Cache.ValidityCollections = defaultCacheValiditySeconds
+	switch config.Output.Hostvars {
+	case "":
+		config.Output.Hostvars = defaultOutputHostvars
+	case "inline", "file", "omit":
+	default:
+		problems = append(problems, fmt.Errorf("output hostvars must be one of inline, file or omit, not %q", config.Output.Hostvars))
 	}
-	if config.Cache.ValidityInventory == 0 {
-		config.Cache.ValidityInventory = defaultInventoryValiditySeconds
+	problems = append(problems, config.checkSources()...)
+	switch config.Output.Signing.Method {
+	case "", "ssh", "gpg":
+	default:
+		problems = append(problems, fmt.Errorf("output signing method must be one of ssh or gpg, not %q", config.Output.Signing.Method))
+	}
+	switch config.HostnameStyle {
+	case "":
+		config.HostnameStyle = defaultHostnameStyle
+	case "short", "fqdn":
+	default:
+		problems = append(problems, fmt.Errorf("hostname_style must be one of short or fqdn, not %q", config.HostnameStyle))
+	}
+	switch config.API.Auth {
+	case "":
+		config.API.Auth = defaultAPIAuth
+	case "basic", "negotiate":
+	default:
+		problems = append(problems, fmt.Errorf("api auth must be one of basic or negotiate, not %q", config.API.Auth))
+	}
+	switch config.ExcludeParameter.Scope {
+	case "":
+		config.ExcludeParameter.Scope = defaultExcludeParameterScope
+	case "valid", "all":
+	default:
+		problems = append(problems, fmt.Errorf("exclude_parameter scope must be one of valid or all, not %q", config.ExcludeParameter.Scope))
+	}
+	switch config.SCA {
+	case "":
+		config.SCA = defaultSCA
+	case "auto", "on", "off":
+	default:
+		problems = append(problems, fmt.Errorf("sca must be one of auto, on or off, not %q", config.SCA))
+	}
+	switch config.SchemaValidation {
+	case "":
+		config.SchemaValidation = defaultSchemaValidation
+	case "error", "warn", "off":
+	default:
+		problems = append(problems, fmt.Errorf("schema_validation must be one of error, warn or off, not %q", config.SchemaValidation))
+	}
+	switch config.Merge.Precedence {
+	case "":
+		config.Merge.Precedence = defaultMergePrecedence
+	case "satinv", "file":
+	default:
+		problems = append(problems, fmt.Errorf("merge precedence must be one of satinv or file, not %q", config.Merge.Precedence))
+	}
+	switch config.Subnets.Mode {
+	case "":
+		config.Subnets.Mode = defaultSubnetsMode
+	case "off", "merge", "replace":
+	default:
+		problems = append(problems, fmt.Errorf("subnets mode must be one of off, merge or replace, not %q", config.Subnets.Mode))
+	}
+	if config.Subnets.Prefix == "" {
+		config.Subnets.Prefix = defaultSubnetsPrefix
+	}
+	for name := range config.SSHConfig.ProxyJump {
+		// The names of subnet CIDRs aren't known until they're fetched from Satellite
+		if _, ok := config.CIDRs[name]; !ok && config.Subnets.Mode == "off" {
+			problems = append(problems, fmt.Errorf("ssh_config proxy_jump refers to an undefined CIDR: %s", name))
+		}
+	}
+	if config.API.Retry.MaxWait == 0 {
+		config.API.Retry.MaxWait = defaultAPIRetryMaxWait
+	}
+	if config.Server.Listen == "" {
+		config.Server.Listen = defaultServerListen
+	}
+	switch config.Server.Protocol {
+	case "":
+		config.Server.Protocol = defaultServerProtocol
+	case "http", "fastcgi", "cgi":
+	default:
+		problems = append(problems, fmt.Errorf("server protocol must be one of http, fastcgi or cgi, not %q", config.Server.Protocol))
+	}
+	if config.Server.Interval <= 0 {
+		config.Server.Interval = int(config.Cache.ValidityInventory)
+	}
+	if config.Tracing.ServiceName == "" {
+		config.Tracing.ServiceName = defaultTracingServiceName
+	}
+	if config.Tracing.Timeout <= 0 {
+		config.Tracing.Timeout = defaultTracingTimeout
+	}
+	if u, err := url.Parse(config.Tracing.Endpoint); err == nil && u.Host != "" && (u.Path == "" || u.Path == "/") {
+		// The endpoint may be given as the collector's base URL, as with OTEL_EXPORTER_OTLP_ENDPOINT
+		u.Path = "/v1/traces"
+		config.Tracing.Endpoint = u.String()
+	}
+	if config.Remediation.MaxHosts == 0 {
+		config.Remediation.MaxHosts = defaultRemediationMaxHosts
+	}
+	if config.Remediation.Cooldown == 0 {
+		config.Remediation.Cooldown = defaultRemediationCooldown
+	}
+	if config.DNSCheck.Enabled && !config.DNSCheck.Forward && !config.DNSCheck.Reverse {
+		// Enabling the check without specifying a direction implies both
+		config.DNSCheck.Forward = true
+		config.DNSCheck.Reverse = true
+	}
+	if config.DNSCheck.Concurrency == 0 {
+		config.DNSCheck.Concurrency = defaultDNSConcurrency
+	}
+	if config.DNSCheck.Timeout == 0 {
+		config.DNSCheck.Timeout = defaultDNSTimeout
+	}
+	if config.NetBox.Concurrency == 0 {
+		config.NetBox.Concurrency = defaultEnricherConcurrency
+	}
+	for name, e := range config.Enrichers {
+		if e == nil {
+			// An enricher with no settings is declared but disabled
+			config.Enrichers[name] = new(Enricher)
+			continue
+		}
+		if e.Validity == 0 {
+			e.Validity = config.Validity(name)
+		}
+		if e.Concurrency == 0 {
+			e.Concurrency = defaultEnricherConcurrency
+		}
 	}
 
+	if config.Cache.Dir == "" {
+		dir, err := defaultCacheDir()
+		if err != nil {
+			problems = append(problems, err)
+		}
+		config.Cache.Dir = dir
+	}
 	// The following config options may need tilde expansion
 	config.Cache.Dir = expandTilde(config.Cache.Dir)
 	config.Logging.Filename = expandTilde(config.Logging.Filename)
+	config.History.Dir = expandTilde(config.History.Dir)
+	config.FromFile = expandTilde(config.FromFile)
+	config.Output.File = expandTilde(config.Output.File)
+	config.Output.HostvarsFile = expandTilde(config.Output.HostvarsFile)
+	config.Output.Signing.Key = expandTilde(config.Output.Signing.Key)
+	config.Output.Signing.PublicKey = expandTilde(config.Output.Signing.PublicKey)
+	config.Merge.InventoryFile = expandTilde(config.Merge.InventoryFile)
+	config.Cache.EncryptionKeyFile = expandTilde(config.Cache.EncryptionKeyFile)
+	config.Server.TokenFile = expandTilde(config.Server.TokenFile)
+	config.Server.TLS.CertFile = expandTilde(config.Server.TLS.CertFile)
+	config.Server.TLS.KeyFile = expandTilde(config.Server.TLS.KeyFile)
+	config.Server.TLS.ClientCAFile = expandTilde(config.Server.TLS.ClientCAFile)
+	if config.History.Dir == "" {
+		config.History.Dir = filepath.Join(config.Cache.Dir, "history")
+	}
+	if config.History.Keep <= 0 {
+		config.History.Keep = defaultHistoryKeep
+	}
 
-	return config, nil
+	return problems
 }
 
-// expandTilde expands filenames and paths that use the tilde convention to imply relative to homedir.
+// expandTilde expands filenames and paths that use the tilde convention to imply relative to homedir.  On Windows, a
+// backslash may follow the tilde in place of a slash.
 func expandTilde(inPath string) (outPath string) {
-	u, err := user.Current()
+	if inPath != "~" && !strings.HasPrefix(inPath, "~/") && !strings.HasPrefix(inPath, "~"+string(filepath.Separator)) {
+		return inPath
+	}
+	home, err := os.UserHomeDir()
 	if err != nil {
 		panic(err)
 	}
-	if inPath == "~" {
-		outPath = u.HomeDir
-	} else if strings.HasPrefix(inPath, "~/") {
-		outPath = path.Join(u.HomeDir, inPath[2:])
-	} else {
-		outPath = inPath
-	}
-	return
+	return filepath.Join(home, inPath[1:])
 }
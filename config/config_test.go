@@ -2,8 +2,8 @@ package config
 
 import (
 	"os"
-	"os/user"
-	"path"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -27,6 +27,33 @@ func TestFlags(t *testing.T) {
 	}
 }
 
+func TestDefaultPaths(t *testing.T) {
+	tempDir := t.TempDir()
+	for _, v := range []string{"XDG_CONFIG_HOME", "XDG_CACHE_HOME"} {
+		defer os.Setenv(v, os.Getenv(v))
+		os.Setenv(v, tempDir)
+	}
+	// Without a per-user config, the system-wide config is the default
+	if f := defaultConfigFile(); f != defaultSystemConfig {
+		t.Errorf("Expected the default config to be %s, got %s", defaultSystemConfig, f)
+	}
+	userConfig := filepath.Join(tempDir, "satinv", "satinv.yml")
+	if err := os.MkdirAll(filepath.Dir(userConfig), 0755); err != nil {
+		t.Fatalf("Unable to create config dir: %v", err)
+	}
+	if err := os.WriteFile(userConfig, []byte("api: {}\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %v", err)
+	}
+	if f := defaultConfigFile(); f != userConfig {
+		t.Errorf("Expected the default config to be %s, got %s", userConfig, f)
+	}
+	c := &Config{}
+	c.applyDefaults()
+	if expected := filepath.Join(tempDir, "satinv"); c.Cache.Dir != expected {
+		t.Errorf("Expected the default cache dir to be %s, got %s", expected, c.Cache.Dir)
+	}
+}
+
 func TestConfig(t *testing.T) {
 	testFile, err := os.CreateTemp("", "testcfg")
 	if err != nil {
@@ -65,6 +92,13 @@ func TestConfig(t *testing.T) {
 	if cfg.Valid.Unlicensed {
 		t.Error(("cfg.Valid.Unlicensed should be false"))
 	}
+	// SCA detection makes an extra API request and changes the valid group, so it isn't enabled by default
+	if cfg.SCA != "off" {
+		t.Errorf("Unexpected default SCA detection.  Expected=off, Got=%s", cfg.SCA)
+	}
+	if cfg.Remediation.Cooldown != defaultRemediationCooldown {
+		t.Errorf("Unexpected default remediation cooldown.  Expected=%d, Got=%d", defaultRemediationCooldown, cfg.Remediation.Cooldown)
+	}
 	if cfg.Cache.ValidityHosts != fakeCfg.Cache.ValidityHosts || cfg.Cache.ValidityHosts != defaultCacheValiditySeconds {
 		t.Fatalf(
 			"Unexpected config.Cache.Validity. Default=%d, Expected=%d, Got=%d",
@@ -81,25 +115,54 @@ func TestConfig(t *testing.T) {
 	}
 }
 
+func TestValidity(t *testing.T) {
+	c := new(Config)
+	// With nothing configured, built-in defaults apply
+	if v := c.Validity("facts"); v != defaultCacheValiditySeconds {
+		t.Errorf("Unexpected default validity: Expected=%d, Got=%d", defaultCacheValiditySeconds, v)
+	}
+	if v := c.Validity("inventory"); v != defaultInventoryValiditySeconds {
+		t.Errorf("Unexpected inventory validity: Expected=%d, Got=%d", defaultInventoryValiditySeconds, v)
+	}
+	c.Cache.ValidityDefault = 600
+	c.Cache.ValidityHosts = 1200
+	c.Cache.Validities = map[string]int64{"collections": 1800, "hosts": 2400}
+	tests := map[string]int64{
+		"facts":       600,  // Falls back to validity_default
+		"collections": 1800, // From the validities map
+		"hosts":       2400, // The validities map overrides validity_hosts
+	}
+	for name, expected := range tests {
+		if v := c.Validity(name); v != expected {
+			t.Errorf("Unexpected validity for %s: Expected=%d, Got=%d", name, expected, v)
+		}
+	}
+}
+
 func TestExpandTilde(t *testing.T) {
-	u, err := user.Current()
+	home, err := os.UserHomeDir()
 	if err != nil {
-		t.Fatalf("Unable to ascertain current user: %v", err)
+		t.Fatalf("Unable to ascertain home directory: %v", err)
 	}
 	// Test homedir, without path
 	testDir := "~"
-	expectDir := u.HomeDir
+	expectDir := home
 	resultDir := expandTilde(testDir)
 	if expectDir != resultDir {
 		t.Errorf("Tilde expansion failed.  Expected=%s, Got=%s", expectDir, resultDir)
 	}
 	// Test homedir with path
 	testDir = "~/dir1/dir2/filename"
-	expectDir = path.Join(u.HomeDir, "dir1/dir2/filename")
+	expectDir = filepath.Join(home, "dir1", "dir2", "filename")
 	resultDir = expandTilde(testDir)
 	if expectDir != resultDir {
 		t.Errorf("Tilde expansion failed.  Expected=%s, Got=%s", expectDir, resultDir)
 	}
+	// Another user's homedir is not expanded
+	testDir = "~other/filename"
+	if resultDir = expandTilde(testDir); resultDir != testDir {
+		t.Errorf("Tilde expansion failed.  Expected=%s, Got=%s", testDir, resultDir)
+	}
 	// Test path without homedir
 	testDir = "/dir1/dir2/filename"
 	expectDir = "/dir1/dir2/filename"
@@ -108,3 +171,283 @@ func TestExpandTilde(t *testing.T) {
 		t.Errorf("Tilde expansion failed.  Expected=%s, Got=%s", expectDir, resultDir)
 	}
 }
+
+func TestValidVariants(t *testing.T) {
+	testFile, err := os.CreateTemp("", "testcfg")
+	if err != nil {
+		t.Fatalf("Unable to create TempFile: %v", err)
+	}
+	defer os.Remove(testFile.Name())
+	fakeCfg := new(Config)
+	fakeCfg.Valid.Hours = 48
+	fakeCfg.ValidVariants = map[string]Valid{
+		"strict": {Hours: 12},
+		"loose":  {Unlicensed: true},
+	}
+	fakeCfg.WriteConfig(testFile.Name())
+
+	cfg, err := ParseConfig(testFile.Name())
+	if err != nil {
+		t.Fatalf("ParseConfig returned: %v", err)
+	}
+	if cfg.ValidVariants["strict"].Hours != 12 {
+		t.Errorf("Unexpected strict hours: Expected=12, Got=%d", cfg.ValidVariants["strict"].Hours)
+	}
+	if cfg.ValidVariants["loose"].Hours != 48 {
+		t.Errorf("Variant should inherit valid hours: Expected=48, Got=%d", cfg.ValidVariants["loose"].Hours)
+	}
+	if !cfg.ValidVariants["loose"].Unlicensed {
+		t.Error("loose variant should include unlicensed hosts")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	testFile, err := os.CreateTemp("", "testcfg")
+	if err != nil {
+		t.Fatalf("Unable to create TempFile: %v", err)
+	}
+	defer os.Remove(testFile.Name())
+	testFile.WriteString(`api:
+  baseurl: https://satellite.fake
+  usr: typo
+bogus: true
+sca: sometimes
+valid:
+  exclude_regex:
+    - "[bad"
+  exclude_fields:
+    - regex: lab
+cidrs:
+  web: 10.0.1.0/33
+timestamp_layout: bogus
+group_name_replacement: "-"
+custom_sources:
+  - name: roles
+    url: /api/v2/hostgroups
+group_expressions:
+  ring1: valid AND
+cache:
+  encryption_key: 0123
+  mode: 0999
+safety:
+  max_shrink_percent: 150
+server:
+  allow:
+    metrics:
+      - 10.0.0.0/8
+  views:
+    web:
+      groups:
+        - web
+      tokens:
+        - webteam
+groups:
+  enable:
+    lifecycle: true
+  prefixes:
+    expressions: x_
+logging:
+  level: debug
+  filename: /tmp/satinv.log
+`)
+	testFile.Close()
+	problems := Validate(testFile.Name(), "")
+	expected := []string{
+		"line 3: unknown key usr",
+		"line 4: unknown key bogus",
+		`sca must be one of auto, on or off, not "sometimes"`,
+		"api user and password are required unless from_file is set",
+		`valid exclude_regex "[bad" is invalid`,
+		"valid exclude_fields entry 1 has no field",
+		`cidrs web: invalid subnet "10.0.1.0/33"`,
+		"custom_sources roles requires a url and a path",
+		"cache encryption_key is invalid: key must be 16, 24 or 32 bytes, not 2",
+		"group_expressions ring1: unexpected end of expression",
+		`cache: mode "0999" is not an octal file mode`,
+		"server allow has an unknown endpoint: metrics",
+		"server views web has tokens, which requires server tokens or a token_file",
+		`timestamp_layout "bogus" contains no date or time elements`,
+		`group_name_replacement "-" must contain only letters, digits or underscores`,
+		"safety max_shrink_percent must be between 0 and 100, not 150",
+		"groups enable has an unknown group family: lifecycle",
+		"groups prefixes has an unknown group family: expressions",
+	}
+	if len(problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %d: %v", len(expected), len(problems), problems)
+	}
+	for i, want := range expected {
+		if !strings.HasPrefix(problems[i].Error(), want) {
+			t.Errorf("Unexpected problem %d.  Expected=%q, Got=%q", i, want, problems[i])
+		}
+	}
+	if problems := Validate(filepath.Join(os.TempDir(), "missing", "satinv.yml"), ""); len(problems) != 1 {
+		t.Errorf("Expected a single problem for a missing file, got %v", problems)
+	}
+}
+
+func TestExample(t *testing.T) {
+	testFile, err := os.CreateTemp("", "testcfg")
+	if err != nil {
+		t.Fatalf("Unable to create TempFile: %v", err)
+	}
+	defer os.Remove(testFile.Name())
+	testFile.WriteString(Example)
+	testFile.Close()
+	// The example must only contain known keys and valid values
+	if problems := Validate(testFile.Name(), ""); len(problems) != 0 {
+		t.Errorf("Example config has problems: %v", problems)
+	}
+	cfg, err := ParseConfig(testFile.Name())
+	if err != nil {
+		t.Fatalf("ParseConfig returned: %v", err)
+	}
+	if cfg.Valid.Hours != defaultSatValidHours || cfg.DNSCheck.Concurrency != defaultDNSConcurrency || cfg.Server.Listen != defaultServerListen {
+		t.Error("Example config should contain the default values")
+	}
+}
+
+func TestFormats(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testcfg")
+	if err != nil {
+		t.Fatalf("Unable to create TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	configs := map[string]string{
+		"satinv.json": `{"api": {"baseurl": "https://satellite.fake"}, "cidrs": {"web": "10.0.1.0/24"}, "valid": {"hours": 12}}`,
+		"satinv.toml": "[api]\nbaseurl = \"https://satellite.fake\"\n\n[cidrs]\nweb = \"10.0.1.0/24\"\n\n[valid]\nhours = 12\n",
+		"satinv.yml":  "api:\n  baseurl: https://satellite.fake\ncidrs:\n  web: 10.0.1.0/24\nvalid:\n  hours: 12\n",
+	}
+	for name, content := range configs {
+		filename := filepath.Join(tempDir, name)
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write %s: %v", name, err)
+		}
+		cfg, err := ParseConfig(filename)
+		if err != nil {
+			t.Errorf("%s: ParseConfig returned: %v", name, err)
+			continue
+		}
+		if cfg.API.BaseURL != "https://satellite.fake" || cfg.CIDRs["web"] != "10.0.1.0/24" || cfg.Valid.Hours != 12 {
+			t.Errorf("%s: Unexpected config: baseurl=%s, cidrs=%v, hours=%d", name, cfg.API.BaseURL, cfg.CIDRs, cfg.Valid.Hours)
+		}
+	}
+	// JSON that yaml.v2 can't parse, like escaped slashes, is still valid
+	filename := filepath.Join(tempDir, "escaped.json")
+	if err := os.WriteFile(filename, []byte(`{"api": {"baseurl": "https:\/\/satellite.fake"}}`), 0644); err != nil {
+		t.Fatalf("Unable to write %s: %v", filename, err)
+	}
+	if cfg, err := ParseConfig(filename); err != nil || cfg.API.BaseURL != "https://satellite.fake" {
+		t.Errorf("Unable to parse JSON with escaped slashes: %v", err)
+	}
+	// An explicit format overrides the file extension
+	filename = filepath.Join(tempDir, "satinv.conf")
+	if err := os.WriteFile(filename, []byte(configs["satinv.toml"]), 0644); err != nil {
+		t.Fatalf("Unable to write %s: %v", filename, err)
+	}
+	if cfg, err := ParseConfigFormat(filename, "toml"); err != nil || cfg.Valid.Hours != 12 {
+		t.Errorf("Unable to parse TOML with an explicit format: %v", err)
+	}
+	if _, err := ParseConfigFormat(filename, "ini"); err == nil {
+		t.Error("Expected an error for an unsupported format")
+	}
+	// Unknown keys are reported, without misleading line numbers, for TOML
+	if err := os.WriteFile(filename, []byte("bogus = true\n"), 0644); err != nil {
+		t.Fatalf("Unable to write %s: %v", filename, err)
+	}
+	problems := Validate(filename, "toml")
+	if len(problems) == 0 || problems[0].Error() != "unknown key bogus" {
+		t.Errorf("Expected an unknown key problem, got: %v", problems)
+	}
+}
+
+func TestMergeFiles(t *testing.T) {
+	tempDir, err := os.MkdirTemp("", "testcfg")
+	if err != nil {
+		t.Fatalf("Unable to create TempDir: %v", err)
+	}
+	defer os.RemoveAll(tempDir)
+	confDir := filepath.Join(tempDir, "satinv.d")
+	if err := os.Mkdir(confDir, 0755); err != nil {
+		t.Fatalf("Unable to create config dir: %v", err)
+	}
+	configs := map[string]string{
+		"satinv.yml":           "api:\n  baseurl: https://satellite.fake\n  user: satinv\nvalid:\n  hours: 12\n  exclude_hosts:\n    - badhost\n",
+		"satinv.d/20-web.json": `{"cidrs": {"web": "10.0.1.0/24"}, "valid": {"exclude_hosts": ["webtest"]}}`,
+		"satinv.d/10-db.yml":   "api:\n  user: override\ncidrs:\n  db: 10.0.2.0/24\nvalid:\n  hours: 24\n",
+		"satinv.d/README":      "Not a config file",
+	}
+	for name, content := range configs {
+		if err := os.WriteFile(filepath.Join(tempDir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Unable to write %s: %v", name, err)
+		}
+	}
+	for _, spec := range []string{
+		filepath.Join(tempDir, "satinv.yml") + "," + confDir,
+		filepath.Join(tempDir, "satinv.yml") + ", " + filepath.Join(confDir, "*0-*"),
+	} {
+		files, err := Files(spec)
+		if err != nil {
+			t.Fatalf("Files returned: %v", err)
+		}
+		if len(files) != 3 || filepath.Base(files[1]) != "10-db.yml" || filepath.Base(files[2]) != "20-web.json" {
+			t.Errorf("Unexpected files for %s: %v", spec, files)
+		}
+		cfg, err := ParseConfig(spec)
+		if err != nil {
+			t.Fatalf("ParseConfig returned: %v", err)
+		}
+		if cfg.API.BaseURL != "https://satellite.fake" || cfg.API.User != "override" || cfg.Valid.Hours != 24 {
+			t.Errorf("Later files should override scalars: baseurl=%s, user=%s, hours=%d", cfg.API.BaseURL, cfg.API.User, cfg.Valid.Hours)
+		}
+		if len(cfg.CIDRs) != 2 || cfg.CIDRs["web"] != "10.0.1.0/24" || cfg.CIDRs["db"] != "10.0.2.0/24" {
+			t.Errorf("Dictionaries should be merged, got: %v", cfg.CIDRs)
+		}
+		if strings.Join(cfg.Valid.ExcludeHosts, ",") != "badhost,webtest" {
+			t.Errorf("Lists should be concatenated, got: %v", cfg.Valid.ExcludeHosts)
+		}
+	}
+	if _, err := Files(filepath.Join(tempDir, "*.conf")); err == nil {
+		t.Error("Expected an error for a pattern without matches")
+	}
+	// Unknown keys are attributed to the file containing them
+	bogus := filepath.Join(confDir, "30-bogus.yml")
+	if err := os.WriteFile(bogus, []byte("bogus: true\n"), 0644); err != nil {
+		t.Fatalf("Unable to write %s: %v", bogus, err)
+	}
+	var found bool
+	for _, p := range Validate(confDir, "") {
+		if p.Error() == bogus+": line 1: unknown key bogus" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected an unknown key problem in %s, got: %v", bogus, Validate(confDir, ""))
+	}
+}
+
+func TestCustomSourcesRefused(t *testing.T) {
+	tempDir := t.TempDir()
+	refused := map[string]string{
+		"name":     "  - name: ../../etc/x\n    url: /api/v2/hostgroups\n    path: results",
+		"host":     "  - name: roles\n    url: https://evil.example.com/api/v2/hostgroups\n    path: results",
+		"userinfo": "  - name: roles\n    url: https://sat.example.com@evil.example.com/api\n    path: results",
+	}
+	for name, source := range refused {
+		file := filepath.Join(tempDir, name+".yml")
+		yml := "api:\n  baseurl: https://sat.example.com\ncustom_sources:\n" + source + "\n"
+		if err := os.WriteFile(file, []byte(yml), 0644); err != nil {
+			t.Fatalf("Unable to write config: %v", err)
+		}
+		if _, err := ParseConfig(file); err == nil || !strings.Contains(err.Error(), "custom_sources") {
+			t.Errorf("%s: Expected ParseConfig to refuse the custom source, got: %v", name, err)
+		}
+	}
+	file := filepath.Join(tempDir, "ok.yml")
+	yml := "api:\n  baseurl: https://sat.example.com\ncustom_sources:\n  - name: roles\n    url: https://SAT.example.com/api/v2/hostgroups\n    path: results\n"
+	if err := os.WriteFile(file, []byte(yml), 0644); err != nil {
+		t.Fatalf("Unable to write config: %v", err)
+	}
+	if _, err := ParseConfig(file); err != nil {
+		t.Errorf("ParseConfig returned: %v", err)
+	}
+}
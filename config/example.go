@@ -0,0 +1,10 @@
+package config
+
+import (
+	_ "embed" // Required by go:embed
+)
+
+// Example is a commented example config file, containing every option with its default value
+//
+//go:embed example.yml
+var Example string
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Supported config file formats
+const (
+	FormatYAML string = "yaml"
+	FormatJSON string = "json"
+	FormatTOML string = "toml"
+)
+
+// configFormat returns the format of a config file: The requested format or, if none is requested, the one implied by
+// the file extension.  Files without a recognised extension are assumed to be YAML.
+func configFormat(filename, format string) (string, error) {
+	switch strings.ToLower(format) {
+	case "":
+	case "yml", FormatYAML:
+		return FormatYAML, nil
+	case FormatJSON, FormatTOML:
+		return strings.ToLower(format), nil
+	default:
+		return "", fmt.Errorf("config format must be one of yaml, json or toml, not %q", format)
+	}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".json":
+		return FormatJSON, nil
+	case ".toml":
+		return FormatTOML, nil
+	default:
+		return FormatYAML, nil
+	}
+}
+
+// readConfig reads a config file in the given format and returns its content as YAML, so that every format can be
+// decoded into the Config struct using its yaml tags.  JSON is converted too: Although JSON is nominally a subset of
+// YAML, yaml.v2 rejects valid JSON such as the \/ escape.
+func readConfig(filename, format string) ([]byte, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var content interface{}
+	switch format {
+	case FormatJSON:
+		if err := json.Unmarshal(b, &content); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+	case FormatTOML:
+		m := make(map[string]interface{})
+		if err := toml.Unmarshal(b, &m); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		content = m
+	default:
+		return b, nil
+	}
+	return yaml.Marshal(content)
+}
@@ -0,0 +1,133 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// configExtensions are the file extensions of config files read from a config directory
+var configExtensions = []string{".yml", ".yaml", ".json", ".toml"}
+
+// Files returns the config files named by a config path.  The path is a comma-separated list, each element of which
+// is a file, a directory (containing config files) or a glob pattern.  Directories and patterns are expanded in
+// lexical order.
+func Files(spec string) ([]string, error) {
+	var files []string
+	for _, p := range strings.Split(spec, ",") {
+		p = expandTilde(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if strings.ContainsAny(p, "*?[") {
+			matches, err := filepath.Glob(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid config pattern %s: %v", p, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no config files match %s", p)
+			}
+			sort.Strings(matches)
+			files = append(files, matches...)
+			continue
+		}
+		info, err := os.Stat(p)
+		if err != nil || !info.IsDir() {
+			// Files that don't exist are reported when they're read
+			files = append(files, p)
+			continue
+		}
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+		var found bool
+		for _, e := range entries {
+			if !e.IsDir() && containsExt(filepath.Ext(e.Name())) {
+				files = append(files, filepath.Join(p, e.Name()))
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("config directory %s contains no config files", p)
+		}
+	}
+	if len(files) == 0 {
+		return nil, errors.New("no config file specified")
+	}
+	return files, nil
+}
+
+// containsExt returns true if ext is the extension of a config file.
+func containsExt(ext string) bool {
+	for _, e := range configExtensions {
+		if strings.EqualFold(e, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// readConfigs reads each of the config files and returns their content merged into a single YAML document.  A single
+// file is returned unchanged so that the line numbers of any errors remain meaningful.
+func readConfigs(files []string, format string) ([]byte, error) {
+	var merged interface{}
+	for i, filename := range files {
+		fileFormat, err := configFormat(filename, format)
+		if err != nil {
+			return nil, err
+		}
+		b, err := readConfig(filename, fileFormat)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 1 {
+			return b, nil
+		}
+		var content interface{}
+		if err := yaml.Unmarshal(b, &content); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		if i == 0 {
+			merged = content
+		} else {
+			merged = mergeConfig(merged, content)
+		}
+	}
+	return yaml.Marshal(merged)
+}
+
+// mergeConfig merges the content of a config file into that of those preceding it.  Dictionaries are merged key by
+// key, lists are concatenated and any other value replaces the earlier one.
+func mergeConfig(dst, src interface{}) interface{} {
+	switch s := src.(type) {
+	case map[interface{}]interface{}:
+		d, ok := dst.(map[interface{}]interface{})
+		if !ok {
+			return s
+		}
+		for k, v := range s {
+			if existing, ok := d[k]; ok {
+				d[k] = mergeConfig(existing, v)
+			} else {
+				d[k] = v
+			}
+		}
+		return d
+	case []interface{}:
+		if d, ok := dst.([]interface{}); ok {
+			return append(d, s...)
+		}
+		return s
+	case nil:
+		// An empty value (e.g. a section containing only comments) leaves the earlier value in place
+		return dst
+	default:
+		return s
+	}
+}
@@ -0,0 +1,363 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	loglevel "github.com/crooks/log-go-level"
+	"github.com/crooks/satinv/groupexpr"
+	"gopkg.in/yaml.v2"
+)
+
+// unknownField matches the errors yaml reports for keys that don't correspond to a Config field
+var unknownField = regexp.MustCompile(`^(line \d+): field (\S+) not found in type .*$`)
+
+// lineNumber matches the line number that prefixes yaml errors
+var lineNumber = regexp.MustCompile(`^line \d+: `)
+
+// sourceNameRE matches valid custom_sources names, which form part of their cache filenames
+var sourceNameRE = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// viewNameRE matches valid server views names, which form part of their URL paths
+var viewNameRE = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Validate reads a config path (see Files), in the given format, and returns every problem found in it: Unknown keys,
+// invalid values, missing required settings and conflicting options.  Unlike ParseConfig, which stops at the first
+// problem that prevents satinv from running, Validate reports them all.
+func Validate(spec, format string) []error {
+	files, err := Files(spec)
+	if err != nil {
+		return []error{err}
+	}
+	var problems []error
+	// Unknown keys are found in each file individually, so they can be attributed to the file containing them
+	for _, filename := range files {
+		fileProblems, err := unknownKeys(filename, format)
+		if err != nil {
+			return []error{err}
+		}
+		for _, p := range fileProblems {
+			if len(files) > 1 {
+				p = fmt.Errorf("%s: %v", filename, p)
+			}
+			problems = append(problems, p)
+		}
+	}
+	b, err := readConfigs(files, format)
+	if err != nil {
+		return []error{err}
+	}
+	config := new(Config)
+	// Type errors have already been reported and decoding continues past them, so the remaining checks still apply
+	var typeErr *yaml.TypeError
+	if err := yaml.Unmarshal(b, config); err != nil && !errors.As(err, &typeErr) {
+		return []error{err}
+	}
+	problems = append(problems, config.applyDefaults()...)
+	return append(problems, config.lint()...)
+}
+
+// unknownKeys returns a problem for each key in a config file that doesn't correspond to a Config field (or has a
+// value of the wrong type).  An error is returned if the file can't be read or isn't valid.
+func unknownKeys(filename, format string) ([]error, error) {
+	format, err := configFormat(filename, format)
+	if err != nil {
+		return nil, err
+	}
+	b, err := readConfig(filename, format)
+	if err != nil {
+		return nil, err
+	}
+	var problems []error
+	if err := yaml.UnmarshalStrict(b, new(Config)); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			// The file isn't valid YAML so nothing else can be checked
+			return nil, err
+		}
+		for _, msg := range typeErr.Errors {
+			msg = unknownField.ReplaceAllString(msg, "$1: unknown key $2")
+			if format != FormatYAML {
+				// Line numbers refer to the converted content, not the original file
+				msg = lineNumber.ReplaceAllString(msg, "")
+			}
+			problems = append(problems, errors.New(msg))
+		}
+	}
+	return problems, nil
+}
+
+// lint returns problems that ParseConfig tolerates but which cause satinv to fail, or behave unexpectedly, at runtime.
+func (c *Config) lint() (problems []error) {
+	if c.FromFile == "" {
+		if c.API.BaseURL == "" {
+			problems = append(problems, errors.New("api baseurl is required unless from_file is set"))
+		}
+		if c.API.Auth != "negotiate" && (c.API.User == "" || c.API.Password == "") {
+			problems = append(problems, errors.New("api user and password are required unless from_file is set or api auth is negotiate"))
+		}
+	}
+	if c.Logging.LevelStr == "" {
+		problems = append(problems, errors.New("logging level is required"))
+	} else if _, err := loglevel.ParseLevel(c.Logging.LevelStr); err != nil {
+		problems = append(problems, fmt.Errorf("logging level is invalid: %v", err))
+	}
+	if !c.Logging.Journal && c.Logging.Filename == "" {
+		problems = append(problems, errors.New("logging filename is required unless logging to the journal (or run with --log-stderr)"))
+	}
+	problems = append(problems, regexProblems("valid", c.Valid)...)
+	var names []string
+	for name := range c.ValidVariants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		problems = append(problems, regexProblems("valid_variants "+name, c.ValidVariants[name])...)
+	}
+	names = nil
+	for name := range c.ValidOverrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if c.ValidOverrides[name].Hours < 0 {
+			problems = append(problems, fmt.Errorf("valid_overrides %s hours cannot be negative: %d", name, c.ValidOverrides[name].Hours))
+		}
+	}
+	names = nil
+	for name := range c.CIDRs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, _, err := net.ParseCIDR(c.CIDRs[name]); err != nil {
+			problems = append(problems, fmt.Errorf("cidrs %s: invalid subnet %q", name, c.CIDRs[name]))
+		}
+	}
+	for _, s := range c.CustomSources {
+		if s.URL == "" || s.Path == "" {
+			problems = append(problems, fmt.Errorf("custom_sources %s requires a url and a path", s.Name))
+		}
+		if s.Validity < 0 {
+			problems = append(problems, fmt.Errorf("custom_sources %s validity cannot be negative: %d", s.Name, s.Validity))
+		}
+	}
+	if c.NetBox.Enabled && c.NetBox.URL == "" {
+		problems = append(problems, errors.New("netbox is enabled but has no url"))
+	}
+	if c.Remediation.Enabled && c.Remediation.JobTemplate == "" {
+		problems = append(problems, errors.New("remediation is enabled but has no job_template"))
+	}
+	if c.Remediation.Cooldown < 0 {
+		problems = append(problems, fmt.Errorf("remediation cooldown cannot be negative: %d", c.Remediation.Cooldown))
+	}
+	if c.Tower.InventorySourceID > 0 && (c.Tower.URL == "" || c.Tower.Token == "") {
+		problems = append(problems, errors.New("tower inventory_source_id requires a tower url and token"))
+	}
+	if c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, fmt.Errorf("tracing endpoint must be an http or https URL, not %q", c.Tracing.Endpoint))
+		}
+	}
+	if c.Cache.EncryptionKey != "" && c.Cache.EncryptionKeyFile != "" {
+		problems = append(problems, errors.New("cache encryption_key and encryption_key_file are mutually exclusive"))
+	} else if c.Cache.EncryptionKey != "" {
+		if _, err := DecodeKey(c.Cache.EncryptionKey); err != nil {
+			problems = append(problems, fmt.Errorf("cache encryption_key is invalid: %v", err))
+		}
+	}
+	if _, _, err := groupexpr.ParseAll(c.GroupExpressions); err != nil {
+		problems = append(problems, fmt.Errorf("group_expressions %v", err))
+	}
+	if _, ok := c.GroupExpressions["all"]; ok {
+		problems = append(problems, errors.New("group_expressions cannot redefine the all group"))
+	}
+	if _, err := c.CachePerms(); err != nil {
+		problems = append(problems, fmt.Errorf("cache: %v", err))
+	}
+	if _, err := c.OutputPerms(); err != nil {
+		problems = append(problems, fmt.Errorf("output: %v", err))
+	}
+	if _, err := c.SocketPerms(); err != nil {
+		problems = append(problems, fmt.Errorf("server socket: %v", err))
+	}
+	problems = append(problems, c.serverProblems()...)
+	if c.TimestampLayout != "" {
+		// A layout without any recognised elements can't match a timestamp
+		ref := time.Date(2001, 11, 12, 13, 14, 15, 0, time.UTC)
+		if ref.Format(c.TimestampLayout) == c.TimestampLayout {
+			problems = append(problems, fmt.Errorf("timestamp_layout %q contains no date or time elements", c.TimestampLayout))
+		}
+	}
+	// A replacement Ansible considers invalid would make every group containing it invalid too
+	for _, r := range c.GroupNameReplacement {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')) {
+			problems = append(problems, fmt.Errorf("group_name_replacement %q must contain only letters, digits or underscores", c.GroupNameReplacement))
+			break
+		}
+	}
+	if c.Safety.MinHosts < 0 {
+		problems = append(problems, fmt.Errorf("safety min_hosts cannot be negative: %d", c.Safety.MinHosts))
+	}
+	if c.Safety.MaxShrinkPercent < 0 || c.Safety.MaxShrinkPercent > 100 {
+		problems = append(problems, fmt.Errorf("safety max_shrink_percent must be between 0 and 100, not %g", c.Safety.MaxShrinkPercent))
+	}
+	if c.API.DebugBody < -1 {
+		problems = append(problems, fmt.Errorf("api debug_body must be -1 (unlimited) or more: %d", c.API.DebugBody))
+	}
+	if c.APIRetries() < 0 {
+		problems = append(problems, fmt.Errorf("api retry retries cannot be negative: %d", c.APIRetries()))
+	}
+	if c.API.Retry.MaxWait < 0 {
+		problems = append(problems, fmt.Errorf("api retry max_wait cannot be negative: %d", c.API.Retry.MaxWait))
+	}
+	if c.Cache.MaxSizeMB < 0 {
+		problems = append(problems, fmt.Errorf("cache max_size_mb cannot be negative: %d", c.Cache.MaxSizeMB))
+	}
+	if c.Cache.RefreshAheadPercent < 0 || c.Cache.RefreshAheadPercent >= 100 {
+		problems = append(problems, fmt.Errorf("cache refresh_ahead_percent must be at least 0 and less than 100, not %g", c.Cache.RefreshAheadPercent))
+	}
+	if c.Build.Timeout < 0 {
+		problems = append(problems, fmt.Errorf("build timeout cannot be negative: %d", c.Build.Timeout))
+	}
+	if c.Output.Hostvars == "file" && c.Output.HostvarsFile == "" {
+		problems = append(problems, errors.New("output hostvars_file is required when hostvars is file"))
+	}
+	if c.Output.Signing.Method != "" && c.Output.Signing.Key == "" {
+		problems = append(problems, errors.New("output signing key is required when a signing method is set"))
+	}
+	if c.Build.Workers < 0 {
+		problems = append(problems, fmt.Errorf("build workers cannot be negative: %d", c.Build.Workers))
+	}
+	if c.History.MaxAge < 0 {
+		problems = append(problems, fmt.Errorf("history max_age cannot be negative: %d", c.History.MaxAge))
+	}
+	var families []string
+	for family := range c.Groups.Enable {
+		families = append(families, family)
+	}
+	problems = append(problems, familyProblems("enable", families, GroupFamilies)...)
+	families = nil
+	for family := range c.Groups.Prefixes {
+		families = append(families, family)
+	}
+	// Expressions are named in full, so they have no prefix
+	var prefixed []string
+	for _, f := range GroupFamilies {
+		if f != GroupExpressions {
+			prefixed = append(prefixed, f)
+		}
+	}
+	problems = append(problems, familyProblems("prefixes", families, prefixed)...)
+	// The DNS check examines the members of the valid group and remediation defaults to the stale group
+	if c.DNSCheck.Enabled && !c.GroupEnabled(GroupValid) {
+		problems = append(problems, errors.New("dns_check requires the valid group family to be enabled"))
+	}
+	if c.Remediation.Enabled && c.Remediation.Group == "" && !c.GroupEnabled(GroupStale) {
+		problems = append(problems, errors.New("remediation requires a group when the stale group family is disabled"))
+	}
+	return
+}
+
+// familyProblems returns a problem for each of the names given to a groups option that isn't one of the permitted
+// group families.
+func familyProblems(option string, names, permitted []string) (problems []error) {
+	sort.Strings(names)
+	for _, name := range names {
+		known := false
+		for _, f := range permitted {
+			known = known || f == name
+		}
+		if !known {
+			problems = append(problems, fmt.Errorf("groups %s has an unknown group family: %s", option, name))
+		}
+	}
+	return
+}
+
+// regexProblems returns a problem for each include_regex, exclude_regex and exclude_fields entry of a valid group that
+// doesn't compile or doesn't name a field.
+func regexProblems(section string, v Valid) (problems []error) {
+	for _, re := range v.IncludeRegex {
+		if _, err := regexp.Compile(re); err != nil {
+			problems = append(problems, fmt.Errorf("%s include_regex %q is invalid: %v", section, re, err))
+		}
+	}
+	for _, re := range v.ExcludeRegex {
+		if _, err := regexp.Compile(re); err != nil {
+			problems = append(problems, fmt.Errorf("%s exclude_regex %q is invalid: %v", section, re, err))
+		}
+	}
+	for i, f := range v.ExcludeFields {
+		if f.Field == "" {
+			problems = append(problems, fmt.Errorf("%s exclude_fields entry %d has no field", section, i+1))
+		}
+		if _, err := regexp.Compile(f.Regex); err != nil {
+			problems = append(problems, fmt.Errorf("%s exclude_fields regex %q is invalid: %v", section, f.Regex, err))
+		}
+	}
+	return
+}
+
+// serverProblems returns the problems with the authentication settings of the serve command.
+func (c *Config) serverProblems() (problems []error) {
+	tls := c.Server.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		problems = append(problems, errors.New("server tls requires both a cert_file and a key_file"))
+	}
+	if tls.ClientCAFile != "" && tls.CertFile == "" {
+		problems = append(problems, errors.New("server tls client_ca_file requires a cert_file and key_file"))
+	}
+	if tls.CertFile != "" && c.Server.Protocol != "" && c.Server.Protocol != "http" {
+		problems = append(problems, fmt.Errorf("server tls cannot be used with the %s protocol", c.Server.Protocol))
+	}
+	for _, token := range c.Server.Tokens {
+		if strings.TrimSpace(token) == "" {
+			problems = append(problems, errors.New("server tokens cannot be blank"))
+			break
+		}
+	}
+	var endpoints []string
+	for endpoint := range c.Server.Allow {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+	for _, endpoint := range endpoints {
+		known := false
+		for _, e := range ServerEndpoints {
+			known = known || e == endpoint
+		}
+		if !known {
+			problems = append(problems, fmt.Errorf("server allow has an unknown endpoint: %s", endpoint))
+		}
+		for _, cidr := range c.Server.Allow[endpoint] {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				problems = append(problems, fmt.Errorf("server allow %s has an invalid CIDR: %s", endpoint, cidr))
+			}
+		}
+	}
+	var views []string
+	for name := range c.Server.Views {
+		views = append(views, name)
+	}
+	sort.Strings(views)
+	for _, name := range views {
+		v := c.Server.Views[name]
+		switch {
+		case !viewNameRE.MatchString(name):
+			problems = append(problems, fmt.Errorf("server views name %q may only contain letters, digits, dots, underscores and hyphens", name))
+		case len(v.Groups) == 0 && len(v.Organizations) == 0:
+			problems = append(problems, fmt.Errorf("server views %s requires groups or organizations", name))
+		case len(v.Tokens) > 0 && len(c.Server.Tokens) == 0 && c.Server.TokenFile == "":
+			// Otherwise /inventory, /rpc and pprof would serve the full inventory without a token
+			problems = append(problems, fmt.Errorf("server views %s has tokens, which requires server tokens or a token_file", name))
+		}
+	}
+	return
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/cidrs"
+	"github.com/crooks/satinv/config"
+	"github.com/tidwall/gjson"
+)
+
+// derivedName is the cache item containing per-host results carried over between runs
+const derivedName string = "derived"
+
+// derivedCheck is the cached record of a failed static valid check
+type derivedCheck struct {
+	Name   string `json:"name"`
+	Detail string `json:"detail"`
+	Warn   bool   `json:"warn"`
+}
+
+// derivedHost contains the results derived from a single host's Satellite record.  They remain correct for as long as
+// the host's updated_at timestamp is unchanged.
+type derivedHost struct {
+	UpdatedAt string `json:"updated_at"`
+	// Valid contains the first failed static check for each valid group.  Groups whose static checks all passed are
+	// absent.
+	Valid      map[string]*derivedCheck `json:"valid,omitempty"`
+	CIDRGroups []string                 `json:"cidr_groups,omitempty"`
+}
+
+// derivedFile is the format of the derived results cache file
+type derivedFile struct {
+	Fingerprint string                  `json:"fingerprint"`
+	Hosts       map[string]*derivedHost `json:"hosts"` // Keyed by FQDN
+}
+
+// derivedStore holds the derived results from the previous run and accumulates those of the current one.  It's safe
+// for concurrent use by derive.
+type derivedStore struct {
+	mu       sync.Mutex
+	previous map[string]*derivedHost
+	current  map[string]*derivedHost
+	hits     int
+	misses   int
+}
+
+// derivedFingerprint identifies the configuration (and Organization SCA modes and Satellite subnets) that derived
+// results depend on.  A change to any of these options invalidates every cached result.
+func (inv *inventory) derivedFingerprint() string {
+	b, err := json.Marshal(struct {
+		Prefix      string
+		Prefixes    map[string]string
+		Style       string
+		Replacement string
+		ForceValid  bool
+		Valid       config.Valid
+		Variants    map[string]config.Valid
+		CIDRs       map[string]string
+		Subnets     map[string]string
+		SCA         string
+		SCAOrgs     map[string]bool
+	}{cfg.InventoryPrefix, cfg.Groups.Prefixes, cfg.HostnameStyle, cfg.GroupNameReplacement, cfg.ForceValidGroupNames,
+		cfg.Valid, cfg.ValidVariants, cfg.CIDRs, inv.subnets, cfg.SCA, inv.scaOrgs})
+	if err != nil {
+		// Can't happen with the types involved, but an empty fingerprint never matches a valid one.
+		return ""
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadDerived reads the per-host results of the previous run from the cache, provided caching of derived data is
+// enabled and the results were produced under the same configuration.
+func (inv *inventory) loadDerived() {
+	inv.derived = &derivedStore{
+		previous: make(map[string]*derivedHost),
+		current:  make(map[string]*derivedHost),
+	}
+	if !cfg.Cache.Derived {
+		return
+	}
+	expired, err := inv.cache.HasExpired(derivedName)
+	if err != nil {
+		log.Warnf("Unable to determine expiry of %s: %v", derivedName, err)
+		return
+	}
+	if expired {
+		log.Debugf("Cache of the %s file has expired.  All hosts will be evaluated.", derivedName)
+		return
+	}
+	b, err := inv.cache.GetFile(derivedName)
+	if err != nil {
+		log.Warnf("Unable to read cached %s file: %v", derivedName, err)
+		return
+	}
+	var f derivedFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		log.Warnf("Unable to parse cached %s file: %v", derivedName, err)
+		return
+	}
+	if f.Fingerprint != inv.derivedFingerprint() {
+		log.Debugf("Configuration has changed since %s was written.  All hosts will be evaluated.", derivedName)
+		return
+	}
+	if f.Hosts != nil {
+		inv.derived.previous = f.Hosts
+	}
+}
+
+// saveDerived writes the per-host results of the current run to the cache.  Hosts that no longer exist in Satellite
+// are dropped.
+func (inv *inventory) saveDerived() {
+	log.Debugf("Derived host results: %d reused, %d evaluated", inv.derived.hits, inv.derived.misses)
+	if !cfg.Cache.Derived {
+		return
+	}
+	b, err := json.Marshal(derivedFile{Fingerprint: inv.derivedFingerprint(), Hosts: inv.derived.current})
+	if err != nil {
+		log.Warnf("Unable to encode %s: %v", derivedName, err)
+		return
+	}
+	if err := inv.cache.PutFile(derivedName, b); err != nil {
+		log.Warnf("Unable to write %s: %v", derivedName, err)
+	}
+}
+
+// derive returns the results derived from a host's Satellite record.  If the host hasn't been updated since the
+// previous run, the cached results are returned, otherwise they're evaluated afresh.
+func (inv *inventory) derive(host gjson.Result, hostNameShort string, cidr cidrs.Cidrs) *derivedHost {
+	name := host.Get("name").String()
+	updatedAt := host.Get("updated_at").String()
+	inv.derived.mu.Lock()
+	if d, ok := inv.derived.previous[name]; ok && updatedAt != "" && d.UpdatedAt == updatedAt {
+		inv.derived.hits++
+		inv.derived.current[name] = d
+		inv.derived.mu.Unlock()
+		return d
+	}
+	inv.derived.misses++
+	inv.derived.mu.Unlock()
+	d := &derivedHost{UpdatedAt: updatedAt, Valid: make(map[string]*derivedCheck)}
+	for _, rules := range inv.validRules {
+		if failed := firstFailure(inv.validStaticChecks(host, hostNameShort, rules)); failed != nil {
+			d.Valid[rules.group] = &derivedCheck{Name: failed.name, Detail: failed.detail, Warn: failed.warn}
+		}
+	}
+	d.CIDRGroups = cidrGroups(host, cidr)
+	// Without a timestamp, there's no way to tell if the results are still valid on the next run
+	if updatedAt != "" {
+		inv.derived.mu.Lock()
+		inv.derived.current[name] = d
+		inv.derived.mu.Unlock()
+	}
+	return d
+}
+
+// staticChecks returns the outcome of the static valid checks for a group, in the form expected by hgValid.
+func (d *derivedHost) staticChecks(group string) []validCheck {
+	c, ok := d.Valid[group]
+	if !ok || c == nil {
+		return nil
+	}
+	return []validCheck{{name: c.Name, passed: false, detail: c.Detail, warn: c.Warn}}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/config"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// dnsResult describes the outcome of resolving a single host
+type dnsResult struct {
+	Addresses []string `json:"addresses,omitempty"` // Forward resolution of the host's name
+	Names     []string `json:"names,omitempty"`     // Reverse resolution of the host's IP address
+	Problems  []string `json:"problems,omitempty"`
+}
+
+// resolveHost checks that a host's name resolves to its IP address and/or that its IP address resolves to its name.
+func resolveHost(ctx context.Context, resolver *net.Resolver, fqdn, ip string, timeout time.Duration) dnsResult {
+	var r dnsResult
+	if cfg.DNSCheck.Forward {
+		lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+		addrs, err := resolver.LookupHost(lookupCtx, fqdn)
+		cancel()
+		r.Addresses = addrs
+		if err != nil {
+			r.Problems = append(r.Problems, fmt.Sprintf("%s does not resolve: %v", fqdn, err))
+		} else if ip != "" && !containsStr(ip, addrs) {
+			r.Problems = append(r.Problems, fmt.Sprintf("%s resolves to %s, not %s", fqdn, strings.Join(addrs, ", "), ip))
+		}
+	}
+	if cfg.DNSCheck.Reverse && ip != "" {
+		lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+		names, err := resolver.LookupAddr(lookupCtx, ip)
+		cancel()
+		for _, n := range names {
+			r.Names = append(r.Names, strings.ToLower(strings.TrimSuffix(n, ".")))
+		}
+		if err != nil {
+			r.Problems = append(r.Problems, fmt.Sprintf("%s does not reverse resolve: %v", ip, err))
+		} else if !containsStr(strings.ToLower(fqdn), r.Names) {
+			r.Problems = append(r.Problems, fmt.Sprintf("%s reverse resolves to %s, not %s", ip, strings.Join(r.Names, ", "), fqdn))
+		}
+	}
+	return r
+}
+
+// hgDNSMismatch resolves each member of the principal valid group and places those whose DNS records don't match
+// Satellite into a dns_mismatch group.  The resolution results are recorded in a satinv_dns hostvar.
+func (inv *inventory) hgDNSMismatch() {
+	if !cfg.DNSCheck.Enabled || !cfg.GroupEnabled(config.GroupDNS) {
+		return
+	}
+	defer timeTrack(time.Now(), "hgDNSMismatch")
+	hosts := uniqueStrings(gjson.Get(inv.json, inv.validRules[0].group+".hosts").Array())
+	results := make(map[string]dnsResult)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, cfg.DNSCheck.Concurrency)
+	resolver := net.DefaultResolver
+	timeout := time.Duration(cfg.DNSCheck.Timeout) * time.Second
+	for _, h := range hosts {
+		hostvars := gjson.Get(inv.json, hostvarsPath(h))
+		fqdn := hostvars.Get("name").String()
+		ip := hostvars.Get("ip").String()
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(h, fqdn, ip string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			r := resolveHost(inv.ctx, resolver, fqdn, ip, timeout)
+			mu.Lock()
+			results[h] = r
+			mu.Unlock()
+		}(h, fqdn, ip)
+	}
+	wg.Wait()
+	group := mkInventoryName(config.GroupDNS, "dns_mismatch")
+	inv.addChild(group)
+	var err error
+	for _, h := range hosts {
+		r := results[h]
+		inv.json, err = sjson.Set(inv.json, hostvarsPath(h)+".satinv_dns", r)
+		if err != nil {
+			inv.jsonFailed(hostvarsPath(h)+".satinv_dns", err)
+			return
+		}
+		if len(r.Problems) == 0 {
+			continue
+		}
+		log.Infof("%s: %s", group, strings.Join(r.Problems, "; "))
+		inv.addHost(group, h)
+	}
+}
@@ -0,0 +1,165 @@
+// enricher provides pluggable sources of additional hostvars for Satellite hosts
+package enricher
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/cacher"
+	"github.com/tidwall/gjson"
+)
+
+// Enricher is implemented by each source of additional per-host data.
+type Enricher interface {
+	// Name returns the logical name of the Enricher.  It's used to key the results it produces.
+	Name() string
+	// Concurrency returns the maximum number of hosts the Enricher may process simultaneously.
+	Concurrency() int
+	// Enrich returns the additional data associated with a single Satellite host.
+	Enrich(host gjson.Result) (gjson.Result, error)
+}
+
+// Results contains enrichment data keyed by hostname and then by Enricher name.
+type Results map[string]map[string]gjson.Result
+
+// satEnricher is an Enricher that retrieves per-host data from a Satellite API endpoint.
+type satEnricher struct {
+	name        string
+	urlFormat   string // Sprintf format taking the Satellite base URL and the host ID
+	cache       *cacher.Cache
+	validity    int64 // Cache validity (in seconds) of each host's data
+	concurrency int
+	extract     func(gjson.Result) gjson.Result
+}
+
+// endpoints maps the name of each built-in Enricher to its Satellite API URL format.
+var endpoints = map[string]string{
+	"facts":  "%s/api/v2/hosts/%s/facts?per_page=10000",
+	"errata": "%s/api/v2/hosts/%s/errata?per_page=10000",
+	"params": "%s/api/v2/hosts/%s/parameters?per_page=10000",
+	"traces": "%s/api/v2/hosts/%s/traces?per_page=10000",
+}
+
+// Names returns the names of all the built-in Enrichers.
+func Names() []string {
+	return []string{"facts", "errata", "params", "traces"}
+}
+
+// New returns a built-in Enricher by name.  Each Enricher caches the data for each host independently, using the
+// provided validity period.
+func New(name string, cache *cacher.Cache, baseURL string, validity int64, concurrency int) (Enricher, error) {
+	urlFormat, ok := endpoints[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown enricher: %s", name)
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	e := &satEnricher{
+		name:        name,
+		urlFormat:   fmt.Sprintf(urlFormat, baseURL, "%s"),
+		cache:       cache,
+		validity:    validity,
+		concurrency: concurrency,
+		extract:     extractResults,
+	}
+	if name == "facts" {
+		e.extract = extractFacts
+	}
+	return e, nil
+}
+
+// Name returns the logical name of the Enricher.
+func (e *satEnricher) Name() string {
+	return e.name
+}
+
+// Concurrency returns the maximum number of hosts that can be enriched simultaneously.
+func (e *satEnricher) Concurrency() int {
+	return e.concurrency
+}
+
+// Enrich fetches (or reads from cache) the Enricher's endpoint for a given host.
+func (e *satEnricher) Enrich(host gjson.Result) (gjson.Result, error) {
+	id := host.Get("id")
+	if !id.Exists() {
+		return gjson.Result{}, fmt.Errorf("%s: host has no id field", e.name)
+	}
+	url := fmt.Sprintf(e.urlFormat, id.String())
+	e.cache.AddURL(url, fmt.Sprintf("%s_%s.json", e.name, id.String()), e.validity)
+	gj, err := e.cache.GetURL(url)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return e.extract(gj), nil
+}
+
+// extractResults returns the results field of a Satellite API response.
+func extractResults(gj gjson.Result) gjson.Result {
+	return gj.Get("results")
+}
+
+// extractFacts returns the facts for a host.  Satellite returns these in a map, keyed by the host's name.
+func extractFacts(gj gjson.Result) gjson.Result {
+	var facts gjson.Result
+	gj.Get("results").ForEach(func(_, value gjson.Result) bool {
+		facts = value
+		return false
+	})
+	return facts
+}
+
+// Run processes every host through each of the provided Enrichers and returns the combined results.  The Enrichers
+// run simultaneously, each constrained by its own concurrency budget.  Failures are logged and the associated data
+// omitted from the results.  Once ctx is cancelled, no further hosts are enriched.
+func Run(ctx context.Context, enrichers []Enricher, hosts []gjson.Result) Results {
+	results := make(Results)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, e := range enrichers {
+		wg.Add(1)
+		go func(e Enricher) {
+			defer wg.Done()
+			// sem constrains the number of hosts this Enricher processes at once
+			sem := make(chan struct{}, e.Concurrency())
+			var hostWG sync.WaitGroup
+			for _, h := range hosts {
+				name := h.Get("name").String()
+				if name == "" {
+					continue
+				}
+				select {
+				case sem <- struct{}{}:
+				case <-ctx.Done():
+				}
+				if ctx.Err() != nil {
+					log.Warnf("Enricher %s cancelled: %v", e.Name(), ctx.Err())
+					break
+				}
+				hostWG.Add(1)
+				go func(h gjson.Result, name string) {
+					defer func() {
+						<-sem
+						hostWG.Done()
+					}()
+					data, err := e.Enrich(h)
+					if err != nil {
+						log.Warnf("Enricher %s failed for host %s: %v", e.Name(), name, err)
+						return
+					}
+					mu.Lock()
+					if _, ok := results[name]; !ok {
+						results[name] = make(map[string]gjson.Result)
+					}
+					results[name][e.Name()] = data
+					mu.Unlock()
+				}(h, name)
+			}
+			hostWG.Wait()
+		}(e)
+	}
+	wg.Wait()
+	return results
+}
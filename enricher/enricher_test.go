@@ -0,0 +1,141 @@
+package enricher
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// fakeEnricher returns the host's ID and records the peak number of simultaneous calls.
+type fakeEnricher struct {
+	mu      sync.Mutex
+	limit   int
+	current int
+	peak    int
+}
+
+func (f *fakeEnricher) Name() string {
+	return "fake"
+}
+
+func (f *fakeEnricher) Concurrency() int {
+	return f.limit
+}
+
+func (f *fakeEnricher) Enrich(host gjson.Result) (gjson.Result, error) {
+	f.mu.Lock()
+	f.current++
+	if f.current > f.peak {
+		f.peak = f.current
+	}
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.current--
+		f.mu.Unlock()
+	}()
+	if host.Get("id").Int() == 3 {
+		return gjson.Result{}, errors.New("fake failure")
+	}
+	return host.Get("id"), nil
+}
+
+func TestRun(t *testing.T) {
+	hosts := gjson.Parse(`[
+		{"id": 1, "name": "host1.fake"},
+		{"id": 2, "name": "host2.fake"},
+		{"id": 3, "name": "host3.fake"},
+		{"id": 4}
+	]`).Array()
+	f := &fakeEnricher{limit: 2}
+	results := Run(context.Background(), []Enricher{f}, hosts)
+	if len(results) != 2 {
+		t.Fatalf("Expected results for 2 hosts, got %d", len(results))
+	}
+	if results["host2.fake"]["fake"].Int() != 2 {
+		t.Errorf("Unexpected result for host2.fake: %v", results["host2.fake"]["fake"])
+	}
+	if _, ok := results["host3.fake"]; ok {
+		t.Error("Failed enrichment should not produce a result")
+	}
+	if f.peak > f.limit {
+		t.Errorf("Concurrency budget exceeded: limit=%d, peak=%d", f.limit, f.peak)
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	hosts := gjson.Parse(`[{"id": 1, "name": "host1.fake"}, {"id": 2, "name": "host2.fake"}]`).Array()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if results := Run(ctx, []Enricher{&fakeEnricher{limit: 1}}, hosts); len(results) != 0 {
+		t.Errorf("A cancelled run should not enrich any hosts, got %d", len(results))
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, name := range Names() {
+		e, err := New(name, nil, "https://fake.url", 60, 0)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if e.Name() != name {
+			t.Errorf("Unexpected name: Expected=%s, Got=%s", name, e.Name())
+		}
+		if e.Concurrency() != 1 {
+			t.Errorf("%s: Concurrency should default to 1, got %d", name, e.Concurrency())
+		}
+	}
+	if _, err := New("nonsense", nil, "https://fake.url", 60, 1); err == nil {
+		t.Error("Expected an error for an unknown enricher")
+	}
+}
+
+func TestExtractFacts(t *testing.T) {
+	gj := gjson.Parse(`{"total": 2, "results": {"host1.fake": {"fqdn": "host1.fake", "virt::is_guest": "true"}}}`)
+	facts := extractFacts(gj)
+	if facts.Get("fqdn").String() != "host1.fake" {
+		t.Errorf("Unexpected facts: %s", facts.Raw)
+	}
+}
+
+func TestExternal(t *testing.T) {
+	// The fake endpoint returns an owner for every host it's sent and records the size of each batch
+	var batches []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		hosts := gjson.ParseBytes(b).Array()
+		batches = append(batches, len(hosts))
+		response := make(map[string]map[string]string)
+		for _, h := range hosts {
+			response[h.Get("name").String()] = map[string]string{"owner": "fake"}
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+	e, err := NewExternal("cmdb", nil, server.URL, 2, time.Minute)
+	if err != nil {
+		t.Fatalf("NewExternal returned: %v", err)
+	}
+	hosts := gjson.Parse(`[{"name": "host1.fake"}, {"name": "host2.fake"}, {"name": "host3.fake"}]`).Array()
+	results := RunBatches(context.Background(), []BatchEnricher{e}, hosts, nil)
+	if len(results) != 3 {
+		t.Fatalf("Expected results for 3 hosts, got %d: %v", len(results), results)
+	}
+	if results["host3.fake"]["cmdb"].Get("owner").String() != "fake" {
+		t.Errorf("Unexpected result for host3.fake: %v", results["host3.fake"]["cmdb"])
+	}
+	if len(batches) != 2 || batches[0] != 2 || batches[1] != 1 {
+		t.Errorf("Unexpected batch sizes: %v", batches)
+	}
+	if _, err := NewExternal("bad", []string{"true"}, "https://fake.url", 1, 0); err == nil {
+		t.Error("Expected an error when both command and url are provided")
+	}
+}
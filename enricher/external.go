@@ -0,0 +1,156 @@
+package enricher
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/tidwall/gjson"
+)
+
+// BatchEnricher is implemented by sources of additional data that process many hosts in a single request.
+type BatchEnricher interface {
+	// Name returns the logical name of the BatchEnricher.
+	Name() string
+	// BatchSize returns the maximum number of hosts in each batch.
+	BatchSize() int
+	// EnrichBatch returns the additional data for a batch of Satellite hosts, keyed by hostname.
+	EnrichBatch(hosts []gjson.Result) (map[string]gjson.Result, error)
+}
+
+// external is a BatchEnricher implemented by an external command or HTTP endpoint.  The hosts in each batch are sent
+// as a JSON array and the response is a JSON object keyed by hostname.
+type external struct {
+	name      string
+	command   []string
+	url       string
+	batchSize int
+	timeout   time.Duration
+	client    *http.Client
+}
+
+// NewExternal returns a BatchEnricher that sends batches of hosts to either a command (on its stdin) or an HTTP
+// endpoint (as a POST).  Exactly one of command or url must be provided.
+func NewExternal(name string, command []string, url string, batchSize int, timeout time.Duration) (BatchEnricher, error) {
+	if name == "" {
+		return nil, errors.New("external enricher requires a name")
+	}
+	if (len(command) == 0) == (url == "") {
+		return nil, fmt.Errorf("external enricher %s requires either a command or a url", name)
+	}
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &external{
+		name:      name,
+		command:   command,
+		url:       url,
+		batchSize: batchSize,
+		timeout:   timeout,
+		client:    &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Name returns the logical name of the BatchEnricher.
+func (e *external) Name() string {
+	return e.name
+}
+
+// BatchSize returns the maximum number of hosts sent in a single request.
+func (e *external) BatchSize() int {
+	return e.batchSize
+}
+
+// EnrichBatch sends a batch of hosts to the command or endpoint and returns its response.
+func (e *external) EnrichBatch(hosts []gjson.Result) (map[string]gjson.Result, error) {
+	raw := make([]string, len(hosts))
+	for i, h := range hosts {
+		raw[i] = h.Raw
+	}
+	payload := []byte("[" + strings.Join(raw, ",") + "]")
+	var response []byte
+	var err error
+	if e.url != "" {
+		response, err = e.post(payload)
+	} else {
+		response, err = e.exec(payload)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !gjson.ValidBytes(response) || !gjson.ParseBytes(response).IsObject() {
+		return nil, errors.New("response is not a JSON object")
+	}
+	return gjson.ParseBytes(response).Map(), nil
+}
+
+// post sends the payload to the HTTP endpoint.
+func (e *external) post(payload []byte) ([]byte, error) {
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s returned: %s", e.url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// exec runs the command with the payload on its stdin.
+func (e *external) exec(payload []byte) ([]byte, error) {
+	ctx := context.Background()
+	if e.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, e.command[0], e.command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// RunBatches processes every host through each of the provided BatchEnrichers and adds their data to the results.
+// Failed batches are logged and the associated data omitted.  Once ctx is cancelled, no further batches are started.
+func RunBatches(ctx context.Context, enrichers []BatchEnricher, hosts []gjson.Result, results Results) Results {
+	if results == nil {
+		results = make(Results)
+	}
+	for _, e := range enrichers {
+		for start := 0; start < len(hosts); start += e.BatchSize() {
+			if ctx.Err() != nil {
+				log.Warnf("Enricher %s cancelled: %v", e.Name(), ctx.Err())
+				return results
+			}
+			end := start + e.BatchSize()
+			if end > len(hosts) {
+				end = len(hosts)
+			}
+			data, err := e.EnrichBatch(hosts[start:end])
+			if err != nil {
+				log.Warnf("Enricher %s failed for hosts %d-%d: %v", e.Name(), start+1, end, err)
+				continue
+			}
+			for name, d := range data {
+				if _, ok := results[name]; !ok {
+					results[name] = make(map[string]gjson.Result)
+				}
+				results[name][e.Name()] = d
+			}
+		}
+	}
+	return results
+}
@@ -0,0 +1,160 @@
+package enricher
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// NetBoxName is the name of the NetBox Enricher
+const NetBoxName string = "netbox"
+
+// netBox is an Enricher that cross-references each host with a NetBox device or virtual machine
+type netBox struct {
+	baseURL     string
+	token       string
+	concurrency int
+	client      *http.Client
+}
+
+// NewNetBox returns an Enricher that looks up each host in NetBox, first by name and then by primary IP address, and
+// returns the site, tenant and role of the matching device or virtual machine.
+func NewNetBox(baseURL, token string, concurrency int, timeout time.Duration) (Enricher, error) {
+	if baseURL == "" {
+		return nil, errors.New("netbox enricher requires a url")
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &netBox{
+		baseURL:     strings.TrimSuffix(baseURL, "/"),
+		token:       token,
+		concurrency: concurrency,
+		client:      &http.Client{Timeout: timeout},
+	}, nil
+}
+
+// Name returns the logical name of the Enricher.
+func (n *netBox) Name() string {
+	return NetBoxName
+}
+
+// Concurrency returns the maximum number of hosts that can be looked up simultaneously.
+func (n *netBox) Concurrency() int {
+	return n.concurrency
+}
+
+// Enrich looks up a host in NetBox.  A host that isn't found in NetBox produces no data, rather than an error.
+func (n *netBox) Enrich(host gjson.Result) (gjson.Result, error) {
+	name := host.Get("name").String()
+	// Devices and virtual machines may be recorded in NetBox by either their full or short name
+	names := []string{name}
+	if short := strings.Split(name, ".")[0]; short != name {
+		names = append(names, short)
+	}
+	for _, path := range []string{"/api/dcim/devices/", "/api/virtualization/virtual-machines/"} {
+		for _, nm := range names {
+			obj, err := n.first(path + "?name=" + url.QueryEscape(nm))
+			if err != nil {
+				return gjson.Result{}, err
+			}
+			if obj.Exists() {
+				return netBoxFields(obj)
+			}
+		}
+	}
+	if ip := host.Get("ip").String(); ip != "" {
+		obj, err := n.byIP(ip)
+		if err != nil {
+			return gjson.Result{}, err
+		}
+		if obj.Exists() {
+			return netBoxFields(obj)
+		}
+	}
+	log.Debugf("Host %s not found in NetBox", name)
+	return gjson.Result{}, nil
+}
+
+// byIP returns the device or virtual machine an IP address is assigned to.
+func (n *netBox) byIP(ip string) (gjson.Result, error) {
+	addr, err := n.first("/api/ipam/ip-addresses/?address=" + url.QueryEscape(ip))
+	if err != nil || !addr.Exists() {
+		return gjson.Result{}, err
+	}
+	assigned := addr.Get("assigned_object")
+	if id := assigned.Get("device.id"); id.Exists() {
+		return n.get(fmt.Sprintf("/api/dcim/devices/%d/", id.Int()))
+	}
+	if id := assigned.Get("virtual_machine.id"); id.Exists() {
+		return n.get(fmt.Sprintf("/api/virtualization/virtual-machines/%d/", id.Int()))
+	}
+	return gjson.Result{}, nil
+}
+
+// first returns the first result of a NetBox list query, if there is one.
+func (n *netBox) first(path string) (gjson.Result, error) {
+	gj, err := n.get(path)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gj.Get("results.0"), nil
+}
+
+// get performs an authenticated request against the NetBox API.
+func (n *netBox) get(path string) (gjson.Result, error) {
+	req, err := http.NewRequest("GET", n.baseURL+path, nil)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if n.token != "" {
+		req.Header.Set("Authorization", "Token "+n.token)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return gjson.Result{}, fmt.Errorf("%s returned: %s", path, resp.Status)
+	}
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	return gjson.ParseBytes(b), nil
+}
+
+// netBoxFields extracts the site, tenant and role from a NetBox device or virtual machine.  Devices in NetBox versions
+// prior to 3.6 record their role as device_role.
+func netBoxFields(obj gjson.Result) (gjson.Result, error) {
+	fields := map[string]string{
+		"site":   obj.Get("site.name").String(),
+		"tenant": obj.Get("tenant.name").String(),
+		"role":   obj.Get("role.name").String(),
+	}
+	if fields["role"] == "" {
+		fields["role"] = obj.Get("device_role.name").String()
+	}
+	data := "{}"
+	var err error
+	for _, k := range []string{"site", "tenant", "role"} {
+		if fields[k] == "" {
+			continue
+		}
+		data, err = sjson.Set(data, k, fields[k])
+		if err != nil {
+			return gjson.Result{}, err
+		}
+	}
+	return gjson.Parse(data), nil
+}
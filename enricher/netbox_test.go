@@ -0,0 +1,56 @@
+package enricher
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestNetBox(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Token faketoken" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch {
+		case r.URL.Path == "/api/dcim/devices/" && r.URL.Query().Get("name") == "host1":
+			fmt.Fprint(w, `{"results": [{"name": "host1", "site": {"name": "dc1"}, "tenant": {"name": "ops"}, "device_role": {"name": "web"}}]}`)
+		case r.URL.Path == "/api/ipam/ip-addresses/" && r.URL.Query().Get("address") == "10.0.0.2":
+			fmt.Fprint(w, `{"results": [{"assigned_object": {"virtual_machine": {"id": 7}}}]}`)
+		case r.URL.Path == "/api/virtualization/virtual-machines/7/":
+			fmt.Fprint(w, `{"name": "vm7", "site": {"name": "dc2"}, "role": {"name": "db"}}`)
+		default:
+			fmt.Fprint(w, `{"results": []}`)
+		}
+	}))
+	defer server.Close()
+	e, err := NewNetBox(server.URL, "faketoken", 1, time.Minute)
+	if err != nil {
+		t.Fatalf("NewNetBox returned: %v", err)
+	}
+	// Found by short name
+	data, err := e.Enrich(gjson.Parse(`{"name": "host1.fake", "ip": "10.0.0.1"}`))
+	if err != nil {
+		t.Fatalf("Enrich returned: %v", err)
+	}
+	if data.Get("site").String() != "dc1" || data.Get("tenant").String() != "ops" || data.Get("role").String() != "web" {
+		t.Errorf("Unexpected data for host1: %s", data.Raw)
+	}
+	// Found by IP address
+	data, err = e.Enrich(gjson.Parse(`{"name": "host2.fake", "ip": "10.0.0.2"}`))
+	if err != nil {
+		t.Fatalf("Enrich returned: %v", err)
+	}
+	if data.Get("site").String() != "dc2" || data.Get("role").String() != "db" || data.Get("tenant").Exists() {
+		t.Errorf("Unexpected data for host2: %s", data.Raw)
+	}
+	// Not found
+	data, err = e.Enrich(gjson.Parse(`{"name": "host3.fake"}`))
+	if err != nil || data.Exists() {
+		t.Errorf("Expected no data for host3, got: %s, %v", data.Raw, err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+	"github.com/tidwall/gjson"
+)
+
+// loadExclusions records the hosts whose exclude_parameter is true, keyed by inventory hostname.  A value that isn't a
+// boolean is logged and ignored, so a typo can't remove a host from the inventory.
+func (inv *inventory) loadExclusions(hosts gjson.Result) {
+	inv.excluded = make(map[string]bool)
+	name := cfg.ExcludeParameter.Name
+	if name == "" {
+		return
+	}
+	hosts.Get("results").ForEach(func(_, h gjson.Result) bool {
+		if !h.Get("name").Exists() {
+			return true
+		}
+		value, ok := inv.hostParameter(h, name)
+		if !ok {
+			return true
+		}
+		excluded, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			log.Warnf("Ignoring %s %q of host %s: Not a boolean", name, value, h.Get("name").String())
+			return true
+		}
+		if excluded {
+			inv.excluded[inventoryHostname(h.Get("name").String())] = true
+		}
+		return true
+	})
+}
+
+// excludedFromInventory returns true if a host is omitted from the entire inventory by its exclude_parameter.
+func (inv *inventory) excludedFromInventory(hostNameShort string) bool {
+	return cfg.ExcludeParameter.Scope == "all" && inv.excluded[hostNameShort]
+}
+
+// validParameterCheck tests whether a host is excluded from the valid groups by its exclude_parameter.
+func (inv *inventory) validParameterCheck(hostNameShort string) validCheck {
+	var checks []validCheck
+	add := checkAdder(&checks)
+	switch {
+	case cfg.ExcludeParameter.Name == "":
+		add(checkExcludedParam, true, false, "No exclude_parameter is configured")
+	case inv.excluded[hostNameShort]:
+		add(checkExcludedParam, false, false, "Host %s is excluded by its %s parameter", hostNameShort, cfg.ExcludeParameter.Name)
+	default:
+		add(checkExcludedParam, true, false, "Host %s is not excluded by its %s parameter", hostNameShort, cfg.ExcludeParameter.Name)
+	}
+	return checks[0]
+}
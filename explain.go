@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/crooks/satinv/config"
+	"github.com/tidwall/gjson"
+)
+
+// findHost returns the Satellite host matching a given short or full hostname.
+func findHost(hosts gjson.Result, hostname string) (gjson.Result, bool) {
+	for _, h := range hosts.Get("results").Array() {
+		name := h.Get("name").String()
+		if name == hostname || inventoryHostname(name) == hostname || shortName(name) == hostname {
+			return h, true
+		}
+	}
+	return gjson.Result{}, false
+}
+
+// passFail returns a label for the outcome of a check.
+func passFail(passed bool) string {
+	if passed {
+		return "PASS"
+	}
+	return "FAIL"
+}
+
+// explainCommand replays the grouping logic for a single host against cached data and prints the outcome of each
+// check.  If a group is specified, the output concludes with whether the host is a member of it.
+func explainCommand(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("explain requires a hostname and, optionally, a group")
+	}
+	inv, err := newInventory()
+	if err != nil {
+		return err
+	}
+	defer inv.close()
+	if err := inv.initAPI(); err != nil {
+		return err
+	}
+	hosts, err := inv.getHosts()
+	if err != nil {
+		return fmt.Errorf("unable to read hosts: %v", err)
+	}
+	host, ok := findHost(hosts, args[0])
+	if !ok {
+		return fmt.Errorf("host %s not found in Satellite", args[0])
+	}
+	inv.loadOrganizations()
+	inv.loadSubnets()
+	inv.loadExclusions(hosts)
+	if len(cfg.ValidOverrides) > 0 && hostsFile() == "" {
+		if err := inv.loadCollections(hosts); err != nil {
+			return fmt.Errorf("unable to read host collections: %v", err)
+		}
+	}
+	hostNameShort := inventoryHostname(host.Get("name").String())
+	// memberOf records each group the host is determined to be a member of
+	memberOf := make(map[string]bool)
+	fmt.Printf("Host: %s (id=%s, name=%s)\n", hostNameShort, host.Get("id").String(), host.Get("name").String())
+
+	// Valid (and stale) group membership
+	for _, rules := range inv.validRules {
+		fmt.Printf("\n%s:\n", rules.group)
+		if override, ok := inv.hostRules(rules, hostNameShort, cidrGroups(host, inv.cidrs)); ok {
+			rules = override
+			fmt.Printf("  valid_overrides applied: hours=%d, include_unlicensed=%t\n", rules.cfg.Hours, rules.cfg.Unlicensed)
+		}
+		checks := inv.validChecks(host, hostNameShort, rules)
+		for _, c := range checks {
+			fmt.Printf("  [%s] %s: %s\n", passFail(c.passed), c.name, c.detail)
+		}
+		failed := firstFailure(checks)
+		if failed == nil {
+			memberOf[rules.group] = true
+		} else if failed.name == checkCheckinAge && rules.primary {
+			memberOf[mkInventoryName(config.GroupStale, "stale")] = true
+		}
+	}
+
+	// CIDR group membership
+	fmt.Println("\nCIDR groups:")
+	ip := host.Get("ip").String()
+	if len(inv.cidrs) == 0 {
+		fmt.Println("  No CIDRs defined")
+	} else if ip == "" {
+		fmt.Println("  Host has no IPv4 address")
+	} else {
+		cidrMembers := inv.cidrs.ParseCIDRs(ip)
+		var names []string
+		for name := range inv.cidrs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			matched := containsStr(name, cidrMembers)
+			if matched {
+				memberOf[mkInventoryName(config.GroupCIDRs, name)] = true
+			}
+			fmt.Printf("  [%s] %s: %s in %s\n", passFail(matched), mkInventoryName(config.GroupCIDRs, name), ip, inv.cidrs[name])
+		}
+	}
+
+	// Host Collection membership
+	fmt.Println("\nHost Collections:")
+	if hostsFile() != "" {
+		fmt.Println("  Not available when reading hosts from a file")
+		return explainMembership(args, hostNameShort, memberOf)
+	}
+	collections, err := inv.getCollections()
+	if err != nil {
+		return fmt.Errorf("unable to read host collections: %v", err)
+	}
+	hostID := host.Get("id").String()
+	for _, c := range collections.Get("results").Array() {
+		hostCollection, err := inv.getHostCollection(c.Get("id").String())
+		if err != nil {
+			fmt.Printf("  [????] %s: %v\n", mkInventoryName(config.GroupCollections, c.Get("name").String()), err)
+			continue
+		}
+		var member bool
+		for _, id := range hostCollection.Get("host_ids").Array() {
+			if id.String() == hostID {
+				member = true
+				break
+			}
+		}
+		if member {
+			memberOf[mkInventoryName(config.GroupCollections, c.Get("name").String())] = true
+		}
+		fmt.Printf("  [%s] %s: host_ids includes %s\n", passFail(member), mkInventoryName(config.GroupCollections, c.Get("name").String()), hostID)
+	}
+
+	return explainMembership(args, hostNameShort, memberOf)
+}
+
+// explainMembership concludes the explanation of a host by stating whether it's a member of the requested group.
+func explainMembership(args []string, hostNameShort string, memberOf map[string]bool) error {
+	if len(args) == 2 {
+		if memberOf[args[1]] {
+			fmt.Printf("\n%s is a member of %s\n", hostNameShort, args[1])
+		} else {
+			fmt.Printf("\n%s is not a member of %s\n", hostNameShort, args[1])
+		}
+	}
+	return nil
+}
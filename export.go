@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/tidwall/gjson"
+)
+
+// exportCommand executes the "export" subcommands, each of which writes the inventory in an alternative format.
+func exportCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("export requires a format: known-hosts, prometheus or ssh-config")
+	}
+	switch args[0] {
+	case "known-hosts":
+		return exportKnownHosts(args[1:])
+	case "prometheus":
+		return exportFileSD(args[1:])
+	case "ssh-config":
+		return exportSSHConfig(args[1:])
+	default:
+		return fmt.Errorf("unknown export format: %s", args[0])
+	}
+}
+
+// nopCloser prevents stdout being closed when an export completes.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// exportWriter returns a writer for an export's output; either a named file or stdout.
+func exportWriter(filename string) (io.WriteCloser, error) {
+	if filename == "" || filename == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	return os.Create(filename)
+}
+
+// exportHost contains the connection details of an inventory host
+type exportHost struct {
+	name     string // Inventory hostname
+	fqdn     string
+	ip       string
+	hostvars gjson.Result
+}
+
+// exportHosts returns the connection details of the hosts in an inventory, sorted by hostname.  If a group is
+// specified, only hosts in that group are returned.
+func exportHosts(invJSON, group string) []exportHost {
+	var members map[string]bool
+	if group != "" {
+		members = make(map[string]bool)
+		for _, h := range gjson.Get(invJSON, group+".hosts").Array() {
+			members[h.String()] = true
+		}
+	}
+	var hosts []exportHost
+	gjson.Get(invJSON, "_meta.hostvars").ForEach(func(k, v gjson.Result) bool {
+		if members != nil && !members[k.String()] {
+			return true
+		}
+		hosts = append(hosts, exportHost{
+			name:     k.String(),
+			fqdn:     v.Get("name").String(),
+			ip:       v.Get("ip").String(),
+			hostvars: v,
+		})
+		return true
+	})
+	sortExportHosts(hosts)
+	return hosts
+}
+
+// sortExportHosts sorts hosts by their inventory hostname.
+func sortExportHosts(hosts []exportHost) {
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].name < hosts[j].name
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/atomicfile"
+	"github.com/tidwall/gjson"
+)
+
+// promLabelRE matches valid Prometheus label names
+var promLabelRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// labelFlags collects repeated --label=<name>=<hostvar> flags
+type labelFlags map[string]string
+
+func (l labelFlags) String() string {
+	var pairs []string
+	for k, v := range l {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (l labelFlags) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 1 || i == len(s)-1 {
+		return fmt.Errorf("label must be of the form <name>=<hostvar>, not %q", s)
+	}
+	name := s[:i]
+	if !promLabelRE.MatchString(name) || strings.HasPrefix(name, "__") {
+		return fmt.Errorf("invalid Prometheus label name: %s", name)
+	}
+	l[name] = s[i+1:]
+	return nil
+}
+
+// fileSDTarget is an entry in a Prometheus file_sd target list
+type fileSDTarget struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// fileSDAddress returns the address by which Prometheus should scrape a host.
+func fileSDAddress(h exportHost, address string, port int) string {
+	var addr string
+	switch address {
+	case "ip":
+		addr = h.ip
+	case "name":
+		addr = h.name
+	default:
+		addr = h.fqdn
+	}
+	if addr == "" {
+		addr = h.name
+	}
+	return fmt.Sprintf("%s:%d", addr, port)
+}
+
+// fileSDTargets returns a file_sd target list with an entry for each inventory group.  Hosts within a group that have
+// differing label values are split across multiple entries.
+func fileSDTargets(invJSON string, groups []string, labels labelFlags, address string, port int) []fileSDTarget {
+	targets := []fileSDTarget{}
+	for _, g := range groups {
+		// Hosts are grouped by the values of their labels
+		entries := make(map[string]*fileSDTarget)
+		var keys []string
+		for _, h := range exportHosts(invJSON, g) {
+			l := map[string]string{"inventory_group": g}
+			for name, path := range labels {
+				if v := h.hostvars.Get(path); v.Exists() && v.String() != "" {
+					l[name] = v.String()
+				}
+			}
+			b, _ := json.Marshal(l)
+			key := string(b)
+			e, ok := entries[key]
+			if !ok {
+				e = &fileSDTarget{Labels: l}
+				entries[key] = e
+				keys = append(keys, key)
+			}
+			e.Targets = append(e.Targets, fileSDAddress(h, address, port))
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			targets = append(targets, *entries[k])
+		}
+	}
+	return targets
+}
+
+// inventoryGroups returns the sorted names of the inventory groups that contain hosts.
+func inventoryGroups(invJSON string) []string {
+	var groups []string
+	for g, n := range groupCounts(invJSON) {
+		if n > 0 {
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// exportFileSD writes a Prometheus file_sd target list containing the hosts in each inventory group.
+func exportFileSD(args []string) error {
+	fs := flag.NewFlagSet("prometheus", flag.ContinueOnError)
+	output := fs.String("output", "", "File to write (default stdout)")
+	groupList := fs.String("groups", "", "Comma-separated list of inventory groups to include (default all)")
+	port := fs.Int("port", 9100, "Port to scrape on each host")
+	address := fs.String("address", "fqdn", "Address to scrape: fqdn, name or ip")
+	labels := make(labelFlags)
+	fs.Var(labels, "label", "Label added to each target, of the form <name>=<hostvar> (may be repeated)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	switch *address {
+	case "fqdn", "name", "ip":
+	default:
+		return fmt.Errorf("address must be one of fqdn, name or ip, not %q", *address)
+	}
+	if *port < 1 || *port > 65535 {
+		return fmt.Errorf("invalid port: %d", *port)
+	}
+	inv, err := newInventory()
+	if err != nil {
+		return err
+	}
+	defer inv.close()
+	if err := inv.load(); err != nil {
+		return err
+	}
+	var groups []string
+	if *groupList == "" {
+		groups = inventoryGroups(inv.json)
+	} else {
+		for _, g := range strings.Split(*groupList, ",") {
+			g = strings.TrimSpace(g)
+			if !gjson.Get(inv.json, g).Exists() {
+				return fmt.Errorf("group %s is not in the inventory", g)
+			}
+			groups = append(groups, g)
+		}
+	}
+	b, err := json.MarshalIndent(fileSDTargets(inv.json, groups, labels, *address, *port), "", "  ")
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	log.Infof("Exported file_sd targets for %d groups", len(groups))
+	if *output == "" || *output == "-" {
+		_, err = os.Stdout.Write(b)
+		return err
+	}
+	return writeAtomic(*output, b)
+}
+
+// writeAtomic writes a file via a temporary file in the same directory so that readers, such as Prometheus watching
+// a file_sd file, never see partial content.  The output mode and ownership are applied to it.
+func writeAtomic(filename string, b []byte) error {
+	perms, err := cfg.OutputPerms()
+	if err != nil {
+		return fmt.Errorf("invalid output permissions: %v", err)
+	}
+	return atomicfile.Write(filename, b, perms)
+}
@@ -3,10 +3,13 @@ module github.com/crooks/satinv
 go 1.16
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/Masterminds/log-go v1.0.0
 	github.com/crooks/jlog v0.0.0-20230205115927-add6f7980f87
 	github.com/crooks/log-go-level v0.0.0-20221021134405-8ea229e5ea34
+	github.com/jcmturner/gokrb5/v8 v8.4.4
 	github.com/tidwall/gjson v1.14.0
 	github.com/tidwall/sjson v1.2.4
+	golang.org/x/crypto v0.6.0
 	gopkg.in/yaml.v2 v2.4.0
 )
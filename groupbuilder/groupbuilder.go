@@ -0,0 +1,118 @@
+// groupbuilder provides an extension point for site-specific inventory grouping logic
+package groupbuilder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/tidwall/gjson"
+)
+
+// GroupBuilder is implemented by each source of custom groups.
+type GroupBuilder interface {
+	// Name returns the logical name of the GroupBuilder.
+	Name() string
+	// Build returns the names of the inventory groups a Satellite host should be a member of.  It's called
+	// concurrently for different hosts.
+	Build(host gjson.Result) []string
+}
+
+var (
+	registry   = make(map[string]GroupBuilder)
+	registryMu sync.Mutex
+)
+
+// Register makes a GroupBuilder available to satinv.  It's intended to be called from an init function in a
+// site-specific source file.  Registering a second GroupBuilder with the same name replaces the first.
+func Register(b GroupBuilder) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[b.Name()] = b
+}
+
+// Registered returns every registered GroupBuilder, sorted by name.
+func Registered() []GroupBuilder {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	builders := make([]GroupBuilder, 0, len(names))
+	for _, name := range names {
+		builders = append(builders, registry[name])
+	}
+	return builders
+}
+
+// execBuilder is a GroupBuilder implemented by an external executable
+type execBuilder struct {
+	name    string
+	command []string
+	timeout time.Duration
+}
+
+// NewExec returns a GroupBuilder that runs an external command for each host.  The host's Satellite record is written
+// to the command's stdin as JSON and the command responds on stdout with a JSON array of group names.
+func NewExec(name string, command []string, timeout time.Duration) (GroupBuilder, error) {
+	if name == "" {
+		return nil, errors.New("group builder requires a name")
+	}
+	if len(command) == 0 {
+		return nil, fmt.Errorf("group builder %s requires a command", name)
+	}
+	return &execBuilder{name: name, command: command, timeout: timeout}, nil
+}
+
+// Name returns the logical name of the GroupBuilder.
+func (x *execBuilder) Name() string {
+	return x.name
+}
+
+// Build runs the command for a host.  Failures are logged and result in no groups.
+func (x *execBuilder) Build(host gjson.Result) []string {
+	groups, err := x.run(host)
+	if err != nil {
+		log.Warnf("Group builder %s failed for host %s: %v", x.name, host.Get("name").String(), err)
+		return nil
+	}
+	return groups
+}
+
+// run executes the command and parses its response.
+func (x *execBuilder) run(host gjson.Result) ([]string, error) {
+	ctx := context.Background()
+	if x.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, x.timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, x.command[0], x.command[1:]...)
+	cmd.Stdin = strings.NewReader(host.Raw)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	response := gjson.Parse(stdout.String())
+	if !gjson.Valid(stdout.String()) || !response.IsArray() {
+		return nil, errors.New("response is not a JSON array")
+	}
+	var groups []string
+	for _, g := range response.Array() {
+		if g.String() != "" {
+			groups = append(groups, g.String())
+		}
+	}
+	return groups, nil
+}
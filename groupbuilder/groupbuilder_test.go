@@ -0,0 +1,57 @@
+package groupbuilder
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+// prefixBuilder groups hosts by the first three characters of their name
+type prefixBuilder struct{}
+
+func (p prefixBuilder) Name() string {
+	return "prefix"
+}
+
+func (p prefixBuilder) Build(host gjson.Result) []string {
+	name := host.Get("name").String()
+	if len(name) < 3 {
+		return nil
+	}
+	return []string{"role_" + strings.ToLower(name[:3])}
+}
+
+func TestRegister(t *testing.T) {
+	Register(prefixBuilder{})
+	builders := Registered()
+	if len(builders) != 1 || builders[0].Name() != "prefix" {
+		t.Fatalf("Unexpected registered builders: %v", builders)
+	}
+	groups := builders[0].Build(gjson.Parse(`{"name": "WEB01.fake"}`))
+	if len(groups) != 1 || groups[0] != "role_web" {
+		t.Errorf("Unexpected groups: %v", groups)
+	}
+}
+
+func TestExec(t *testing.T) {
+	b, err := NewExec("fake", []string{"/bin/sh", "-c", `grep -q host1 && echo '["one", "two"]' || echo '[]'`}, time.Minute)
+	if err != nil {
+		t.Fatalf("NewExec returned: %v", err)
+	}
+	groups := b.Build(gjson.Parse(`{"name": "host1.fake"}`))
+	if strings.Join(groups, ",") != "one,two" {
+		t.Errorf("Unexpected groups: %v", groups)
+	}
+	if groups := b.Build(gjson.Parse(`{"name": "host2.fake"}`)); len(groups) != 0 {
+		t.Errorf("Expected no groups, got: %v", groups)
+	}
+	bad, _ := NewExec("bad", []string{"/bin/sh", "-c", "echo not json"}, time.Minute)
+	if groups := bad.Build(gjson.Parse(`{"name": "host1.fake"}`)); groups != nil {
+		t.Errorf("Invalid response should produce no groups, got: %v", groups)
+	}
+	if _, err := NewExec("", []string{"true"}, 0); err == nil {
+		t.Error("Expected an error for a builder without a name")
+	}
+}
@@ -0,0 +1,267 @@
+// groupexpr evaluates set expressions over inventory groups, such as "sat_valid AND sat_dc1 AND NOT sat_db_servers".
+//
+// An expression combines group names with the operators NOT, AND and OR (in order of decreasing precedence, and
+// case-insensitive) and parentheses.  The special name "all" refers to every host.
+package groupexpr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Hosts is a set of hostnames
+type Hosts map[string]bool
+
+// Lookup returns the members of a group.  A group that doesn't exist has no members.
+type Lookup func(group string) Hosts
+
+// Expr is a parsed group expression
+type Expr interface {
+	// Eval returns the hosts selected by the expression, given the members of each group and all the hosts.
+	Eval(lookup Lookup, all Hosts) Hosts
+	// Groups returns the names of the groups the expression refers to.
+	Groups() []string
+	String() string
+}
+
+type groupExpr string
+
+type notExpr struct{ x Expr }
+
+type binaryExpr struct {
+	op   string // AND or OR
+	l, r Expr
+}
+
+func (g groupExpr) Eval(lookup Lookup, all Hosts) Hosts {
+	if g == "all" {
+		return all
+	}
+	return lookup(string(g))
+}
+
+func (g groupExpr) Groups() []string {
+	if g == "all" {
+		return nil
+	}
+	return []string{string(g)}
+}
+
+func (g groupExpr) String() string {
+	return string(g)
+}
+
+func (n notExpr) Eval(lookup Lookup, all Hosts) Hosts {
+	x := n.x.Eval(lookup, all)
+	hosts := make(Hosts)
+	for h := range all {
+		if !x[h] {
+			hosts[h] = true
+		}
+	}
+	return hosts
+}
+
+func (n notExpr) Groups() []string {
+	return n.x.Groups()
+}
+
+func (n notExpr) String() string {
+	return "NOT " + n.x.String()
+}
+
+func (b binaryExpr) Eval(lookup Lookup, all Hosts) Hosts {
+	l := b.l.Eval(lookup, all)
+	r := b.r.Eval(lookup, all)
+	hosts := make(Hosts)
+	for h := range l {
+		if b.op == "OR" || r[h] {
+			hosts[h] = true
+		}
+	}
+	if b.op == "OR" {
+		for h := range r {
+			hosts[h] = true
+		}
+	}
+	return hosts
+}
+
+func (b binaryExpr) Groups() []string {
+	return append(b.l.Groups(), b.r.Groups()...)
+}
+
+func (b binaryExpr) String() string {
+	return fmt.Sprintf("(%s %s %s)", b.l, b.op, b.r)
+}
+
+// parser is a recursive descent parser of a tokenised expression
+type parser struct {
+	tokens []string
+	pos    int
+}
+
+// tokenize splits an expression into parentheses and words
+func tokenize(s string) []string {
+	var tokens []string
+	word := ""
+	flush := func() {
+		if word != "" {
+			tokens = append(tokens, word)
+			word = ""
+		}
+	}
+	for _, r := range s {
+		switch {
+		case r == '(' || r == ')':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t' || r == '\n':
+			flush()
+		default:
+			word += string(r)
+		}
+	}
+	flush()
+	return tokens
+}
+
+// peek returns the next token, with operators in upper case, or an empty string at the end of the expression.
+func (p *parser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	t := p.tokens[p.pos]
+	switch strings.ToUpper(t) {
+	case "AND", "OR", "NOT":
+		return strings.ToUpper(t)
+	}
+	return t
+}
+
+func (p *parser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// or parses: and {OR and}
+func (p *parser) or() (Expr, error) {
+	x, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "OR" {
+		p.next()
+		y, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: "OR", l: x, r: y}
+	}
+	return x, nil
+}
+
+// and parses: not {AND not}
+func (p *parser) and() (Expr, error) {
+	x, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "AND" {
+		p.next()
+		y, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		x = binaryExpr{op: "AND", l: x, r: y}
+	}
+	return x, nil
+}
+
+// not parses: NOT not | ( or ) | group
+func (p *parser) not() (Expr, error) {
+	switch t := p.next(); t {
+	case "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case "NOT":
+		x, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{x}, nil
+	case "(":
+		x, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing closing parenthesis")
+		}
+		return x, nil
+	case ")", "AND", "OR":
+		return nil, fmt.Errorf("unexpected %s", t)
+	default:
+		return groupExpr(t), nil
+	}
+}
+
+// Parse returns the parsed form of a group expression.
+func Parse(s string) (Expr, error) {
+	p := &parser{tokens: tokenize(s)}
+	x, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s", p.tokens[p.pos])
+	}
+	return x, nil
+}
+
+// ParseAll parses a set of expressions, keyed by the name of the group each one defines, and returns them together
+// with the order in which they must be evaluated: An expression is evaluated after those defining groups it refers
+// to.  Expressions that refer to one another in a cycle are an error.
+func ParseAll(exprs map[string]string) (map[string]Expr, []string, error) {
+	var names []string
+	parsed := make(map[string]Expr)
+	for name, s := range exprs {
+		x, err := Parse(s)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", name, err)
+		}
+		parsed[name] = x
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var order []string
+	// state is 1 while an expression's dependencies are being visited and 2 once it has been ordered
+	state := make(map[string]int)
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case 1:
+			return fmt.Errorf("%s: circular reference: %s", path[0], strings.Join(append(path, name), " -> "))
+		case 2:
+			return nil
+		}
+		state[name] = 1
+		for _, g := range parsed[name].Groups() {
+			if _, ok := parsed[g]; ok {
+				if err := visit(g, append(path, name)); err != nil {
+					return err
+				}
+			}
+		}
+		state[name] = 2
+		order = append(order, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+	return parsed, order, nil
+}
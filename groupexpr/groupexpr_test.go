@@ -0,0 +1,80 @@
+package groupexpr
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+var testGroups = map[string]Hosts{
+	"sat_valid":      {"web01": true, "web02": true, "db01": true, "app01": true},
+	"sat_dc1":        {"web01": true, "db01": true, "app02": true},
+	"sat_db_servers": {"db01": true},
+}
+
+var testAll = Hosts{"web01": true, "web02": true, "db01": true, "app01": true, "app02": true}
+
+func lookup(group string) Hosts {
+	return testGroups[group]
+}
+
+// names returns the sorted, comma-separated members of a set of hosts
+func names(hosts Hosts) string {
+	var s []string
+	for h := range hosts {
+		s = append(s, h)
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+func TestEval(t *testing.T) {
+	tests := map[string]string{
+		"sat_valid AND sat_dc1 AND NOT sat_db_servers": "web01",
+		"sat_valid and not sat_dc1":                    "app01,web02",
+		"sat_db_servers OR sat_dc1 AND NOT sat_valid":  "app02,db01",
+		"(sat_db_servers OR sat_dc1) AND sat_valid":    "db01,web01",
+		"NOT NOT sat_db_servers":                       "db01",
+		"all AND NOT sat_valid":                        "app02",
+		"sat_missing OR sat_db_servers":                "db01",
+	}
+	for s, want := range tests {
+		x, err := Parse(s)
+		if err != nil {
+			t.Errorf("%s: Parse returned: %v", s, err)
+			continue
+		}
+		if got := names(x.Eval(lookup, testAll)); got != want {
+			t.Errorf("%s: Expected=%q, Got=%q", s, want, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, s := range []string{"", "sat_valid AND", "AND sat_valid", "(sat_valid", "sat_valid)", "sat_valid sat_dc1", "NOT"} {
+		if _, err := Parse(s); err == nil {
+			t.Errorf("%q: Expected a parse error", s)
+		}
+	}
+}
+
+func TestParseAll(t *testing.T) {
+	parsed, order, err := ParseAll(map[string]string{
+		"sat_ring2": "sat_valid AND NOT sat_ring1",
+		"sat_ring1": "sat_valid AND sat_dc1",
+		"sat_other": "sat_db_servers",
+	})
+	if err != nil {
+		t.Fatalf("ParseAll returned: %v", err)
+	}
+	if len(parsed) != 3 || strings.Join(order, ",") != "sat_other,sat_ring1,sat_ring2" {
+		t.Errorf("Unexpected evaluation order: %v", order)
+	}
+	_, _, err = ParseAll(map[string]string{"a": "b AND sat_valid", "b": "NOT a"})
+	if err == nil || !strings.Contains(err.Error(), "a -> b -> a") {
+		t.Errorf("Expected a circular reference error, got: %v", err)
+	}
+	if _, _, err := ParseAll(map[string]string{"a": "sat_valid OR"}); err == nil || !strings.HasPrefix(err.Error(), "a: ") {
+		t.Errorf("Expected a parse error for a, got: %v", err)
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/config"
+	"github.com/crooks/satinv/enricher"
+	"github.com/crooks/satinv/groupbuilder"
+	"github.com/crooks/satinv/groupexpr"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// defaultGroupBuilderTimeout is the time permitted for an external group builder to process a single host
+const defaultGroupBuilderTimeout = 10 * time.Second
+
+// groupBuilders returns the registered GroupBuilders followed by those configured as external executables.
+func groupBuilders() ([]groupbuilder.GroupBuilder, error) {
+	builders := groupbuilder.Registered()
+	for _, c := range cfg.GroupBuilders {
+		timeout := defaultGroupBuilderTimeout
+		if c.Timeout > 0 {
+			timeout = time.Duration(c.Timeout) * time.Second
+		}
+		b, err := groupbuilder.NewExec(c.Name, c.Command, timeout)
+		if err != nil {
+			return nil, err
+		}
+		builders = append(builders, b)
+	}
+	for _, b := range builders {
+		log.Debugf("Group builder %s enabled", b.Name())
+	}
+	return builders, nil
+}
+
+// hgCustom adds a host to the groups returned by each GroupBuilder.  Group names are sanitized and prefixed in the
+// same way as Host Collection names.
+func (inv *inventory) hgCustom(b *hostBuild, host gjson.Result) {
+	if !cfg.GroupEnabled(config.GroupBuilders) {
+		return
+	}
+	for _, builder := range inv.builders {
+		for _, g := range builder.Build(host) {
+			b.addGroup(mkInventoryName(config.GroupBuilders, g), true)
+		}
+	}
+}
+
+// hgExpressions adds the composite groups defined by group_expressions.  They're evaluated once every other group is
+// complete and may refer to each other.  Members are added in the order the hosts appear in the hostvars.
+func (inv *inventory) hgExpressions() {
+	if len(inv.exprOrder) == 0 || !cfg.GroupEnabled(config.GroupExpressions) {
+		return
+	}
+	var hosts []string
+	all := make(groupexpr.Hosts)
+	gjson.Get(inv.json, "_meta.hostvars").ForEach(func(k, _ gjson.Result) bool {
+		hosts = append(hosts, k.String())
+		all[k.String()] = true
+		return true
+	})
+	lookup := func(group string) groupexpr.Hosts {
+		return inv.members[group]
+	}
+	for _, name := range inv.exprOrder {
+		if inv.children[name] {
+			log.Warnf("Ignoring group expression %s.  A group of that name already exists.", name)
+			continue
+		}
+		members := inv.expressions[name].Eval(lookup, all)
+		log.Debugf("Group expression %s = %s selected %d hosts", name, inv.expressions[name], len(members))
+		inv.addChild(name)
+		for _, h := range hosts {
+			if members[h] {
+				inv.addHost(name, h)
+			}
+		}
+	}
+}
+
+// hostParameter returns the value of a Satellite host parameter.  Parameters are read from the host's record (when
+// requested with include[]=all_parameters), falling back to the data collected by the params enricher.
+func (inv *inventory) hostParameter(host gjson.Result, name string) (string, bool) {
+	sources := []gjson.Result{host.Get("all_parameters"), host.Get("parameters"), inv.enrichments[host.Get("name").String()]["params"]}
+	for _, params := range sources {
+		for _, p := range params.Array() {
+			if p.Get("name").String() == name {
+				return p.Get("value").String(), true
+			}
+		}
+	}
+	return "", false
+}
+
+// hostTags returns the tags assigned to a host by the tag parameter: A comma-separated list.
+func (inv *inventory) hostTags(host gjson.Result) []string {
+	if cfg.TagParameter == "" {
+		return nil
+	}
+	value, ok := inv.hostParameter(host, cfg.TagParameter)
+	if !ok {
+		return nil
+	}
+	var tags []string
+	for _, t := range strings.Split(value, ",") {
+		t = strings.TrimSpace(t)
+		if t != "" && !containsStr(t, tags) {
+			tags = append(tags, t)
+		}
+	}
+	return tags
+}
+
+// hgTags adds a host to a tag_<tag> group for each of its tags and records the tags in a <prefix>tags hostvar.
+func (inv *inventory) hgTags(b *hostBuild, host gjson.Result) {
+	if !cfg.GroupEnabled(config.GroupTags) {
+		return
+	}
+	tags := inv.hostTags(host)
+	if len(tags) == 0 {
+		return
+	}
+	var err error
+	b.hostvars, err = sjson.Set(b.hostvars, cfg.InventoryPrefix+"tags", tags)
+	if err != nil {
+		b.err = err
+		return
+	}
+	for _, t := range tags {
+		b.addGroup(mkInventoryName(config.GroupTags, "tag_"+t), true)
+	}
+}
+
+// hgParameterGroups adds a host to each of the groups listed by the groups parameter: A comma-separated list.
+func (inv *inventory) hgParameterGroups(b *hostBuild, host gjson.Result) {
+	if cfg.GroupsParameter == "" || !cfg.GroupEnabled(config.GroupParameter) {
+		return
+	}
+	value, ok := inv.hostParameter(host, cfg.GroupsParameter)
+	if !ok {
+		return
+	}
+	for _, g := range strings.Split(value, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			b.addGroup(mkInventoryName(config.GroupParameter, g), true)
+		}
+	}
+}
+
+// subscriptionStates names the values of a host's subscription_status
+var subscriptionStates = map[int64]string{
+	0: "valid",
+	1: "partial",
+	2: "invalid",
+	3: "unknown",
+	4: "disabled",   // Simple Content Access
+	5: "unentitled", // An unsubscribed hypervisor
+}
+
+// hgSubscription adds a host to a sub_<state> group for its subscription_status, regardless of whether it's valid.
+// Hosts without a recognised status are in sub_unknown.
+func hgSubscription(b *hostBuild, host gjson.Result) {
+	if !cfg.GroupEnabled(config.GroupSubscription) {
+		return
+	}
+	status := host.Get("subscription_status")
+	state, ok := subscriptionStates[status.Int()]
+	if !ok || !status.Exists() {
+		state = "unknown"
+	}
+	b.addGroup(mkInventoryName(config.GroupSubscription, "sub_"+state), true)
+}
+
+// defaultOSNames are the short names of common Operating Systems, keyed by their Satellite names.  groups.os_names
+// takes precedence.
+var defaultOSNames = map[string]string{
+	"RedHat":        "rhel",
+	"RHEL":          "rhel",
+	"CentOS":        "centos",
+	"CentOS Linux":  "centos",
+	"CentOS_Stream": "centos_stream",
+	"CentOS Stream": "centos_stream",
+	"Rocky":         "rocky",
+	"AlmaLinux":     "alma",
+	"OracleLinux":   "ol",
+	"Fedora":        "fedora",
+	"SLES":          "sles",
+	"Debian":        "debian",
+	"Ubuntu":        "ubuntu",
+}
+
+// osGroup returns the name of a host's OS group, e.g. os_rhel8, from its operatingsystem_name ("RedHat 8.6").  The
+// OS name is translated by groups.os_names or defaultOSNames and followed by the major version.  An empty string is
+// returned if the host has no OS.
+func osGroup(host gjson.Result) string {
+	name := strings.TrimSpace(host.Get("operatingsystem_name").String())
+	if name == "" {
+		return ""
+	}
+	var major string
+	if i := strings.LastIndex(name, " "); i > 0 && name[i+1] >= '0' && name[i+1] <= '9' {
+		major = strings.SplitN(name[i+1:], ".", 2)[0]
+		name = strings.TrimSpace(name[:i])
+	}
+	if short, ok := cfg.Groups.OSNames[name]; ok {
+		name = short
+	} else if short, ok := defaultOSNames[name]; ok {
+		name = short
+	}
+	return "os_" + name + major
+}
+
+// hgOS adds a host to the group of its Operating System and major version.
+func hgOS(b *hostBuild, host gjson.Result) {
+	if !cfg.GroupEnabled(config.GroupOS) {
+		return
+	}
+	if group := osGroup(host); group != "" {
+		b.addGroup(mkInventoryName(config.GroupOS, group), true)
+	}
+}
+
+// hgCapsule adds a host to a capsule_<name> group for its content source, where name is the first label of the
+// Capsule's name, e.g. capsule_eu1 for eu1.example.com.
+func hgCapsule(b *hostBuild, host gjson.Result) {
+	if !cfg.GroupEnabled(config.GroupCapsule) {
+		return
+	}
+	source := host.Get("content_facet_attributes.content_source_name").String()
+	if source == "" {
+		return
+	}
+	b.addGroup(mkInventoryName(config.GroupCapsule, "capsule_"+strings.SplitN(source, ".", 2)[0]), true)
+}
+
+// hgVirtual adds a host to the virtual or physical group and, if it's a guest, to groups for its hypervisor and
+// compute resource (cluster): hypervisor_<name> and cluster_<name>.  A host is virtual if virt-who has reported its
+// hypervisor, if it was provisioned on a compute resource or if its virt::is_guest fact is true.  It's physical if the
+// fact is false or virt-who reports it as a hypervisor.  Hosts with no such evidence are in neither group.
+func (inv *inventory) hgVirtual(b *hostBuild, host gjson.Result) {
+	if !cfg.GroupEnabled(config.GroupVirtual) {
+		return
+	}
+	hypervisor := host.Get("subscription_facet_attributes.virtual_host.name").String()
+	cluster := host.Get("compute_resource_name").String()
+	guest := inv.enrichments[host.Get("name").String()]["facts"].Get("virt::is_guest")
+	switch {
+	case hypervisor != "" || cluster != "" || (guest.Exists() && guest.Bool()):
+		b.addGroup(mkInventoryName(config.GroupVirtual, "virtual"), true)
+	case guest.Exists() || len(host.Get("subscription_facet_attributes.virtual_guests").Array()) > 0:
+		b.addGroup(mkInventoryName(config.GroupVirtual, "physical"), true)
+	}
+	if hypervisor != "" {
+		// The hypervisor is named in the hostname_style, so its group matches the hypervisor's own inventory name
+		b.addGroup(mkInventoryName(config.GroupVirtual, "hypervisor_"+inv.hostname(inventoryHostname(hypervisor))), true)
+	}
+	if cluster != "" {
+		b.addGroup(mkInventoryName(config.GroupVirtual, "cluster_"+cluster), true)
+	}
+}
+
+// hgNetBox adds a host to a group for each of its NetBox site, tenant and role, e.g. netbox_site_<site>.
+func (inv *inventory) hgNetBox(b *hostBuild, host gjson.Result) {
+	if !cfg.GroupEnabled(config.GroupNetBox) {
+		return
+	}
+	data := inv.enrichments[host.Get("name").String()][enricher.NetBoxName]
+	if !data.Exists() {
+		return
+	}
+	for _, field := range []string{"site", "tenant", "role"} {
+		value := data.Get(field).String()
+		if value == "" {
+			continue
+		}
+		b.addGroup(mkInventoryName(config.GroupNetBox, fmt.Sprintf("netbox_%s_%s", field, value)), true)
+	}
+}
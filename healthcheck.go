@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/tidwall/gjson"
+)
+
+// runName is the cache item recording the outcome of the most recent inventory refresh
+const runName = "run"
+
+// healthCritical is the exit status of a failed healthcheck, as understood by Nagios and Icinga
+const healthCritical = 2
+
+// runRecord describes the most recent inventory refresh
+type runRecord struct {
+	Time          time.Time `json:"time"`
+	Hosts         int       `json:"hosts"`
+	PreviousHosts int       `json:"previous_hosts"` // Hosts in the inventory it replaced
+}
+
+// drop returns the percentage by which the number of hosts fell in the refresh.
+func (r runRecord) drop() float64 {
+	if r.PreviousHosts == 0 || r.Hosts >= r.PreviousHosts {
+		return 0
+	}
+	return float64(r.PreviousHosts-r.Hosts) * 100 / float64(r.PreviousHosts)
+}
+
+// hostCount returns the number of hosts in an inventory.
+func hostCount(invJSON string) int {
+	return len(gjson.Get(invJSON, "_meta.hostvars").Map())
+}
+
+// recordRun writes the record of a completed refresh.  previous is the inventory it replaced.
+func (inv *inventory) recordRun(previous string) {
+	b, err := json.Marshal(runRecord{Time: time.Now().UTC(), Hosts: hostCount(inv.json), PreviousHosts: hostCount(previous)})
+	if err != nil {
+		log.Warnf("Unable to encode %s: %v", runName, err)
+		return
+	}
+	if err := inv.cache.PutFile(runName, b); err != nil {
+		log.Warnf("Unable to write %s: %v", runName, err)
+	}
+}
+
+// lastRun returns the record of the most recent refresh.
+func (inv *inventory) lastRun() (runRecord, error) {
+	var r runRecord
+	b, err := inv.cache.GetFile(runName)
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(b, &r)
+	return r, err
+}
+
+// statusURL returns the Satellite API URL that reports the health of the server.
+func statusURL() string {
+	return fmt.Sprintf("%s/api/status", cfg.API.BaseURL)
+}
+
+// healthStatus is the outcome of a healthcheck
+type healthStatus struct {
+	problems []string
+	run      runRecord
+	recorded bool          // A refresh has been recorded
+	latency  time.Duration // Of the Satellite API, if it was checked
+}
+
+func (h *healthStatus) fail(format string, args ...interface{}) {
+	h.problems = append(h.problems, fmt.Sprintf(format, args...))
+}
+
+// String returns the status in the form of a Nagios plugin's output, with performance data following the "|".
+func (h *healthStatus) String() string {
+	var msg string
+	if len(h.problems) > 0 {
+		msg = "SATINV CRITICAL - " + strings.Join(h.problems, "; ")
+	} else {
+		msg = fmt.Sprintf("SATINV OK - %d hosts, refreshed %s ago", h.run.Hosts, time.Since(h.run.Time).Round(time.Second))
+	}
+	var perf []string
+	if h.recorded {
+		perf = append(perf, fmt.Sprintf("age=%ds", int(time.Since(h.run.Time).Seconds())), fmt.Sprintf("hosts=%d", h.run.Hosts))
+	}
+	if h.latency > 0 {
+		perf = append(perf, fmt.Sprintf("api=%.3fs", h.latency.Seconds()))
+	}
+	if len(perf) == 0 {
+		return msg
+	}
+	return msg + " | " + strings.Join(perf, " ")
+}
+
+// health checks that the inventory has been refreshed within maxAge, that the refresh didn't lose more than maxDrop
+// percent of the hosts and, if checkAPI is true, that the Satellite API responds within timeout.
+func (inv *inventory) health(maxAge time.Duration, maxDrop float64, checkAPI bool, timeout time.Duration) *healthStatus {
+	h := new(healthStatus)
+	run, err := inv.lastRun()
+	if err != nil {
+		h.fail("no inventory refresh has been recorded")
+	} else {
+		h.run = run
+		h.recorded = true
+		if age := time.Since(run.Time); maxAge > 0 && age > maxAge {
+			h.fail("inventory was refreshed %s ago (maximum %s)", age.Round(time.Second), maxAge)
+		}
+		if drop := run.drop(); drop > maxDrop {
+			h.fail("host count fell by %.1f%% (from %d to %d) in the last refresh", drop, run.PreviousHosts, run.Hosts)
+		}
+	}
+	if _, err := inv.cache.GetFile(inventoryName); err != nil {
+		h.fail("cached inventory is unreadable: %v", err)
+	}
+	if checkAPI && hostsFile() == "" {
+		ctx, cancel := context.WithTimeout(inv.ctx, timeout)
+		defer cancel()
+		inv.cache.SetContext(ctx)
+		start := time.Now()
+		if err := inv.initAPI(); err != nil {
+			h.fail("Satellite API is unusable: %v", err)
+		} else if _, err := inv.cache.Get(statusURL()); err != nil {
+			h.fail("Satellite API is unreachable: %s", strings.TrimSpace(err.Error()))
+		} else {
+			h.latency = time.Since(start)
+		}
+	}
+	return h
+}
+
+// healthcheckCommand checks the health of the cached inventory and the Satellite API.  A single line of status is
+// written in the form expected of a Nagios plugin and the exit status is non-zero if any check fails.
+func healthcheckCommand(args []string) error {
+	fs := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	maxAge := fs.Duration("max-age", 2*time.Duration(cfg.Cache.ValidityInventory)*time.Second, "Maximum age of the inventory")
+	maxDrop := fs.Float64("max-drop", 20, "Maximum percentage by which the host count may fall in a refresh")
+	noAPI := fs.Bool("no-api", false, "Don't check the Satellite API")
+	timeout := fs.Duration("timeout", 10*time.Second, "Maximum time to wait for the Satellite API")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *maxDrop < 0 || *maxDrop > 100 {
+		return fmt.Errorf("invalid --max-drop percentage: %g", *maxDrop)
+	}
+	inv, err := newInventory()
+	if err != nil {
+		return err
+	}
+	// The inventory isn't closed, so a healthcheck doesn't replace the cache statistics of the last real run
+	h := inv.health(*maxAge, *maxDrop, !*noAPI, *timeout)
+	fmt.Println(h)
+	if len(h.problems) > 0 {
+		return &exitError{code: healthCritical, err: errors.New(strings.Join(h.problems, "; "))}
+	}
+	return nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/tidwall/gjson"
+)
+
+const (
+	historyPrefix string = "inventory-"
+	historyLayout string = "20060102T150405Z"
+)
+
+// snapshot is an archived copy of an inventory
+type snapshot struct {
+	file string
+	time time.Time // When the inventory was superseded
+}
+
+// snapshots returns the archived inventories, most recent first.
+func snapshots() ([]snapshot, error) {
+	entries, err := os.ReadDir(cfg.History.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var snaps []snapshot
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, historyPrefix) || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		t, err := time.Parse(historyLayout, strings.TrimSuffix(strings.TrimPrefix(name, historyPrefix), ".json"))
+		if err != nil {
+			log.Debugf("Ignoring unrecognised history file: %s", name)
+			continue
+		}
+		snaps = append(snaps, snapshot{file: filepath.Join(cfg.History.Dir, name), time: t})
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].time.After(snaps[j].time)
+	})
+	return snaps, nil
+}
+
+// archiveInventory adds the inventory being replaced to the history and prunes snapshots that exceed the retention
+// limits.  Failures are logged; they shouldn't prevent the new inventory being written.
+func archiveInventory(previous string) {
+	if !cfg.History.Enabled || previous == "" {
+		return
+	}
+	if flags.DryRun {
+		log.Info("Dry run: not archiving the previous inventory")
+		return
+	}
+	if err := os.MkdirAll(cfg.History.Dir, 0755); err != nil {
+		log.Warnf("Unable to create history dir: %v", err)
+		return
+	}
+	filename := filepath.Join(cfg.History.Dir, historyPrefix+time.Now().UTC().Format(historyLayout)+".json")
+	if err := writeAtomic(filename, []byte(previous)); err != nil {
+		log.Warnf("Unable to archive inventory: %v", err)
+		return
+	}
+	log.Debugf("Archived previous inventory to %s", filename)
+	if err := pruneHistory(); err != nil {
+		log.Warnf("Unable to prune inventory history: %v", err)
+	}
+}
+
+// pruneHistory removes the oldest snapshots, beyond the number to keep, and those older than the maximum age.
+func pruneHistory() error {
+	snaps, err := snapshots()
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-time.Duration(cfg.History.MaxAge) * 24 * time.Hour)
+	for i, s := range snaps {
+		if i < cfg.History.Keep && (cfg.History.MaxAge == 0 || s.time.After(cutoff)) {
+			continue
+		}
+		if err := os.Remove(s.file); err != nil {
+			return err
+		}
+		log.Debugf("Pruned inventory snapshot: %s", s.file)
+	}
+	return nil
+}
+
+// groupMembers returns the hosts in each group of an inventory.
+func groupMembers(invJSON string) map[string]map[string]bool {
+	members := make(map[string]map[string]bool)
+	gjson.Parse(invJSON).ForEach(func(k, v gjson.Result) bool {
+		name := k.String()
+		if name == "_meta" || name == "all" || name == metaGroup {
+			return true
+		}
+		members[name] = make(map[string]bool)
+		for _, h := range v.Get("hosts").Array() {
+			members[name][h.String()] = true
+		}
+		return true
+	})
+	return members
+}
+
+// membershipChanges returns the hosts that have joined (+) or left (-) each group between two inventories.
+func membershipChanges(oldJSON, newJSON string) []string {
+	oldMembers := groupMembers(oldJSON)
+	newMembers := groupMembers(newJSON)
+	var changes []string
+	for g, hosts := range newMembers {
+		for h := range hosts {
+			if !oldMembers[g][h] {
+				changes = append(changes, fmt.Sprintf("%s: +%s", g, h))
+			}
+		}
+	}
+	for g, hosts := range oldMembers {
+		for h := range hosts {
+			if !newMembers[g][h] {
+				changes = append(changes, fmt.Sprintf("%s: -%s", g, h))
+			}
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// hostGroups returns the sorted groups a host is a member of.
+func hostGroups(invJSON, host string) []string {
+	var groups []string
+	for g, hosts := range groupMembers(invJSON) {
+		if hosts[host] {
+			groups = append(groups, g)
+		}
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+// historyCommand executes the "history" subcommands.
+func historyCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("history requires a subcommand: diff, host, list")
+	}
+	switch args[0] {
+	case "diff":
+		return historyDiff(args[1:])
+	case "host":
+		return historyHost(args[1:])
+	case "list":
+		return historyList()
+	default:
+		return fmt.Errorf("unknown history subcommand: %s", args[0])
+	}
+}
+
+// currentInventory returns the inventory, refreshing it if it has expired.
+func currentInventory() (string, error) {
+	inv, err := newInventory()
+	if err != nil {
+		return "", err
+	}
+	defer inv.close()
+	if err := inv.load(); err != nil {
+		return "", err
+	}
+	return inv.json, nil
+}
+
+// snapshotJSON returns the content of the nth most recent snapshot.  Snapshot 0 is the current inventory.
+func snapshotJSON(snaps []snapshot, arg string) (string, error) {
+	n, err := strconv.Atoi(arg)
+	if err != nil || n < 0 {
+		return "", fmt.Errorf("invalid snapshot number: %s", arg)
+	}
+	if n == 0 {
+		return currentInventory()
+	}
+	if n > len(snaps) {
+		return "", fmt.Errorf("snapshot %d requested but only %d are available", n, len(snaps))
+	}
+	b, err := ioutil.ReadFile(snaps[n-1].file)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// historyList shows the available snapshots with their host and group counts.
+func historyList() error {
+	snaps, err := snapshots()
+	if err != nil {
+		return err
+	}
+	if len(snaps) == 0 {
+		fmt.Println("No inventory snapshots found")
+		return nil
+	}
+	for i, s := range snaps {
+		b, err := ioutil.ReadFile(s.file)
+		if err != nil {
+			return err
+		}
+		hostCount := len(gjson.GetBytes(b, "_meta.hostvars").Map())
+		fmt.Printf("%3d  %s  %d hosts, %d groups\n", i+1, s.time.Local().Format(shortDate), hostCount, len(groupCounts(string(b))))
+	}
+	return nil
+}
+
+// historyDiff compares the group memberships of a snapshot with the current inventory, or with another snapshot.
+func historyDiff(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("usage: history diff <n> [m]")
+	}
+	snaps, err := snapshots()
+	if err != nil {
+		return err
+	}
+	oldJSON, err := snapshotJSON(snaps, args[0])
+	if err != nil {
+		return err
+	}
+	to := "0"
+	if len(args) == 2 {
+		to = args[1]
+	}
+	newJSON, err := snapshotJSON(snaps, to)
+	if err != nil {
+		return err
+	}
+	changes := membershipChanges(oldJSON, newJSON)
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+	if len(changes) == 0 {
+		fmt.Println("No group membership changes")
+	}
+	return nil
+}
+
+// historyHost shows when a host joined or left groups, oldest snapshot first.
+func historyHost(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: history host <host>")
+	}
+	host := inventoryHostname(args[0])
+	snaps, err := snapshots()
+	if err != nil {
+		return err
+	}
+	var previous []string
+	for i := len(snaps); i >= 0; i-- {
+		invJSON, err := snapshotJSON(snaps, strconv.Itoa(i))
+		if err != nil {
+			return err
+		}
+		label := "current"
+		if i > 0 {
+			label = fmt.Sprintf("until %s", snaps[i-1].time.Local().Format(shortDate))
+		}
+		groups := hostGroups(invJSON, host)
+		var changes []string
+		for _, g := range groups {
+			if !containsStr(g, previous) {
+				changes = append(changes, "+"+g)
+			}
+		}
+		for _, g := range previous {
+			if !containsStr(g, groups) {
+				changes = append(changes, "-"+g)
+			}
+		}
+		if len(changes) > 0 {
+			fmt.Printf("%s: %s\n", label, strings.Join(changes, " "))
+		}
+		previous = groups
+	}
+	return nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/rules"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// hostBuild is a single host's contribution to the inventory: Its hostvars and the groups it's a member of.  Builds
+// are independent of each other, so hosts can be processed concurrently and their builds merged afterwards.
+type hostBuild struct {
+	name     string // Inventory hostname
+	hostvars string // JSON object
+	groups   []groupMembership
+	err      error // A failure to build the hostvars, which abandons the refresh when the builds are merged
+}
+
+// groupMembership is the membership of a host in a group.  child is true if the group is also a child of all.
+type groupMembership struct {
+	group string
+	child bool
+}
+
+// addGroup records that the host is a member of a group.
+func (b *hostBuild) addGroup(group string, child bool) {
+	b.groups = append(b.groups, groupMembership{group: group, child: child})
+}
+
+// buildWorkers returns the number of goroutines that build hosts concurrently.
+func buildWorkers() int {
+	if cfg.Build.Workers > 0 {
+		return cfg.Build.Workers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// buildHosts builds every host in the Satellite results, sharded across buildWorkers goroutines.  The builds are
+// returned in the order of the results, regardless of the order in which they completed.  Hosts without a name, and
+// those excluded from the inventory, are returned as nil.
+func (inv *inventory) buildHosts(results gjson.Result) []*hostBuild {
+	type job struct {
+		index int
+		host  gjson.Result
+	}
+	builds := make([]*hostBuild, int(results.Get("#").Int()))
+	p := newProgress("parseHosts", "hosts", len(builds))
+	jobs := make(chan job)
+	var wg sync.WaitGroup
+	for i := 0; i < buildWorkers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				builds[j.index] = inv.buildHost(j.host)
+				p.step()
+			}
+		}()
+	}
+	// ForEach parses each host in turn, rather than building an array of every host up front.
+	i := 0
+	results.ForEach(func(_, h gjson.Result) bool {
+		jobs <- job{index: i, host: h}
+		i++
+		return true
+	})
+	close(jobs)
+	wg.Wait()
+	return builds
+}
+
+// buildHost builds the hostvars and group memberships of a single host.  It must only read the inventory's state, as
+// it's called concurrently for different hosts.
+func (inv *inventory) buildHost(h gjson.Result) *hostBuild {
+	// Every individual host map should contain a "name" key
+	if !h.Get("name").Exists() {
+		log.Errorf("No hostname found in Satellite host map")
+		return nil
+	}
+	hostNameShort := inventoryHostname(h.Get("name").String())
+	log.Debugf("Parsing Satellite info for host: %s", hostNameShort)
+	if inv.excludedFromInventory(hostNameShort) {
+		log.Infof("Host %s is excluded from the inventory by its %s parameter", hostNameShort, cfg.ExcludeParameter.Name)
+		inv.run.host(&validCheck{name: checkExcludedParam})
+		return nil
+	}
+	b := &hostBuild{name: inv.hostname(hostNameShort)}
+	hostvars, err := inv.hostvars(h)
+	if err == nil && cfg.SCA == "auto" {
+		hostvars, err = sjson.Set(hostvars, "satinv_sca", inv.hostSCA(h))
+	}
+	if err != nil {
+		b.err = err
+		return b
+	}
+	b.hostvars = hostvars
+	derived := inv.derive(h, hostNameShort, inv.cidrs)
+	for _, rules := range inv.validRules {
+		if override, ok := inv.hostRules(rules, hostNameShort, derived.CIDRGroups); ok {
+			// The cached results were derived under the group's own rules, so they don't apply
+			inv.hgValid(b, h, override, inv.validStaticChecks(h, hostNameShort, override))
+			continue
+		}
+		inv.hgValid(b, h, rules, derived.staticChecks(rules.group))
+	}
+	hgCIDRMembers(b, derived.CIDRGroups)
+	hgSubscription(b, h)
+	hgOS(b, h)
+	hgCapsule(b, h)
+	inv.hgVirtual(b, h)
+	inv.hgCustom(b, h)
+	inv.hgTags(b, h)
+	inv.hgParameterGroups(b, h)
+	inv.hgNetBox(b, h)
+	return b
+}
+
+// mergeBuilds adds host builds to the inventory, in order.  The result is identical to that of adding each host's
+// hostvars and groups in turn: Where hosts share a name, the hostvars of the last replace those of the earlier ones but
+// retain their position.  Each hostvars object and hosts array is written once, rather than once per host.
+func (inv *inventory) mergeBuilds(builds []*hostBuild) {
+	var hostOrder []string
+	hostvars := make(map[string]string)
+	gjson.Get(inv.json, "_meta.hostvars").ForEach(func(k, v gjson.Result) bool {
+		hostOrder = append(hostOrder, k.String())
+		hostvars[k.String()] = v.Raw
+		return true
+	})
+	var groupOrder []string
+	added := make(map[string][]string) // Hosts added to each group, in order
+	for _, b := range builds {
+		if b == nil {
+			continue
+		}
+		if b.err != nil {
+			inv.jsonFailed(hostvarsPath(b.name), b.err)
+			continue
+		}
+		if _, ok := hostvars[b.name]; !ok {
+			hostOrder = append(hostOrder, b.name)
+		}
+		hostvars[b.name] = b.hostvars
+		for _, m := range b.groups {
+			if m.child {
+				inv.addChild(m.group)
+			}
+			if !inv.addMember(m.group, b.name) {
+				continue
+			}
+			if _, ok := added[m.group]; !ok {
+				groupOrder = append(groupOrder, m.group)
+			}
+			added[m.group] = append(added[m.group], b.name)
+		}
+	}
+	if len(hostOrder) > 0 {
+		var sb strings.Builder
+		sb.WriteByte('{')
+		for i, name := range hostOrder {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			key, _ := json.Marshal(name)
+			sb.Write(key)
+			sb.WriteByte(':')
+			sb.WriteString(hostvars[name])
+		}
+		sb.WriteByte('}')
+		inv.setRaw("_meta.hostvars", sb.String())
+	}
+	for _, group := range groupOrder {
+		path := rules.Escape(group) + ".hosts"
+		hosts := added[group]
+		if existing := gjson.Get(inv.json, path); existing.Exists() {
+			var prior []string
+			for _, h := range existing.Array() {
+				prior = append(prior, h.String())
+			}
+			hosts = append(prior, hosts...)
+		}
+		var err error
+		inv.json, err = sjson.Set(inv.json, path, hosts)
+		if err != nil {
+			inv.jsonFailed(path, err)
+		}
+	}
+}
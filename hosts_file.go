@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+
+	"github.com/tidwall/gjson"
+)
+
+// hostsFile returns the name of a local Satellite hosts export to build the inventory from, or an empty string if
+// hosts are read from the Satellite API.  The --from-file flag takes precedence over the from_file option.
+func hostsFile() string {
+	if flags.FromFile != "" {
+		return flags.FromFile
+	}
+	return cfg.FromFile
+}
+
+// readHostsFile reads a Satellite hosts export.  The file can either be a copy of an /api/v2/hosts response or a
+// JSON array of host records.
+func readHostsFile(filename string) (gjson.Result, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	if !gjson.ValidBytes(b) {
+		return gjson.Result{}, fmt.Errorf("%s does not contain valid JSON", filename)
+	}
+	gj := gjson.ParseBytes(b)
+	if gj.IsArray() {
+		return gjson.Parse(fmt.Sprintf(`{"results":%s}`, gj.Raw)), nil
+	}
+	if !gj.Get("results").IsArray() {
+		return gjson.Result{}, fmt.Errorf("%s contains no results array", filename)
+	}
+	return gj, nil
+}
+
+// getHosts returns the Satellite hosts, either from the hosts file or from the API (via the cache).
+func (inv *inventory) getHosts() (gjson.Result, error) {
+	if hostsFile() != "" {
+		return readHostsFile(hostsFile())
+	}
+	return inv.getPages("hosts", hostsPageURL, inv.registerHostsPage)
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/jlog"
+)
+
+// journalLogger returns a logger that writes to the systemd journal, or false if the journal isn't available.
+func journalLogger(level int) (log.Logger, bool) {
+	if !jlog.Enabled() {
+		return nil, false
+	}
+	return jlog.NewJournal(level), true
+}
@@ -0,0 +1,8 @@
+package main
+
+import "github.com/Masterminds/log-go"
+
+// journalLogger returns false, as there's no systemd journal on Windows.
+func journalLogger(level int) (log.Logger, bool) {
+	return nil, false
+}
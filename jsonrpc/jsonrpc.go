@@ -0,0 +1,158 @@
+// jsonrpc provides a minimal JSON-RPC 2.0 server over HTTP
+package jsonrpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Standard JSON-RPC 2.0 error codes
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+)
+
+// maxRequestBytes limits the size of a request body
+const maxRequestBytes int64 = 1 << 20
+
+// Error is a JSON-RPC error.  Handlers may return one to control the code reported to the caller; any other error is
+// reported as an internal error.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// InvalidParams returns an Error reporting that a method's parameters are invalid.
+func InvalidParams(format string, args ...interface{}) *Error {
+	return &Error{Code: CodeInvalidParams, Message: fmt.Sprintf(format, args...)}
+}
+
+// Handler implements a method.  It's passed the raw params of the request and returns a result that can be encoded
+// as JSON.
+type Handler func(params json.RawMessage) (interface{}, error)
+
+type request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+	ID      json.RawMessage `json:"id"`
+}
+
+type response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// Server dispatches JSON-RPC requests, POSTed over HTTP, to registered methods.  It's safe for concurrent use.
+type Server struct {
+	mu      sync.RWMutex
+	methods map[string]Handler
+}
+
+// NewServer returns a Server with no methods.
+func NewServer() *Server {
+	return &Server{methods: make(map[string]Handler)}
+}
+
+// Register associates a method name with a Handler.
+func (s *Server) Register(method string, h Handler) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.methods[method] = h
+}
+
+// Methods returns the sorted names of the registered methods.
+func (s *Server) Methods() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var names []string
+	for name := range s.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// call executes a single request.
+func (s *Server) call(req request) response {
+	resp := response{JSONRPC: "2.0", ID: req.ID}
+	if resp.ID == nil {
+		resp.ID = json.RawMessage("null")
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		resp.Error = &Error{Code: CodeInvalidRequest, Message: "invalid request"}
+		return resp
+	}
+	s.mu.RLock()
+	h, ok := s.methods[req.Method]
+	s.mu.RUnlock()
+	if !ok {
+		resp.Error = &Error{Code: CodeMethodNotFound, Message: fmt.Sprintf("method not found: %s", req.Method)}
+		return resp
+	}
+	result, err := h(req.Params)
+	if err != nil {
+		rpcErr, ok := err.(*Error)
+		if !ok {
+			rpcErr = &Error{Code: CodeInternalError, Message: err.Error()}
+		}
+		resp.Error = rpcErr
+		return resp
+	}
+	if result == nil {
+		result = struct{}{}
+	}
+	resp.Result = result
+	return resp
+}
+
+// ServeHTTP decodes a request, or a batch of requests, and writes the response(s).
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "JSON-RPC requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	var raw json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(&raw); err != nil {
+		writeJSON(w, response{JSONRPC: "2.0", Error: &Error{Code: CodeParseError, Message: err.Error()}, ID: json.RawMessage("null")})
+		return
+	}
+	if len(raw) > 0 && raw[0] == '[' {
+		var reqs []request
+		if err := json.Unmarshal(raw, &reqs); err != nil || len(reqs) == 0 {
+			writeJSON(w, response{JSONRPC: "2.0", Error: &Error{Code: CodeInvalidRequest, Message: "invalid batch"}, ID: json.RawMessage("null")})
+			return
+		}
+		resps := make([]response, 0, len(reqs))
+		for _, req := range reqs {
+			resps = append(resps, s.call(req))
+		}
+		writeJSON(w, resps)
+		return
+	}
+	var req request
+	if err := json.Unmarshal(raw, &req); err != nil {
+		writeJSON(w, response{JSONRPC: "2.0", Error: &Error{Code: CodeInvalidRequest, Message: err.Error()}, ID: json.RawMessage("null")})
+		return
+	}
+	writeJSON(w, s.call(req))
+}
+
+// writeJSON encodes a response body.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
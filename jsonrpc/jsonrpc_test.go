@@ -0,0 +1,79 @@
+package jsonrpc
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func post(t *testing.T, url, body string) gjson.Result {
+	t.Helper()
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("POST returned: %v", err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Unable to read response: %v", err)
+	}
+	return gjson.ParseBytes(b)
+}
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	s.Register("echo", func(params json.RawMessage) (interface{}, error) {
+		var p struct {
+			Text string `json:"text"`
+		}
+		if err := json.Unmarshal(params, &p); err != nil || p.Text == "" {
+			return nil, InvalidParams("text is required")
+		}
+		return p.Text, nil
+	})
+	s.Register("fail", func(params json.RawMessage) (interface{}, error) {
+		return nil, errors.New("broken")
+	})
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	tests := []struct {
+		body string
+		path string
+		want string
+	}{
+		{`{"jsonrpc":"2.0","method":"echo","params":{"text":"hi"},"id":1}`, "result", "hi"},
+		{`{"jsonrpc":"2.0","method":"echo","params":{},"id":2}`, "error.code", "-32602"},
+		{`{"jsonrpc":"2.0","method":"fail","id":3}`, "error.message", "broken"},
+		{`{"jsonrpc":"2.0","method":"missing","id":4}`, "error.code", "-32601"},
+		{`{"method":"echo","id":5}`, "error.code", "-32600"},
+		{`{not json`, "error.code", "-32700"},
+		{`[{"jsonrpc":"2.0","method":"echo","params":{"text":"a"},"id":1},{"jsonrpc":"2.0","method":"echo","params":{"text":"b"},"id":2}]`, "#.result", `["a","b"]`},
+	}
+	for _, tt := range tests {
+		got := post(t, ts.URL, tt.body).Get(tt.path)
+		if got.String() != tt.want && got.Raw != tt.want {
+			t.Errorf("%s: Expected %s=%s, got %s", tt.body, tt.path, tt.want, got.Raw)
+		}
+	}
+	if post(t, ts.URL, `{"jsonrpc":"2.0","method":"echo","params":{"text":"x"},"id":"abc"}`).Get("id").String() != "abc" {
+		t.Error("Response should echo the request ID")
+	}
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected GET to be rejected, got %d", resp.StatusCode)
+	}
+	if m := s.Methods(); len(m) != 2 || m[0] != "echo" {
+		t.Errorf("Unexpected methods: %v", m)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Masterminds/log-go"
+)
+
+// hostKeyFacts maps the Satellite facts known to contain SSH host keys to their key types.
+var hostKeyFacts = map[string]string{
+	"sshrsakey":                           "ssh-rsa",
+	"sshecdsakey":                         "ecdsa-sha2-nistp256",
+	"sshed25519key":                       "ssh-ed25519",
+	"ssh::rsa::key":                       "ssh-rsa",
+	"ssh::ecdsa::key":                     "ecdsa-sha2-nistp256",
+	"ssh::ed25519::key":                   "ssh-ed25519",
+	"ansible_ssh_host_key_rsa_public":     "ssh-rsa",
+	"ansible_ssh_host_key_ecdsa_public":   "ecdsa-sha2-nistp256",
+	"ansible_ssh_host_key_ed25519_public": "ssh-ed25519",
+}
+
+// knownHostNames returns the comma separated list of names by which a host may be known to SSH.
+func knownHostNames(h exportHost) string {
+	names := []string{h.name}
+	for _, n := range []string{h.fqdn, h.ip} {
+		if n != "" && !containsStr(n, names) {
+			names = append(names, n)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// factHostKeys returns known_hosts lines for the host keys found in a host's Satellite facts.  These are only
+// available when the facts enricher is enabled.
+func factHostKeys(h exportHost) []string {
+	facts := h.hostvars.Get("satinv_facts")
+	if !facts.Exists() {
+		return nil
+	}
+	// Iterate through the facts in a consistent order
+	var factNames []string
+	for f := range hostKeyFacts {
+		factNames = append(factNames, f)
+	}
+	sort.Strings(factNames)
+	var lines []string
+	seen := make(map[string]bool)
+	for _, f := range factNames {
+		key := facts.Get(strings.ReplaceAll(f, ".", `\.`))
+		if !key.Exists() || key.String() == "" || seen[key.String()] {
+			continue
+		}
+		seen[key.String()] = true
+		lines = append(lines, fmt.Sprintf("%s %s %s", knownHostNames(h), hostKeyFacts[f], key.String()))
+	}
+	return lines
+}
+
+// keyscan uses ssh-keyscan to collect the host keys of a host.
+func keyscan(h exportHost, timeout int) ([]string, error) {
+	target := h.fqdn
+	if target == "" {
+		target = h.name
+	}
+	out, err := exec.Command("ssh-keyscan", "-T", strconv.Itoa(timeout), target).Output()
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s", knownHostNames(h), fields[1], fields[2]))
+	}
+	return lines, nil
+}
+
+// exportKnownHosts writes an OpenSSH known_hosts file containing the host keys of inventory hosts.  Keys are taken from
+// Satellite facts and, optionally, by scanning hosts that have no keys in their facts.
+func exportKnownHosts(args []string) error {
+	fs := flag.NewFlagSet("known-hosts", flag.ContinueOnError)
+	output := fs.String("output", "", "File to write (default stdout)")
+	group := fs.String("group", "", "Only include hosts in this inventory group")
+	scan := fs.Bool("keyscan", false, "Use ssh-keyscan for hosts without keys in their facts")
+	concurrency := fs.Int("concurrency", 8, "Maximum number of simultaneous ssh-keyscan processes")
+	timeout := fs.Int("timeout", 5, "ssh-keyscan timeout in seconds")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *concurrency < 1 {
+		*concurrency = 1
+	}
+	inv, err := newInventory()
+	if err != nil {
+		return err
+	}
+	defer inv.close()
+	if err := inv.load(); err != nil {
+		return err
+	}
+	hosts := exportHosts(inv.json, *group)
+	keys := make([][]string, len(hosts))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, *concurrency)
+	for i, h := range hosts {
+		keys[i] = factHostKeys(h)
+		if len(keys[i]) > 0 || !*scan {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, h exportHost) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			lines, err := keyscan(h, *timeout)
+			if err != nil {
+				log.Warnf("ssh-keyscan failed for %s: %v", h.name, err)
+				return
+			}
+			keys[i] = lines
+		}(i, h)
+	}
+	wg.Wait()
+	w, err := exportWriter(*output)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	var count int
+	for i, h := range hosts {
+		if len(keys[i]) == 0 {
+			log.Infof("No host keys found for %s", h.name)
+			continue
+		}
+		for _, line := range keys[i] {
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+		}
+		count++
+	}
+	log.Infof("Exported known_hosts entries for %d of %d hosts", count, len(hosts))
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+)
+
+// systemdListenFD is the first file descriptor passed by systemd socket activation
+const systemdListenFD = 3
+
+// listen returns a listener for the serve command's listen address: A TCP address (e.g. 127.0.0.1:8086), "unix:"
+// followed by the path of a unix socket, or "systemd" for a socket passed by systemd socket activation.
+func listen(addr string) (net.Listener, error) {
+	if addr == "systemd" {
+		return systemdListener()
+	}
+	if strings.HasPrefix(addr, "unix:") {
+		return unixListener(strings.TrimPrefix(addr, "unix:"))
+	}
+	return net.Listen("tcp", addr)
+}
+
+// unixListener listens on a unix socket, replacing any socket left behind by a previous instance.  The socket is given
+// the configured permissions and group, so that a web server can be allowed to connect to it.
+func unixListener(path string) (net.Listener, error) {
+	if path == "" {
+		return nil, errors.New("no unix socket path given")
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	perms, err := cfg.SocketPerms()
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	if perms.Mode != 0 {
+		err = os.Chmod(path, perms.Mode)
+	}
+	if err == nil && perms.GID != -1 {
+		err = os.Chown(path, -1, perms.GID)
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// systemdListener returns the first socket passed by systemd socket activation (see sd_listen_fds(3)).  The
+// environment variables describing the sockets are unset, so they aren't inherited by child processes.
+func systemdListener() (net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no sockets were passed by systemd socket activation")
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, errors.New("no sockets were passed by systemd socket activation")
+	}
+	if fds > 1 {
+		log.Warnf("systemd passed %d sockets.  Only the first will be used.", fds)
+	}
+	f := os.NewFile(systemdListenFD, "systemd")
+	defer f.Close()
+	return net.FileListener(f)
+}
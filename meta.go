@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/tidwall/sjson"
+)
+
+// metaGroup is the key of the satinv_meta object in the inventory.  It takes the form of a group without hosts, whose
+// vars describe the refresh, so that Ansible accepts the inventory and no host inherits them.
+const metaGroup = "_satinv_meta"
+
+// maxMetaWarnings limits the warnings listed in the satinv_meta object, so that a problem affecting every host can't
+// swamp the inventory.
+const maxMetaWarnings = 100
+
+// warningLogger passes messages to another logger, recording those logged at warning level.  It's safe for concurrent
+// use.
+type warningLogger struct {
+	log.Logger
+	mu       sync.Mutex
+	warnings []string
+	dropped  int // Warnings not recorded because maxMetaWarnings was reached
+}
+
+// warnings records the warnings logged during each refresh, once recordWarnings has installed it
+var warnings = &warningLogger{}
+
+// recordWarnings returns a logger that records the warnings logged to l.
+func recordWarnings(l log.Logger) log.Logger {
+	warnings.mu.Lock()
+	defer warnings.mu.Unlock()
+	warnings.Logger = l
+	return warnings
+}
+
+func (w *warningLogger) record(msg string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.warnings) >= maxMetaWarnings {
+		w.dropped++
+		return
+	}
+	w.warnings = append(w.warnings, msg)
+}
+
+func (w *warningLogger) Warn(msg ...interface{}) {
+	w.record(fmt.Sprint(msg...))
+	w.Logger.Warn(msg...)
+}
+
+func (w *warningLogger) Warnf(template string, args ...interface{}) {
+	w.record(fmt.Sprintf(template, args...))
+	w.Logger.Warnf(template, args...)
+}
+
+func (w *warningLogger) Warnw(msg string, fields log.Fields) {
+	w.record(msg)
+	w.Logger.Warnw(msg, fields)
+}
+
+// reset discards the recorded warnings, at the start of a refresh.
+func (w *warningLogger) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.warnings = nil
+	w.dropped = 0
+}
+
+// recorded returns the warnings recorded since the last reset.
+func (w *warningLogger) recorded() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	recorded := append([]string{}, w.warnings...)
+	if w.dropped > 0 {
+		recorded = append(recorded, fmt.Sprintf("%d more warnings omitted", w.dropped))
+	}
+	return recorded
+}
+
+// metaSource returns the source of the hosts in the inventory: The Satellite API or, with from_file, the hosts file.
+func metaSource() string {
+	if hostsFile() != "" {
+		return "file://" + hostsFile()
+	}
+	return cfg.API.BaseURL
+}
+
+// addMeta adds the satinv_meta object to the inventory, if output satinv_meta is enabled: The time it was generated,
+// the source of its hosts, the number of hosts and groups and the warnings logged while it was built.  Downstream
+// automation can then check the inventory's freshness from the inventory alone.
+func (inv *inventory) addMeta() {
+	if !cfg.Output.SatinvMeta {
+		return
+	}
+	counts := map[string]int{
+		"hosts":       hostCount(inv.json),
+		"groups":      len(groupCounts(inv.json)),
+		"collections": len(inv.collections),
+	}
+	if r := inv.run; r != nil {
+		r.mu.Lock()
+		counts["valid"] = r.valid
+		counts["excluded"] = r.hosts - r.valid
+		r.mu.Unlock()
+	}
+	meta := map[string]interface{}{
+		"generated_at": time.Now().UTC().Format(time.RFC3339),
+		"source":       metaSource(),
+		"counts":       counts,
+		"warnings":     warnings.recorded(),
+	}
+	var err error
+	inv.json, err = sjson.Set(inv.json, metaGroup+".vars", meta)
+	if err != nil {
+		inv.jsonFailed(metaGroup+".vars", err)
+	}
+}
@@ -1,7 +1,7 @@
 package multire
 
 import (
-	"log"
+	"fmt"
 	"regexp"
 )
 
@@ -11,29 +11,34 @@ type MultiRE struct {
 }
 
 // compileRE is an internal function that compiles a string into a Regular Expression
-func compileRE(s string) *regexp.Regexp {
+func compileRE(s string) (*regexp.Regexp, error) {
 	cre, err := regexp.Compile(s)
 	if err != nil {
-		log.Fatalf("Unable to compile Regex: %s", s)
+		return nil, fmt.Errorf("unable to compile regex %q: %v", s, err)
 	}
-	return cre
+	return cre, nil
 }
 
 // InitRegex contructs a new instance of multiRE and populates it with compiled Regular Expressions.
 // The Expressions are based on a provided string slice.
-func InitRegex(regexStrings []string) MultiRE {
+func InitRegex(regexStrings []string) (MultiRE, error) {
 	regexList := new(MultiRE)
 	for _, s := range regexStrings {
-		cre := compileRE(s)
-		regexList.res = append(regexList.res, *cre)
+		if err := regexList.Extend(s); err != nil {
+			return MultiRE{}, err
+		}
 	}
-	return *regexList
+	return *regexList, nil
 }
 
 // Extend adds a single Regular Expression to an existing multiRE instance
-func (mre *MultiRE) Extend(s string) {
-	cre := compileRE(s)
+func (mre *MultiRE) Extend(s string) error {
+	cre, err := compileRE(s)
+	if err != nil {
+		return err
+	}
 	mre.res = append(mre.res, *cre)
+	return nil
 }
 
 // Match returns true if a given string matches any Regular Expression in a multiRE instance
@@ -7,12 +7,27 @@ import (
 func TestRE(t *testing.T) {
 	var regexStrings []string
 	regexStrings = append(regexStrings, "^foo")
-	mre := InitRegex(regexStrings)
+	mre, err := InitRegex(regexStrings)
+	if err != nil {
+		t.Fatalf("InitRegex returned: %v", err)
+	}
 	if mre.Match("barfoo") {
 		t.Fatal("string \"barfoo\" shouldn't match the test Regex")
 	}
-	mre.Extend("^bar")
+	if err := mre.Extend("^bar"); err != nil {
+		t.Fatalf("Extend returned: %v", err)
+	}
 	if !mre.Match("barfoo") {
 		t.Fatal("string \"barfoo\" should match the test Regex")
 	}
 }
+
+func TestInvalidRE(t *testing.T) {
+	if _, err := InitRegex([]string{"^foo", "[bar"}); err == nil {
+		t.Error("Expected an error for an invalid Regex")
+	}
+	var mre MultiRE
+	if err := mre.Extend("(foo"); err == nil {
+		t.Error("Expected an error extending with an invalid Regex")
+	}
+}
@@ -0,0 +1,187 @@
+// notifier provides pluggable sinks for alerts and change notifications
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	// KindAlert events report a problem that requires attention
+	KindAlert string = "alert"
+	// KindChange events report a change to the inventory
+	KindChange string = "change"
+)
+
+// Event describes something worth notifying
+type Event struct {
+	Kind    string
+	Subject string
+	Body    string
+}
+
+// Notifier is implemented by each notification sink.
+type Notifier interface {
+	// Name returns a description of the Notifier, used in logging.
+	Name() string
+	// Notify delivers an Event.
+	Notify(e Event) error
+}
+
+// filtered is a Notifier that only delivers Events of particular kinds
+type filtered struct {
+	Notifier
+	kinds map[string]bool
+}
+
+// Filter returns a Notifier that only delivers Events of the given kinds.  If no kinds are given, all Events are
+// delivered.
+func Filter(n Notifier, kinds []string) Notifier {
+	if len(kinds) == 0 {
+		return n
+	}
+	f := &filtered{Notifier: n, kinds: make(map[string]bool)}
+	for _, k := range kinds {
+		f.kinds[k] = true
+	}
+	return f
+}
+
+// Notify delivers the Event if it's of a permitted kind.
+func (f *filtered) Notify(e Event) error {
+	if !f.kinds[e.Kind] {
+		return nil
+	}
+	return f.Notifier.Notify(e)
+}
+
+// smtpNotifier sends Events by email
+type smtpNotifier struct {
+	server   string // host:port
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+// NewSMTP returns a Notifier that emails Events via an SMTP server.  If a username is provided, PLAIN authentication
+// is used.
+func NewSMTP(server, from string, to []string, username, password string) (Notifier, error) {
+	if server == "" || from == "" || len(to) == 0 {
+		return nil, errors.New("smtp notifier requires a server, from and to")
+	}
+	if !strings.Contains(server, ":") {
+		server += ":25"
+	}
+	return &smtpNotifier{server: server, from: from, to: to, username: username, password: password}, nil
+}
+
+// Name returns a description of the Notifier.
+func (s *smtpNotifier) Name() string {
+	return "smtp:" + s.server
+}
+
+// Notify emails the Event to each recipient.
+func (s *smtpNotifier) Notify(e Event) error {
+	var auth smtp.Auth
+	if s.username != "" {
+		host, _, err := net.SplitHostPort(s.server)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.username, s.password, host)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", e.Subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(e.Body, "\n", "\r\n"))
+	msg.WriteString("\r\n")
+	return smtp.SendMail(s.server, auth, s.from, s.to, msg.Bytes())
+}
+
+// slackNotifier posts Events to a Slack incoming webhook
+type slackNotifier struct {
+	webhookURL string
+	client     *http.Client
+}
+
+// NewSlack returns a Notifier that posts Events to a Slack incoming webhook.
+func NewSlack(webhookURL string) (Notifier, error) {
+	if webhookURL == "" {
+		return nil, errors.New("slack notifier requires a webhook_url")
+	}
+	return &slackNotifier{webhookURL: webhookURL, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+// Name returns a description of the Notifier.
+func (s *slackNotifier) Name() string {
+	return "slack"
+}
+
+// Notify posts the Event to the webhook.
+func (s *slackNotifier) Notify(e Event) error {
+	payload, err := json.Marshal(map[string]string{"text": fmt.Sprintf("*%s*\n%s", e.Subject, e.Body)})
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.webhookURL, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("slack webhook returned: %s", resp.Status)
+	}
+	return nil
+}
+
+// execNotifier passes Events to an external command
+type execNotifier struct {
+	command []string
+	timeout time.Duration
+}
+
+// NewExec returns a Notifier that runs a command for each Event.  The Event's body is written to the command's stdin
+// and its kind and subject are passed in the SATINV_EVENT and SATINV_SUBJECT environment variables.
+func NewExec(command []string, timeout time.Duration) (Notifier, error) {
+	if len(command) == 0 {
+		return nil, errors.New("exec notifier requires a command")
+	}
+	return &execNotifier{command: command, timeout: timeout}, nil
+}
+
+// Name returns a description of the Notifier.
+func (x *execNotifier) Name() string {
+	return "exec:" + x.command[0]
+}
+
+// Notify runs the command.
+func (x *execNotifier) Notify(e Event) error {
+	ctx := context.Background()
+	if x.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, x.timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, x.command[0], x.command[1:]...)
+	cmd.Env = append(os.Environ(), "SATINV_EVENT="+e.Kind, "SATINV_SUBJECT="+e.Subject)
+	cmd.Stdin = strings.NewReader(e.Body)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
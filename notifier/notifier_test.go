@@ -0,0 +1,95 @@
+package notifier
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countNotifier counts the Events it receives
+type countNotifier struct {
+	count int
+}
+
+func (c *countNotifier) Name() string {
+	return "count"
+}
+
+func (c *countNotifier) Notify(e Event) error {
+	c.count++
+	return nil
+}
+
+func TestFilter(t *testing.T) {
+	c := new(countNotifier)
+	n := Filter(c, []string{KindAlert})
+	n.Notify(Event{Kind: KindAlert})
+	n.Notify(Event{Kind: KindChange})
+	if c.count != 1 {
+		t.Errorf("Expected 1 event to be delivered, got %d", c.count)
+	}
+	if Filter(c, nil) != Notifier(c) {
+		t.Error("An empty filter should return the original Notifier")
+	}
+}
+
+func TestSlack(t *testing.T) {
+	var text string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]string
+		json.NewDecoder(r.Body).Decode(&payload)
+		text = payload["text"]
+	}))
+	defer server.Close()
+	n, err := NewSlack(server.URL)
+	if err != nil {
+		t.Fatalf("NewSlack returned: %v", err)
+	}
+	if err := n.Notify(Event{Kind: KindAlert, Subject: "fake subject", Body: "fake body"}); err != nil {
+		t.Fatalf("Notify returned: %v", err)
+	}
+	if !strings.Contains(text, "fake subject") || !strings.Contains(text, "fake body") {
+		t.Errorf("Unexpected slack text: %s", text)
+	}
+}
+
+func TestExec(t *testing.T) {
+	dir, err := os.MkdirTemp("", "notifier")
+	if err != nil {
+		t.Fatalf("Unable to create TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	outFile := path.Join(dir, "out")
+	n, err := NewExec([]string{"/bin/sh", "-c", "echo $SATINV_EVENT $SATINV_SUBJECT > " + outFile + "; cat >> " + outFile}, time.Minute)
+	if err != nil {
+		t.Fatalf("NewExec returned: %v", err)
+	}
+	if err := n.Notify(Event{Kind: KindChange, Subject: "fake", Body: "fake body"}); err != nil {
+		t.Fatalf("Notify returned: %v", err)
+	}
+	b, err := os.ReadFile(outFile)
+	if err != nil {
+		t.Fatalf("Unable to read command output: %v", err)
+	}
+	if string(b) != "change fake\nfake body" {
+		t.Errorf("Unexpected command output: %q", string(b))
+	}
+}
+
+func TestNewSMTP(t *testing.T) {
+	if _, err := NewSMTP("", "from@fake", []string{"to@fake"}, "", ""); err == nil {
+		t.Error("Expected an error without a server")
+	}
+	n, err := NewSMTP("mail.fake", "from@fake", []string{"to@fake"}, "", "")
+	if err != nil {
+		t.Fatalf("NewSMTP returned: %v", err)
+	}
+	if n.Name() != "smtp:mail.fake:25" {
+		t.Errorf("Unexpected name: %s", n.Name())
+	}
+}
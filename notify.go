@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/notifier"
+)
+
+// defaultExecNotifierTimeout is the time permitted for a notification command to complete
+const defaultExecNotifierTimeout = time.Minute
+
+// buildNotifiers returns a Notifier for each of the configured notification sinks.
+func buildNotifiers() ([]notifier.Notifier, error) {
+	var notifiers []notifier.Notifier
+	for i, c := range cfg.Notifiers {
+		var n notifier.Notifier
+		var err error
+		switch c.Type {
+		case "smtp":
+			n, err = notifier.NewSMTP(c.Server, c.From, c.To, c.Username, c.Password)
+		case "slack":
+			n, err = notifier.NewSlack(c.WebhookURL)
+		case "exec":
+			timeout := defaultExecNotifierTimeout
+			if c.Timeout > 0 {
+				timeout = time.Duration(c.Timeout) * time.Second
+			}
+			n, err = notifier.NewExec(c.Command, timeout)
+		default:
+			err = fmt.Errorf("unknown type: %q", c.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("notifier %d: %v", i+1, err)
+		}
+		notifiers = append(notifiers, notifier.Filter(n, c.Events))
+	}
+	return notifiers, nil
+}
+
+// notify sends an Event to every Notifier.  Failures are logged but otherwise ignored; a broken notification sink
+// shouldn't prevent the inventory being produced.
+func (inv *inventory) notify(kind, subject, body string) {
+	if flags.DryRun && len(inv.notifiers) > 0 {
+		log.Infof("Dry run: not sending notification: %s", subject)
+		return
+	}
+	e := notifier.Event{Kind: kind, Subject: "satinv: " + subject, Body: body}
+	for _, n := range inv.notifiers {
+		if err := n.Notify(e); err != nil {
+			log.Warnf("Notification via %s failed: %v", n.Name(), err)
+		}
+	}
+}
+
+// inventoryChanges describes the differences in group membership counts between two inventories.
+func inventoryChanges(oldJSON, newJSON string) []string {
+	oldCounts := groupCounts(oldJSON)
+	newCounts := groupCounts(newJSON)
+	var changes []string
+	for g, n := range newCounts {
+		o, ok := oldCounts[g]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("%s: new group with %d hosts", g, n))
+		} else if o != n {
+			changes = append(changes, fmt.Sprintf("%s: %d -> %d hosts", g, o, n))
+		}
+	}
+	for g, o := range oldCounts {
+		if _, ok := newCounts[g]; !ok {
+			changes = append(changes, fmt.Sprintf("%s: removed (had %d hosts)", g, o))
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
+// notifyChanges compares a newly refreshed inventory with the one it replaces and sends a change notification if group
+// memberships have changed.
+func (inv *inventory) notifyChanges(previous string) {
+	if len(inv.notifiers) == 0 || previous == "" {
+		return
+	}
+	changes := inventoryChanges(previous, inv.json)
+	if len(changes) == 0 {
+		return
+	}
+	inv.notify(notifier.KindChange, fmt.Sprintf("%d inventory groups changed", len(changes)), strings.Join(changes, "\n"))
+}
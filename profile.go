@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/crooks/satinv/config"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// trustedProfile is the name of the built-in profile used for exporting inventories to less-trusted hosts.
+const trustedProfile string = "trusted"
+
+// defaultTrustedHostvars are the hostvars retained by the trusted profile, unless overridden in the config.  They're
+// limited to what's required to connect to a host.
+var defaultTrustedHostvars = []string{
+	"name",
+	"ip",
+	"ip6",
+	"domain_name",
+	"operatingsystem_name",
+	"architecture_name",
+}
+
+// getProfile returns a named export profile from the config, falling back to the built-in trusted profile.
+func getProfile(name string) (config.Profile, error) {
+	if p, ok := cfg.Profiles[name]; ok {
+		return p, nil
+	}
+	if name == trustedProfile {
+		return config.Profile{Hostvars: defaultTrustedHostvars}, nil
+	}
+	return config.Profile{}, fmt.Errorf("unknown profile: %s", name)
+}
+
+// applyProfile returns a copy of an inventory where each host's hostvars are reduced to only those permitted by the
+// named profile.  Group memberships are unaffected.
+func applyProfile(invJSON, name string) (string, error) {
+	profile, err := getProfile(name)
+	if err != nil {
+		return "", err
+	}
+	out, err := sjson.Delete(invJSON, "_meta.hostvars")
+	if err != nil {
+		return "", err
+	}
+	out, err = sjson.Set(out, "_meta.hostvars", map[string]interface{}{})
+	if err != nil {
+		return "", err
+	}
+	gjson.Get(invJSON, "_meta.hostvars").ForEach(func(host, hostvars gjson.Result) bool {
+		hostKey := hostvarsPath(host.String())
+		out, err = sjson.Set(out, hostKey, map[string]interface{}{})
+		if err != nil {
+			return false
+		}
+		for _, p := range profile.Hostvars {
+			v := hostvars.Get(p)
+			if !v.Exists() {
+				continue
+			}
+			out, err = sjson.SetRaw(out, fmt.Sprintf("%s.%s", hostKey, p), v.Raw)
+			if err != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+	return out, nil
+}
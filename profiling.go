@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	rpprof "runtime/pprof"
+	"runtime/trace"
+
+	"github.com/Masterminds/log-go"
+)
+
+// startProfiling starts the CPU profile and execution trace requested by the --pprof-cpu and --trace flags.  The
+// returned function stops them and writes the heap profile requested by --pprof-mem.  It's safe to call more than once.
+func startProfiling() (func(), error) {
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	if flags.PprofCPU != "" {
+		f, err := os.Create(flags.PprofCPU)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create CPU profile: %v", err)
+		}
+		files = append(files, f)
+		if err := rpprof.StartCPUProfile(f); err != nil {
+			closeAll()
+			return nil, fmt.Errorf("unable to start CPU profile: %v", err)
+		}
+	}
+	if flags.Trace != "" {
+		f, err := os.Create(flags.Trace)
+		if err != nil {
+			rpprof.StopCPUProfile()
+			closeAll()
+			return nil, fmt.Errorf("unable to create trace: %v", err)
+		}
+		files = append(files, f)
+		if err := trace.Start(f); err != nil {
+			rpprof.StopCPUProfile()
+			closeAll()
+			return nil, fmt.Errorf("unable to start trace: %v", err)
+		}
+	}
+	stopped := false
+	return func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		if flags.PprofCPU != "" {
+			rpprof.StopCPUProfile()
+			log.Infof("CPU profile written to %s", flags.PprofCPU)
+		}
+		if flags.Trace != "" {
+			trace.Stop()
+			log.Infof("Execution trace written to %s", flags.Trace)
+		}
+		closeAll()
+		if flags.PprofMem != "" {
+			writeHeapProfile(flags.PprofMem)
+		}
+	}, nil
+}
+
+// writeHeapProfile writes a profile of the memory allocated by live objects to filename.
+func writeHeapProfile(filename string) {
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Warnf("Unable to create memory profile: %v", err)
+		return
+	}
+	defer f.Close()
+	// Collect garbage first so the profile reflects live objects
+	runtime.GC()
+	if err := rpprof.WriteHeapProfile(f); err != nil {
+		log.Warnf("Unable to write memory profile: %v", err)
+		return
+	}
+	log.Infof("Memory profile written to %s", filename)
+}
+
+// pprofHandlers registers the net/http/pprof handlers under /debug/pprof/.
+func pprofHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"runtime/trace"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/tracing"
+)
+
+// progressInterval is the longest time between progress reports, regardless of how little progress has been made
+const progressInterval = 10 * time.Second
+
+// progress logs the advance of a long-running loop: Each time another 10% of the items have been processed, or at
+// least every progressInterval.  It's safe for concurrent use.
+type progress struct {
+	mu       sync.Mutex
+	name     string
+	unit     string
+	total    int
+	done     int
+	nextPct  int
+	lastTime time.Time
+}
+
+// newProgress returns a progress report of a loop over total items.
+func newProgress(name, unit string, total int) *progress {
+	return &progress{name: name, unit: unit, total: total, nextPct: 10, lastTime: time.Now()}
+}
+
+// step records that another item has been processed.
+func (p *progress) step() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done++
+	if p.total <= 0 {
+		return
+	}
+	pct := p.done * 100 / p.total
+	if pct < p.nextPct && time.Since(p.lastTime) < progressInterval {
+		return
+	}
+	log.Infof("%s: %d/%d %s processed (%d%%)", p.name, p.done, p.total, p.unit, pct)
+	for p.nextPct <= pct {
+		p.nextPct += 10
+	}
+	p.lastTime = time.Now()
+}
+
+// phaseDuration is the time taken by a phase of an inventory refresh
+type phaseDuration struct {
+	phase    string
+	duration time.Duration
+}
+
+// runStats collects the figures reported in the summary of an inventory refresh.  It's safe for concurrent use.
+type runStats struct {
+	mu         sync.Mutex
+	start      time.Time
+	ctx        context.Context // Carries the span of the whole refresh
+	span       *tracing.Span
+	phase      string
+	phaseStart time.Time
+	phaseSpan  *tracing.Span
+	region     *trace.Region // Marks the current phase in an execution trace
+	phases     []phaseDuration
+	hosts      int            // Satellite hosts processed
+	valid      int            // Hosts in the principal valid group
+	excluded   map[string]int // Hosts excluded from the principal valid group, by the first check they failed
+}
+
+// newRunStats begins the statistics, and the tracing span, of a refresh.  The span's Context is derived from ctx.
+func newRunStats(ctx context.Context) *runStats {
+	now := time.Now()
+	r := &runStats{start: now, phaseStart: now, excluded: make(map[string]int)}
+	r.ctx, r.span = tracing.Start(ctx, "refreshInventory", tracing.KindInternal)
+	return r
+}
+
+// enter records the start of a new phase and returns a Context carrying the phase's tracing span.  When an execution
+// trace is being written (see --trace), each phase is also marked as a region of the trace.
+func (r *runStats) enter(phase string) context.Context {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.endPhase()
+	r.phase = phase
+	r.phaseStart = time.Now()
+	r.region = trace.StartRegion(r.ctx, phase)
+	var ctx context.Context
+	ctx, r.phaseSpan = tracing.Start(r.ctx, phase, tracing.KindInternal)
+	return ctx
+}
+
+// endPhase records the duration of the current phase.  It must be called with mu held.
+func (r *runStats) endPhase() {
+	if r.phase != "" {
+		r.phases = append(r.phases, phaseDuration{r.phase, time.Since(r.phaseStart)})
+		r.phase = ""
+		r.region.End()
+		r.phaseSpan.End()
+	}
+}
+
+// host records the outcome of evaluating a host against the principal valid group.  failed is the first check it
+// failed, or nil if it's valid.
+func (r *runStats) host(failed *validCheck) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.hosts++
+	if failed == nil {
+		r.valid++
+		return
+	}
+	r.excluded[failed.name]++
+}
+
+// logSummary logs the summary of a completed refresh as a single structured message.
+func (inv *inventory) logSummary() {
+	r := inv.run
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.endPhase()
+	var excluded []string
+	for reason, n := range r.excluded {
+		excluded = append(excluded, reason+"="+strconv.Itoa(n))
+	}
+	sort.Strings(excluded)
+	var phases []string
+	for _, p := range r.phases {
+		phases = append(phases, p.phase+"="+p.duration.Round(time.Millisecond).String())
+	}
+	r.span.SetAttribute("satinv.hosts", r.hosts)
+	r.span.SetAttribute("satinv.valid", r.valid)
+	r.span.SetAttribute("satinv.groups", len(inv.children))
+	r.span.End()
+	log.Infow("Inventory refresh summary", log.Fields{
+		"hosts":       r.hosts,
+		"valid":       r.valid,
+		"excluded":    strings.Join(excluded, ","),
+		"groups":      len(inv.children),
+		"phases":      strings.Join(phases, ","),
+		"duration":    time.Since(r.start).Round(time.Millisecond).String(),
+		"collections": len(inv.collections),
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/Masterminds/log-go"
+)
+
+// minRefreshLockAge is the minimum age at which a background refresh's lock is presumed to have been abandoned
+const minRefreshLockAge = time.Hour
+
+// refreshLockAge returns the age at which a background refresh's lock is presumed to have been abandoned: Twice the
+// build timeout, or minRefreshLockAge if that's longer.
+func refreshLockAge() time.Duration {
+	if age := 2 * time.Duration(cfg.Build.Timeout) * time.Second; age > minRefreshLockAge {
+		return age
+	}
+	return minRefreshLockAge
+}
+
+// startRefreshAhead starts a background refresh if the cached inventory will expire within refresh_ahead_percent of
+// its validity.  The inventory has already been output, so the caller doesn't wait for the refresh, and the next run
+// finds a fresh inventory in the cache.
+func (inv *inventory) startRefreshAhead() {
+	percent := cfg.Cache.RefreshAheadPercent
+	if percent <= 0 || flags.RefreshAhead || flags.Refresh || !cfg.CacheOnDisk() || hostsFile() != "" {
+		return
+	}
+	if soon, err := inv.cache.ExpiresSoon(inventoryName, percent); err != nil || !soon {
+		return
+	}
+	locked, err := inv.cache.LockRefresh(refreshLockAge())
+	if err != nil {
+		log.Warnf("Unable to lock the cache for a background refresh: %v", err)
+		return
+	}
+	if !locked {
+		log.Debug("A background refresh is already running")
+		return
+	}
+	exe, err := os.Executable()
+	if err == nil {
+		args := []string{"--config=" + flags.Config, "--refresh-ahead"}
+		if flags.ConfigFormat != "" {
+			args = append(args, "--config-format="+flags.ConfigFormat)
+		}
+		// The refresh is given none of the standard streams, so it doesn't hold Ansible's pipes open
+		cmd := exec.Command(exe, args...)
+		if err = cmd.Start(); err == nil {
+			log.Infof("Started a background refresh of the inventory ahead of its expiry (pid %d)", cmd.Process.Pid)
+			cmd.Process.Release()
+			return
+		}
+	}
+	log.Warnf("Unable to start a background refresh: %v", err)
+	inv.cache.UnlockRefresh()
+}
+
+// refreshAhead is the background refresh started by startRefreshAhead.  Cache items that will expire within
+// refresh_ahead_percent of their validity are refreshed, as though they had expired.  Nothing is output.
+func (inv *inventory) refreshAhead() error {
+	defer inv.cache.UnlockRefresh()
+	inv.cache.SetRefreshAhead(cfg.Cache.RefreshAheadPercent)
+	return inv.load()
+}
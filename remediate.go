@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/config"
+	"github.com/crooks/satinv/notifier"
+	"github.com/crooks/satinv/rules"
+	"github.com/tidwall/gjson"
+)
+
+// remediationName is the cache item recording when each host was last remediated
+const remediationName = "remediation"
+
+// remediationRecord describes the remediation jobs triggered within the cooldown
+type remediationRecord struct {
+	Hosts map[string]time.Time `json:"hosts"` // Keyed by Satellite host name
+}
+
+// lastRemediation returns the record of recent remediation jobs.  It's empty if no job has been recorded.
+func (inv *inventory) lastRemediation() remediationRecord {
+	r := remediationRecord{Hosts: make(map[string]time.Time)}
+	b, err := inv.cache.GetFile(remediationName)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Warnf("Unable to read %s: %v", remediationName, err)
+		}
+		return r
+	}
+	if err := json.Unmarshal(b, &r); err != nil {
+		log.Warnf("Unable to decode %s: %v", remediationName, err)
+	}
+	if r.Hosts == nil {
+		r.Hosts = make(map[string]time.Time)
+	}
+	return r
+}
+
+// recordRemediation records that a job was triggered against hosts, forgetting those remediated before the cooldown.
+func (inv *inventory) recordRemediation(r remediationRecord, hosts []string) {
+	now := time.Now().UTC()
+	for name, t := range r.Hosts {
+		if now.Sub(t) >= cooldown() {
+			delete(r.Hosts, name)
+		}
+	}
+	for _, name := range hosts {
+		r.Hosts[name] = now
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Warnf("Unable to encode %s: %v", remediationName, err)
+		return
+	}
+	if err := inv.cache.PutFile(remediationName, b); err != nil {
+		log.Warnf("Unable to write %s: %v", remediationName, err)
+	}
+}
+
+// cooldown returns the period before a host is remediated again.
+func cooldown() time.Duration {
+	return time.Duration(cfg.Remediation.Cooldown) * time.Second
+}
+
+// remediationGroup returns the inventory group targeted by remediation.  It defaults to the group of stale hosts.
+func remediationGroup() string {
+	if cfg.Remediation.Group != "" {
+		return cfg.Remediation.Group
+	}
+	return mkInventoryName(config.GroupStale, "stale")
+}
+
+// jobTemplateID returns the ID of a Satellite Remote Execution Job Template, looked up by name.
+func (inv *inventory) jobTemplateID(name string) (int64, error) {
+	search := url.QueryEscape(fmt.Sprintf("name=\"%s\"", name))
+	templates, err := inv.cache.Query(fmt.Sprintf("%s/api/v2/job_templates?search=%s", cfg.API.BaseURL, search))
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range templates.Get("results").Array() {
+		if t.Get("name").String() == name {
+			return t.Get("id").Int(), nil
+		}
+	}
+	return 0, fmt.Errorf("job template not found: %s", name)
+}
+
+// remediate triggers a Satellite Remote Execution job against the hosts in the remediation group, less those
+// remediated within the cooldown.
+func (inv *inventory) remediate() error {
+	if cfg.Remediation.JobTemplate == "" {
+		return errors.New("no job_template defined")
+	}
+	group := remediationGroup()
+	// Satellite identifies hosts by their full name so convert each inventory hostname back to it.
+	var names []string
+	for _, h := range gjson.Get(inv.json, rules.Escape(group)+".hosts").Array() {
+		name := gjson.Get(inv.json, hostvarsPath(h.String())+".name")
+		if !name.Exists() {
+			log.Warnf("Remediation: no hostvars found for %s", h.String())
+			continue
+		}
+		names = append(names, name.String())
+	}
+	if len(names) == 0 {
+		log.Debugf("Remediation: no hosts in group %s", group)
+		return nil
+	}
+	if len(names) > cfg.Remediation.MaxHosts {
+		return fmt.Errorf("group %s contains %d hosts, exceeding the limit of %d", group, len(names), cfg.Remediation.MaxHosts)
+	}
+	// Hosts remain in the group until the job has fixed them, so don't repeat the job on every refresh
+	record := inv.lastRemediation()
+	var due []string
+	for _, name := range names {
+		if t, ok := record.Hosts[name]; !ok || time.Since(t) >= cooldown() {
+			due = append(due, name)
+		}
+	}
+	if len(due) == 0 {
+		log.Infof("Remediation: all %d hosts in %s were remediated within the last %s", len(names), group, cooldown())
+		return nil
+	}
+	names = due
+	templateID, err := inv.jobTemplateID(cfg.Remediation.JobTemplate)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"job_invocation": map[string]interface{}{
+			"job_template_id": templateID,
+			"targeting_type":  "static_query",
+			"search_query":    fmt.Sprintf("name ^ (%s)", strings.Join(names, ",")),
+			"inputs":          cfg.Remediation.Inputs,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	job, err := inv.cache.Post(fmt.Sprintf("%s/api/v2/job_invocations", cfg.API.BaseURL), payload)
+	if err != nil {
+		return err
+	}
+	inv.recordRemediation(record, names)
+	log.Infof("Remediation: triggered job %s (template=%s) against %d hosts in %s", job.Get("id").String(), cfg.Remediation.JobTemplate, len(names), group)
+	inv.notify(notifier.KindChange, fmt.Sprintf("remediation job %s triggered", job.Get("id").String()),
+		fmt.Sprintf("Job Template %s was triggered against %d hosts in %s:\n%s", cfg.Remediation.JobTemplate, len(names), group, strings.Join(names, "\n")))
+	return nil
+}
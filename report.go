@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/tidwall/gjson"
+)
+
+// exclusion describes a host that isn't a member of a valid group and why
+type exclusion struct {
+	Host               string   `json:"host"`
+	FQDN               string   `json:"fqdn"`
+	Group              string   `json:"group"`
+	Reason             string   `json:"reason"` // The first check the host failed
+	Detail             string   `json:"detail"`
+	FailedChecks       []string `json:"failed_checks"` // Every check the host failed
+	OperatingSystem    string   `json:"operating_system"`
+	SubscriptionStatus string   `json:"subscription_status"`
+	LastCheckin        string   `json:"last_checkin"`
+	UpdatedAt          string   `json:"updated_at"`
+}
+
+// exclusionReport is the JSON form of the exclusions report
+type exclusionReport struct {
+	GeneratedAt string      `json:"generated_at"`
+	Exclusions  []exclusion `json:"exclusions"`
+}
+
+// uncollectedHost is a Satellite host that isn't a member of any Host Collection
+type uncollectedHost struct {
+	Host  string `json:"host"`
+	FQDN  string `json:"fqdn"`
+	Valid bool   `json:"valid"`
+}
+
+// invalidCollection is a Host Collection none of whose members are valid
+type invalidCollection struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+}
+
+// coverageReport is the JSON form of the coverage report
+type coverageReport struct {
+	GeneratedAt        string              `json:"generated_at"`
+	Group              string              `json:"group"`
+	UncollectedHosts   []uncollectedHost   `json:"uncollected_hosts"`
+	InvalidCollections []invalidCollection `json:"invalid_collections"`
+}
+
+// reportCommand executes the "report" subcommands.
+func reportCommand(args []string) error {
+	if len(args) == 0 {
+		return errors.New("report requires a type: coverage or exclusions")
+	}
+	switch args[0] {
+	case "coverage":
+		return reportCoverage(args[1:])
+	case "exclusions":
+		return reportExclusions(args[1:])
+	default:
+		return fmt.Errorf("unknown report: %s", args[0])
+	}
+}
+
+// reportHosts returns the Satellite hosts, having loaded the data needed to evaluate them against the valid rules.
+// Host Collections are loaded if they're required by valid_overrides or by the caller.
+func (inv *inventory) reportHosts(collections bool) (gjson.Result, error) {
+	if err := inv.initAPI(); err != nil {
+		return gjson.Result{}, err
+	}
+	hosts, err := inv.getHosts()
+	if err != nil {
+		return hosts, fmt.Errorf("unable to read hosts: %v", err)
+	}
+	inv.loadOrganizations()
+	inv.loadSubnets()
+	inv.loadExclusions(hosts)
+	if (collections || len(cfg.ValidOverrides) > 0) && hostsFile() == "" {
+		if err := inv.loadCollections(hosts); err != nil {
+			return hosts, fmt.Errorf("unable to read host collections: %v", err)
+		}
+	}
+	return hosts, nil
+}
+
+// exclusions evaluates every Satellite host against the rules of a valid group and returns those that fail.
+func (inv *inventory) exclusions(rules validRules) ([]exclusion, error) {
+	hosts, err := inv.reportHosts(false)
+	if err != nil {
+		return nil, err
+	}
+	var excluded []exclusion
+	for _, h := range hosts.Get("results").Array() {
+		if !h.Get("name").Exists() {
+			continue
+		}
+		hostNameShort := inventoryHostname(h.Get("name").String())
+		hostRules, _ := inv.hostRules(rules, hostNameShort, cidrGroups(h, inv.cidrs))
+		checks := inv.validChecks(h, hostNameShort, hostRules)
+		failed := firstFailure(checks)
+		if failed == nil {
+			continue
+		}
+		var failedChecks []string
+		for _, c := range checks {
+			if !c.passed {
+				failedChecks = append(failedChecks, c.name)
+			}
+		}
+		excluded = append(excluded, exclusion{
+			Host:               hostNameShort,
+			FQDN:               h.Get("name").String(),
+			Group:              rules.group,
+			Reason:             failed.name,
+			Detail:             failed.detail,
+			FailedChecks:       failedChecks,
+			OperatingSystem:    h.Get("operatingsystem_name").String(),
+			SubscriptionStatus: h.Get("subscription_status").String(),
+			LastCheckin:        h.Get("subscription_facet_attributes.last_checkin").String(),
+			UpdatedAt:          h.Get("updated_at").String(),
+		})
+	}
+	return excluded, nil
+}
+
+// reportRules returns the rules of the named valid group or, if no group is named, of the principal valid group.
+func (inv *inventory) reportRules(group string) (validRules, error) {
+	if group == "" {
+		return inv.validRules[0], nil
+	}
+	for _, r := range inv.validRules {
+		if r.group == group {
+			return r, nil
+		}
+	}
+	return validRules{}, fmt.Errorf("%s is not a valid group", group)
+}
+
+// reportExclusions writes a JSON or CSV report of every host excluded from a valid group.
+func reportExclusions(args []string) error {
+	fs := flag.NewFlagSet("exclusions", flag.ContinueOnError)
+	format := fs.String("format", "json", "Report format: json or csv")
+	output := fs.String("output", "", "File to write (default stdout)")
+	group := fs.String("group", "", "Valid group to report on (default the principal valid group)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("format must be one of json or csv, not %q", *format)
+	}
+	inv, err := newInventory()
+	if err != nil {
+		return err
+	}
+	defer inv.close()
+	rules, err := inv.reportRules(*group)
+	if err != nil {
+		return err
+	}
+	excluded, err := inv.exclusions(rules)
+	if err != nil {
+		return err
+	}
+	w, err := exportWriter(*output)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	log.Infof("Reporting %d hosts excluded from %s", len(excluded), rules.group)
+	if *format == "csv" {
+		c := csv.NewWriter(w)
+		c.Write([]string{"host", "fqdn", "group", "reason", "detail", "failed_checks", "operating_system", "subscription_status", "last_checkin", "updated_at"})
+		for _, e := range excluded {
+			c.Write([]string{e.Host, e.FQDN, e.Group, e.Reason, e.Detail, strings.Join(e.FailedChecks, ";"), e.OperatingSystem, e.SubscriptionStatus, e.LastCheckin, e.UpdatedAt})
+		}
+		c.Flush()
+		return c.Error()
+	}
+	if excluded == nil {
+		excluded = []exclusion{}
+	}
+	b, err := json.MarshalIndent(exclusionReport{GeneratedAt: time.Now().UTC().Format(time.RFC3339), Exclusions: excluded}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// coverage returns the Satellite hosts that aren't in any Host Collection and the Host Collections that have no
+// members that are valid under the rules of a valid group.
+func (inv *inventory) coverage(rules validRules) (uncollected []uncollectedHost, invalid []invalidCollection, err error) {
+	if hostsFile() != "" {
+		return nil, nil, errors.New("host collections are not available when reading hosts from a file")
+	}
+	hosts, err := inv.reportHosts(true)
+	if err != nil {
+		return nil, nil, err
+	}
+	valid := make(map[string]bool)
+	for _, h := range hosts.Get("results").Array() {
+		if !h.Get("name").Exists() {
+			continue
+		}
+		hostNameShort := inventoryHostname(h.Get("name").String())
+		hostRules, _ := inv.hostRules(rules, hostNameShort, cidrGroups(h, inv.cidrs))
+		valid[hostNameShort] = firstFailure(inv.validChecks(h, hostNameShort, hostRules)) == nil
+		if len(inv.memberOf[hostNameShort]) == 0 {
+			uncollected = append(uncollected, uncollectedHost{
+				Host:  hostNameShort,
+				FQDN:  h.Get("name").String(),
+				Valid: valid[hostNameShort],
+			})
+		}
+	}
+	for _, c := range inv.collections {
+		var anyValid bool
+		for _, m := range c.members {
+			anyValid = anyValid || valid[m]
+		}
+		if !anyValid {
+			// Host Collections can list a host more than once
+			members := []string{}
+			for _, m := range c.members {
+				if !containsStr(m, members) {
+					members = append(members, m)
+				}
+			}
+			invalid = append(invalid, invalidCollection{Name: c.name, Members: members})
+		}
+	}
+	return uncollected, invalid, nil
+}
+
+// reportCoverage writes a JSON or CSV report of the Satellite hosts that aren't in any Host Collection and the Host
+// Collections whose members are all invalid (including those with no members).
+func reportCoverage(args []string) error {
+	fs := flag.NewFlagSet("coverage", flag.ContinueOnError)
+	format := fs.String("format", "json", "Report format: json or csv")
+	output := fs.String("output", "", "File to write (default stdout)")
+	group := fs.String("group", "", "Valid group that members are evaluated against (default the principal valid group)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *format != "json" && *format != "csv" {
+		return fmt.Errorf("format must be one of json or csv, not %q", *format)
+	}
+	inv, err := newInventory()
+	if err != nil {
+		return err
+	}
+	defer inv.close()
+	rules, err := inv.reportRules(*group)
+	if err != nil {
+		return err
+	}
+	uncollected, invalid, err := inv.coverage(rules)
+	if err != nil {
+		return err
+	}
+	w, err := exportWriter(*output)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	log.Infof("Reporting %d hosts in no Host Collection and %d Host Collections with no %s members", len(uncollected), len(invalid), rules.group)
+	if *format == "csv" {
+		c := csv.NewWriter(w)
+		c.Write([]string{"type", "name", "fqdn", "valid", "members"})
+		for _, h := range uncollected {
+			c.Write([]string{"uncollected_host", h.Host, h.FQDN, fmt.Sprint(h.Valid), ""})
+		}
+		for _, col := range invalid {
+			c.Write([]string{"invalid_collection", col.Name, "", "false", strings.Join(col.Members, ";")})
+		}
+		c.Flush()
+		return c.Error()
+	}
+	if uncollected == nil {
+		uncollected = []uncollectedHost{}
+	}
+	if invalid == nil {
+		invalid = []invalidCollection{}
+	}
+	b, err := json.MarshalIndent(coverageReport{
+		GeneratedAt:        time.Now().UTC().Format(time.RFC3339),
+		Group:              rules.group,
+		UncollectedHosts:   uncollected,
+		InvalidCollections: invalid,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
@@ -0,0 +1,144 @@
+// rules provides assertions of invariants against a generated Ansible inventory
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"gopkg.in/yaml.v2"
+)
+
+// Rule defines a set of conditions that a single inventory group must satisfy
+type Rule struct {
+	Name         string `yaml:"name"`
+	Group        string `yaml:"group"`
+	SubsetOf     string `yaml:"subset_of"`     // Every host in Group must also be in this group
+	DisjointWith string `yaml:"disjoint_with"` // No host in Group may also be in this group
+	MinHosts     *int   `yaml:"min_hosts"`
+	MaxHosts     *int   `yaml:"max_hosts"`
+}
+
+// Rules is a collection of Rule definitions
+type Rules struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Violation describes a Rule that an inventory failed to satisfy
+type Violation struct {
+	Rule    string
+	Message string
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("%s: %s", v.Rule, v.Message)
+}
+
+// ParseRules reads a YAML formatted rules file
+func ParseRules(filename string) (*Rules, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := new(Rules)
+	if err := yaml.UnmarshalStrict(b, r); err != nil {
+		return nil, err
+	}
+	for i, rule := range r.Rules {
+		if rule.Group == "" {
+			return nil, fmt.Errorf("rule %d has no group", i+1)
+		}
+		if rule.Name == "" {
+			r.Rules[i].Name = fmt.Sprintf("rule %d (%s)", i+1, rule.Group)
+		}
+	}
+	if len(r.Rules) == 0 {
+		return nil, errors.New("no rules defined")
+	}
+	return r, nil
+}
+
+// Check evaluates every Rule against an inventory and returns any Violations.
+func (r *Rules) Check(invJSON string) []Violation {
+	inv := gjson.Parse(invJSON)
+	var violations []Violation
+	for _, rule := range r.Rules {
+		violations = append(violations, rule.check(inv)...)
+	}
+	return violations
+}
+
+// check evaluates a single Rule against an inventory.
+func (rule Rule) check(inv gjson.Result) (violations []Violation) {
+	fail := func(format string, args ...interface{}) {
+		violations = append(violations, Violation{Rule: rule.Name, Message: fmt.Sprintf(format, args...)})
+	}
+	if !inv.Get(Escape(rule.Group)).Exists() {
+		fail("group %s does not exist", rule.Group)
+		return
+	}
+	hosts := groupHosts(inv, rule.Group)
+	if rule.MinHosts != nil && len(hosts) < *rule.MinHosts {
+		fail("group %s has %d hosts, minimum is %d", rule.Group, len(hosts), *rule.MinHosts)
+	}
+	if rule.MaxHosts != nil && len(hosts) > *rule.MaxHosts {
+		fail("group %s has %d hosts, maximum is %d", rule.Group, len(hosts), *rule.MaxHosts)
+	}
+	if rule.SubsetOf != "" {
+		other := hostSet(groupHosts(inv, rule.SubsetOf))
+		var missing []string
+		for _, h := range hosts {
+			if !other[h] {
+				missing = append(missing, h)
+			}
+		}
+		if len(missing) > 0 {
+			fail("hosts in %s but not in %s: %s", rule.Group, rule.SubsetOf, strings.Join(missing, ", "))
+		}
+	}
+	if rule.DisjointWith != "" {
+		other := hostSet(groupHosts(inv, rule.DisjointWith))
+		var common []string
+		for _, h := range hosts {
+			if other[h] {
+				common = append(common, h)
+			}
+		}
+		if len(common) > 0 {
+			fail("hosts in both %s and %s: %s", rule.Group, rule.DisjointWith, strings.Join(common, ", "))
+		}
+	}
+	return
+}
+
+// groupHosts returns the hosts that are members of an inventory group.
+func groupHosts(inv gjson.Result, group string) []string {
+	var hosts []string
+	for _, h := range inv.Get(Escape(group) + ".hosts").Array() {
+		hosts = append(hosts, h.String())
+	}
+	return hosts
+}
+
+// hostSet converts a slice of hosts to a map for membership testing.
+func hostSet(hosts []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, h := range hosts {
+		set[h] = true
+	}
+	return set
+}
+
+// escape prevents characters in a group name being interpreted as gjson path syntax.
+func Escape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`.*?|#@\`, c) {
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,59 @@
+package rules
+
+import (
+	"os"
+	"testing"
+)
+
+const testInventory = `{
+	"_meta": {"hostvars": {}},
+	"all": {"children": ["sat_valid", "sat_prod", "sat_dmz"]},
+	"sat_valid": {"hosts": ["host1", "host2", "host3"]},
+	"sat_prod": {"hosts": ["host1", "host4"]},
+	"sat_dmz": {"hosts": ["host2", "host3"]}
+}`
+
+func TestParseRules(t *testing.T) {
+	testFile, err := os.CreateTemp("", "testrules")
+	if err != nil {
+		t.Fatalf("Unable to create TempFile: %v", err)
+	}
+	defer os.Remove(testFile.Name())
+	testFile.WriteString("rules:\n  - group: sat_dmz\n    max_hosts: 50\n")
+	testFile.Close()
+	r, err := ParseRules(testFile.Name())
+	if err != nil {
+		t.Fatalf("ParseRules returned: %v", err)
+	}
+	if len(r.Rules) != 1 || r.Rules[0].Name == "" || *r.Rules[0].MaxHosts != 50 {
+		t.Errorf("Unexpected rules: %+v", r.Rules)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	one := 1
+	fifty := 50
+	r := Rules{Rules: []Rule{
+		{Name: "prod is valid", Group: "sat_prod", SubsetOf: "sat_valid"},
+		{Name: "dmz is valid", Group: "sat_dmz", SubsetOf: "sat_valid"},
+		{Name: "dmz size", Group: "sat_dmz", MaxHosts: &fifty},
+		{Name: "dmz tiny", Group: "sat_dmz", MaxHosts: &one},
+		{Name: "prod not dmz", Group: "sat_prod", DisjointWith: "sat_dmz"},
+		{Name: "missing group", Group: "sat_nonexistent", MinHosts: &one},
+	}}
+	violations := r.Check(testInventory)
+	failed := make(map[string]bool)
+	for _, v := range violations {
+		failed[v.Rule] = true
+	}
+	for _, name := range []string{"prod is valid", "dmz tiny", "missing group"} {
+		if !failed[name] {
+			t.Errorf("Rule \"%s\" should have failed", name)
+		}
+	}
+	for _, name := range []string{"dmz is valid", "dmz size", "prod not dmz"} {
+		if failed[name] {
+			t.Errorf("Rule \"%s\" should have passed", name)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+// schemaRule is the Rule name reported for Violations of Ansible's inventory format
+const schemaRule = "schema"
+
+// groupNameRE matches group names that Ansible accepts without transformation
+var groupNameRE = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// Validate checks that an inventory conforms to the structure Ansible expects of a dynamic inventory script.  Group
+// names must be valid identifiers, groups must not be empty and every host in _meta.hostvars must belong to at least
+// one group (Ansible ignores hosts that don't).
+func Validate(invJSON string) (violations []Violation) {
+	fail := func(format string, args ...interface{}) {
+		violations = append(violations, Violation{Rule: schemaRule, Message: fmt.Sprintf(format, args...)})
+	}
+	if !gjson.Valid(invJSON) {
+		fail("inventory is not valid JSON")
+		return
+	}
+	inv := gjson.Parse(invJSON)
+	if !inv.IsObject() {
+		fail("inventory is not a JSON object")
+		return
+	}
+	if !inv.Get("_meta.hostvars").IsObject() {
+		fail("_meta.hostvars is missing or not an object")
+	}
+	grouped := make(map[string]bool)
+	inv.ForEach(func(key, group gjson.Result) bool {
+		name := key.String()
+		if name == "_meta" {
+			return true
+		}
+		if !groupNameRE.MatchString(name) {
+			fail("group name %q contains invalid characters", name)
+		}
+		if !group.IsObject() {
+			fail("group %s is not an object", name)
+			return true
+		}
+		hosts := group.Get("hosts")
+		children := group.Get("children")
+		if hosts.Exists() && !hosts.IsArray() {
+			fail("hosts of group %s is not an array", name)
+		}
+		if children.Exists() && !children.IsArray() {
+			fail("children of group %s is not an array", name)
+		}
+		if len(hosts.Array()) == 0 && len(children.Array()) == 0 && !group.Get("vars").Exists() {
+			fail("group %s is empty", name)
+		}
+		for _, h := range hosts.Array() {
+			grouped[h.String()] = true
+		}
+		for _, c := range children.Array() {
+			if !groupNameRE.MatchString(c.String()) {
+				fail("child group name %q of %s contains invalid characters", c.String(), name)
+			}
+		}
+		return true
+	})
+	var ungrouped []string
+	inv.Get("_meta.hostvars").ForEach(func(key, _ gjson.Result) bool {
+		if !grouped[key.String()] {
+			ungrouped = append(ungrouped, key.String())
+		}
+		return true
+	})
+	if len(ungrouped) > 0 {
+		sort.Strings(ungrouped)
+		fail("%d hosts in _meta.hostvars are not members of any group: %s", len(ungrouped), strings.Join(ungrouped, ", "))
+	}
+	return
+}
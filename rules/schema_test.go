@@ -0,0 +1,34 @@
+package rules
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	if v := Validate(testInventory); len(v) != 0 {
+		t.Errorf("Valid inventory produced violations: %v", v)
+	}
+	bad := `{
+		"_meta": {"hostvars": {"host1": {}, "host9": {}}},
+		"all": {"children": ["sat_prod", "sat-dmz"]},
+		"sat_prod": {"hosts": ["host1"]},
+		"sat-dmz": {"hosts": ["host1"]},
+		"sat_empty": {}
+	}`
+	violations := Validate(bad)
+	for _, expected := range []string{`"sat-dmz" contains`, "sat_empty is empty", "any group: host9"} {
+		found := false
+		for _, v := range violations {
+			if v.Rule == schemaRule && strings.Contains(v.Message, expected) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Expected a violation containing %q, got: %v", expected, violations)
+		}
+	}
+	if v := Validate("not json"); len(v) != 1 {
+		t.Errorf("Expected a single violation for invalid JSON, got: %v", v)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/notifier"
+)
+
+// checkSafety compares a refreshed inventory with the safety thresholds.  previous is the inventory it would replace.
+// It returns a description of the first threshold crossed, or an empty string if none are.
+func (inv *inventory) checkSafety(previous string) string {
+	hosts := hostCount(inv.json)
+	if cfg.Safety.MinHosts > 0 && hosts < cfg.Safety.MinHosts {
+		return fmt.Sprintf("inventory contains %d hosts, fewer than the safety min_hosts of %d", hosts, cfg.Safety.MinHosts)
+	}
+	if cfg.Safety.MaxShrinkPercent > 0 && previous != "" {
+		run := runRecord{Hosts: hosts, PreviousHosts: hostCount(previous)}
+		if drop := run.drop(); drop > cfg.Safety.MaxShrinkPercent {
+			return fmt.Sprintf("inventory has shrunk by %.1f%% (from %d to %d hosts), more than the safety max_shrink_percent of %g", drop, run.PreviousHosts, run.Hosts, cfg.Safety.MaxShrinkPercent)
+		}
+	}
+	return ""
+}
+
+// enforceSafety replaces a refreshed inventory that crosses a safety threshold with the previous inventory.  It
+// returns true if the inventory was replaced.  Without a previous inventory to fall back on, the inventory is refused
+// with an error.
+func (inv *inventory) enforceSafety(previous string) (bool, error) {
+	msg := inv.checkSafety(previous)
+	if msg == "" {
+		return false, nil
+	}
+	inv.notify(notifier.KindAlert, "inventory safety threshold crossed", msg)
+	if previous == "" {
+		return false, &exitError{code: exitRefused, err: fmt.Errorf("refusing to publish the inventory: %s", msg)}
+	}
+	log.Warnf("Refusing to replace the cached inventory: %s.  Using the previous inventory instead.", msg)
+	inv.json = previous
+	return true, nil
+}
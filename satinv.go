@@ -1,25 +1,39 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	stdlog "log"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
 	"time"
 
 	"github.com/Masterminds/log-go"
-	"github.com/crooks/jlog"
 	loglevel "github.com/crooks/log-go-level"
 	"github.com/crooks/satinv/cacher"
+	"github.com/crooks/satinv/cacher/satapi"
 	"github.com/crooks/satinv/cidrs"
 	"github.com/crooks/satinv/config"
-	"github.com/crooks/satinv/multire"
+	"github.com/crooks/satinv/enricher"
+	"github.com/crooks/satinv/groupbuilder"
+	"github.com/crooks/satinv/groupexpr"
+	"github.com/crooks/satinv/notifier"
+	"github.com/crooks/satinv/rules"
+	"github.com/crooks/satinv/tracing"
 	"github.com/tidwall/gjson"
 	"github.com/tidwall/sjson"
 )
 
 const (
+	// Defaults for external enrichers
+	defaultExternalEnricherBatchSize int           = 100
+	defaultExternalEnricherTimeout   time.Duration = time.Minute
+
 	inventoryName string = "inventory"
 	shortDate     string = "2006-01-02 15:04:05 MST"
 )
@@ -27,12 +41,35 @@ const (
 var (
 	cfg   *config.Config
 	flags *config.Flags
+	// invalidGroupCharsRE matches characters that Ansible doesn't permit in group names
+	invalidGroupCharsRE = regexp.MustCompile(`[^A-Za-z0-9_]`)
 )
 
 type inventory struct {
-	json            string
-	cache           *cacher.Cache
-	oldestValidTime time.Time
+	json        string
+	cache       *cacher.Cache
+	validRules  []validRules               // Conditions for each of the valid groups
+	derived     *derivedStore              // Per-host results carried over from previous runs
+	enrichments enricher.Results           // Additional hostvars, keyed by hostname
+	children    map[string]bool            // Groups that have been added to all.children
+	members     map[string]map[string]bool // Hosts that have been added to each group
+	truncated   []string                   // Descriptions of Satellite API responses with missing results
+	hostNames   map[string]string          // Index of hostnames, keyed by host ID
+	collections []hostCollection           // Host Collections and their members, resolved by loadCollections
+	memberOf    map[string][]string        // Names of the Host Collections each host is a member of
+	notifiers   []notifier.Notifier
+	scaOrgs     map[string]bool             // Simple Content Access mode, keyed by Organization ID
+	builders    []groupbuilder.GroupBuilder // Sources of custom groups
+	ctx         context.Context             // Cancelled when the inventory build is abandoned
+	budget      *buildBudget                // Limits the time taken by refreshInventory
+	run         *runStats                   // Figures reported in the summary of refreshInventory
+	cidrs       cidrs.Cidrs                 // Subnets tested for CIDR group membership
+	subnets     map[string]string           // Networks of the Satellite subnets, keyed by CIDR name
+	expressions map[string]groupexpr.Expr   // Composite groups from group_expressions, keyed by group name
+	exprOrder   []string                    // Names of the expressions, in evaluation order
+	aliases     map[string]string           // Names given by the alias_parameter, keyed by inventory hostname
+	excluded    map[string]bool             // Hosts excluded by the exclude_parameter, keyed by inventory hostname
+	jsonErr     error                       // The first failure to update json, which abandons the refresh
 }
 
 // shortName take a hostname string and returns the shortname for it.
@@ -40,23 +77,53 @@ func shortName(host string) string {
 	return strings.Split(host, ".")[0]
 }
 
-// satTimestamp parses a DateTime string of the format used in the Satellite API
+// inventoryHostname returns the name a Satellite host is given in the inventory: Its shortname or, with
+// hostname_style fqdn, its full name.
+func inventoryHostname(host string) string {
+	if cfg.HostnameStyle == "fqdn" {
+		return host
+	}
+	return shortName(host)
+}
+
+// hostvarsPath returns the gjson path of an inventory host's hostvars.
+func hostvarsPath(host string) string {
+	return "_meta.hostvars." + rules.Escape(host)
+}
+
+// satTimestampLayouts are the DateTime formats the Satellite API is known to use, in the order they're tried.
+// Timestamps without a zone are assumed to be UTC.
+var satTimestampLayouts = []string{
+	"2006-01-02 15:04:05 MST",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05 -07:00",
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05-0700",
+	"2006-01-02 15:04:05",
+}
+
+// satTimestamp parses a DateTime string from the Satellite API.  The timestamp_layout option, if configured, is
+// tried before the known Satellite formats.
 func satTimestamp(ts string) (t time.Time, err error) {
-	layout := "2006-01-02 15:04:05 MST"
-	t, err = time.Parse(layout, ts)
-	if err != nil {
-		log.Errorf("Sat time parse: %v", err)
-		return
+	layouts := satTimestampLayouts
+	if cfg.TimestampLayout != "" {
+		layouts = append([]string{cfg.TimestampLayout}, layouts...)
+	}
+	for _, layout := range layouts {
+		t, err = time.Parse(layout, ts)
+		if err == nil {
+			return
+		}
 	}
+	err = fmt.Errorf("%q does not match any known timestamp format", ts)
+	log.Errorf("Sat time parse: %v", err)
 	return
 }
 
-// getHostByID returns the string representation of a hostname for a given ID string.
-func getHostByID(hosts gjson.Result, id string) (string, error) {
-	query := fmt.Sprintf("results.#(id=\"%s\").name", id)
-	hostname := hosts.Get(query)
-	if hostname.Exists() {
-		return hostname.String(), nil
+// hostByID returns the hostname for a given host ID string, using the index built by parseHosts.
+func (inv *inventory) hostByID(id string) (string, error) {
+	if hostname, ok := inv.hostNames[id]; ok {
+		return hostname, nil
 	}
 	err := fmt.Errorf("name not found for id: %s", id)
 	return "", err
@@ -72,20 +139,140 @@ func containsStr(str string, strs []string) bool {
 	return false
 }
 
-// mkInventoryName converts a Host Collection name to something compatible with Ansible Inventories.
-func mkInventoryName(s string) string {
+// mkInventoryName converts a Host Collection (or CIDR) name to something compatible with Ansible Inventories.  The
+// name is lowercased, any character that isn't a letter, digit or underscore is replaced and the prefix of the group's
+// family is prepended.
+func mkInventoryName(family, s string) string {
 	s = strings.ToLower(s)
-	s = strings.ReplaceAll(s, " ", "_")
-	s = cfg.InventoryPrefix + s
+	s = invalidGroupCharsRE.ReplaceAllString(s, cfg.GroupNameReplacement)
+	s = cfg.GroupPrefix(family) + s
+	if cfg.ForceValidGroupNames {
+		s = forceValidGroupName(s)
+	}
+	return s
+}
+
+// forceValidGroupName mirrors Ansible's force_valid_group_names transformation: Invalid characters, and a leading
+// digit, are replaced with underscores.  Unlike mkInventoryName, it also applies to the inventory_prefix.
+func forceValidGroupName(s string) string {
+	s = invalidGroupCharsRE.ReplaceAllString(s, "_")
+	if s != "" && s[0] >= '0' && s[0] <= '9' {
+		s = "_" + s[1:]
+	}
 	return s
 }
 
+// hostsURL returns the Satellite API URL for hosts.  When any host parameters are configured, they're included so they
+// can be read without a request per host.
+func hostsURL() string {
+	url := fmt.Sprintf("%s/api/v2/hosts?per_page=1000", cfg.API.BaseURL)
+	if cfg.HostParameters() {
+		url += "&include%5B%5D=all_parameters"
+	}
+	return url
+}
+
+// hostsPageURL returns the Satellite API URL for a page of the hosts.  The first page is hostsURL, so that it has the
+// same cache key regardless of how many pages there are.
+func hostsPageURL(page int) string {
+	if page == 1 {
+		return hostsURL()
+	}
+	return fmt.Sprintf("%s&page=%d", hostsURL(), page)
+}
+
+// registerHostsPage adds the URL of a page of the hosts to the cache.  The first page is registered with the principal
+// items.
+func (inv *inventory) registerHostsPage(page int) {
+	inv.cache.AddURL(hostsPageURL(page), fmt.Sprintf("hosts_page%d.json", page), cfg.Cache.ValidityHosts)
+}
+
+// collectionsBaseURL returns the Satellite API URL for Host Collections, without any query parameters.
+func collectionsBaseURL() string {
+	return fmt.Sprintf("%s/katello/api/host_collections", cfg.API.BaseURL)
+}
+
+// collectionsURL returns the Satellite API URL for a page of the list of Host Collections, optionally scoped to an
+// Organization.
+func collectionsURL(page int) string {
+	url := fmt.Sprintf("%s?per_page=%d&page=%d", collectionsBaseURL(), cfg.HostCollections.PerPage, page)
+	if cfg.HostCollections.OrganizationID > 0 {
+		url += fmt.Sprintf("&organization_id=%d", cfg.HostCollections.OrganizationID)
+	}
+	return url
+}
+
+// collectionURL returns the Satellite API URL for an individual Host Collection.
+func collectionURL(id string) string {
+	return fmt.Sprintf("%s/%s", collectionsBaseURL(), id)
+}
+
+// registerCollectionsPage adds the URL of a page of the Host Collections list to the cache.  The first page is
+// registered with the principal items.
+func (inv *inventory) registerCollectionsPage(page int) {
+	inv.cache.AddURL(collectionsURL(page), fmt.Sprintf("host_collections_page%d.json", page), cfg.Cache.ValidityCollections)
+}
+
+// getCollections returns the list of Host Collections.
+func (inv *inventory) getCollections() (gjson.Result, error) {
+	return inv.getPages("Host Collections", collectionsURL, inv.registerCollectionsPage)
+}
+
+// getPages returns a paginated Satellite API list.  Each page of results is fetched in turn, from pageURL, and the
+// results are combined into a single response, retaining the totals of the first page so truncation can still be
+// detected.  Pages after the first are registered with the cache by register.
+func (inv *inventory) getPages(name string, pageURL func(page int) string, register func(page int)) (gjson.Result, error) {
+	first, err := inv.cache.GetURL(pageURL(1))
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	expected := first.Get("subtotal")
+	if !expected.Exists() {
+		expected = first.Get("total")
+	}
+	perPage := first.Get("per_page").Int()
+	if perPage <= 0 || expected.Int() <= perPage {
+		return first, nil
+	}
+	pages := int((expected.Int() + perPage - 1) / perPage)
+	var results []string
+	for _, r := range first.Get("results").Array() {
+		results = append(results, r.Raw)
+	}
+	for page := 2; page <= pages; page++ {
+		register(page)
+		gj, err := inv.cache.GetURL(pageURL(page))
+		if err != nil {
+			return gjson.Result{}, err
+		}
+		rs := gj.Get("results").Array()
+		if len(rs) == 0 {
+			// Records have been deleted since the first page was fetched
+			break
+		}
+		for _, r := range rs {
+			results = append(results, r.Raw)
+		}
+	}
+	// The results are combined in a single update, as appending each in turn would copy the response every time
+	combined, err := sjson.SetRaw(first.Raw, "results", "["+strings.Join(results, ",")+"]")
+	if err != nil {
+		return gjson.Result{}, err
+	}
+	log.Debugf("Fetched %d pages of %s", pages, name)
+	return gjson.Parse(combined), nil
+}
+
+// registerCollection adds the URL of an individual Host Collection to the cache.
+func (inv *inventory) registerCollection(id string) {
+	collectionFilename := fmt.Sprintf("host_collections_%s.json", id)
+	inv.cache.AddURL(collectionURL(id), collectionFilename, cfg.Cache.ValidityCollections)
+}
+
 // getHostCollection takes an ID string and returns the Host Collection associated with it.
 func (inv *inventory) getHostCollection(id string) (gjson.Result, error) {
-	collectionURL := fmt.Sprintf("%s/katello/api/host_collections/%s", cfg.API.BaseURL, id)
-	collectionFilename := fmt.Sprintf("host_collections_%s.json", id)
-	inv.cache.AddURL(collectionURL, collectionFilename, cfg.Cache.ValidityCollections)
-	collection, err := inv.cache.GetURL(collectionURL)
+	inv.registerCollection(id)
+	collection, err := inv.cache.GetURL(collectionURL(id))
 	if err != nil {
 		return gjson.Result{}, err
 	}
@@ -102,250 +289,970 @@ func (inv *inventory) getHostCollection(id string) (gjson.Result, error) {
 }
 
 // importCIDRs constructs a new instance of Cidrs and then populates it from a map in the Config.
-func importCIDRs() cidrs.Cidrs {
+func importCIDRs() (cidrs.Cidrs, error) {
 	cidr := make(cidrs.Cidrs)
-	cidr.AddCIDRMap(cfg.CIDRs)
-	return cidr
+	if err := cidr.AddCIDRMap(cfg.CIDRs); err != nil {
+		return nil, err
+	}
+	return cidr, nil
+}
+
+// enrich runs all the Enrichers enabled in the Config against the Satellite hosts.
+func (inv *inventory) enrich(hosts gjson.Result) error {
+	defer timeTrack(time.Now(), "enrich")
+	var enrichers []enricher.Enricher
+	for _, name := range enricher.Names() {
+		ec, ok := cfg.Enrichers[name]
+		if !ok || !ec.Enabled {
+			continue
+		}
+		if hostsFile() != "" {
+			log.Warnf("Ignoring enricher %s.  It requires the Satellite API.", name)
+			continue
+		}
+		e, err := enricher.New(name, inv.cache, cfg.API.BaseURL, ec.Validity, ec.Concurrency)
+		if err != nil {
+			return &exitError{code: exitConfig, err: fmt.Errorf("unable to initialise enricher: %v", err)}
+		}
+		log.Debugf("Enabling enricher %s: validity=%d, concurrency=%d", name, ec.Validity, ec.Concurrency)
+		enrichers = append(enrichers, e)
+	}
+	for name := range cfg.Enrichers {
+		if !containsStr(name, enricher.Names()) {
+			log.Warnf("Ignoring unknown enricher: %s", name)
+		}
+	}
+	if cfg.NetBox.Enabled {
+		timeout := defaultExternalEnricherTimeout
+		if cfg.NetBox.Timeout > 0 {
+			timeout = time.Duration(cfg.NetBox.Timeout) * time.Second
+		}
+		e, err := enricher.NewNetBox(cfg.NetBox.URL, cfg.NetBox.Token, cfg.NetBox.Concurrency, timeout)
+		if err != nil {
+			return &exitError{code: exitConfig, err: fmt.Errorf("unable to initialise enricher: %v", err)}
+		}
+		log.Debugf("Enabling enricher %s: concurrency=%d", enricher.NetBoxName, cfg.NetBox.Concurrency)
+		enrichers = append(enrichers, e)
+	}
+	external, err := externalEnrichers()
+	if err != nil {
+		return &exitError{code: exitConfig, err: fmt.Errorf("unable to initialise enricher: %v", err)}
+	}
+	if len(enrichers) == 0 && len(external) == 0 {
+		log.Debug("Bypassing host enrichment.  No enrichers enabled.")
+		return nil
+	}
+	inv.enrichments = enricher.Run(inv.ctx, enrichers, hosts.Get("results").Array())
+	inv.enrichments = enricher.RunBatches(inv.ctx, external, hosts.Get("results").Array(), inv.enrichments)
+	return nil
+}
+
+// externalEnrichers returns a BatchEnricher for each of the configured external enrichers.
+func externalEnrichers() ([]enricher.BatchEnricher, error) {
+	var external []enricher.BatchEnricher
+	for _, c := range cfg.ExternalEnrichers {
+		if containsStr(c.Name, enricher.Names()) {
+			return nil, fmt.Errorf("external enricher %s has the same name as a built-in enricher", c.Name)
+		}
+		timeout := defaultExternalEnricherTimeout
+		if c.Timeout > 0 {
+			timeout = time.Duration(c.Timeout) * time.Second
+		}
+		batchSize := c.BatchSize
+		if batchSize == 0 {
+			batchSize = defaultExternalEnricherBatchSize
+		}
+		e, err := enricher.NewExternal(c.Name, c.Command, c.URL, batchSize, timeout)
+		if err != nil {
+			return nil, err
+		}
+		log.Debugf("Enabling external enricher %s: batch_size=%d", c.Name, batchSize)
+		external = append(external, e)
+	}
+	return external, nil
+}
+
+// initAPI initialises the Satellite API.  This has to be done if URLs may need to be pulled from the API.
+func (inv *inventory) initAPI() error {
+	if hostsFile() != "" {
+		log.Debugf("Reading hosts from %s.  The Satellite API will not be used.", hostsFile())
+		return nil
+	}
+	opts := satapi.Options{
+		CertFile:     cfg.API.CertFile,
+		ProxyURL:     cfg.API.ProxyURL,
+		Retries:      cfg.APIRetries(),
+		MaxRetryWait: time.Duration(cfg.API.Retry.MaxWait) * time.Second,
+		Logf:         log.Warnf,
+	}
+	if cfg.API.Debug {
+		opts.Debugf = log.Infof
+		opts.DebugBody = cfg.API.DebugBody
+	}
+	var err error
+	if cfg.API.Auth == "negotiate" {
+		k := cfg.API.Kerberos
+		err = inv.cache.InitNegotiateAPI(satapi.Negotiate{Krb5Conf: k.Config, CCache: k.CCache, SPN: k.SPN}, opts)
+	} else {
+		err = inv.cache.InitAPI(cfg.API.User, cfg.API.Password, opts)
+	}
+	if err != nil {
+		return &exitError{code: exitConfig, err: fmt.Errorf("unable to initialise API: %v", err)}
+	}
+	return nil
+}
+
+// configureRateLimit applies the rate budget and in-flight cap shared by all API requests, including those made
+// concurrently by enrichers.  It's called once at startup, and again only when a reload changes the rate_limit, as
+// replacing the budget refills it.
+func configureRateLimit() {
+	if cfg.API.RateLimit.RequestsPerSecond > 0 {
+		log.Debugf("Limiting API requests to %.2f/second (burst=%d)", cfg.API.RateLimit.RequestsPerSecond, cfg.API.RateLimit.Burst)
+	}
+	satapi.SetRateLimit(cfg.API.RateLimit.RequestsPerSecond, cfg.API.RateLimit.Burst)
+	if cfg.API.RateLimit.MaxInFlight > 0 {
+		log.Debugf("Limiting concurrent API requests to %d", cfg.API.RateLimit.MaxInFlight)
+	}
+	satapi.SetMaxInFlight(cfg.API.RateLimit.MaxInFlight)
 }
 
-// refreshInventory produces a new inventory.json copy from the Satellite API (or cache).
-func (inv *inventory) refreshInventory() {
-	// If URLs have to be pulled from an API, this has to be initialised.
-	inv.cache.InitAPI(cfg.API.User, cfg.API.Password, cfg.API.CertFile)
+// registerItems adds the principal Satellite API URLs to the cache.
+func (inv *inventory) registerItems() {
+	inv.cache.AddURL(hostsURL(), "hosts.json", cfg.Cache.ValidityHosts)
+	inv.cache.AddURL(collectionsURL(1), "host_collections.json", cfg.Cache.ValidityCollections)
+	inv.cache.AddFile(derivedName, "derived.json", cfg.Validity(derivedName))
+	inv.cache.AddFile(runName, "run.json", cfg.Cache.ValidityInventory)
+	inv.cache.AddFile(remediationName, "remediation.json", cfg.Remediation.Cooldown)
+	if cfg.SCA == "auto" {
+		inv.cache.AddURL(organizationsURL(), "organizations.json", cfg.Validity("organizations"))
+	}
+	if cfg.Subnets.Mode != "off" {
+		inv.cache.AddURL(subnetsURL(), "subnets.json", cfg.Validity("subnets"))
+	}
+	inv.registerSources()
+}
+
+// refreshInventory produces a new inventory.json copy from the Satellite API (or cache).  If the refresh fails, or the
+// new inventory is refused, inv.json isn't a publishable inventory and an error is returned.
+func (inv *inventory) refreshInventory() error {
+	inv.budget.begin()
+	inv.run = newRunStats(inv.ctx)
+	warnings.reset()
+	if err := inv.enterPhase("hosts"); err != nil {
+		return err
+	}
+	if err := inv.initAPI(); err != nil {
+		return err
+	}
 
 	// Populate the hosts object
-	hostsURL := fmt.Sprintf("%s/api/v2/hosts?per_page=1000", cfg.API.BaseURL)
-	inv.cache.AddURL(hostsURL, "hosts.json", cfg.Cache.ValidityHosts)
-	hosts, err := inv.cache.GetURL(hostsURL)
+	hosts, err := inv.getHosts()
 	if err != nil {
-		log.Fatalf("Unable to read hosts from JSON file: %v", err)
+		return inv.fetchFailed("Unable to read hosts from JSON file", err)
 	}
+	inv.checkTruncated("hosts", hosts)
 
 	// Initialize the inventory object that contains the json string field
 	inv.json = "{}"
 	inv.json, err = sjson.Set(inv.json, "_meta", "hostvars")
 	if err != nil {
-		log.Fatal(err)
+		return &exitError{code: exitOutput, err: fmt.Errorf("unable to initialise the inventory: %v", err)}
+	}
+	if err := inv.enterPhase("enrich"); err != nil {
+		return err
+	}
+	if err := inv.enrich(hosts); err != nil {
+		return err
+	}
+	inv.loadAliases(hosts)
+	inv.loadExclusions(hosts)
+	if err := inv.enterPhase("organizations"); err != nil {
+		return err
+	}
+	inv.loadOrganizations()
+	inv.recordSCA()
+	if err := inv.enterPhase("subnets"); err != nil {
+		return err
 	}
+	inv.loadSubnets()
+	if err := inv.enterPhase("hostCollections"); err != nil {
+		return err
+	}
+	// Without collection groups, membership is only needed if it may override validity rules
+	if hostsFile() == "" && (cfg.GroupEnabled(config.GroupCollections) || len(cfg.ValidOverrides) > 0) {
+		// Host Collection membership is resolved before the hosts are parsed as it may override validity rules
+		if err := inv.loadCollections(hosts); err != nil {
+			return inv.fetchFailed("Unable to read JSON from file", err)
+		}
+	}
+	if err := inv.enterPhase("parseHosts"); err != nil {
+		return err
+	}
+	inv.loadDerived()
 	inv.parseHosts(hosts)
-	inv.parseHostCollections(hosts)
+	inv.saveDerived()
+	if err := inv.enterPhase("dns"); err != nil {
+		return err
+	}
+	inv.hgDNSMismatch()
+	if err := inv.enterPhase("parseHostCollections"); err != nil {
+		return err
+	}
+	if hostsFile() == "" && cfg.GroupEnabled(config.GroupCollections) {
+		inv.parseHostCollections()
+	}
+	if err := inv.enterPhase("customSources"); err != nil {
+		return err
+	}
+	if hostsFile() == "" {
+		inv.hgSources()
+	}
+	if err := inv.enterPhase("merge"); err != nil {
+		return err
+	}
+	if err := inv.mergeStatic(); err != nil {
+		return err
+	}
+	if err := inv.enterPhase("groupExpressions"); err != nil {
+		return err
+	}
+	inv.hgExpressions()
+	if err := inv.enterPhase("validation"); err != nil {
+		return err
+	}
+	if err := inv.handleTruncated(); err != nil {
+		return err
+	}
+	if err := inv.validateSchema(); err != nil {
+		return err
+	}
+	previous := inv.previousInventory()
+	if hostsFile() == "" {
+		if err := inv.enterPhase("safety"); err != nil {
+			return err
+		}
+		replaced, err := inv.enforceSafety(previous)
+		if err != nil {
+			return err
+		}
+		if replaced {
+			inv.budget.finish()
+			inv.logSummary()
+			return nil
+		}
+	}
+	if err := inv.enterPhase("notify"); err != nil {
+		return err
+	}
+	inv.notifyChanges(previous)
+	inv.addMeta()
 	// For human readability, put an LF on the end of the json.
 	inv.json += "\n"
-	filename, err := inv.cache.GetFilename(inventoryName)
+	if err := inv.enterPhase("write"); err != nil {
+		return err
+	}
+	if hostsFile() != "" {
+		// An inventory built from a file mustn't replace the cached inventory built from Satellite.  Nor should it
+		// trigger any action against Satellite or Tower.
+		inv.budget.finish()
+		inv.logSummary()
+		log.Debugf("Not caching the inventory built from %s", hostsFile())
+		return nil
+	}
+	archiveInventory(previous)
+	// If the inventory is successfully written, its expiry is reset to a new refresh timestamp.
+	err = inv.cache.PutFile(inventoryName, []byte(inv.json))
 	if err != nil {
-		log.Fatalf("Unable to get cached filename: %v", err)
+		return &exitError{code: exitCache, err: fmt.Errorf("unable to write inventory: %v", err)}
+	}
+	inv.recordRun(previous)
+	// The inventory is complete.  Subsequent actions don't count towards the build budget.
+	inv.budget.finish()
+	inv.logSummary()
+	// When run by AWX itself, requesting an update would cause another run, so it's only done from elsewhere
+	if cfg.Tower.InventorySourceID > 0 && flags.DryRun {
+		log.Infof("Dry run: not requesting update of Tower inventory source %d", cfg.Tower.InventorySourceID)
+	} else if cfg.Tower.InventorySourceID > 0 && !towerMode() {
+		if err := towerUpdate(); err != nil {
+			log.Errorf("Tower inventory source update failed: %v", err)
+			inv.notify(notifier.KindAlert, "Tower inventory source update failed", err.Error())
+		}
+	}
+	if cfg.Remediation.Enabled && flags.DryRun {
+		log.Infof("Dry run: not triggering remediation against %s", remediationGroup())
+	} else if cfg.Remediation.Enabled {
+		if err := inv.remediate(); err != nil {
+			log.Errorf("Remediation failed: %v", err)
+			inv.notify(notifier.KindAlert, "remediation failed", err.Error())
+		}
 	}
-	err = os.WriteFile(filename, []byte(inv.json), 0644)
+	if cfg.Cache.AutoPrune {
+		if _, err := inv.pruneCache(); err != nil {
+			log.Warnf("Unable to prune cache: %v", err)
+		}
+	}
+	return nil
+}
+
+// evictCache removes the least recently used cache items if the cache exceeds max_size_mb.  The inventory is always
+// retained, as it's the fallback when Satellite can't be reached.
+func (inv *inventory) evictCache() {
+	if cfg.Cache.MaxSizeMB <= 0 {
+		return
+	}
+	evicted, err := inv.cache.Evict(cfg.Cache.MaxSizeMB*1024*1024, inventoryName)
 	if err != nil {
-		log.Fatalf("WriteFile: %v", err)
+		log.Warnf("Unable to evict cache items: %v", err)
+	}
+	if len(evicted) > 0 {
+		log.Infof("Evicted %d cache items to limit the cache to %d MB", len(evicted), cfg.Cache.MaxSizeMB)
 	}
-	// If the inventory has been successfully refreshed, update the expiry file with a new refresh timestamp.
-	inv.cache.ResetExpire(inventoryName)
 }
 
-// mkInventory assembles all the components of a Dynamic Inventory and writes them to Stdout (or a file).
-func mkInventory() {
-	// Initialize an inventory struct
+// validateSchema checks the inventory conforms to Ansible's expectations before it's written.  Depending on the
+// schema_validation option, problems are either logged or returned as an error that refuses the inventory.
+func (inv *inventory) validateSchema() error {
+	if cfg.SchemaValidation == "off" {
+		return nil
+	}
+	violations := rules.Validate(inv.json)
+	for _, v := range violations {
+		if cfg.SchemaValidation == "error" {
+			log.Errorf("Inventory validation: %s", v.Message)
+		} else {
+			log.Warnf("Inventory validation: %s", v.Message)
+		}
+	}
+	if len(violations) > 0 {
+		var lines []string
+		for _, v := range violations {
+			lines = append(lines, v.Message)
+		}
+		inv.notify(notifier.KindAlert, fmt.Sprintf("inventory failed validation with %d problems", len(violations)), strings.Join(lines, "\n"))
+	}
+	if len(violations) > 0 && cfg.SchemaValidation == "error" {
+		return &exitError{code: exitRefused, err: fmt.Errorf("inventory failed validation with %d problems; not writing it", len(violations))}
+	}
+	return nil
+}
+
+// memoryCache holds the cache files when they aren't kept on disk.  It persists between inventories for the lifetime
+// of the process.
+var memoryCache = cacher.NewMemory()
+
+// newInventory returns an inventory struct with an initialised cache and the principal cache items registered.
+func newInventory() (*inventory, error) {
 	inv := new(inventory)
+	inv.ctx = appCtx
 	// Initialize the URL cache
-	inv.cache = cacher.NewCacher(cfg.Cache.Dir)
-	// When this function completes, write the expiry file (if one or more cache items have been refreshed).
+	var err error
+	if cfg.CacheOnDisk() {
+		inv.cache, err = cacher.NewCacher(cfg.Cache.Dir)
+	} else {
+		inv.cache, err = cacher.NewMemoryCacher(memoryCache)
+	}
+	if err != nil {
+		return nil, &exitError{code: exitCache, err: fmt.Errorf("unable to initialise cache: %v", err)}
+	}
+	inv.cache.SetContext(inv.ctx)
+	key, err := cfg.CacheKey()
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		if err := inv.cache.SetEncryptionKey(key); err != nil {
+			return nil, err
+		}
+	}
+	perms, err := cfg.CachePerms()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache permissions: %v", err)
+	}
+	inv.cache.SetPerms(perms)
+	inv.cache.SetDefaultValidity(cfg.Cache.ValidityDefault)
+	inv.cache.SetJitter(cfg.Cache.JitterPercent)
 	if flags.Refresh {
 		// Force a cache refresh
 		inv.cache.SetRefresh()
 	}
-	// An age in hours beyond which hosts will be considered invalid (excluded from hgValid).
-	inv.oldestValidTime = time.Now().Add(-time.Hour * time.Duration(cfg.Valid.Hours))
-	log.Debugf("Hosts older then %s will be deemed invalid", inv.oldestValidTime.Format(shortDate))
-
+	if flags.DryRun {
+		inv.cache.SetDryRun()
+	}
 	// The inventory is the output of the entire process.  We cache it to avoid having to reconstruct it from source APIs.
 	inv.cache.AddFile(inventoryName, fmt.Sprintf("%s.json", inventoryName), cfg.Cache.ValidityInventory)
+	inv.registerItems()
+	var refreshItems []string
+	if flags.RefreshHosts {
+		refreshItems = append(refreshItems, "hosts")
+	}
+	if flags.RefreshCollections {
+		refreshItems = append(refreshItems, "collections")
+	}
+	for _, item := range refreshItems {
+		keys, err := inv.invalidateItem(item)
+		if err != nil {
+			return nil, err
+		}
+		log.Infof("Forcing a refresh of the %s (%d cache items)", item, len(keys))
+	}
+	inv.validRules, err = allValidRules()
+	if err != nil {
+		return nil, fmt.Errorf("unable to compile valid rules: %v", err)
+	}
+	inv.cidrs, err = importCIDRs()
+	if err != nil {
+		return nil, fmt.Errorf("unable to import CIDRs: %v", err)
+	}
+	inv.notifiers, err = buildNotifiers()
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialise notifications: %v", err)
+	}
+	inv.builders, err = groupBuilders()
+	if err != nil {
+		return nil, fmt.Errorf("unable to initialise group builders: %v", err)
+	}
+	inv.expressions, inv.exprOrder, err = groupexpr.ParseAll(cfg.GroupExpressions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid group expression: %v", err)
+	}
+	return inv, nil
+}
+
+// previousInventory returns the cached inventory, regardless of whether it has expired, or an empty string if there
+// isn't one.
+func (inv *inventory) previousInventory() string {
+	b, err := inv.cache.GetFile(inventoryName)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// load populates the inventory json, either from the cache or, if the cache has expired, by refreshing it.
+func (inv *inventory) load() error {
+	if hostsFile() != "" {
+		// The file may have changed since the inventory was last built from it, so it's always rebuilt
+		return inv.refreshInventory()
+	}
 	refresh, err := inv.cache.HasExpired(inventoryName)
 	if err != nil {
-		log.Fatal(err)
+		return &exitError{code: exitCache, err: err}
 	}
 	if refresh {
 		log.Debugf("Cache of the %s file has expired.  Refreshing it.", inventoryName)
-		inv.refreshInventory()
-	} else {
-		log.Debugf("Cache of the %s file is still valid so not refreshing it.", inventoryName)
-		i, err := inv.cache.GetFile(inventoryName)
+		return inv.refreshInventory()
+	}
+	log.Debugf("Cache of the %s file is still valid so not refreshing it.", inventoryName)
+	i, err := inv.cache.GetFile(inventoryName)
+	if errors.Is(err, cacher.ErrChecksum) || errors.Is(err, cacher.ErrDecrypt) {
+		log.Warnf("Cached %s file is unreadable.  Refreshing it.", inventoryName)
+		return inv.refreshInventory()
+	} else if err != nil {
+		return &exitError{code: exitCache, err: fmt.Errorf("unable to get file: %v", err)}
+	}
+	inv.json = string(i)
+	return nil
+}
+
+// close writes the cache metadata on completion of a run.
+func (inv *inventory) close() {
+	inv.evictCache()
+	// Write the expiry file (if one or more cache items have been refreshed).
+	inv.cache.WriteExpiryFile()
+	if err := inv.cache.WriteStats(); err != nil {
+		log.Warnf("Unable to write cache statistics: %v", err)
+	}
+	// The export isn't bound to appCtx, so spans are still sent when satinv is stopping
+	if n, err := tracing.Flush(context.Background()); err != nil {
+		log.Warnf("Unable to export traces: %v", err)
+	} else if n > 0 {
+		log.Debugf("Exported %d spans", n)
+	}
+}
+
+// mkInventory assembles all the components of a Dynamic Inventory and writes them to Stdout (or a file).
+func mkInventory() error {
+	// Initialize an inventory struct
+	inv, err := newInventory()
+	if err != nil {
+		return err
+	}
+	defer inv.close()
+	inv.limitBuild()
+	if flags.DryRun {
+		// A dry run always performs a full refresh, but nothing is written
+		if err := inv.refreshInventory(); err != nil {
+			return inv.loadFailed(err)
+		}
+		printSummary(inv.json)
+		return nil
+	}
+	if flags.RefreshAhead {
+		return inv.refreshAhead()
+	}
+	if err := inv.load(); err != nil {
+		return inv.loadFailed(err)
+	}
+	inv.output()
+	inv.startRefreshAhead()
+	return nil
+}
+
+// output applies the requested profile (and Tower adaptations) to the inventory and writes it to the output file
+// and, if requested, to stdout.
+func (inv *inventory) output() {
+	var err error
+	if flags.Profile != "" {
+		inv.json, err = applyProfile(inv.json, flags.Profile)
 		if err != nil {
-			log.Fatalf("Unable to get file: %v", err)
+			exitf(exitConfig, "Unable to apply profile: %v", err)
+		}
+	}
+	if towerMode() {
+		inv.json, err = towerInventory(inv.json)
+		if err != nil {
+			exitf(exitOutput, "Unable to adapt inventory for Tower: %v", err)
+		}
+	}
+	if flags.Host != "" {
+		inv.outputHost(flags.Host)
+		return
+	}
+	var files []outputContent
+	if cfg.Output.Hostvars != "inline" {
+		if hostvars := inv.separateHostvars(); hostvars != nil {
+			files = append(files, outputContent{"Hostvars", cfg.Output.HostvarsFile, hostvars})
 		}
-		inv.json = string(i)
+	}
+	if filename := outputFile(); filename != "" {
+		files = append(files, outputContent{"Inventory", filename, []byte(inv.json)})
+	}
+	if err := writeOutputs(files); err != nil {
+		exitf(exitOutput, "%v", err)
 	}
 	if flags.List {
-		_, err = fmt.Fprint(os.Stdout, inv.json)
+		_, err = fmt.Fprint(inventoryOut, inv.json)
 		if err != nil {
-			log.Fatalf("Fprintf: %v", err)
+			exitf(exitOutput, "Fprintf: %v", err)
 		}
 	}
-	inv.cache.WriteExpiryFile()
+}
+
+// outputContent is a file written by output
+type outputContent struct {
+	desc     string // Logged when the file is written
+	filename string
+	content  []byte
+}
+
+// writeOutputs writes the output files, each with its detached signature if output signing is configured.  Every file
+// is signed before any is written, so nothing is published if signing fails, and each signature is written before its
+// file, so a new file never sits beside an old signature.
+func writeOutputs(files []outputContent) error {
+	sigs := make([][]byte, len(files))
+	if cfg.Output.Signing.Method != "" {
+		for i, f := range files {
+			sig, err := sign(f.content)
+			if err != nil {
+				return fmt.Errorf("unable to sign %s: %v", f.filename, err)
+			}
+			sigs[i] = sig
+		}
+	}
+	for i, f := range files {
+		if sigs[i] != nil {
+			if err := writeAtomic(signatureFile(f.filename), sigs[i]); err != nil {
+				return fmt.Errorf("unable to write signature to %s: %v", signatureFile(f.filename), err)
+			}
+			log.Infof("Signature written to %s", signatureFile(f.filename))
+		}
+		if err := writeAtomic(f.filename, f.content); err != nil {
+			return fmt.Errorf("unable to write %s to %s: %v", strings.ToLower(f.desc), f.filename, err)
+		}
+		log.Infof("%s written to %s", f.desc, f.filename)
+	}
+	return nil
+}
+
+// inventoryOut is where the inventory requested by --list or --host is written.  Ansible parses everything written to
+// stdout as the inventory, so reserveStdout ensures nothing else can reach it.
+var inventoryOut io.Writer = os.Stdout
+
+// reserveStdout reserves stdout for the inventory.  Anything else written to os.Stdout, by satinv or the libraries it
+// uses, goes to stderr instead.
+func reserveStdout() {
+	inventoryOut = os.Stdout
+	os.Stdout = os.Stderr
+}
+
+// outputStale outputs the previous inventory in place of a refresh that couldn't be completed, then exits.  The exit
+// status is success, so that Ansible accepts the inventory, unless --exit-stale was given.
+func (inv *inventory) outputStale(previous string) {
+	stale := &inventory{json: previous}
+	if flags.DryRun {
+		printSummary(stale.json)
+	} else {
+		stale.output()
+	}
+	inv.close()
+	if flags.ExitStale {
+		os.Exit(exitStale)
+	}
+	os.Exit(0)
+}
+
+// fetchFailed returns the error that ends a refresh that couldn't read from Satellite, with the exit status it
+// warrants.  If the build has exceeded its budget, the build timeout applies instead.
+func (inv *inventory) fetchFailed(msg string, err error) error {
+	// A request cancelled because the build exceeded its budget is handled as a timeout
+	inv.budget.check()
+	code := exitCode(err)
+	if appCtx.Err() != nil {
+		// The request was abandoned because satinv was asked to stop
+		code = exitCancelled
+	}
+	return &exitError{code: code, err: fmt.Errorf("%s: %v", msg, err)}
+}
+
+// loadFailed handles an inventory that couldn't be loaded for output.  If Satellite couldn't be reached, the previous
+// inventory is output in its place (unless build on_unreachable is error).  Otherwise the error is returned.
+func (inv *inventory) loadFailed(err error) error {
+	if exitCode(err) == exitUnreachable && cfg.Build.OnUnreachable == "stale" {
+		if previous := inv.previousInventory(); previous != "" {
+			log.Warnf("%v.  Using the previous inventory instead.", err)
+			inv.notify(notifier.KindAlert, "Satellite unreachable, using the previous inventory", err.Error())
+			inv.outputStale(previous)
+		}
+	}
+	return err
+}
+
+// outputHost writes the hostvars of a single host to stdout, as requested by Ansible with --host.  An unknown host has
+// no hostvars.
+func (inv *inventory) outputHost(host string) {
+	hostvars := gjson.Get(inv.json, hostvarsPath(host))
+	out := "{}"
+	if hostvars.IsObject() {
+		out = hostvars.Raw
+	}
+	if _, err := fmt.Fprintln(inventoryOut, out); err != nil {
+		exitf(exitOutput, "Fprintf: %v", err)
+	}
+}
+
+// separateHostvars removes the hostvars from the inventory, returning them if the hostvars option is file, for output
+// to output.hostvars_file.  Without _meta, Ansible requests the hostvars of each host with --host, which reads them
+// from the cached inventory.
+func (inv *inventory) separateHostvars() []byte {
+	var hostvars []byte
+	if cfg.Output.Hostvars == "file" {
+		raw := gjson.Get(inv.json, "_meta.hostvars").Raw
+		if raw == "" {
+			raw = "{}"
+		}
+		hostvars = []byte(raw + "\n")
+	}
+	var err error
+	inv.json, err = sjson.Delete(inv.json, "_meta")
+	if err != nil {
+		exitf(exitOutput, "Unable to remove hostvars: %v", err)
+	}
+	return hostvars
+}
+
+// outputFile returns the file the inventory is written to, if any.  The --output flag takes precedence over the
+// output.file option.
+func outputFile() string {
+	if flags.Output != "" {
+		return flags.Output
+	}
+	return cfg.Output.File
 }
 
 // parseHosts creates the inventory hostvars metadata for each host
 func (inv *inventory) parseHosts(hosts gjson.Result) {
 	defer timeTrack(time.Now(), "parseHosts")
-	var err error
 
-	// Import the CIDRs we want to test each address against.
-	cidr := importCIDRs()
-	if len(cidr) == 0 {
+	// The CIDRs we want to test each address against.
+	if len(inv.cidrs) == 0 {
 		log.Debug("Bypassing CIDR membership processing.  No CIDRs defined.")
 	}
 
-	// Initialize the valid inventory group
-	// validAppend is a special string used by sjson to append entries to an inventory group
-	validAppend := fmt.Sprintf("%svalid.hosts.-1", cfg.InventoryPrefix)
-	// Add "valid" to the all{children} array
-	inv.json, err = sjson.Set(inv.json, "all.children.-1", cfg.InventoryPrefix+"valid")
-	if err != nil {
-		log.Fatal(err)
+	// Add the valid groups to the all{children} array
+	if cfg.GroupEnabled(config.GroupValid) {
+		for _, rules := range inv.validRules {
+			inv.addChild(rules.group)
+		}
 	}
 
-	// Before we get into a hosts loop, create an instance of multiRE to test hostnames against Regular Expressions
-	validExcludeRE := multire.InitRegex(cfg.Valid.ExcludeRegex)
+	// Hosts are built concurrently and then merged in their original order, so the inventory doesn't depend on which
+	// finished first.
+	inv.mergeBuilds(inv.buildHosts(hosts.Get("results")))
+}
 
-	// Iterate through each host in the Satellite results
-	for _, h := range hosts.Get("results").Array() {
-		// Every individual host map should contain a "name" key
-		if !h.Get("name").Exists() {
-			log.Errorf("No hostname found in Satellite host map")
+// contentCounts are the hostvars promoted from the fields of a host's content_facet_attributes
+var contentCounts = []struct {
+	hostvar string
+	path    string
+}{
+	{"satinv_errata_security", "errata_counts.security"},
+	{"satinv_errata_bugfix", "errata_counts.bugfix"},
+	{"satinv_packages_upgradable", "upgradable_package_count"},
+}
+
+// hostvars returns the JSON hostvars of a host: Its Satellite record combined with any enrichment data, less the
+// fields in the hostvars_ignore list.
+func (inv *inventory) hostvars(host gjson.Result) (string, error) {
+	b, err := json.Marshal(host.Value())
+	if err != nil {
+		return "", err
+	}
+	hostvars := string(b)
+	// Enrichment data is added to the hostvars with a "satinv_" prefix, except that from external enrichers, which is
+	// merged into the hostvars, and NetBox, whose fields are prefixed with "netbox_".
+	for name, data := range inv.enrichments[host.Get("name").String()] {
+		if !data.Exists() {
 			continue
 		}
-		hostNameShort := shortName(h.Get("name").String())
-		log.Debugf("Parsing Satellite info for host: %s", hostNameShort)
-		key := fmt.Sprintf("_meta.hostvars.%s", hostNameShort)
-		inv.json, err = sjson.Set(inv.json, key, h.Value())
+		if name == enricher.NetBoxName {
+			data.ForEach(func(k, v gjson.Result) bool {
+				hostvars, err = sjson.SetRaw(hostvars, "netbox_"+k.String(), v.Raw)
+				return err == nil
+			})
+		} else if !containsStr(name, enricher.Names()) && data.IsObject() {
+			data.ForEach(func(k, v gjson.Result) bool {
+				hostvars, err = sjson.SetRaw(hostvars, rules.Escape(k.String()), v.Raw)
+				return err == nil
+			})
+		} else {
+			hostvars, err = sjson.SetRaw(hostvars, "satinv_"+name, data.Raw)
+		}
 		if err != nil {
-			log.Fatal(err)
+			return "", err
+		}
+	}
+	// Errata and package counts are promoted from the content facet, so playbooks don't have to dig for them
+	facet := host.Get("content_facet_attributes")
+	for _, c := range contentCounts {
+		if count := facet.Get(c.path); count.Exists() {
+			hostvars, err = sjson.Set(hostvars, c.hostvar, count.Int())
+			if err != nil {
+				return "", err
+			}
 		}
-		inv.hgValid(h, validAppend, hostNameShort, validExcludeRE)
-		if len(cidr) > 0 {
-			inv.hgCIDRMembers(h, cidr)
+	}
+	_, aliased := inv.aliases[inventoryHostname(host.Get("name").String())]
+	if (aliased || cfg.HostnameStyle == "fqdn") && !gjson.Get(hostvars, "ansible_host").Exists() {
+		// Ansible would connect to the FQDN anyway, but it's stated explicitly for consumers that rely on ansible_host.
+		// An alias may not resolve at all.
+		hostvars, err = sjson.Set(hostvars, "ansible_host", host.Get("name").String())
+		if err != nil {
+			return "", err
+		}
+	}
+	for _, path := range cfg.HostvarsIgnore {
+		hostvars, err = sjson.Delete(hostvars, path)
+		if err != nil {
+			return "", fmt.Errorf("unable to remove hostvar %s: %v", path, err)
 		}
 	}
+	return hostvars, nil
 }
 
-// parseHostCollections iterates through the Satellite Host Collections and associates hostnames with the each
-// Collection's host_ids.
-func (inv *inventory) parseHostCollections(hosts gjson.Result) {
-	defer timeTrack(time.Now(), "parseHostCollections")
-	collectionsURL := fmt.Sprintf("%s/katello/api/host_collections", cfg.API.BaseURL)
-	inv.cache.AddURL(collectionsURL, "host_collections.json", cfg.Cache.ValidityCollections)
-	collections, err := inv.cache.GetURL(collectionsURL)
+// hostCollection is a Host Collection and the short names of its members
+type hostCollection struct {
+	name    string
+	members []string
+}
+
+// loadCollections fetches the Satellite Host Collections and resolves the members of each Collection.  Collections
+// whose members can't be resolved are omitted.
+func (inv *inventory) loadCollections(hosts gjson.Result) error {
+	defer timeTrack(time.Now(), "loadCollections")
+	// The index of hostnames is used to resolve the host_ids of each Collection
+	inv.hostNames = make(map[string]string)
+	hosts.Get("results").ForEach(func(_, h gjson.Result) bool {
+		if h.Get("name").Exists() {
+			inv.hostNames[h.Get("id").String()] = h.Get("name").String()
+		}
+		return true
+	})
+	collections, err := inv.getCollections()
 	if err != nil {
-		log.Fatalf("Unable to read JSON from file: %v", err)
+		return err
 	}
-	for _, c := range collections.Get("results").Array() {
+	inv.checkTruncated("host_collections", collections)
+	inv.collections = nil
+	inv.memberOf = make(map[string][]string)
+	results := collections.Get("results").Array()
+	p := newProgress("loadCollections", "Host Collections", len(results))
+	for _, c := range results {
 		hostCollectionName := c.Get("name").String()
 		hostCollectionID := c.Get("id").String()
 		log.Debugf("Parsing Satellite Host Collection. Name=%s, ID=%s", hostCollectionName, hostCollectionID)
-		hostCollection, err := inv.getHostCollection(hostCollectionID)
+		var members []string
+		if cfg.HostCollections.Mode == "search" {
+			members, err = inv.searchCollectionMembers(hostCollectionName, hostCollectionID)
+		} else {
+			members, err = inv.collectionMembers(hostCollectionID)
+		}
+		p.step()
 		if err != nil {
 			log.Warnf("Unable to get host_collection: %v", err)
 			continue
 		}
-		collectionKey := mkInventoryName(hostCollectionName)
-		inv.json, err = sjson.Set(inv.json, "all.children.-1", collectionKey)
-		if err != nil {
-			log.Fatal(err)
+		collection := hostCollection{name: hostCollectionName}
+		for _, host := range members {
+			collection.members = append(collection.members, inventoryHostname(host))
+			inv.memberOf[inventoryHostname(host)] = append(inv.memberOf[inventoryHostname(host)], hostCollectionName)
 		}
-		collectionAppend := fmt.Sprintf("%s.hosts.-1", collectionKey)
-		for _, v := range hostCollection.Get("host_ids").Array() {
-			host, err := getHostByID(hosts, v.String())
-			if err != nil {
-				log.Warnf("Cannot fetch host by ID: %v", err)
+		inv.collections = append(inv.collections, collection)
+	}
+	return nil
+}
+
+// parseHostCollections adds an inventory group for each of the Host Collections resolved by loadCollections.
+func (inv *inventory) parseHostCollections() {
+	p := newProgress("parseHostCollections", "Host Collections", len(inv.collections))
+	for _, c := range inv.collections {
+		collectionKey := mkInventoryName(config.GroupCollections, c.name)
+		inv.addChild(collectionKey)
+		for _, host := range c.members {
+			if inv.excludedFromInventory(host) {
 				continue
 			}
-			inv.json, err = sjson.Set(inv.json, collectionAppend, shortName(host))
-			if err != nil {
-				log.Fatal(err)
-			}
+			inv.addHost(collectionKey, inv.hostname(host))
 		}
+		p.step()
 	}
 }
 
-// hgValid creates an inventory group of hosts that meet "valid" conditions.
-func (inv *inventory) hgValid(host gjson.Result, validAppend, hostNameShort string, validExcludeRE multire.MultiRE) {
-	// Test if the host is excluded in the Config file
-	if containsStr(hostNameShort, cfg.Valid.ExcludeHosts) {
-		log.Infof("%svalid: Host %s is excluded from inventory group", cfg.InventoryPrefix, hostNameShort)
-		return
+// collectionMembers returns the names of the hosts in a Host Collection by fetching the Collection and resolving each
+// of its host_ids against the index of hosts.
+func (inv *inventory) collectionMembers(id string) ([]string, error) {
+	hostCollection, err := inv.getHostCollection(id)
+	if err != nil {
+		return nil, err
 	}
-	// Test if the host is excluded by regex matching the hostname
-	if validExcludeRE.Match(hostNameShort) {
-		log.Infof("%svalid: Host %s is excluded from inventory group by Regular Expression match", cfg.InventoryPrefix, hostNameShort)
-		return
+	var members []string
+	for _, v := range hostCollection.Get("host_ids").Array() {
+		host, err := inv.hostByID(v.String())
+		if err != nil {
+			log.Warnf("Cannot fetch host by ID: %v", err)
+			continue
+		}
+		members = append(members, host)
 	}
-	// Check the host has a valid Operating System installed
-	osid := host.Get("operatingsystem_id")
-	if !osid.Exists() || osid.Int() == 0 {
-		log.Debugf("%svalid: No valid OS found for %s", cfg.InventoryPrefix, hostNameShort)
-		return
+	return members, nil
+}
+
+// collectionHostsURL returns the Satellite API URL that searches for the hosts in a Host Collection.
+func collectionHostsURL(id string) string {
+	return fmt.Sprintf("%s&search=%s", hostsURL(), url.QueryEscape("host_collection_id="+id))
+}
+
+// registerCollectionHosts adds the URL of the hosts search for a Host Collection to the cache.
+func (inv *inventory) registerCollectionHosts(id string) {
+	inv.cache.AddURL(collectionHostsURL(id), fmt.Sprintf("host_collection_hosts_%s.json", id), cfg.Cache.ValidityCollections)
+}
+
+// searchCollectionMembers returns the names of the hosts in a Host Collection using a hosts search.  Satellite returns
+// the names directly, avoiding the need to resolve each host ID.
+func (inv *inventory) searchCollectionMembers(name, id string) ([]string, error) {
+	inv.registerCollectionHosts(id)
+	gj, err := inv.cache.GetURL(collectionHostsURL(id))
+	if err != nil {
+		return nil, err
 	}
-	// Ensure the host has a valid subscription
-	subStatus := host.Get("subscription_status")
-	if !subStatus.Exists() {
-		log.Warnf("%svalid: subscription_status not found for %s", cfg.InventoryPrefix, hostNameShort)
-		return
+	inv.checkTruncated(fmt.Sprintf("host collection %s", name), gj)
+	var members []string
+	for _, h := range gj.Get("results.#.name").Array() {
+		members = append(members, h.String())
+	}
+	return members, nil
+}
+
+// cidrGroups compares the IPv4 address of a host to a list of CIDRs and returns the names of the CIDRs it's a member
+// of.
+func cidrGroups(host gjson.Result, cidr cidrs.Cidrs) []string {
+	if len(cidr) == 0 {
+		return nil
+	}
+	// Test the validity of the address for CIDR membership processing.
+	gjIP4 := host.Get("ip")
+	if !gjIP4.Exists() {
+		return nil
+	}
+	ip4 := gjIP4.String()
+	if ip4 == "" {
+		return nil
 	}
-	if subStatus.Int() != 0 && !cfg.Valid.Unlicensed {
-		log.Infof("%svalid: Invalid subscription status (%d) for %s", cfg.InventoryPrefix, subStatus.Int(), hostNameShort)
+	return cidr.ParseCIDRs(ip4)
+}
+
+// hgCIDRMembers adds a host to an inventory group for each of the CIDRs its address is a member of.
+func hgCIDRMembers(b *hostBuild, invGrps []string) {
+	if !cfg.GroupEnabled(config.GroupCIDRs) {
 		return
 	}
+	for _, invGrp := range invGrps {
+		b.addGroup(mkInventoryName(config.GroupCIDRs, invGrp), false)
+	}
+}
+
+// jsonFailed records a failure to update the inventory json at a path.  sjson only fails given a malformed path or
+// document, so rather than every update returning an error, the first failure is kept and returned when the refresh
+// enters its next phase.
+func (inv *inventory) jsonFailed(path string, err error) {
+	if inv.jsonErr == nil {
+		inv.jsonErr = &exitError{code: exitOutput, err: fmt.Errorf("unable to set %s in the inventory: %v", path, err)}
+	}
+}
 
-	// Check last_checkin date
-	checkin := host.Get("subscription_facet_attributes.last_checkin")
-	if !checkin.Exists() {
-		log.Warnf("%svalid: subscription_facet_attributes.last_checkin not found for %s", cfg.InventoryPrefix, hostNameShort)
+// addChild adds a group to the all.children array, unless it has already been added.
+func (inv *inventory) addChild(group string) {
+	if inv.children == nil {
+		inv.children = make(map[string]bool)
+	}
+	if inv.children[group] {
 		return
 	}
-	satTime, err := satTimestamp(checkin.String())
+	var err error
+	inv.json, err = sjson.Set(inv.json, "all.children.-1", group)
 	if err != nil {
-		// consider the host to be invalid
-		log.Warnf("%svalid: Cannot parse date/time string %s for host %s", cfg.InventoryPrefix, checkin.String(), hostNameShort)
+		inv.jsonFailed("all.children", err)
 		return
 	}
-	if satTime.Before(inv.oldestValidTime) {
-		log.Infof("Last checkin for %s is too old. Excluding from %s_valid.", hostNameShort, cfg.InventoryPrefix)
+	inv.children[group] = true
+}
+
+// addHost appends a host to a group's hosts array, unless it's already a member.  Host Collections can list a host
+// more than once and distinct hosts can share a shortname, neither of which should result in duplicate entries.
+func (inv *inventory) addHost(group, hostNameShort string) {
+	if !inv.addMember(group, hostNameShort) {
 		return
 	}
-
-	// All the above conditions passed; this is a valid host.
-	inv.json, err = sjson.Set(inv.json, validAppend, hostNameShort)
+	var err error
+	inv.json, err = sjson.Set(inv.json, rules.Escape(group)+".hosts.-1", hostNameShort)
 	if err != nil {
-		log.Fatal(err)
+		inv.jsonFailed(group+".hosts", err)
 	}
 }
 
-// hgCIDRMembers compares the IPv4 address of the current host to a list of CIDRs.  When the address is a member of a
-// CIDR, its appended to an inventory group for that CIDR.
-func (inv *inventory) hgCIDRMembers(host gjson.Result, cidr cidrs.Cidrs) {
-	hostNameShort := shortName(host.Get("name").String())
-
-	// Test the validity of the address for CIDR membership processing.
-	gjIP4 := host.Get("ip")
-	if !gjIP4.Exists() {
-		return
+// addMember records a host's membership of a group, without adding it to the group's hosts array.  It returns false
+// if the host is already a member.
+func (inv *inventory) addMember(group, hostNameShort string) bool {
+	if inv.members == nil {
+		inv.members = make(map[string]map[string]bool)
 	}
-	ip4 := gjIP4.String()
-	if ip4 == "" {
-		return
+	if inv.members[group] == nil {
+		inv.members[group] = make(map[string]bool)
 	}
-
-	// invGrps will contain a slice of all inventory groups the address is a member of.
-	invGrps := cidr.ParseCIDRs(ip4)
-
-	var err error
-	for _, invGrp := range invGrps {
-		sjKey := fmt.Sprintf("%s.hosts.-1", mkInventoryName(invGrp))
-		inv.json, err = sjson.Set(inv.json, sjKey, hostNameShort)
-		if err != nil {
-			log.Warnf("hgCIDRMembers: %s: %v", hostNameShort, err)
-		}
+	if inv.members[group][hostNameShort] {
+		return false
 	}
+	inv.members[group][hostNameShort] = true
+	return true
 }
 
 // timeTrack can be used to time the processing duration of a function.
@@ -357,33 +1264,81 @@ func timeTrack(start time.Time, name string) {
 func main() {
 	var err error
 	flags = config.ParseFlags()
-	cfg, err = config.ParseConfig(flags.Config)
+	if (flags.List || flags.Host != "") && !flags.DryRun {
+		reserveStdout()
+	}
+	if len(flags.Args) > 0 && flags.Args[0] == "config" {
+		if err := configCommand(flags.Args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "satinv: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	cfg, err = config.ParseConfigFormat(flags.Config, flags.ConfigFormat)
 	if err != nil {
-		log.Fatalf("Cannot parse config: %v", err)
+		exitf(exitConfig, "Cannot parse config: %v", err)
 	}
 	loglev, err := loglevel.ParseLevel(cfg.Logging.LevelStr)
 	if err != nil {
-		log.Fatalf("Unable to set log level: %v", err)
+		exitf(exitConfig, "Unable to set log level: %v", err)
 	}
-	if cfg.Logging.Journal && !jlog.Enabled() {
+	journal, journalOK := journalLogger(loglev)
+	if cfg.Logging.Journal && !journalOK && !flags.LogStderr {
 		log.Warn("Cannot log to systemd journal")
 	}
-	if cfg.Logging.Journal && jlog.Enabled() {
-		log.Current = jlog.NewJournal(loglev)
+	if flags.LogStderr {
+		stdlog.SetOutput(os.Stderr)
+		log.Current = log.StdLogger{Level: loglev}
+		log.Debugf("Logging to stderr has been initialised at level: %s", cfg.Logging.LevelStr)
+	} else if cfg.Logging.Journal && journalOK {
+		log.Current = journal
 		log.Debugf("Logging to journal has been initialised at level: %s", cfg.Logging.LevelStr)
 	} else {
 		if cfg.Logging.Filename == "" {
-			log.Fatal("Cannot log to file, no filename specified in config")
+			exitf(exitConfig, "Cannot log to file, no filename specified in config (or use --log-stderr)")
 		}
 		logWriter, err := os.OpenFile(cfg.Logging.Filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
 		if err != nil {
-			log.Fatalf("Unable to open logfile: %s", err)
+			exitf(exitConfig, "Unable to open logfile: %s", err)
 		}
 		defer logWriter.Close()
 		stdlog.SetOutput(logWriter)
 		log.Current = log.StdLogger{Level: loglev}
 		log.Debugf("Logging to file %s has been initialised at level: %s", cfg.Logging.Filename, cfg.Logging.LevelStr)
 	}
-	// Time to do some real work
-	mkInventory()
+	if flags.Debug {
+		log.Warn("--debug is deprecated and will be removed.  Use --log-stderr instead.")
+	}
+	// Warnings are recorded, regardless of the log level, for the satinv_meta of each inventory
+	log.Current = recordWarnings(log.Current)
+	stopSignals := handleSignals()
+	defer stopSignals()
+	tracing.Configure(tracing.Options{
+		Endpoint:    cfg.Tracing.Endpoint,
+		ServiceName: cfg.Tracing.ServiceName,
+		Headers:     cfg.Tracing.Headers,
+		Timeout:     time.Duration(cfg.Tracing.Timeout) * time.Second,
+	})
+	configureRateLimit()
+	stopProfiling, err := startProfiling()
+	if err != nil {
+		exitf(exitConfig, "Unable to start profiling: %v", err)
+	}
+	defer stopProfiling()
+	// Subcommands replace the default behaviour of producing an inventory
+	command := "inventory"
+	if len(flags.Args) > 0 {
+		command = flags.Args[0]
+		err = runCommand(flags.Args)
+	} else {
+		// Time to do some real work
+		err = mkInventory()
+	}
+	if err != nil {
+		log.Errorf("%s: %v", command, err)
+		fmt.Fprintf(os.Stderr, "satinv: %v\n", err)
+		stopSignals()
+		stopProfiling()
+		os.Exit(exitCode(err))
+	}
 }
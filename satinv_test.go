@@ -0,0 +1,1958 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/cacher"
+	"github.com/crooks/satinv/config"
+	"github.com/crooks/satinv/rules"
+	"github.com/crooks/satinv/satinvmock"
+	"github.com/crooks/satinv/tracing"
+	"github.com/tidwall/gjson"
+	"golang.org/x/crypto/ssh"
+)
+
+// setup points satinv at a mock Satellite, with a config containing the given additional YAML, and returns a function
+// that removes the temporary cache dir.
+func setup(t *testing.T, baseURL, extra string) func() {
+	t.Helper()
+	log.Current = log.StdLogger{Level: log.ErrorLevel}
+	dir, err := os.MkdirTemp("", "satinv")
+	if err != nil {
+		t.Fatalf("Unable to create TempDir: %v", err)
+	}
+	cfgFile := path.Join(dir, "satinv.yml")
+	// The demo Satellite has an SCA Organization, which the tests expect to be detected
+	yml := fmt.Sprintf("api:\n  baseurl: %s\ncache:\n  dir: %s\ncidrs:\n  web: 10.0.1.0/24\nsca: auto\n%s", baseURL, path.Join(dir, "cache"), extra)
+	if err := ioutil.WriteFile(cfgFile, []byte(yml), 0644); err != nil {
+		t.Fatalf("Unable to write config: %v", err)
+	}
+	cfg, err = config.ParseConfig(cfgFile)
+	if err != nil {
+		t.Fatalf("ParseConfig returned: %v", err)
+	}
+	flags = &config.Flags{Config: cfgFile}
+	return func() {
+		os.RemoveAll(dir)
+	}
+}
+
+// testInventory returns a new inventory, failing the test if it can't be initialised.
+func testInventory(t *testing.T) *inventory {
+	t.Helper()
+	inv, err := newInventory()
+	if err != nil {
+		t.Fatalf("newInventory returned: %v", err)
+	}
+	return inv
+}
+
+// cacheInventory writes an inventory to the cache, so that commands load it instead of refreshing it.
+func cacheInventory(t *testing.T, invJSON string) {
+	t.Helper()
+	inv := testInventory(t)
+	defer inv.close()
+	if err := inv.cache.PutFile(inventoryName, []byte(invJSON)); err != nil {
+		t.Fatalf("Unable to cache the inventory: %v", err)
+	}
+}
+
+// readOutput returns the content of a file written by a test, failing the test if it can't be read.
+func readOutput(t *testing.T, filename string) string {
+	t.Helper()
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Unable to read %s: %v", filename, err)
+	}
+	return string(b)
+}
+
+// captureStdout returns what a function writes to stdout, and the error it returns.
+func captureStdout(t *testing.T, f func() error) (string, error) {
+	t.Helper()
+	tmp, err := os.CreateTemp("", "satinv-stdout")
+	if err != nil {
+		t.Fatalf("Unable to create TempFile: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	stdout := os.Stdout
+	os.Stdout = tmp
+	err = f()
+	os.Stdout = stdout
+	tmp.Close()
+	return readOutput(t, tmp.Name()), err
+}
+
+// members returns the sorted hosts in an inventory group.
+func members(invJSON, group string) string {
+	var hosts []string
+	for _, h := range gjson.Get(invJSON, group+".hosts").Array() {
+		hosts = append(hosts, h.String())
+	}
+	sort.Strings(hosts)
+	return strings.Join(hosts, ",")
+}
+
+// checkGroups compares the members of inventory groups with those expected.
+func checkGroups(t *testing.T, invJSON string, expected map[string]string) {
+	t.Helper()
+	for group, want := range expected {
+		if got := members(invJSON, group); got != want {
+			t.Errorf("Unexpected members of %s.  Expected=%q, Got=%q", group, want, got)
+		}
+	}
+}
+
+func TestRefreshInventory(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	checkGroups(t, inv.json, map[string]string{
+		// app01 has an invalid subscription but app02 is in an SCA Organization
+		"valid":       "app02,web01,web02",
+		"stale":       "db01",
+		"web":         "web01,web02",
+		"web_servers": "web01,web02",
+		"databases":   "db01",
+	})
+	if n := len(gjson.Get(inv.json, "_meta.hostvars").Map()); n != 6 {
+		t.Errorf("Expected hostvars for 6 hosts, got %d", n)
+	}
+	if !gjson.Get(inv.json, "_meta.hostvars.app02.satinv_sca").Bool() {
+		t.Error("Expected app02 to be marked as using Simple Content Access")
+	}
+	if !strings.HasSuffix(inv.json, "\n") {
+		t.Error("Inventory should end with a newline")
+	}
+	if r := inv.run; r.hosts != 6 || r.valid != 3 || len(r.excluded) != 3 || r.excluded[checkCheckinAge] != 1 {
+		t.Errorf("Unexpected run summary: hosts=%d, valid=%d, excluded=%v", r.hosts, r.valid, r.excluded)
+	}
+
+	// A second refresh should be built from the cache
+	inv = testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	if n := sat.Requests("/api/v2/hosts"); n != 1 {
+		t.Errorf("Expected a single hosts request, got %d", n)
+	}
+	checkGroups(t, inv.json, map[string]string{"valid": "app02,web01,web02"})
+}
+
+func TestRefreshInventorySearch(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "host_collections:\n  mode: search\ninventory_prefix: sat_\n")()
+	cfg.SCA = "off"
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	checkGroups(t, inv.json, map[string]string{
+		"sat_valid":       "web01,web02",
+		"sat_web_servers": "web01,web02",
+		"sat_databases":   "db01",
+	})
+	if n := sat.Requests("/katello/api/host_collections/1"); n != 0 {
+		t.Errorf("Search mode should not fetch individual collections, got %d requests", n)
+	}
+	if n := sat.Requests("/katello/api/organizations"); n != 0 {
+		t.Errorf("Organizations should not be fetched when sca is off, got %d requests", n)
+	}
+}
+
+func TestHostParameters(t *testing.T) {
+	sat := satinvmock.Demo()
+	now := time.Now().UTC()
+	params := func(alias, groups string) map[string]interface{} {
+		return map[string]interface{}{"all_parameters": []map[string]string{
+			{"name": "satinv_alias", "value": alias},
+			{"name": "satinv_groups", "value": groups},
+		}}
+	}
+	sat.AddHost(satinvmock.Host{ID: 7, Name: "lx0042.example.com", IP: "10.0.1.42", OperatingSystemID: 1,
+		OperatingSystem: "RedHat 8.6", LastCheckin: now, UpdatedAt: now, OrganizationID: 1,
+		Extra: params("legacy-web", "dmz, Backup Nightly,")})
+	// An alias that's already the name of another host is ignored
+	sat.AddHost(satinvmock.Host{ID: 8, Name: "lx0043.example.com", IP: "10.0.1.43", UpdatedAt: now,
+		Extra: params("web01", "dmz")})
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "alias_parameter: satinv_alias\ngroups_parameter: satinv_groups\n")()
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	checkGroups(t, inv.json, map[string]string{
+		"valid":          "app02,legacy-web,web01,web02",
+		"web":            "legacy-web,lx0043,web01,web02",
+		"dmz":            "legacy-web,lx0043",
+		"backup_nightly": "legacy-web",
+	})
+	if h := gjson.Get(inv.json, "_meta.hostvars.legacy-web.ansible_host").String(); h != "lx0042.example.com" {
+		t.Errorf("Expected ansible_host of legacy-web to be lx0042.example.com, got %q", h)
+	}
+	if gjson.Get(inv.json, "_meta.hostvars.lx0042").Exists() {
+		t.Error("Aliased host lx0042 should not be in the hostvars by its Satellite name")
+	}
+	if gjson.Get(inv.json, "_meta.hostvars.lx0043.ansible_host").Exists() {
+		t.Error("Unaliased host lx0043 should not be given an ansible_host")
+	}
+}
+
+func TestExcludeParameter(t *testing.T) {
+	expected := map[string]map[string]string{
+		"valid": {"valid": "app02,app03,web01,web02", "web": "dec01,web01,web02", "decommissioned": "dec01"},
+		"all":   {"valid": "app02,app03,web01,web02", "web": "web01,web02", "decommissioned": ""},
+	}
+	for scope, groups := range expected {
+		sat := satinvmock.Demo()
+		now := time.Now().UTC()
+		exclude := func(value string) map[string]interface{} {
+			return map[string]interface{}{"all_parameters": []map[string]string{{"name": "satinv_exclude", "value": value}}}
+		}
+		sat.AddHost(satinvmock.Host{ID: 7, Name: "dec01.example.com", IP: "10.0.1.7", OperatingSystemID: 1,
+			OperatingSystem: "RedHat 8.6", LastCheckin: now, UpdatedAt: now, OrganizationID: 1, Extra: exclude("true")})
+		// A value that isn't a boolean doesn't exclude the host
+		sat.AddHost(satinvmock.Host{ID: 8, Name: "app03.example.com", IP: "10.0.3.3", OperatingSystemID: 1,
+			OperatingSystem: "RedHat 8.6", LastCheckin: now, UpdatedAt: now, OrganizationID: 2, Extra: exclude("maybe")})
+		sat.AddCollection(satinvmock.Collection{ID: 3, Name: "Decommissioned", HostIDs: []int{7}})
+		ts := sat.Start()
+		cleanup := setup(t, ts.URL, "exclude_parameter:\n  name: satinv_exclude\n  scope: "+scope+"\n")
+		inv := testInventory(t)
+		if err := inv.refreshInventory(); err != nil {
+			t.Fatal(err)
+		}
+		inv.close()
+		ts.Close()
+		cleanup()
+		checkGroups(t, inv.json, groups)
+		if listed := gjson.Get(inv.json, hostvarsPath("dec01")).Exists(); listed != (scope == "valid") {
+			t.Errorf("scope %s: Unexpected presence of dec01 in the hostvars: %v", scope, listed)
+		}
+		if n := inv.run.excluded[checkExcludedParam]; n != 1 {
+			t.Errorf("scope %s: Expected 1 host excluded by its parameter, got %d", scope, n)
+		}
+	}
+}
+
+func TestRefreshInventoryFromFile(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	// Capture a hosts export from the mock and then build an inventory from it, without the API
+	resp, err := http.Get(ts.URL + "/api/v2/hosts?per_page=1000")
+	if err != nil {
+		t.Fatalf("Unable to export hosts: %v", err)
+	}
+	hosts, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("Unable to read hosts: %v", err)
+	}
+	hostsFile := path.Join(cfg.Cache.Dir, "..", "hosts.json")
+	if err := ioutil.WriteFile(hostsFile, hosts, 0644); err != nil {
+		t.Fatalf("Unable to write hosts file: %v", err)
+	}
+	flags.FromFile = hostsFile
+	requests := sat.Requests("/api/v2/hosts")
+	inv := testInventory(t)
+	if err := inv.load(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	if n := sat.Requests("/api/v2/hosts"); n != requests {
+		t.Errorf("Expected no API requests when reading hosts from a file, got %d", n-requests)
+	}
+	// Without the API, Organizations are unknown so app02 isn't treated as SCA
+	checkGroups(t, inv.json, map[string]string{"valid": "web01,web02", "stale": "db01", "web_servers": ""})
+}
+
+func TestNewInventoryErrors(t *testing.T) {
+	defer setup(t, "http://127.0.0.1:0", "valid:\n  exclude_regex:\n    - \"[bad\"\n")()
+	if _, err := newInventory(); err == nil || !strings.Contains(err.Error(), "[bad") {
+		t.Errorf("Expected an error for an invalid exclude_regex, got: %v", err)
+	}
+	cfg.Valid.ExcludeRegex = nil
+	cfg.CIDRs["bad"] = "10.0.0.0/40"
+	if _, err := newInventory(); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Errorf("Expected an error for an invalid CIDR, got: %v", err)
+	}
+}
+
+func TestExcludeFields(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	extra := "valid:\n  exclude_fields:\n    - field: fqdn\n      regex: ^web02\\.\n    - field: ip\n      regex: ^10\\.0\\.3\\.\n    - field: location\n      regex: .\n"
+	defer setup(t, ts.URL, extra)()
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	// The location entry doesn't match as the hosts have no location
+	checkGroups(t, inv.json, map[string]string{"valid": "web01", "web": "web01,web02"})
+
+	cfg.Valid.ExcludeFields = append(cfg.Valid.ExcludeFields, config.FieldRegex{Field: "name", Regex: "[bad"})
+	if _, err := newInventory(); err == nil || !strings.Contains(err.Error(), "[bad") {
+		t.Errorf("Expected an error for an invalid exclude_fields regex, got: %v", err)
+	}
+}
+
+func TestIncludeAllowlist(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "valid:\n  include_hosts:\n    - app02\n  include_regex:\n    - ^web0[1]\n    - ^db\n")()
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	// db01 is included but still fails the checkin age condition
+	checkGroups(t, inv.json, map[string]string{"valid": "app02,web01", "stale": "db01"})
+}
+
+func TestValidOverrides(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "valid_overrides:\n  Databases:\n    hours: 300\n  apps:\n    include_unlicensed: true\nvalid_variants:\n  strict:\n    hours: 48\n")()
+	cfg.CIDRs["apps"] = "10.0.3.0/24"
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	// db01 is given longer to check in by its Host Collection and app01 is tolerated as unlicensed by its CIDR
+	checkGroups(t, inv.json, map[string]string{
+		"valid":        "app01,app02,db01,web01,web02",
+		"stale":        "",
+		"valid_strict": "app02,web01,web02",
+		"databases":    "db01",
+	})
+}
+
+func TestSubnets(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "subnets:\n  mode: merge\n")()
+	cfg.CIDRs["subnet_Web"] = "10.0.1.1/32"
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	// The cidrs option takes precedence over a subnet of the same name
+	checkGroups(t, inv.json, map[string]string{
+		"web":             "web01,web02",
+		"subnet_web":      "web01",
+		"subnet_app_tier": "app01,app02",
+	})
+	cfg.Subnets.Mode = "replace"
+	cfg.Subnets.Prefix = "net_"
+	inv = testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	checkGroups(t, inv.json, map[string]string{
+		"web":          "",
+		"net_web":      "web01,web02",
+		"net_app_tier": "app01,app02",
+	})
+	if n := sat.Requests("/api/v2/subnets"); n != 1 {
+		t.Errorf("Subnets should be cached.  Expected=1 request, Got=%d", n)
+	}
+}
+
+func TestGroupExpressions(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, `group_expressions:
+  ring1: valid AND web
+  ring2: (valid OR stale) AND NOT ring1
+  unmanaged: all AND NOT (valid OR stale)
+  valid: web
+`)()
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	// An expression can't replace a generated group
+	checkGroups(t, inv.json, map[string]string{
+		"ring1":     "web01,web02",
+		"ring2":     "app02,db01",
+		"unmanaged": "app01,new01",
+		"valid":     "app02,web01,web02",
+	})
+}
+
+func TestMergeStatic(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "group_expressions:\n  managed: all AND NOT network\n")()
+	cfg.Merge.InventoryFile = path.Join(cfg.Cache.Dir, "..", "static.yml")
+	err := ioutil.WriteFile(cfg.Merge.InventoryFile, []byte(`all:
+  children:
+    network:
+      hosts:
+        switch1.example.com:
+          ansible_host: 10.9.0.1
+      vars:
+        ansible_connection: network_cli
+    web:
+      hosts:
+        web01:
+          ip: 192.0.2.1
+          owner: webteam
+`), 0644)
+	if err != nil {
+		t.Fatalf("Unable to write static inventory: %v", err)
+	}
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	checkGroups(t, inv.json, map[string]string{
+		"network": "switch1.example.com",
+		"web":     "web01,web02",
+		"managed": "app01,app02,db01,new01,web01,web02",
+	})
+	if got := gjson.Get(inv.json, `_meta.hostvars.switch1\.example\.com.ansible_host`).String(); got != "10.9.0.1" {
+		t.Errorf("Unexpected static hostvar: %q", got)
+	}
+	if got := gjson.Get(inv.json, "network.vars.ansible_connection").String(); got != "network_cli" {
+		t.Errorf("Unexpected group var: %q", got)
+	}
+	// By default, Satellite's hostvars take precedence over those in the file
+	if ip, owner := gjson.Get(inv.json, "_meta.hostvars.web01.ip").String(), gjson.Get(inv.json, "_meta.hostvars.web01.owner").String(); ip != "10.0.1.1" || owner != "webteam" {
+		t.Errorf("Unexpected merged hostvars: ip=%s, owner=%s", ip, owner)
+	}
+	cfg.Merge.Precedence = "file"
+	inv = testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	if ip := gjson.Get(inv.json, "_meta.hostvars.web01.ip").String(); ip != "192.0.2.1" {
+		t.Errorf("The file should take precedence, got ip=%s", ip)
+	}
+}
+
+func TestHostnameStyleFQDN(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "hostname_style: fqdn\n")()
+	cfg.Valid.ExcludeHosts = []string{"web02.example.com"}
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	checkGroups(t, inv.json, map[string]string{
+		"valid":       "app02.example.com,web01.example.com",
+		"web":         "web01.example.com,web02.example.com",
+		"web_servers": "web01.example.com,web02.example.com",
+	})
+	hostvars := gjson.Get(inv.json, `_meta.hostvars.web01\.example\.com`)
+	if got := hostvars.Get("ansible_host").String(); got != "web01.example.com" {
+		t.Errorf("Unexpected ansible_host: %q", got)
+	}
+	if gjson.Get(inv.json, "_meta.hostvars.web01").Exists() {
+		t.Error("Hosts should not be keyed by their shortname")
+	}
+}
+
+func TestContentCounts(t *testing.T) {
+	sat := satinvmock.Demo()
+	now := time.Now().UTC()
+	sat.AddHost(satinvmock.Host{ID: 7, Name: "patch01.example.com", IP: "10.0.5.1", OperatingSystemID: 1,
+		OperatingSystem: "RedHat 8.6", LastCheckin: now, UpdatedAt: now, OrganizationID: 1,
+		Extra: map[string]interface{}{"content_facet_attributes": map[string]interface{}{
+			"errata_counts":            map[string]interface{}{"security": 3, "bugfix": 5, "enhancement": 1, "total": 9},
+			"upgradable_package_count": 42,
+		}}})
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	hostvars := gjson.Get(inv.json, "_meta.hostvars.patch01")
+	for hostvar, want := range map[string]int64{"satinv_errata_security": 3, "satinv_errata_bugfix": 5, "satinv_packages_upgradable": 42} {
+		if got := hostvars.Get(hostvar); got.Int() != want {
+			t.Errorf("Unexpected %s: Expected=%d, Got=%s", hostvar, want, got.Raw)
+		}
+	}
+	// Counts are only given for hosts with a content facet
+	if gjson.Get(inv.json, "_meta.hostvars.web01.satinv_errata_security").Exists() {
+		t.Error("web01 has no content facet, so should have no errata counts")
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	sat := satinvmock.Demo()
+	sat.AddCollection(satinvmock.Collection{ID: 3, Name: "Empty"})
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	inv := testInventory(t)
+	uncollected, invalid, err := inv.coverage(inv.validRules[0])
+	inv.close()
+	if err != nil {
+		t.Fatalf("coverage returned: %v", err)
+	}
+	var hosts []string
+	for _, h := range uncollected {
+		hosts = append(hosts, fmt.Sprintf("%s:%t", h.Host, h.Valid))
+	}
+	if got := strings.Join(hosts, ","); got != "app01:false,app02:true,new01:false" {
+		t.Errorf("Unexpected uncollected hosts: %s", got)
+	}
+	// Databases only contains the stale db01
+	var collections []string
+	for _, c := range invalid {
+		collections = append(collections, fmt.Sprintf("%s%v", c.Name, c.Members))
+	}
+	if got := strings.Join(collections, ","); got != "Databases[db01],Empty[]" {
+		t.Errorf("Unexpected invalid collections: %s", got)
+	}
+}
+
+func TestSatTimestamp(t *testing.T) {
+	defer setup(t, "http://127.0.0.1:0", "")()
+	want := time.Date(2023, 5, 1, 10, 0, 0, 0, time.UTC)
+	for _, ts := range []string{
+		"2023-05-01 10:00:00 UTC",
+		"2023-05-01 11:00:00 +0100",
+		"2023-05-01 11:00:00 +01:00",
+		"2023-05-01T10:00:00Z",
+		"2023-05-01T12:00:00.000+02:00",
+		"2023-05-01T11:00:00+0100",
+		"2023-05-01 10:00:00",
+	} {
+		got, err := satTimestamp(ts)
+		if err != nil {
+			t.Errorf("%s: satTimestamp returned: %v", ts, err)
+		} else if !got.Equal(want) {
+			t.Errorf("%s: Expected=%s, Got=%s", ts, want, got)
+		}
+	}
+	if _, err := satTimestamp("01/05/2023 10:00"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+	cfg.TimestampLayout = "02/01/2006 15:04"
+	if got, err := satTimestamp("01/05/2023 10:00"); err != nil || !got.Equal(want) {
+		t.Errorf("Custom layout: Expected=%s, Got=%s (%v)", want, got, err)
+	}
+}
+
+func TestEncryptedCache(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	cfg.Cache.EncryptionKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	b, err := ioutil.ReadFile(path.Join(cfg.Cache.Dir, "hosts.json"))
+	if err != nil {
+		t.Fatalf("Unable to read hosts cache: %v", err)
+	}
+	if strings.Contains(string(b), "web01") {
+		t.Error("Hosts cache file should be encrypted")
+	}
+	// A second refresh is built from the encrypted cache
+	inv = testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	if n := sat.Requests("/api/v2/hosts"); n != 1 {
+		t.Errorf("Expected a single hosts request, got %d", n)
+	}
+	checkGroups(t, inv.json, map[string]string{"valid": "app02,web01,web02"})
+
+	// Without the key, the cached inventory is unreadable and is rebuilt
+	cfg.Cache.EncryptionKey = ""
+	inv = testInventory(t)
+	if err := inv.load(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	checkGroups(t, inv.json, map[string]string{"valid": "app02,web01,web02"})
+}
+
+func TestMemoryCache(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	disk := false
+	cfg.Cache.Disk = &disk
+	memoryCache = cacher.NewMemory()
+	for i := 0; i < 2; i++ {
+		inv := testInventory(t)
+		if err := inv.load(); err != nil {
+			t.Fatal(err)
+		}
+		inv.close()
+		checkGroups(t, inv.json, map[string]string{"valid": "app02,web01,web02"})
+	}
+	if n := sat.Requests("/api/v2/hosts"); n != 1 {
+		t.Errorf("Expected the second inventory to be served from memory, got %d hosts requests", n)
+	}
+	if _, err := os.Stat(cfg.Cache.Dir); !os.IsNotExist(err) {
+		t.Errorf("The cache dir should not be created: %v", err)
+	}
+}
+
+func TestOutputFile(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	cfg.Output.File = path.Join(cfg.Cache.Dir, "..", "inventory.json")
+	inv := testInventory(t)
+	if err := inv.load(); err != nil {
+		t.Fatal(err)
+	}
+	inv.output()
+	inv.close()
+	b, err := ioutil.ReadFile(cfg.Output.File)
+	if err != nil {
+		t.Fatalf("Unable to read output file: %v", err)
+	}
+	if string(b) != inv.json {
+		t.Error("Output file should contain the inventory")
+	}
+	// The flag takes precedence over the config, and profiles are applied to the output
+	flags.Output = path.Join(cfg.Cache.Dir, "..", "trusted.json")
+	flags.Profile = "trusted"
+	inv = testInventory(t)
+	if err := inv.load(); err != nil {
+		t.Fatal(err)
+	}
+	inv.output()
+	inv.close()
+	b, err = ioutil.ReadFile(flags.Output)
+	if err != nil {
+		t.Fatalf("Unable to read output file: %v", err)
+	}
+	if gjson.GetBytes(b, "_meta.hostvars.web01.subscription_status").Exists() {
+		t.Error("The trusted profile should have been applied to the output file")
+	}
+	entries, _ := os.ReadDir(path.Dir(flags.Output))
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp") {
+			t.Errorf("Temporary file %s should have been removed", e.Name())
+		}
+	}
+}
+
+func TestHostvarsFile(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	cfg.Output.File = path.Join(cfg.Cache.Dir, "..", "inventory.json")
+	cfg.Output.Hostvars = "file"
+	cfg.Output.HostvarsFile = path.Join(cfg.Cache.Dir, "..", "hostvars.json")
+	inv := testInventory(t)
+	if err := inv.load(); err != nil {
+		t.Fatal(err)
+	}
+	inv.output()
+	inv.close()
+	b, err := ioutil.ReadFile(cfg.Output.File)
+	if err != nil {
+		t.Fatalf("Unable to read output file: %v", err)
+	}
+	if gjson.GetBytes(b, "_meta").Exists() {
+		t.Error("The output file should not contain hostvars")
+	}
+	checkGroups(t, string(b), map[string]string{"valid": "app02,web01,web02"})
+	b, err = ioutil.ReadFile(cfg.Output.HostvarsFile)
+	if err != nil {
+		t.Fatalf("Unable to read hostvars file: %v", err)
+	}
+	if n := len(gjson.ParseBytes(b).Map()); n != 6 {
+		t.Errorf("Expected hostvars for 6 hosts, got %d", n)
+	}
+	// The cached inventory retains the hostvars, for --host
+	if hostCount(inv.previousInventory()) != 6 {
+		t.Error("The cached inventory should contain the hostvars")
+	}
+}
+
+func TestFilePerms(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	cfg.Cache.Mode = "0600"
+	cfg.Output.File = path.Join(cfg.Cache.Dir, "..", "inventory.json")
+	cfg.Output.Mode = "0640"
+	inv := testInventory(t)
+	if err := inv.load(); err != nil {
+		t.Fatal(err)
+	}
+	inv.output()
+	inv.close()
+	entries, err := os.ReadDir(cfg.Cache.Dir)
+	if err != nil {
+		t.Fatalf("Unable to read cache dir: %v", err)
+	}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil {
+			t.Fatalf("Unable to stat %s: %v", e.Name(), err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("Unexpected mode of cache file %s: Expected=0600, Got=%#o", e.Name(), fi.Mode().Perm())
+		}
+	}
+	fi, err := os.Stat(cfg.Output.File)
+	if err != nil {
+		t.Fatalf("Unable to stat output file: %v", err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("Unexpected mode of output file: Expected=0640, Got=%#o", fi.Mode().Perm())
+	}
+}
+
+func TestProfiling(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	dir := t.TempDir()
+	flags.PprofCPU = path.Join(dir, "cpu.pprof")
+	flags.PprofMem = path.Join(dir, "mem.pprof")
+	flags.Trace = path.Join(dir, "satinv.trace")
+	stop, err := startProfiling()
+	if err != nil {
+		t.Fatalf("startProfiling returned: %v", err)
+	}
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	stop()
+	stop()
+	for _, filename := range []string{flags.PprofCPU, flags.PprofMem, flags.Trace} {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			t.Errorf("Unable to stat %s: %v", filename, err)
+		} else if fi.Size() == 0 {
+			t.Errorf("%s is empty", filename)
+		}
+	}
+}
+
+func TestTracing(t *testing.T) {
+	var spans []gjson.Result
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		spans = append(spans, gjson.GetBytes(b, "resourceSpans.0.scopeSpans.0.spans").Array()...)
+	}))
+	defer collector.Close()
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	tracing.Configure(tracing.Options{Endpoint: collector.URL, ServiceName: "satinv"})
+	defer tracing.Configure(tracing.Options{})
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	ids := make(map[string]string)
+	for _, s := range spans {
+		ids[s.Get("spanId").String()] = s.Get("name").String()
+	}
+	// Every span is part of the refresh and API requests are made within a phase's cache lookup
+	parents := make(map[string]bool)
+	var requests int
+	for _, s := range spans {
+		name, parent := s.Get("name").String(), ids[s.Get("parentSpanId").String()]
+		parents[name+"<"+parent] = true
+		if name == "HTTP GET" {
+			requests++
+		}
+		if name != "refreshInventory" && parent == "" {
+			t.Errorf("Span %s has no parent", name)
+		}
+	}
+	for _, want := range []string{"hosts<refreshInventory", "parseHosts<refreshInventory", "cache.GetURL<hosts", "HTTP GET<cache.GetURL"} {
+		if !parents[want] {
+			t.Errorf("Expected a %s span", want)
+		}
+	}
+	if n := sat.Requests("/api/v2/hosts"); requests < n || n == 0 {
+		t.Errorf("Expected a span for each API request, got %d", requests)
+	}
+}
+
+func TestHealthcheck(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	inv := testInventory(t)
+	if h := inv.health(time.Hour, 20, false, time.Second); len(h.problems) != 2 {
+		t.Errorf("Expected problems before the first refresh, got: %s", h)
+	}
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+
+	inv = testInventory(t)
+	h := inv.health(time.Hour, 20, true, time.Second)
+	if len(h.problems) > 0 || h.run.Hosts != 6 || !strings.HasPrefix(h.String(), "SATINV OK - 6 hosts") {
+		t.Errorf("Expected a healthy inventory, got: %s", h)
+	}
+	if sat.Requests("/api/status") != 1 {
+		t.Error("Expected the Satellite status to be requested")
+	}
+	if h := inv.health(time.Nanosecond, 20, false, time.Second); len(h.problems) != 1 || !strings.Contains(h.problems[0], "refreshed") {
+		t.Errorf("Expected an age problem, got: %s", h)
+	}
+	if err := inv.cache.PutFile(runName, []byte(`{"time":"2030-01-01T00:00:00Z","hosts":6,"previous_hosts":10}`)); err != nil {
+		t.Fatalf("Unable to write run record: %v", err)
+	}
+	if h := inv.health(0, 20, false, time.Second); len(h.problems) != 1 || !strings.Contains(h.problems[0], "fell by 40.0% (from 10 to 6)") {
+		t.Errorf("Expected a host count problem, got: %s", h)
+	}
+	ts.Close()
+	if h := inv.health(0, 50, true, time.Second); len(h.problems) != 1 || !strings.Contains(h.problems[0], "unreachable") {
+		t.Errorf("Expected an API problem, got: %s", h)
+	}
+}
+
+func TestSafety(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	// The previous inventory had 10 hosts, so the refreshed 6 is a 40% fall
+	previous := `{"all":{"children":["valid"]},"valid":{"hosts":["h1","h2","h3","h4","h5","h6","h7","h8","h9","h10"]},"_meta":{"hostvars":{"h1":{},"h2":{},"h3":{},"h4":{},"h5":{},"h6":{},"h7":{},"h8":{},"h9":{},"h10":{}}}}` + "\n"
+	tests := []struct {
+		minHosts  int
+		maxShrink float64
+		replaced  bool
+	}{
+		{0, 0, false},
+		{7, 0, true},
+		{6, 50, false},
+		{0, 30, true},
+	}
+	for _, test := range tests {
+		cfg.Safety.MinHosts = test.minHosts
+		cfg.Safety.MaxShrinkPercent = test.maxShrink
+		inv := testInventory(t)
+		if err := inv.cache.PutFile(inventoryName, []byte(previous)); err != nil {
+			t.Fatalf("Unable to write the previous inventory: %v", err)
+		}
+		if err := inv.refreshInventory(); err != nil {
+			t.Fatal(err)
+		}
+		inv.close()
+		cached := inv.previousInventory()
+		if test.replaced && (inv.json != previous || cached != previous) {
+			t.Errorf("min_hosts=%d, max_shrink_percent=%g: Expected the previous inventory to be retained", test.minHosts, test.maxShrink)
+		}
+		if !test.replaced && (hostCount(inv.json) != 6 || cached != inv.json) {
+			t.Errorf("min_hosts=%d, max_shrink_percent=%g: Expected the refreshed inventory", test.minHosts, test.maxShrink)
+		}
+	}
+}
+
+func TestBuildWorkers(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	var want string
+	for _, workers := range []int{1, 2, 16} {
+		cfg.Build.Workers = workers
+		inv := testInventory(t)
+		if err := inv.refreshInventory(); err != nil {
+			t.Fatal(err)
+		}
+		inv.close()
+		if hostCount(inv.json) != 6 {
+			t.Fatalf("workers=%d: Expected 6 hosts, got %d", workers, hostCount(inv.json))
+		}
+		if want == "" {
+			want = inv.json
+			continue
+		}
+		if inv.json != want {
+			t.Errorf("workers=%d: Inventory differs from that built by a single worker", workers)
+		}
+	}
+}
+
+func TestGroupsEnable(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "groups:\n  enable:\n    stale: false\n    cidrs: false\n    collections: false\n")()
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	checkGroups(t, inv.json, map[string]string{
+		"valid":       "app02,web01,web02",
+		"stale":       "",
+		"web":         "",
+		"web_servers": "",
+		"databases":   "",
+	})
+	children := gjson.Get(inv.json, "all.children").Array()
+	if len(children) != 1 || children[0].String() != "valid" {
+		t.Errorf("Expected valid to be the only child of all, got %v", children)
+	}
+	if n := hostCount(inv.json); n != 6 {
+		t.Errorf("Expected hostvars for 6 hosts, got %d", n)
+	}
+}
+
+func TestGroupPrefixes(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "inventory_prefix: sat_\ngroups:\n  prefixes:\n    valid: \"\"\n    collections: hc_\n    cidrs: net_\n")()
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	checkGroups(t, inv.json, map[string]string{
+		"valid":          "app02,web01,web02",
+		"sat_stale":      "db01",
+		"net_web":        "web01,web02",
+		"hc_web_servers": "web01,web02",
+		"hc_databases":   "db01",
+	})
+}
+
+func TestSubscriptionGroups(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "inventory_prefix: sat_\ngroups:\n  enable:\n    subscription: true\n")()
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	// The groups are independent of validity, so app02's SCA Organization doesn't make it valid here
+	checkGroups(t, inv.json, map[string]string{
+		"sat_sub_valid":   "db01,web01,web02",
+		"sat_sub_invalid": "app01,app02",
+		"sat_sub_unknown": "new01",
+	})
+}
+
+func TestOSGroups(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "groups:\n  enable:\n    os: true\n")()
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	checkGroups(t, inv.json, map[string]string{
+		"os_rhel8": "app01,app02,web01,web02",
+		"os_rhel9": "db01",
+	})
+	cfg.Groups.OSNames = map[string]string{"CentOS Linux": "el"}
+	tests := []struct {
+		name  string
+		group string
+	}{
+		{"RedHat 8.6", "os_rhel8"},
+		{"CentOS Linux 7.9.2009", "os_el7"},
+		{"Ubuntu 22.04", "os_ubuntu22"},
+		{"Oracle Linux 9.1", "os_Oracle Linux9"},
+		{"Windows", "os_Windows"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		host := gjson.Parse(fmt.Sprintf(`{"operatingsystem_name":%q}`, test.name))
+		if got := osGroup(host); got != test.group {
+			t.Errorf("Unexpected OS group for %q: Expected=%q, Got=%q", test.name, test.group, got)
+		}
+	}
+}
+
+func TestCapsuleGroups(t *testing.T) {
+	sat := satinvmock.Demo()
+	now := time.Now().UTC()
+	for i, source := range []string{"eu1.example.com", "us1.example.com", "eu1.example.com"} {
+		sat.AddHost(satinvmock.Host{ID: 10 + i, Name: fmt.Sprintf("cap%02d.example.com", i), IP: fmt.Sprintf("10.0.6.%d", i+1),
+			OperatingSystemID: 1, OperatingSystem: "RedHat 8.6", LastCheckin: now, UpdatedAt: now, OrganizationID: 1,
+			Extra: map[string]interface{}{"content_facet_attributes": map[string]interface{}{"content_source_name": source}}})
+	}
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "groups:\n  enable:\n    capsule: true\n")()
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	checkGroups(t, inv.json, map[string]string{
+		"capsule_eu1": "cap00,cap02",
+		"capsule_us1": "cap01",
+	})
+}
+
+func TestVirtualGroups(t *testing.T) {
+	sat := satinvmock.NewServer()
+	sat.AddOrganization(satinvmock.Organization{ID: 1, Name: "Default Organization"})
+	hosts := []map[string]interface{}{
+		{"subscription_facet_attributes": map[string]interface{}{"virtual_host": map[string]interface{}{"id": 2, "name": "hv01.example.com"}}},
+		{"subscription_facet_attributes": map[string]interface{}{"virtual_guests": []interface{}{map[string]interface{}{"id": 1}}}},
+		{"compute_resource_name": "VMware DC1"},
+		{},
+	}
+	for i, extra := range hosts {
+		sat.AddHost(satinvmock.Host{ID: i + 1, Name: fmt.Sprintf("host%02d.example.com", i+1), IP: fmt.Sprintf("10.0.7.%d", i+1),
+			OrganizationID: 1, Extra: extra})
+	}
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "groups:\n  enable:\n    virtual: true\n")()
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	// host04 offers no evidence either way
+	checkGroups(t, inv.json, map[string]string{
+		"virtual":            "host01,host03",
+		"physical":           "host02",
+		"hypervisor_hv01":    "host01",
+		"cluster_vmware_dc1": "host03",
+	})
+}
+
+func TestCustomSources(t *testing.T) {
+	sat := satinvmock.Demo()
+	// Custom sources are fetched with the api credentials, so the source is served alongside the mock Satellite
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/tiers" {
+			sat.ServeHTTP(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"results":[
+			{"title":"Web Tier","hosts":["web01.example.com","web02.example.com"]},
+			{"title":"DB Tier","hosts":["db01.example.com","gone01.example.com"]}]}`)
+	}))
+	defer ts.Close()
+	extra := fmt.Sprintf("custom_sources:\n  - name: tiers\n    url: %s/tiers\n    path: results.#.{group:title,host:hosts}\n", ts.URL)
+	defer setup(t, ts.URL, extra)()
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	// Hosts that aren't in the inventory are ignored
+	checkGroups(t, inv.json, map[string]string{
+		"web_tier": "web01,web02",
+		"db_tier":  "db01",
+	})
+	pairs := sourcePairs(gjson.Parse(`[["a","h1"],["b",["h2","h3"]],{"group":"c","host":"h4"},{"host":"h5"}]`), "@this")
+	if got := fmt.Sprint(pairs); got != "[[a h1] [b h2] [b h3] [c h4]]" {
+		t.Errorf("Unexpected pairs: %s", got)
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	inv := testInventory(t)
+	if err := inv.load(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	hostRequests := sat.Requests("/api/v2/hosts")
+
+	// Nothing is close enough to expiry to be refreshed
+	cfg.Cache.RefreshAheadPercent = 1
+	inv = testInventory(t)
+	inv.refreshAhead()
+	inv.close()
+	if sat.Requests("/api/v2/hosts") != hostRequests {
+		t.Error("Hosts should not be refreshed long before they expire")
+	}
+
+	// Everything is within 100% of its validity of expiring
+	cfg.Cache.RefreshAheadPercent = 100
+	inv = testInventory(t)
+	if ok, _ := inv.cache.LockRefresh(time.Hour); !ok {
+		t.Fatal("Unable to take the refresh lock")
+	}
+	inv.refreshAhead()
+	inv.close()
+	if sat.Requests("/api/v2/hosts") != hostRequests+1 {
+		t.Error("Hosts should be refreshed ahead of expiry")
+	}
+	if hostCount(inv.json) != 6 {
+		t.Errorf("Unexpected hosts in the refreshed inventory: %d", hostCount(inv.json))
+	}
+	if ok, _ := inv.cache.LockRefresh(time.Hour); !ok {
+		t.Error("The refresh lock should be released by the refresh")
+	}
+}
+
+func TestPartialRefresh(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	inv := testInventory(t)
+	if err := inv.load(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	hosts := sat.Requests("/api/v2/hosts")
+	collections := sat.Requests("/katello/api/host_collections")
+
+	flags.RefreshCollections = true
+	inv = testInventory(t)
+	if err := inv.load(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	if sat.Requests("/api/v2/hosts") != hosts {
+		t.Error("Hosts should not be fetched when only collections are refreshed")
+	}
+	if sat.Requests("/katello/api/host_collections") != collections+1 {
+		t.Error("Host Collections should be fetched again")
+	}
+
+	flags.RefreshCollections = false
+	flags.RefreshHosts = true
+	inv = testInventory(t)
+	if err := inv.load(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	if sat.Requests("/api/v2/hosts") != hosts+1 {
+		t.Error("Hosts should be fetched again")
+	}
+	if sat.Requests("/katello/api/host_collections") != collections+1 {
+		t.Error("Host Collections should not be fetched when only hosts are refreshed")
+	}
+
+	flags.RefreshHosts = false
+	inv = testInventory(t)
+	if _, err := inv.invalidateItem("https://unknown.fake"); err == nil {
+		t.Error("Expected an error invalidating an unknown item")
+	}
+	if keys, err := inv.invalidateItem("hosts"); err != nil || len(keys) != 1 {
+		t.Errorf("Unexpected invalidation of hosts: %v, %v", keys, err)
+	}
+	if expired, _ := inv.cache.HasExpired(inventoryName); !expired {
+		t.Error("Invalidating an item should also expire the inventory")
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	status := http.StatusUnauthorized
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Unable to authenticate user", status)
+	}))
+	defer setup(t, ts.URL, "api:\n  retry:\n    retries: 0\n")()
+	inv := testInventory(t)
+	if err := inv.initAPI(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := inv.getHosts(); exitCode(err) != exitAuth {
+		t.Errorf("Expected exit status %d for a refused login, got %d: %v", exitAuth, exitCode(err), err)
+	}
+	status = http.StatusServiceUnavailable
+	inv.cache.Invalidate(hostsURL())
+	if _, err := inv.getHosts(); exitCode(err) != exitUnreachable {
+		t.Errorf("Expected exit status %d for an unavailable API, got %d: %v", exitUnreachable, exitCode(err), err)
+	}
+	ts.Close()
+	if _, err := inv.getHosts(); exitCode(err) != exitUnreachable {
+		t.Errorf("Expected exit status %d for an unreachable API, got %d: %v", exitUnreachable, exitCode(err), err)
+	}
+	for err, code := range map[error]int{
+		cacher.ErrChecksum: exitCache,
+		&exitError{code: exitConfig, err: cacher.ErrDecrypt}: exitConfig,
+		fmt.Errorf("unexpected"):                             1,
+	} {
+		if exitCode(err) != code {
+			t.Errorf("%v: Expected exit status %d, got %d", err, code, exitCode(err))
+		}
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	for response, want := range map[string]string{
+		`{"total": 3, "subtotal": 2, "results": [1, 2]}`: "",
+		`{"total": 2, "subtotal": 3, "results": [1, 2]}`: "2 of 3 results returned",
+		`{"total": 3, "results": [1, 2]}`:                "2 of 3 results returned",
+		`{"results": [1, 2]}`:                            "",
+		`{"total": 3, "subtotal": 3, "results": {}}`:     "",
+		`{"total": 3, "subtotal": 3}`:                    "",
+	} {
+		if got := truncation(gjson.Parse(response)); got != want {
+			t.Errorf("%s: Expected %q, got %q", response, want, got)
+		}
+	}
+}
+
+func TestPagination(t *testing.T) {
+	sat := satinvmock.Demo()
+	now := time.Now().UTC()
+	// More hosts than fit on a single page of 1000
+	for i := 0; i < 1000; i++ {
+		sat.AddHost(satinvmock.Host{ID: 100 + i, Name: fmt.Sprintf("bulk%04d.example.com", i), IP: "10.0.9.1",
+			OperatingSystemID: 1, OperatingSystem: "RedHat 8.6", LastCheckin: now, UpdatedAt: now, OrganizationID: 1})
+	}
+	for i := 0; i < 3; i++ {
+		sat.AddCollection(satinvmock.Collection{ID: 10 + i, Name: fmt.Sprintf("Extra %d", i)})
+	}
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "host_collections:\n  per_page: 2\n")()
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatalf("refreshInventory returned: %v", err)
+	}
+	inv.close()
+	if n := hostCount(inv.json); n != 1006 {
+		t.Errorf("Expected 1006 hosts, got %d", n)
+	}
+	if n := sat.Requests("/api/v2/hosts"); n != 2 {
+		t.Errorf("Expected 2 pages of hosts, got %d requests", n)
+	}
+	if len(inv.truncated) != 0 {
+		t.Errorf("Paginated responses should not be truncated: %v", inv.truncated)
+	}
+	if n := len(inv.collections); n != 5 {
+		t.Errorf("Expected 5 Host Collections from 3 pages, got %d", n)
+	}
+	checkGroups(t, inv.json, map[string]string{"web_servers": "web01,web02", "databases": "db01"})
+
+	// Invalidating the hosts invalidates every page
+	inv = testInventory(t)
+	defer inv.close()
+	keys, err := inv.invalidateItem("hosts")
+	if err != nil || len(keys) != 2 {
+		t.Errorf("Expected both pages of hosts to be invalidated, got %v: %v", keys, err)
+	}
+}
+
+func TestRefreshErrors(t *testing.T) {
+	ts := satinvmock.Demo().Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+
+	// An unreadable static inventory is a config problem
+	cfg.Merge.InventoryFile = path.Join(cfg.Cache.Dir, "missing.yml")
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); exitCode(err) != exitConfig {
+		t.Errorf("Expected exit status %d for a missing static inventory, got %d: %v", exitConfig, exitCode(err), err)
+	}
+	inv.close()
+	cfg.Merge.InventoryFile = ""
+
+	// A failure to update the inventory abandons the refresh at the next phase
+	inv = testInventory(t)
+	inv.run = newRunStats(inv.ctx)
+	inv.jsonFailed("all.children", errors.New("path cannot be empty"))
+	inv.jsonFailed("web.hosts", errors.New("ignored"))
+	if err := inv.enterPhase("merge"); exitCode(err) != exitOutput || !strings.Contains(err.Error(), "all.children") {
+		t.Errorf("Expected the first failure to update the inventory, got: %v", err)
+	}
+	inv.close()
+
+	// As does a request to stop
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	saved := appCtx
+	appCtx = ctx
+	defer func() { appCtx = saved }()
+	inv = testInventory(t)
+	if err := inv.refreshInventory(); exitCode(err) != exitCancelled {
+		t.Errorf("Expected exit status %d for a cancelled refresh, got %d: %v", exitCancelled, exitCode(err), err)
+	}
+	inv.close()
+}
+
+func TestReserveStdout(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	stdout, stderr := os.Stdout, os.Stderr
+	defer func() {
+		os.Stdout, os.Stderr, inventoryOut = stdout, stderr, stdout
+	}()
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Unable to create pipe: %v", err)
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Unable to create pipe: %v", err)
+	}
+	os.Stdout, os.Stderr = outW, errW
+	reserveStdout()
+	fmt.Println("Stray output")
+	flags.List = true
+	inv := testInventory(t)
+	if err := inv.load(); err != nil {
+		t.Fatal(err)
+	}
+	inv.output()
+	inv.close()
+	outW.Close()
+	errW.Close()
+	out, _ := ioutil.ReadAll(outR)
+	if string(out) != inv.json {
+		t.Errorf("Expected only the inventory on stdout, got: %.100s", out)
+	}
+	if diverted, _ := ioutil.ReadAll(errR); string(diverted) != "Stray output\n" {
+		t.Errorf("Expected stray output on stderr, got: %q", diverted)
+	}
+}
+
+func TestSignOutput(t *testing.T) {
+	dir, err := os.MkdirTemp("", "satinv-sign")
+	if err != nil {
+		t.Fatalf("Unable to create TempDir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := path.Join(dir, "signing_key")
+	trustedFile := path.Join(dir, "trusted_keys")
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey returned: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("MarshalPKCS8PrivateKey returned: %v", err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatalf("NewPublicKey returned: %v", err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("Unable to write key: %v", err)
+	}
+	if err := ioutil.WriteFile(trustedFile, ssh.MarshalAuthorizedKey(sshPub), 0644); err != nil {
+		t.Fatalf("Unable to write trusted keys: %v", err)
+	}
+
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	invFile := path.Join(dir, "inventory.json")
+	defer setup(t, ts.URL, fmt.Sprintf("output:\n  file: %s\n  signing:\n    method: ssh\n    key: %s\n    public_key: %s\n", invFile, keyFile, trustedFile))()
+	inv := testInventory(t)
+	if err := inv.load(); err != nil {
+		t.Fatal(err)
+	}
+	inv.output()
+	inv.close()
+	if _, err := os.Stat(invFile + ".sig"); err != nil {
+		t.Fatalf("Expected a signature alongside the inventory: %v", err)
+	}
+	if err := verifyFile(invFile); err != nil {
+		t.Errorf("verifyFile returned: %v", err)
+	}
+
+	// A signature by a key that isn't trusted fails, even if it's otherwise good
+	if err := ioutil.WriteFile(trustedFile, nil, 0644); err != nil {
+		t.Fatalf("Unable to write trusted keys: %v", err)
+	}
+	if err := verifyFile(invFile); err == nil || !strings.Contains(err.Error(), "untrusted") {
+		t.Errorf("Expected an untrusted key to fail, got: %v", err)
+	}
+	if err := ioutil.WriteFile(trustedFile, ssh.MarshalAuthorizedKey(sshPub), 0644); err != nil {
+		t.Fatalf("Unable to write trusted keys: %v", err)
+	}
+
+	// Any change to the inventory invalidates the signature
+	content, err := ioutil.ReadFile(invFile)
+	if err != nil {
+		t.Fatalf("Unable to read inventory: %v", err)
+	}
+	if err := ioutil.WriteFile(invFile, append(content, ' '), 0644); err != nil {
+		t.Fatalf("Unable to write inventory: %v", err)
+	}
+	if err := verifyFile(invFile); err == nil {
+		t.Error("Expected a tampered inventory to fail verification")
+	}
+	if err := verifyCommand(nil); err == nil {
+		t.Error("Expected verify to fail for a tampered inventory")
+	}
+
+	// If any file can't be signed, none are written
+	hostvarsFile := path.Join(dir, "hostvars.json")
+	cfg.Output.Signing.Key = path.Join(dir, "missing_key")
+	files := []outputContent{{"Hostvars", hostvarsFile, []byte("{}\n")}, {"Inventory", invFile, []byte("{}\n")}}
+	if err := writeOutputs(files); err == nil || !strings.Contains(err.Error(), "unable to sign") {
+		t.Errorf("Expected writeOutputs to fail without a signing key, got: %v", err)
+	}
+	if _, err := os.Stat(hostvarsFile); !os.IsNotExist(err) {
+		t.Errorf("Expected no hostvars file when signing fails: %v", err)
+	}
+	if b, _ := ioutil.ReadFile(invFile); string(b) == "{}\n" {
+		t.Error("Expected the inventory to be unchanged when signing fails")
+	}
+	cfg.Output.Signing.Key = keyFile
+	if err := writeOutputs(files); err != nil {
+		t.Fatalf("writeOutputs returned: %v", err)
+	}
+	for _, f := range []string{hostvarsFile, invFile} {
+		if err := verifyFile(f); err != nil {
+			t.Errorf("verifyFile %s returned: %v", f, err)
+		}
+	}
+}
+
+func TestSatinvMeta(t *testing.T) {
+	sat := satinvmock.Demo()
+	now := time.Now().UTC()
+	sat.AddHost(satinvmock.Host{ID: 7, Name: "app03.example.com", IP: "10.0.3.3", OperatingSystemID: 1,
+		OperatingSystem: "RedHat 8.6", LastCheckin: now, UpdatedAt: now, OrganizationID: 2,
+		Extra: map[string]interface{}{"all_parameters": []map[string]string{{"name": "satinv_exclude", "value": "maybe"}}}})
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "exclude_parameter:\n  name: satinv_exclude\noutput:\n  satinv_meta: true\n")()
+	logger := log.Current
+	defer func() {
+		log.Current = logger
+	}()
+	log.Current = recordWarnings(logger)
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	meta := gjson.Get(inv.json, metaGroup+".vars")
+	generated, err := time.Parse(time.RFC3339, meta.Get("generated_at").String())
+	if err != nil || time.Since(generated) > time.Minute {
+		t.Errorf("Unexpected generated_at: %s", meta.Get("generated_at").String())
+	}
+	if source := meta.Get("source").String(); source != ts.URL {
+		t.Errorf("Expected source %s, got %s", ts.URL, source)
+	}
+	if hosts := meta.Get("counts.hosts").Int(); hosts != int64(hostCount(inv.json)) || hosts == 0 {
+		t.Errorf("Unexpected host count: %d", hosts)
+	}
+	if groups := meta.Get("counts.groups").Int(); groups != int64(len(groupCounts(inv.json))) {
+		t.Errorf("Unexpected group count: %d", groups)
+	}
+	found := false
+	for _, w := range meta.Get("warnings").Array() {
+		found = found || strings.Contains(w.String(), `satinv_exclude "maybe"`)
+	}
+	if !found {
+		t.Errorf("Expected the exclude_parameter warning, got: %s", meta.Get("warnings").Raw)
+	}
+	// The object is a group without hosts, so Ansible accepts the inventory
+	for _, v := range rules.Validate(inv.json) {
+		if strings.Contains(v.Message, metaGroup) {
+			t.Errorf("Unexpected validation failure: %s", v.Message)
+		}
+	}
+	if _, ok := groupCounts(inv.json)[metaGroup]; ok {
+		t.Errorf("%s counted as an inventory group", metaGroup)
+	}
+}
+
+func TestBuildBudget(t *testing.T) {
+	var calls int
+	var expiredPhase string
+	b, ctx := newBuildBudget(context.Background(), 10*time.Millisecond, func(phase string, _ time.Duration) {
+		calls++
+		expiredPhase = phase
+	})
+	// Nothing is timed until the build begins
+	time.Sleep(20 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Fatal("Expected the budget not to expire before the build begins")
+	}
+	b.begin()
+	b.enter("hosts")
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Expected the budget to cancel the build's Context")
+	}
+	// The fallback is left to the build, rather than running on the timer's goroutine
+	if calls != 0 {
+		t.Fatalf("Expected onExpire to wait for the build, got %d calls", calls)
+	}
+	b.enter("enrich")
+	b.finish()
+	if calls != 1 || expiredPhase != "hosts" {
+		t.Errorf("Expected one call of onExpire for the hosts phase, got %d for %q", calls, expiredPhase)
+	}
+}
+
+func TestRemediate(t *testing.T) {
+	sat := satinvmock.Demo()
+	sat.AddJobTemplate(satinvmock.JobTemplate{ID: 7, Name: "Run Command - Script Default"})
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "remediation:\n  enabled: true\n  job_template: Run Command - Script Default\n  inputs:\n    command: subscription-manager refresh\n")()
+	inv := testInventory(t)
+	defer inv.close()
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatalf("refreshInventory returned: %v", err)
+	}
+	// The only stale host in the demo Satellite is db01
+	jobs := sat.Jobs()
+	if len(jobs) != 1 {
+		t.Fatalf("Expected 1 job, got %d", len(jobs))
+	}
+	job := gjson.GetBytes(jobs[0], "job_invocation")
+	if job.Get("job_template_id").Int() != 7 || job.Get("targeting_type").String() != "static_query" ||
+		job.Get("search_query").String() != "name ^ (db01.example.com)" ||
+		job.Get("inputs.command").String() != "subscription-manager refresh" {
+		t.Errorf("Unexpected job payload: %s", jobs[0])
+	}
+
+	// Within the cooldown, db01 isn't remediated again
+	if err := inv.remediate(); err != nil {
+		t.Errorf("remediate returned: %v", err)
+	}
+	if n := len(sat.Jobs()); n != 1 {
+		t.Errorf("Expected no job within the cooldown, got %d jobs", n)
+	}
+
+	// A group larger than max_hosts is refused
+	cfg.Remediation.Group = "valid"
+	cfg.Remediation.MaxHosts = 1
+	if err := inv.remediate(); err == nil || !strings.Contains(err.Error(), "exceeding the limit") {
+		t.Errorf("Expected max_hosts to refuse the job, got: %v", err)
+	}
+	cfg.Remediation.MaxHosts = 50
+
+	// An empty or missing group triggers nothing
+	cfg.Remediation.Group = "missing"
+	if err := inv.remediate(); err != nil {
+		t.Errorf("remediate returned: %v", err)
+	}
+	if n := len(sat.Jobs()); n != 1 {
+		t.Errorf("Expected no job for a missing group, got %d jobs", n)
+	}
+
+	// Group names are paths, so those containing a dot must be escaped
+	cfg.Remediation.Group = "web.tier"
+	inv.addHost("web.tier", "web01")
+	if err := inv.remediate(); err != nil {
+		t.Errorf("remediate returned: %v", err)
+	}
+	if jobs := sat.Jobs(); len(jobs) != 2 || gjson.GetBytes(jobs[1], "job_invocation.search_query").String() != "name ^ (web01.example.com)" {
+		t.Errorf("Expected a job against web01, got: %s", jobs)
+	}
+}
+
+func TestMkInventoryName(t *testing.T) {
+	defer setup(t, "https://satellite.fake", "")()
+	tests := []struct {
+		prefix      string
+		replacement string
+		forceValid  bool
+		name        string
+		want        string
+	}{
+		{"", "_", false, "Web-Servers", "web_servers"},
+		{"", "_", false, "app.example.com", "app_example_com"},
+		{"", "_", false, "10.0.1.0/24", "10_0_1_0_24"},
+		{"", "_", false, "2nd Floor", "2nd_floor"},
+		{"", "X", false, "Web Servers/Prod", "webXserversXprod"},
+		{"sat_", "_", false, "Web-Servers", "sat_web_servers"},
+		{"sat-", "_", false, "Databases", "sat-databases"},
+		{"", "_", true, "2nd Floor", "_nd_floor"},
+		{"sat-", "_", true, "Databases", "sat_databases"},
+		{"1-", "_", true, "Databases", "__databases"},
+	}
+	for _, test := range tests {
+		cfg.InventoryPrefix = test.prefix
+		cfg.GroupNameReplacement = test.replacement
+		cfg.ForceValidGroupNames = test.forceValid
+		if got := mkInventoryName(config.GroupCollections, test.name); got != test.want {
+			t.Errorf("prefix=%q, replacement=%q, force_valid=%v: %s: Expected %q, got %q", test.prefix, test.replacement, test.forceValid, test.name, test.want, got)
+		}
+	}
+}
+
+func TestDuplicateMembers(t *testing.T) {
+	sat := satinvmock.Demo()
+	now := time.Now().UTC()
+	// lx0007's groups parameter overlaps with itself and with its Host Collection
+	sat.AddHost(satinvmock.Host{ID: 7, Name: "lx0007.example.com", IP: "10.0.1.7", OperatingSystemID: 1,
+		OperatingSystem: "RedHat 8.6", LastCheckin: now, UpdatedAt: now, OrganizationID: 1,
+		Extra: map[string]interface{}{"all_parameters": []map[string]string{{"name": "satinv_groups", "value": "doubled, Doubled"}}}})
+	// A Host Collection can list a host more than once
+	sat.AddCollection(satinvmock.Collection{ID: 3, Name: "Doubled", HostIDs: []int{1, 1, 7}})
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "groups_parameter: satinv_groups\n")()
+	// Overlapping CIDRs whose names sanitise to the same group
+	cfg.CIDRs["Web"] = "10.0.0.0/16"
+	inv := testInventory(t)
+	if err := inv.refreshInventory(); err != nil {
+		t.Fatal(err)
+	}
+	inv.close()
+	checkGroups(t, inv.json, map[string]string{
+		"doubled": "lx0007,web01",
+		"web":     "app01,app02,db01,lx0007,new01,web01,web02",
+	})
+}
+
+func TestExportKnownHosts(t *testing.T) {
+	defer setup(t, "http://127.0.0.1:0", "")()
+	cacheInventory(t, `{"all":{"children":["web"]},"web":{"hosts":["web01","db01"]},"_meta":{"hostvars":{`+
+		`"web01":{"name":"web01.example.com","ip":"10.0.1.1","satinv_facts":{"sshed25519key":"AAAAC3Nza","ssh::ed25519::key":"AAAAC3Nza","sshrsakey":"AAAAB3Nza"}},`+
+		`"db01":{"name":"db01.example.com","ip":"10.0.2.1"},`+
+		`"app01":{"name":"app01.example.com","ip":"10.0.3.1","satinv_facts":{"sshecdsakey":"AAAAE2Vj"}}}}}`)
+	outFile := path.Join(cfg.Cache.Dir, "known_hosts")
+	if err := exportKnownHosts([]string{"--output", outFile, "--group", "web"}); err != nil {
+		t.Fatalf("exportKnownHosts returned: %v", err)
+	}
+	// web01's ed25519 key is listed under two facts but exported once, db01 has no keys and app01 isn't in web
+	want := "web01,web01.example.com,10.0.1.1 ssh-ed25519 AAAAC3Nza\n" +
+		"web01,web01.example.com,10.0.1.1 ssh-rsa AAAAB3Nza\n"
+	if got := readOutput(t, outFile); got != want {
+		t.Errorf("Unexpected known_hosts.  Expected=%q, Got=%q", want, got)
+	}
+}
+
+func TestExportFileSD(t *testing.T) {
+	ts := satinvmock.Demo().Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	outFile := path.Join(cfg.Cache.Dir, "targets.json")
+	args := []string{"--output", outFile, "--groups", "web,databases", "--address", "ip", "--port", "9182", "--label", "os=operatingsystem_name"}
+	if err := exportFileSD(args); err != nil {
+		t.Fatalf("exportFileSD returned: %v", err)
+	}
+	var targets []fileSDTarget
+	if err := json.Unmarshal([]byte(readOutput(t, outFile)), &targets); err != nil {
+		t.Fatalf("Unable to parse the targets: %v", err)
+	}
+	want := []fileSDTarget{
+		{Targets: []string{"10.0.1.1:9182", "10.0.1.2:9182"}, Labels: map[string]string{"inventory_group": "web", "os": "RedHat 8.6"}},
+		{Targets: []string{"10.0.2.1:9182"}, Labels: map[string]string{"inventory_group": "databases", "os": "RedHat 9.0"}},
+	}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("Unexpected targets.  Expected=%v, Got=%v", want, targets)
+	}
+	if err := exportFileSD([]string{"--groups", "missing"}); err == nil || !strings.Contains(err.Error(), "not in the inventory") {
+		t.Errorf("Expected an unknown group to be refused, got: %v", err)
+	}
+}
+
+func TestExportSSHConfig(t *testing.T) {
+	ts := satinvmock.Demo().Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "ssh_config:\n  user: ansible\n  proxy_jump:\n    web: bastion.example.com\n")()
+	outFile := path.Join(cfg.Cache.Dir, "ssh_config")
+	if err := exportSSHConfig([]string{"--output", outFile}); err != nil {
+		t.Fatalf("exportSSHConfig returned: %v", err)
+	}
+	// Only the valid hosts are included and those in the web CIDR are reached via its jump host
+	want := `# Generated by satinv from the valid inventory group
+
+Host app02 app02.example.com
+    HostName 10.0.3.2
+    User ansible
+
+Host web01 web01.example.com
+    HostName 10.0.1.1
+    User ansible
+    ProxyJump bastion.example.com
+
+Host web02 web02.example.com
+    HostName 10.0.1.2
+    User ansible
+    ProxyJump bastion.example.com
+`
+	if got := readOutput(t, outFile); got != want {
+		t.Errorf("Unexpected ssh config.  Expected=%q, Got=%q", want, got)
+	}
+}
+
+func TestHistory(t *testing.T) {
+	defer setup(t, "http://127.0.0.1:0", "")()
+	cfg.History.Enabled = true
+	cfg.History.Dir = path.Join(cfg.Cache.Dir, "history")
+	cfg.History.Keep = 2
+	if err := os.MkdirAll(cfg.History.Dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	// Across two snapshots and the current inventory, web02 moves from web to db to app
+	now := time.Now().UTC()
+	for age, invJSON := range map[int]string{
+		2: `{"web":{"hosts":["web01","web02"]},"_meta":{"hostvars":{"web01":{},"web02":{}}}}`,
+		1: `{"web":{"hosts":["web01"]},"db":{"hosts":["web02"]},"_meta":{"hostvars":{"web01":{},"web02":{}}}}`,
+	} {
+		filename := path.Join(cfg.History.Dir, historyPrefix+now.Add(-time.Duration(age)*time.Hour).Format(historyLayout)+".json")
+		if err := ioutil.WriteFile(filename, []byte(invJSON), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := `{"web":{"hosts":["web01"]},"db":{"hosts":[]},"app":{"hosts":["web02"]},"_meta":{"hostvars":{"web01":{},"web02":{}}}}`
+	cacheInventory(t, current)
+
+	out, err := captureStdout(t, func() error { return historyDiff([]string{"2"}) })
+	if err != nil {
+		t.Fatalf("history diff returned: %v", err)
+	}
+	if want := "app: +web02\nweb: -web02\n"; out != want {
+		t.Errorf("Unexpected history diff.  Expected=%q, Got=%q", want, out)
+	}
+	out, err = captureStdout(t, func() error { return historyDiff([]string{"1", "2"}) })
+	if err != nil {
+		t.Fatalf("history diff returned: %v", err)
+	}
+	if want := "db: -web02\nweb: +web02\n"; out != want {
+		t.Errorf("Unexpected history diff of two snapshots.  Expected=%q, Got=%q", want, out)
+	}
+	out, err = captureStdout(t, func() error { return historyHost([]string{"web02"}) })
+	if err != nil {
+		t.Fatalf("history host returned: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasSuffix(lines[0], ": +web") || !strings.HasSuffix(lines[1], ": +db -web") || lines[2] != "current: +app -db" {
+		t.Errorf("Unexpected history of web02: %q", out)
+	}
+	if _, err := captureStdout(t, func() error { return historyDiff([]string{"3"}) }); err == nil {
+		t.Error("Expected an error for a snapshot that doesn't exist")
+	}
+
+	// Archiving the current inventory prunes the oldest snapshot
+	archiveInventory(current)
+	out, err = captureStdout(t, historyList)
+	if err != nil {
+		t.Fatalf("history list returned: %v", err)
+	}
+	lines = strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "2 hosts, 3 groups") || !strings.HasSuffix(lines[1], "2 hosts, 2 groups") {
+		t.Errorf("Unexpected history list: %q", out)
+	}
+}
+
+func TestReportExclusions(t *testing.T) {
+	ts := satinvmock.Demo().Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	outFile := path.Join(cfg.Cache.Dir, "exclusions.csv")
+	if err := reportExclusions([]string{"--format", "csv", "--output", outFile}); err != nil {
+		t.Fatalf("reportExclusions returned: %v", err)
+	}
+	records, err := csv.NewReader(strings.NewReader(readOutput(t, outFile))).ReadAll()
+	if err != nil {
+		t.Fatalf("Unable to parse the report: %v", err)
+	}
+	if len(records) == 0 || records[0][0] != "host" || records[0][5] != "failed_checks" {
+		t.Fatalf("Expected a header row, got: %v", records)
+	}
+	// app02 has an invalid subscription status, but is in an SCA Organization
+	var got []string
+	for _, r := range records[1:] {
+		got = append(got, fmt.Sprintf("%s:%s:%s", r[0], r[2], r[5]))
+	}
+	want := "db01:valid:checkin_age,app01:valid:subscription_status,new01:valid:operating_system;subscription_status;last_checkin"
+	if strings.Join(got, ",") != want {
+		t.Errorf("Unexpected exclusions.  Expected=%q, Got=%q", want, strings.Join(got, ","))
+	}
+	if err := reportExclusions([]string{"--group", "missing"}); err == nil || !strings.Contains(err.Error(), "not a valid group") {
+		t.Errorf("Expected an unknown group to be refused, got: %v", err)
+	}
+}
+
+func TestTowerInventory(t *testing.T) {
+	defer setup(t, "http://127.0.0.1:0", "")()
+	// web-tier is renamed to web_tier, merging the two groups
+	invJSON := `{"all":{"children":["web_tier","web-tier","db"]},"web_tier":{"hosts":["web01"]},` +
+		`"web-tier":{"hosts":["web01","web02"],"vars":{"tier":"web"}},"db":{"hosts":["db01"]},` +
+		`"_meta":{"hostvars":{"web01":{},"web02":{},"db01":{}}}}` + "\n"
+	got, err := towerInventory(invJSON)
+	if err != nil {
+		t.Fatalf("towerInventory returned: %v", err)
+	}
+	if strings.HasSuffix(got, "\n") {
+		t.Error("The Tower inventory should not have a trailing newline")
+	}
+	checkGroups(t, got, map[string]string{"web_tier": "web01,web02", "db": "db01"})
+	if gjson.Get(got, "web-tier").Exists() || gjson.Get(got, "web_tier.vars.tier").String() != "web" {
+		t.Errorf("Expected web-tier, and its vars, to be merged into web_tier: %s", got)
+	}
+	if c := gjson.Get(got, "all.children").Raw; c != `["db","web_tier"]` {
+		t.Errorf("Expected the children of all to be de-duplicated and sorted, got %s", c)
+	}
+	if h := gjson.Get(got, "_meta.hostvars").Raw; h != `{"web01":{},"web02":{},"db01":{}}` {
+		t.Errorf("Expected the hostvars to be unchanged, got %s", h)
+	}
+}
+
+func TestTowerUpdate(t *testing.T) {
+	defer setup(t, "http://127.0.0.1:0", "")()
+	var requests []string
+	status := http.StatusAccepted
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, fmt.Sprintf("%s %s %s", r.Method, r.URL.Path, r.Header.Get("Authorization")))
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	cfg.Tower.URL = ts.URL + "/"
+	cfg.Tower.Token = "secret"
+	cfg.Tower.InventorySourceID = 12
+	if err := towerUpdate(); err != nil {
+		t.Errorf("towerUpdate returned: %v", err)
+	}
+	if len(requests) != 1 || requests[0] != "POST /api/v2/inventory_sources/12/update/ Bearer secret" {
+		t.Errorf("Unexpected requests: %v", requests)
+	}
+	status = http.StatusForbidden
+	if err := towerUpdate(); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("Expected a refused update to fail, got: %v", err)
+	}
+}
+
+func TestDNSMismatch(t *testing.T) {
+	defer setup(t, "http://127.0.0.1:0", "dns_check:\n  enabled: true\n  forward: true\n  timeout: 1\n")()
+	inv := testInventory(t)
+	defer inv.close()
+	// localhost is resolved from the hosts file, so the check doesn't depend on a DNS server
+	inv.json = `{"all":{"children":["valid"]},"valid":{"hosts":["good","bad"]},"_meta":{"hostvars":{` +
+		`"good":{"name":"localhost","ip":"127.0.0.1"},"bad":{"name":"localhost","ip":"10.9.9.9"}}}}`
+	inv.hgDNSMismatch()
+	checkGroups(t, inv.json, map[string]string{"dns_mismatch": "bad"})
+	if p := gjson.Get(inv.json, "_meta.hostvars.bad.satinv_dns.problems.0").String(); !strings.HasSuffix(p, "not 10.9.9.9") {
+		t.Errorf("Unexpected problem for bad: %q", p)
+	}
+	if gjson.Get(inv.json, "_meta.hostvars.good.satinv_dns.problems").Exists() {
+		t.Errorf("Expected no problems for good: %s", gjson.Get(inv.json, "_meta.hostvars.good.satinv_dns").Raw)
+	}
+	if !containsStr("dns_mismatch", uniqueStrings(gjson.Get(inv.json, "all.children").Array())) {
+		t.Errorf("Expected dns_mismatch to be a child of all: %s", gjson.Get(inv.json, "all.children").Raw)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	ts := satinvmock.Demo().Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	out, err := captureStdout(t, func() error { return explainCommand([]string{"db01", "stale"}) })
+	if err != nil {
+		t.Fatalf("explain returned: %v", err)
+	}
+	for _, want := range []string{
+		"Host: db01 (id=3, name=db01.example.com)\n",
+		"  [FAIL] checkin_age: Last checkin for db01 is too old",
+		"  [FAIL] web: 10.0.2.1 in 10.0.1.0/24\n",
+		"  [FAIL] web_servers: host_ids includes 3\n",
+		"  [PASS] databases: host_ids includes 3\n",
+		"\ndb01 is a member of stale\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected the explanation to contain %q, got:\n%s", want, out)
+		}
+	}
+	out, err = captureStdout(t, func() error { return explainCommand([]string{"web01", "stale"}) })
+	if err != nil || !strings.HasSuffix(out, "\nweb01 is not a member of stale\n") {
+		t.Errorf("Expected web01 not to be stale, got %v:\n%s", err, out)
+	}
+	if err := explainCommand([]string{"missing"}); err == nil || !strings.Contains(err.Error(), "not found in Satellite") {
+		t.Errorf("Expected an unknown host to be refused, got: %v", err)
+	}
+}
+
+func TestAssert(t *testing.T) {
+	ts := satinvmock.Demo().Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	rulesFile := path.Join(cfg.Cache.Dir, "rules.yml")
+	if err := os.MkdirAll(cfg.Cache.Dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	write := func(yml string) {
+		if err := ioutil.WriteFile(rulesFile, []byte(yml), 0644); err != nil {
+			t.Fatalf("Unable to write rules: %v", err)
+		}
+	}
+	write("rules:\n  - name: web servers are in the web cidr\n    group: web_servers\n    subset_of: web\n  - name: few stale hosts\n    group: stale\n    max_hosts: 1\n")
+	out, err := captureStdout(t, func() error { return assertCommand([]string{"--rules", rulesFile}) })
+	if err != nil || out != "PASS: 2 rules satisfied\n" {
+		t.Errorf("Expected the rules to pass, got %v: %q", err, out)
+	}
+	// db01 is stale and in databases
+	write("rules:\n  - name: databases are valid\n    group: databases\n    subset_of: valid\n  - name: few stale hosts\n    group: stale\n    max_hosts: 1\n")
+	out, err = captureStdout(t, func() error { return assertCommand([]string{"--rules", rulesFile}) })
+	if err == nil || err.Error() != "1 of 2 rules violated" || !strings.HasPrefix(out, "FAIL: ") || !strings.Contains(out, "db01") {
+		t.Errorf("Expected a rule to be violated, got %v: %q", err, out)
+	}
+	if err := assertCommand(nil); err == nil {
+		t.Error("Expected assert without a rules file to fail")
+	}
+}
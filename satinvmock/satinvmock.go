@@ -0,0 +1,309 @@
+// satinvmock provides a mock Red Hat Satellite API.  It serves canned hosts, Host Collections, Organizations,
+// subnets and Job Templates for use in integration tests and demonstrations, and records the jobs invoked.
+package satinvmock
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Timestamp layout used by the Satellite API
+const satTimestamp string = "2006-01-02 15:04:05 MST"
+
+// Host is a Satellite host record.  Only the fields satinv uses are modelled, but any others can be added to Extra.
+type Host struct {
+	ID                 int
+	Name               string
+	IP                 string
+	OperatingSystemID  int
+	OperatingSystem    string
+	SubscriptionStatus int
+	LastCheckin        time.Time // Zero omits subscription_facet_attributes
+	UpdatedAt          time.Time
+	OrganizationID     int
+	Extra              map[string]interface{}
+}
+
+// Collection is a Katello Host Collection
+type Collection struct {
+	ID      int
+	Name    string
+	HostIDs []int
+}
+
+// Organization is a Katello Organization
+type Organization struct {
+	ID                  int
+	Name                string
+	SimpleContentAccess bool
+}
+
+// Subnet is a Satellite subnet
+type Subnet struct {
+	ID      int
+	Name    string
+	Network string // e.g. 10.0.1.0
+	CIDR    int    // Prefix length
+	VLANID  int
+}
+
+// JobTemplate is a Remote Execution Job Template
+type JobTemplate struct {
+	ID   int
+	Name string
+}
+
+// Server is a mock Satellite API.  It's safe for concurrent use.
+type Server struct {
+	mu            sync.Mutex
+	hosts         []Host
+	collections   []Collection
+	organizations []Organization
+	subnets       []Subnet
+	jobTemplates  []JobTemplate
+	jobs          []json.RawMessage // Bodies of job invocation requests
+	requests      map[string]int    // Count of requests, keyed by path
+	// Username and Password are required for every request, unless both are empty
+	Username string
+	Password string
+}
+
+// NewServer returns a mock Satellite API with no content.
+func NewServer() *Server {
+	return &Server{requests: make(map[string]int)}
+}
+
+// Demo returns a mock Satellite API populated with a small estate: Hosts that are valid, stale, unsubscribed and
+// without an OS, together with Host Collections, Organizations and subnets.  Check-in times are relative to now.
+func Demo() *Server {
+	s := NewServer()
+	now := time.Now().UTC()
+	s.AddOrganization(Organization{ID: 1, Name: "Default Organization"})
+	s.AddOrganization(Organization{ID: 2, Name: "SCA Organization", SimpleContentAccess: true})
+	s.AddHost(Host{ID: 1, Name: "web01.example.com", IP: "10.0.1.1", OperatingSystemID: 1, OperatingSystem: "RedHat 8.6",
+		LastCheckin: now.Add(-time.Hour), UpdatedAt: now.Add(-time.Hour), OrganizationID: 1})
+	s.AddHost(Host{ID: 2, Name: "web02.example.com", IP: "10.0.1.2", OperatingSystemID: 1, OperatingSystem: "RedHat 8.6",
+		LastCheckin: now.Add(-2 * time.Hour), UpdatedAt: now.Add(-2 * time.Hour), OrganizationID: 1})
+	s.AddHost(Host{ID: 3, Name: "db01.example.com", IP: "10.0.2.1", OperatingSystemID: 2, OperatingSystem: "RedHat 9.0",
+		LastCheckin: now.Add(-200 * time.Hour), UpdatedAt: now.Add(-200 * time.Hour), OrganizationID: 1})
+	s.AddHost(Host{ID: 4, Name: "app01.example.com", IP: "10.0.3.1", OperatingSystemID: 1, OperatingSystem: "RedHat 8.6",
+		SubscriptionStatus: 2, LastCheckin: now.Add(-time.Hour), UpdatedAt: now.Add(-time.Hour), OrganizationID: 1})
+	s.AddHost(Host{ID: 5, Name: "app02.example.com", IP: "10.0.3.2", OperatingSystemID: 1, OperatingSystem: "RedHat 8.6",
+		SubscriptionStatus: 2, LastCheckin: now.Add(-time.Hour), UpdatedAt: now.Add(-time.Hour), OrganizationID: 2})
+	s.AddHost(Host{ID: 6, Name: "new01.example.com", IP: "10.0.4.1", UpdatedAt: now})
+	s.AddCollection(Collection{ID: 1, Name: "Web Servers", HostIDs: []int{1, 2}})
+	s.AddCollection(Collection{ID: 2, Name: "Databases", HostIDs: []int{3}})
+	s.AddSubnet(Subnet{ID: 1, Name: "Web", Network: "10.0.1.0", CIDR: 24, VLANID: 101})
+	s.AddSubnet(Subnet{ID: 2, Name: "App Tier", Network: "10.0.3.0", CIDR: 24, VLANID: 103})
+	return s
+}
+
+// AddHost adds a host to the mock Satellite.
+func (s *Server) AddHost(h Host) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hosts = append(s.hosts, h)
+}
+
+// AddCollection adds a Host Collection to the mock Satellite.
+func (s *Server) AddCollection(c Collection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.collections = append(s.collections, c)
+}
+
+// AddOrganization adds an Organization to the mock Satellite.
+func (s *Server) AddOrganization(o Organization) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.organizations = append(s.organizations, o)
+}
+
+// AddSubnet adds a subnet to the mock Satellite.
+func (s *Server) AddSubnet(n Subnet) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subnets = append(s.subnets, n)
+}
+
+// AddJobTemplate adds a Remote Execution Job Template to the mock Satellite.
+func (s *Server) AddJobTemplate(j JobTemplate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobTemplates = append(s.jobTemplates, j)
+}
+
+// Jobs returns the body of each job invocation request, in the order they were made.
+func (s *Server) Jobs() []json.RawMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]json.RawMessage{}, s.jobs...)
+}
+
+// Requests returns the number of requests made for a path (excluding the query string).
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// Start serves the mock API on a local test server.  The caller should Close it on completion.
+func (s *Server) Start() *httptest.Server {
+	return httptest.NewServer(s)
+}
+
+// record returns the JSON form of a host, as returned by the Satellite API.
+func (h Host) record() map[string]interface{} {
+	r := map[string]interface{}{
+		"id":              h.ID,
+		"name":            h.Name,
+		"ip":              h.IP,
+		"organization_id": h.OrganizationID,
+	}
+	if h.OperatingSystemID != 0 {
+		r["operatingsystem_id"] = h.OperatingSystemID
+		r["operatingsystem_name"] = h.OperatingSystem
+	}
+	if !h.LastCheckin.IsZero() {
+		r["subscription_status"] = h.SubscriptionStatus
+		r["subscription_facet_attributes"] = map[string]interface{}{
+			"last_checkin": h.LastCheckin.UTC().Format(satTimestamp),
+		}
+	}
+	if !h.UpdatedAt.IsZero() {
+		r["updated_at"] = h.UpdatedAt.UTC().Format(satTimestamp)
+	}
+	for k, v := range h.Extra {
+		r[k] = v
+	}
+	return r
+}
+
+// page returns the subset of results for the page and per_page parameters of a request.
+func page(r *http.Request, results []interface{}, defaultPerPage int) map[string]interface{} {
+	perPage, err := strconv.Atoi(r.URL.Query().Get("per_page"))
+	if err != nil || perPage <= 0 {
+		perPage = defaultPerPage
+	}
+	p, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || p <= 0 {
+		p = 1
+	}
+	start := (p - 1) * perPage
+	if start > len(results) {
+		start = len(results)
+	}
+	end := start + perPage
+	if end > len(results) {
+		end = len(results)
+	}
+	return map[string]interface{}{
+		"total":    len(results),
+		"subtotal": len(results),
+		"page":     p,
+		"per_page": perPage,
+		"results":  results[start:end],
+	}
+}
+
+// ServeHTTP implements the subset of the Satellite API used by satinv.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.URL.Path]++
+	if s.Username != "" || s.Password != "" {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != s.Username || pass != s.Password {
+			http.Error(w, `{"error":{"message":"Unable to authenticate user"}}`, http.StatusUnauthorized)
+			return
+		}
+	}
+	var body interface{}
+	switch {
+	case r.URL.Path == "/api/status":
+		body = map[string]interface{}{"result": "ok", "status": 200, "version": "3.5.1", "api_version": 2}
+	case r.URL.Path == "/api/v2/hosts":
+		body = s.hostsResponse(r)
+	case r.URL.Path == "/katello/api/host_collections":
+		results := []interface{}{}
+		for _, c := range s.collections {
+			results = append(results, map[string]interface{}{"id": c.ID, "name": c.Name})
+		}
+		body = page(r, results, 20)
+	case strings.HasPrefix(r.URL.Path, "/katello/api/host_collections/"):
+		id := strings.TrimPrefix(r.URL.Path, "/katello/api/host_collections/")
+		for _, c := range s.collections {
+			if strconv.Itoa(c.ID) == id {
+				body = map[string]interface{}{"id": c.ID, "name": c.Name, "host_ids": c.HostIDs}
+			}
+		}
+	case r.URL.Path == "/katello/api/organizations":
+		results := []interface{}{}
+		for _, o := range s.organizations {
+			results = append(results, map[string]interface{}{"id": o.ID, "name": o.Name, "simple_content_access": o.SimpleContentAccess})
+		}
+		body = page(r, results, 20)
+	case r.URL.Path == "/api/v2/subnets":
+		results := []interface{}{}
+		for _, n := range s.subnets {
+			results = append(results, map[string]interface{}{"id": n.ID, "name": n.Name, "network": n.Network,
+				"cidr": n.CIDR, "network_address": fmt.Sprintf("%s/%d", n.Network, n.CIDR), "network_type": "IPv4",
+				"vlanid": n.VLANID})
+		}
+		body = page(r, results, 20)
+	case r.URL.Path == "/api/v2/job_templates":
+		// The only search supported is name="<name>"
+		name := strings.Trim(strings.TrimPrefix(r.URL.Query().Get("search"), "name="), `"`)
+		results := []interface{}{}
+		for _, j := range s.jobTemplates {
+			if name == "" || j.Name == name {
+				results = append(results, map[string]interface{}{"id": j.ID, "name": j.Name})
+			}
+		}
+		body = page(r, results, 20)
+	case r.URL.Path == "/api/v2/job_invocations" && r.Method == http.MethodPost:
+		var job json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+			http.Error(w, fmt.Sprintf(`{"error":{"message":"%v"}}`, err), http.StatusUnprocessableEntity)
+			return
+		}
+		s.jobs = append(s.jobs, job)
+		body = map[string]interface{}{"id": len(s.jobs)}
+	}
+	if body == nil {
+		http.Error(w, fmt.Sprintf(`{"error":{"message":"Route %s not found"}}`, r.URL.Path), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// hostsResponse returns the hosts matching a request.  The only search supported is host_collection_id=<id>.
+func (s *Server) hostsResponse(r *http.Request) map[string]interface{} {
+	var members map[int]bool
+	if search := r.URL.Query().Get("search"); strings.HasPrefix(search, "host_collection_id=") {
+		members = make(map[int]bool)
+		id := strings.TrimPrefix(search, "host_collection_id=")
+		for _, c := range s.collections {
+			if strconv.Itoa(c.ID) != id {
+				continue
+			}
+			for _, h := range c.HostIDs {
+				members[h] = true
+			}
+		}
+	}
+	results := []interface{}{}
+	for _, h := range s.hosts {
+		if members == nil || members[h.ID] {
+			results = append(results, h.record())
+		}
+	}
+	return page(r, results, 20)
+}
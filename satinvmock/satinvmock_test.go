@@ -0,0 +1,114 @@
+package satinvmock
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func get(t *testing.T, url string) gjson.Result {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("Unable to read %s: %v", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d: %s", url, resp.StatusCode, b)
+	}
+	return gjson.ParseBytes(b)
+}
+
+func TestDemo(t *testing.T) {
+	s := Demo()
+	ts := s.Start()
+	defer ts.Close()
+	hosts := get(t, ts.URL+"/api/v2/hosts?per_page=1000")
+	if n := len(hosts.Get("results").Array()); n != 6 || hosts.Get("subtotal").Int() != 6 {
+		t.Errorf("Expected 6 hosts, got %d", n)
+	}
+	if hosts.Get("results.0.subscription_facet_attributes.last_checkin").String() == "" {
+		t.Error("Expected the first host to have a last_checkin")
+	}
+	page := get(t, ts.URL+"/api/v2/hosts?per_page=4&page=2")
+	if n := len(page.Get("results").Array()); n != 2 {
+		t.Errorf("Expected 2 hosts on the second page, got %d", n)
+	}
+	members := get(t, ts.URL+"/api/v2/hosts?search=host_collection_id%3D1")
+	if n := len(members.Get("results").Array()); n != 2 {
+		t.Errorf("Expected 2 members of collection 1, got %d", n)
+	}
+	collection := get(t, ts.URL+"/katello/api/host_collections/2")
+	if collection.Get("name").String() != "Databases" || collection.Get("host_ids.0").Int() != 3 {
+		t.Errorf("Unexpected collection: %s", collection.Raw)
+	}
+	if s.Requests("/api/v2/hosts") != 3 {
+		t.Errorf("Expected 3 hosts requests, got %d", s.Requests("/api/v2/hosts"))
+	}
+	resp, err := http.Get(ts.URL + "/katello/api/host_collections/99")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown collection, got %d", resp.StatusCode)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	s := NewServer()
+	s.Username = "user"
+	s.Password = "secret"
+	ts := s.Start()
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/api/v2/hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without credentials, got %d", resp.StatusCode)
+	}
+	req, _ := http.NewRequest("GET", ts.URL+"/api/v2/hosts", nil)
+	req.SetBasicAuth("user", "secret")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200 with credentials, got %d", resp.StatusCode)
+	}
+}
+
+func TestJobs(t *testing.T) {
+	s := NewServer()
+	s.AddJobTemplate(JobTemplate{ID: 7, Name: "Run Command - Script Default"})
+	s.AddJobTemplate(JobTemplate{ID: 8, Name: "Other"})
+	ts := s.Start()
+	defer ts.Close()
+	templates := get(t, ts.URL+"/api/v2/job_templates?search=name%3D%22Run+Command+-+Script+Default%22")
+	if n := len(templates.Get("results").Array()); n != 1 || templates.Get("results.0.id").Int() != 7 {
+		t.Errorf("Unexpected job templates: %s", templates.Raw)
+	}
+	resp, err := http.Post(ts.URL+"/api/v2/job_invocations", "application/json", strings.NewReader(`{"job_invocation":{"job_template_id":7}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if gjson.GetBytes(b, "id").Int() != 1 {
+		t.Errorf("Expected job 1, got %s", b)
+	}
+	jobs := s.Jobs()
+	if len(jobs) != 1 || gjson.GetBytes(jobs[0], "job_invocation.job_template_id").Int() != 7 {
+		t.Errorf("Unexpected jobs: %s", jobs)
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/log-go"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// organizationsURL returns the Satellite API URL for the list of Organizations.
+func organizationsURL() string {
+	return fmt.Sprintf("%s/katello/api/organizations?per_page=1000", cfg.API.BaseURL)
+}
+
+// loadOrganizations determines which Organizations use Simple Content Access (SCA).  Hosts in SCA Organizations don't
+// have meaningful subscription statuses, so the subscription check is bypassed for them.
+func (inv *inventory) loadOrganizations() {
+	inv.scaOrgs = make(map[string]bool)
+	if cfg.SCA != "auto" {
+		return
+	}
+	if hostsFile() != "" {
+		log.Warn("Simple Content Access modes can't be determined when reading hosts from a file; treating them as off")
+		return
+	}
+	orgs, err := inv.cache.GetURL(organizationsURL())
+	if err != nil {
+		log.Warnf("Unable to determine Simple Content Access modes: %v", err)
+		return
+	}
+	inv.checkTruncated("organizations", orgs)
+	for _, o := range orgs.Get("results").Array() {
+		sca := o.Get("simple_content_access").Bool()
+		inv.scaOrgs[o.Get("id").String()] = sca
+		log.Debugf("Organization %s: simple_content_access=%t", o.Get("name").String(), sca)
+	}
+}
+
+// hostSCA returns true if a host belongs to an Organization that uses Simple Content Access.
+func (inv *inventory) hostSCA(host gjson.Result) bool {
+	switch cfg.SCA {
+	case "on":
+		return true
+	case "off":
+		return false
+	}
+	return inv.scaOrgs[host.Get("organization_id").String()]
+}
+
+// recordSCA adds the Simple Content Access mode of each Organization to the inventory's _meta.
+func (inv *inventory) recordSCA() {
+	if len(inv.scaOrgs) == 0 {
+		return
+	}
+	var err error
+	inv.json, err = sjson.Set(inv.json, "_meta.satinv_sca", inv.scaOrgs)
+	if err != nil {
+		inv.jsonFailed("_meta.satinv_sca", err)
+	}
+}
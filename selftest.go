@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/crooks/satinv/config"
+	"github.com/crooks/satinv/rules"
+	"github.com/tidwall/gjson"
+)
+
+// selftestCommand checks that the inventory is in a format its consumers can parse.  The inventory is always checked
+// against Ansible's structural expectations.  With --ansible, it's also parsed by ansible-inventory and the result
+// compared with satinv's own view of the inventory.
+func selftestCommand(args []string) error {
+	fs := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	ansible := fs.Bool("ansible", false, "Compare the inventory with the output of ansible-inventory")
+	timeout := fs.Duration("timeout", 5*time.Minute, "Maximum time to wait for ansible-inventory")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	inv, err := newInventory()
+	if err != nil {
+		return err
+	}
+	defer inv.close()
+	if err := inv.load(); err != nil {
+		return err
+	}
+	var problems []string
+	for _, v := range rules.Validate(inv.json) {
+		problems = append(problems, v.Message)
+	}
+	if *ansible {
+		p, err := ansibleSelftest(inv.json, *timeout)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, p...)
+	}
+	for _, p := range problems {
+		fmt.Printf("FAIL: %s\n", p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("selftest found %d problems", len(problems))
+	}
+	fmt.Println("PASS: inventory is compatible")
+	return nil
+}
+
+// ansibleSelftest runs ansible-inventory, with satinv as its inventory script, and compares the outcome with the
+// inventory.  If ansible-inventory isn't installed, the test is skipped.
+func ansibleSelftest(invJSON string, timeout time.Duration) ([]string, error) {
+	ansibleInventory, err := exec.LookPath("ansible-inventory")
+	if err != nil {
+		fmt.Println("SKIP: ansible-inventory not found in PATH")
+		return nil, nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("unable to locate the satinv executable: %v", err)
+	}
+	// Ansible runs the inventory script without any flags, so the config files are passed in the environment.
+	files, err := config.Files(flags.Config)
+	if err != nil {
+		return nil, err
+	}
+	for i, f := range files {
+		if files[i], err = filepath.Abs(f); err != nil {
+			return nil, err
+		}
+	}
+	cfgFile := strings.Join(files, ",")
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, ansibleInventory, "-i", self, "--list")
+	cmd.Env = append(os.Environ(), "SATINVCFG="+cfgFile)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("ansible-inventory timed out after %s", timeout)
+		}
+		return []string{fmt.Sprintf("ansible-inventory failed: %v: %s", err, strings.TrimSpace(stderr.String()))}, nil
+	}
+	if !gjson.Valid(stdout.String()) {
+		return []string{"ansible-inventory produced invalid JSON"}, nil
+	}
+	return compareInventories(gjson.Parse(invJSON), gjson.Parse(stdout.String())), nil
+}
+
+// compareInventories returns the differences between satinv's inventory and Ansible's interpretation of it.  Every
+// group containing hosts must exist with the same members and every grouped host must have hostvars.
+func compareInventories(ours, theirs gjson.Result) []string {
+	var problems []string
+	grouped := make(map[string]bool)
+	ours.ForEach(func(key, group gjson.Result) bool {
+		name := key.String()
+		if name == "_meta" || name == "all" {
+			return true
+		}
+		expected := uniqueStrings(group.Get("hosts").Array())
+		if len(expected) == 0 {
+			return true
+		}
+		for _, h := range expected {
+			grouped[h] = true
+		}
+		theirGroup := theirs.Get(rules.Escape(name))
+		if !theirGroup.Exists() {
+			problems = append(problems, fmt.Sprintf("group %s is missing from ansible-inventory output", name))
+			return true
+		}
+		got := uniqueStrings(theirGroup.Get("hosts").Array())
+		if strings.Join(expected, ",") != strings.Join(got, ",") {
+			problems = append(problems, fmt.Sprintf("group %s has %d hosts, ansible-inventory reports %d", name, len(expected), len(got)))
+		}
+		return true
+	})
+	var missing []string
+	for h := range grouped {
+		if !theirs.Get("_meta.hostvars." + rules.Escape(h)).Exists() {
+			missing = append(missing, h)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		problems = append(problems, fmt.Sprintf("ansible-inventory has no hostvars for: %s", strings.Join(missing, ", ")))
+	}
+	return problems
+}
+
+// uniqueStrings returns the sorted, de-duplicated string values of a gjson array.
+func uniqueStrings(values []gjson.Result) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, v := range values {
+		if !seen[v.String()] {
+			seen[v.String()] = true
+			unique = append(unique, v.String())
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
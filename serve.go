@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/http/cgi"
+	"net/http/fcgi"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/config"
+	"github.com/crooks/satinv/jsonrpc"
+	"github.com/tidwall/gjson"
+)
+
+// shutdownTimeout is the time allowed for outstanding requests to complete when the daemon is stopped
+const shutdownTimeout = 10 * time.Second
+
+// daemon holds the most recent inventory and refreshes it periodically.
+type daemon struct {
+	refreshMu  sync.Mutex   // Serialises refreshes and changes to the cache
+	mu         sync.RWMutex // Guards the fields below and, in the daemon, replacement of cfg
+	json       string
+	hostGroups map[string][]string // Groups of each host, sorted
+	groupHosts map[string][]string // Hosts in each group, sorted
+	views      map[string]string   // Inventory of each view
+	auth       *serverAuth         // Authentication of requests, rebuilt when the config is reloaded
+	refreshed  time.Time
+	trigger    chan struct{} // Requests an immediate refresh
+}
+
+// newDaemon returns a daemon with an empty inventory.
+func newDaemon() *daemon {
+	return &daemon{
+		json:       "{}",
+		hostGroups: make(map[string][]string),
+		groupHosts: make(map[string][]string),
+		views:      make(map[string]string),
+		trigger:    make(chan struct{}, 1),
+	}
+}
+
+// refresh loads the inventory (rebuilding it if the cache has expired) and indexes its groups.  If the inventory can't
+// be loaded, or a rebuilt inventory is refused, the previous inventory continues to be served.
+func (d *daemon) refresh() error {
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
+	inv, err := newInventory()
+	if err != nil {
+		return err
+	}
+	err = inv.load()
+	inv.close()
+	if err != nil {
+		return err
+	}
+	hostGroups := make(map[string][]string)
+	groupHosts := make(map[string][]string)
+	for g, hosts := range groupMembers(inv.json) {
+		groupHosts[g] = []string{}
+		for h := range hosts {
+			groupHosts[g] = append(groupHosts[g], h)
+			hostGroups[h] = append(hostGroups[h], g)
+		}
+		sort.Strings(groupHosts[g])
+	}
+	for h := range hostGroups {
+		sort.Strings(hostGroups[h])
+	}
+	views := make(map[string]string)
+	for _, name := range viewNames() {
+		if views[name], err = viewInventory(inv.json, cfg.Server.Views[name]); err != nil {
+			return fmt.Errorf("unable to build view %s: %v", name, err)
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.json = inv.json
+	d.hostGroups = hostGroups
+	d.groupHosts = groupHosts
+	d.views = views
+	d.refreshed = time.Now()
+	log.Debugf("Daemon inventory refreshed: %d hosts, %d groups", len(hostGroups), len(groupHosts))
+	return nil
+}
+
+// requestRefresh schedules an immediate refresh, unless one is already pending.
+func (d *daemon) requestRefresh() {
+	select {
+	case d.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// run refreshes the inventory at each interval, or when requested.
+func (d *daemon) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.trigger:
+		case <-appCtx.Done():
+			return
+		}
+		if err := d.refresh(); err != nil {
+			log.Errorf("Unable to refresh inventory: %v", err)
+		}
+	}
+}
+
+// invalidate marks the cache items named by item (see cacheItemKeys) as expired, along with the inventory built from
+// them, and schedules a refresh.
+func (d *daemon) invalidate(item string) error {
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
+	inv, err := newInventory()
+	if err != nil {
+		return err
+	}
+	defer inv.close()
+	if _, err := inv.invalidateItem(item); err != nil {
+		return err
+	}
+	d.requestRefresh()
+	return nil
+}
+
+// reload rereads the config files and, provided they're valid, replaces the running config with them.  The inventory
+// is marked as expired so that the next refresh applies the new CIDRs, exclusions and validity rules.  If the new
+// config is invalid, the running config remains in place.  Changes to settings that only apply at startup are logged.
+func (d *daemon) reload() error {
+	if problems := config.Validate(flags.Config, flags.ConfigFormat); len(problems) > 0 {
+		return fmt.Errorf("%s: %v (%d problems in total)", flags.Config, problems[0], len(problems))
+	}
+	newCfg, err := config.ParseConfigFormat(flags.Config, flags.ConfigFormat)
+	if err != nil {
+		return err
+	}
+	auth, err := newServerAuth(newCfg)
+	if err != nil {
+		return err
+	}
+	d.refreshMu.Lock()
+	defer d.refreshMu.Unlock()
+	oldCfg, oldAuth := cfg, d.auth
+	d.setConfig(newCfg, auth)
+	inv, err := newInventory()
+	if err != nil {
+		d.setConfig(oldCfg, oldAuth)
+		return err
+	}
+	defer inv.close()
+	if oldCfg.API.RateLimit != newCfg.API.RateLimit {
+		log.Info("The api rate_limit has changed")
+		configureRateLimit()
+	}
+	for _, setting := range restartSettings(oldCfg, newCfg) {
+		log.Warnf("The %s settings have changed, but require a restart to take effect", setting)
+	}
+	if err := inv.cache.Invalidate(inventoryName); err != nil {
+		return err
+	}
+	d.requestRefresh()
+	return nil
+}
+
+// setConfig replaces the running config and the authentication built from it.  Requests are served with d.mu held, so
+// they never see the config changing beneath them; refreshes are excluded by refreshMu, which the caller must hold.
+func (d *daemon) setConfig(c *config.Config, auth *serverAuth) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cfg = c
+	d.auth = auth
+}
+
+// restartSettings returns the names of the settings, changed between two configs, that are only applied when the
+// daemon starts: Those of its listener, logging and tracing.
+func restartSettings(old, new *config.Config) []string {
+	var changed []string
+	o, n := old.Server, new.Server
+	if o.Listen != n.Listen || o.Protocol != n.Protocol || o.SocketMode != n.SocketMode || o.SocketGroup != n.SocketGroup {
+		changed = append(changed, "server listen")
+	}
+	if o.Interval != n.Interval {
+		changed = append(changed, "server interval")
+	}
+	if o.TLS != n.TLS {
+		changed = append(changed, "server tls")
+	}
+	if o.Pprof != n.Pprof {
+		changed = append(changed, "server pprof")
+	}
+	if old.Logging != new.Logging {
+		changed = append(changed, "logging")
+	}
+	if !reflect.DeepEqual(old.Tracing, new.Tracing) {
+		changed = append(changed, "tracing")
+	}
+	return changed
+}
+
+// handler wraps a handler with the daemon's authentication, so that requests are authenticated by the current config.
+func (d *daemon) handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d.mu.RLock()
+		auth := d.auth
+		d.mu.RUnlock()
+		auth.handler(h).ServeHTTP(w, r)
+	})
+}
+
+// handleReload reloads the config on receipt of SIGHUP.  The returned function stops signal handling.
+func (d *daemon) handleReload() func() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			log.Infof("Received SIGHUP, reloading %s", flags.Config)
+			if err := d.reload(); err != nil {
+				log.Errorf("Config not reloaded: %v", err)
+				continue
+			}
+			log.Info("Config reloaded")
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(sigs)
+	}
+}
+
+// stringParam decodes a single, required, string parameter from JSON-RPC params.
+func stringParam(params json.RawMessage, name string) (string, error) {
+	var p map[string]string
+	if err := json.Unmarshal(params, &p); err != nil || p[name] == "" {
+		return "", jsonrpc.InvalidParams("%s is required", name)
+	}
+	return p[name], nil
+}
+
+// hostName returns the inventory name of a host named in an RPC request.  Aliased hosts are named exactly, while other
+// hosts may also be named by their Satellite name.
+func (d *daemon) hostName(host string) string {
+	if gjson.Get(d.json, hostvarsPath(host)).Exists() {
+		return host
+	}
+	return inventoryHostname(host)
+}
+
+// rpcServer returns a JSON-RPC server exposing queries of the daemon's inventory.
+func (d *daemon) rpcServer() *jsonrpc.Server {
+	s := jsonrpc.NewServer()
+	s.Register("host.groups", func(params json.RawMessage) (interface{}, error) {
+		host, err := stringParam(params, "host")
+		if err != nil {
+			return nil, err
+		}
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		host = d.hostName(host)
+		groups, ok := d.hostGroups[host]
+		if !ok && !gjson.Get(d.json, hostvarsPath(host)).Exists() {
+			return nil, jsonrpc.InvalidParams("host %s is not in the inventory", host)
+		}
+		if groups == nil {
+			groups = []string{}
+		}
+		return groups, nil
+	})
+	s.Register("host.vars", func(params json.RawMessage) (interface{}, error) {
+		host, err := stringParam(params, "host")
+		if err != nil {
+			return nil, err
+		}
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		vars := gjson.Get(d.json, hostvarsPath(d.hostName(host)))
+		if !vars.Exists() {
+			return nil, jsonrpc.InvalidParams("host %s is not in the inventory", host)
+		}
+		return json.RawMessage(vars.Raw), nil
+	})
+	s.Register("group.hosts", func(params json.RawMessage) (interface{}, error) {
+		group, err := stringParam(params, "group")
+		if err != nil {
+			return nil, err
+		}
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		hosts, ok := d.groupHosts[group]
+		if !ok {
+			return nil, jsonrpc.InvalidParams("group %s is not in the inventory", group)
+		}
+		return hosts, nil
+	})
+	s.Register("cache.invalidate", func(params json.RawMessage) (interface{}, error) {
+		item, err := stringParam(params, "item")
+		if err != nil {
+			return nil, err
+		}
+		if err := d.invalidate(item); err != nil {
+			return nil, jsonrpc.InvalidParams("%v", err)
+		}
+		return map[string]string{"invalidated": item}, nil
+	})
+	s.Register("inventory.refresh", func(params json.RawMessage) (interface{}, error) {
+		d.requestRefresh()
+		return map[string]bool{"scheduled": true}, nil
+	})
+	s.Register("inventory.status", func(params json.RawMessage) (interface{}, error) {
+		d.mu.RLock()
+		defer d.mu.RUnlock()
+		return map[string]interface{}{
+			"refreshed": d.refreshed.UTC().Format(time.RFC3339),
+			"hosts":     len(gjson.Get(d.json, "_meta.hostvars").Map()),
+			"groups":    len(d.groupHosts),
+		}, nil
+	})
+	return s
+}
+
+// ServeHTTP returns the current inventory.
+func (d *daemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprint(w, d.json)
+}
+
+// serveCommand runs satinv as a daemon.  The inventory is refreshed periodically and served over HTTP (or FastCGI),
+// together with a JSON-RPC interface for querying it.  With the cgi protocol, a single CGI request is served instead.
+func serveCommand(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	listenAddr := fs.String("listen", cfg.Server.Listen, "Address to listen on: host:port, unix:/path/to/socket or systemd")
+	interval := fs.Duration("interval", time.Duration(cfg.Server.Interval)*time.Second, "Time between inventory refreshes")
+	protocol := fs.String("protocol", cfg.Server.Protocol, "Protocol of requests: http, fastcgi or cgi")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("invalid refresh interval: %s", *interval)
+	}
+	switch *protocol {
+	case "http", "fastcgi", "cgi":
+	default:
+		return fmt.Errorf("invalid protocol: %s", *protocol)
+	}
+	auth, err := newServerAuth(cfg)
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := serverTLS()
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil && *protocol != "http" {
+		return fmt.Errorf("server tls cannot be used with the %s protocol", *protocol)
+	}
+	d := newDaemon()
+	d.auth = auth
+	if err := d.refresh(); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/inventory", d)
+	mux.HandleFunc("/inventory/", d.serveView)
+	mux.Handle("/rpc", d.rpcServer())
+	if cfg.Server.Pprof {
+		pprofHandlers(mux)
+	}
+	handler := d.handler(mux)
+	if *protocol == "cgi" {
+		// Each CGI request is a new process, so there's nothing to refresh periodically
+		return cgi.Serve(cgiHandler(handler))
+	}
+	go d.run(*interval)
+	stopReload := d.handleReload()
+	defer stopReload()
+	l, err := listen(*listenAddr)
+	if err != nil {
+		return err
+	}
+	log.Infof("Serving inventory on %s (%s), refreshing every %s", *listenAddr, *protocol, *interval)
+	if *protocol == "fastcgi" {
+		go func() {
+			// FastCGI has no graceful shutdown, so stop accepting connections when asked to stop
+			<-appCtx.Done()
+			l.Close()
+		}()
+		if err := fcgi.Serve(l, handler); appCtx.Err() == nil {
+			return err
+		}
+		log.Info("Daemon stopped")
+		return nil
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	srv := &http.Server{Handler: handler}
+	go func() {
+		// Stop accepting connections when asked to stop, allowing outstanding requests to complete
+		<-appCtx.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+	if err := srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	log.Info("Daemon stopped")
+	return nil
+}
+
+// cgiHandler routes CGI requests by their PATH_INFO, so the endpoints have the same paths as when satinv is serving
+// HTTP, e.g. /cgi-bin/satinv/inventory is routed to /inventory.
+func cgiHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if info := os.Getenv("PATH_INFO"); info != "" {
+			r.URL.Path = info
+		}
+		h.ServeHTTP(w, r)
+	})
+}
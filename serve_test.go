@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/crooks/satinv/config"
+	"github.com/crooks/satinv/satinvmock"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// rpcCall POSTs a JSON-RPC request and returns the response.
+func rpcCall(t *testing.T, url, method, params string) gjson.Result {
+	t.Helper()
+	body := `{"jsonrpc":"2.0","id":1,"method":"` + method + `","params":` + params + `}`
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	return gjson.ParseBytes(b)
+}
+
+func TestServe(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "")()
+	d := newDaemon()
+	if err := d.refresh(); err != nil {
+		t.Fatalf("refresh returned: %v", err)
+	}
+	rpc := httptest.NewServer(d.rpcServer())
+	defer rpc.Close()
+
+	groups := rpcCall(t, rpc.URL, "host.groups", `{"host":"web01.example.com"}`)
+	if got := groups.Get("result").String(); got != `["valid","web","web_servers"]` {
+		t.Errorf("Unexpected groups for web01: %s", got)
+	}
+	hosts := rpcCall(t, rpc.URL, "group.hosts", `{"group":"valid"}`)
+	if got := hosts.Get("result").String(); got != `["app02","web01","web02"]` {
+		t.Errorf("Unexpected hosts in valid: %s", got)
+	}
+	if vars := rpcCall(t, rpc.URL, "host.vars", `{"host":"db01"}`); vars.Get("result.ip").String() != "10.0.2.1" {
+		t.Errorf("Unexpected hostvars for db01: %s", vars.Raw)
+	}
+	if missing := rpcCall(t, rpc.URL, "group.hosts", `{"group":"nonexistent"}`); !missing.Get("error").Exists() {
+		t.Error("Expected an error for an unknown group")
+	}
+
+	// Invalidating the hosts cache should cause them to be fetched again on the next refresh
+	before := sat.Requests("/api/v2/hosts")
+	if r := rpcCall(t, rpc.URL, "cache.invalidate", `{"item":"`+hostsURL()+`"}`); r.Get("error").Exists() {
+		t.Fatalf("cache.invalidate returned: %s", r.Get("error").Raw)
+	}
+	if err := d.refresh(); err != nil {
+		t.Fatalf("refresh returned: %v", err)
+	}
+	if sat.Requests("/api/v2/hosts") != before+1 {
+		t.Error("Expected hosts to be fetched again after invalidation")
+	}
+	if r := rpcCall(t, rpc.URL, "cache.invalidate", `{"item":"unknown"}`); !r.Get("error").Exists() {
+		t.Error("Expected an error invalidating an unknown item")
+	}
+	if status := rpcCall(t, rpc.URL, "inventory.status", `{}`); status.Get("result.hosts").Int() != 6 {
+		t.Errorf("Unexpected status: %s", status.Raw)
+	}
+	if !strings.Contains(d.json, `"web_servers"`) {
+		t.Error("Daemon inventory should contain the web_servers group")
+	}
+}
+
+func TestServeRefreshFails(t *testing.T) {
+	sat := satinvmock.Demo()
+	truncate := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !truncate || r.URL.Path != "/api/v2/hosts" {
+			sat.ServeHTTP(w, r)
+			return
+		}
+		// Claim more hosts than are returned
+		rec := httptest.NewRecorder()
+		sat.ServeHTTP(rec, r)
+		body, _ := sjson.Set(rec.Body.String(), "subtotal", 1000)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+	defer setup(t, ts.URL, "api:\n  retry:\n    retries: 0\nbuild:\n  on_unreachable: error\n")()
+	d := newDaemon()
+	if err := d.refresh(); err != nil {
+		t.Fatalf("refresh returned: %v", err)
+	}
+	served := d.json
+
+	// A refused inventory leaves the previous one in place
+	truncate = true
+	if err := d.invalidate(hostsURL()); err != nil {
+		t.Fatalf("invalidate returned: %v", err)
+	}
+	if err := d.refresh(); exitCode(err) != exitRefused {
+		t.Errorf("Expected a truncated refresh to be refused, got: %v", err)
+	}
+	if d.json != served {
+		t.Error("A refused refresh should not replace the served inventory")
+	}
+
+	// As does a Satellite that can't be reached
+	ts.Close()
+	if err := d.invalidate(hostsURL()); err != nil {
+		t.Fatalf("invalidate returned: %v", err)
+	}
+	if err := d.refresh(); exitCode(err) != exitUnreachable {
+		t.Errorf("Expected an unreachable Satellite to fail the refresh, got: %v", err)
+	}
+	if d.json != served {
+		t.Error("A failed refresh should not replace the served inventory")
+	}
+	rpc := httptest.NewServer(d.rpcServer())
+	defer rpc.Close()
+	if status := rpcCall(t, rpc.URL, "inventory.status", `{}`); status.Get("result.hosts").Int() != 6 {
+		t.Errorf("Unexpected status after a failed refresh: %s", status.Raw)
+	}
+}
+
+func TestReload(t *testing.T) {
+	sat := satinvmock.Demo()
+	ts := sat.Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "logging:\n  journal: true\n  level: info\n")()
+	d := newDaemon()
+	if err := d.refresh(); err != nil {
+		t.Fatalf("refresh returned: %v", err)
+	}
+	original, err := ioutil.ReadFile(flags.Config)
+	if err != nil {
+		t.Fatalf("Unable to read config: %v", err)
+	}
+	// Reloading validates the config, which requires credentials
+	yml := strings.Replace(string(original), "api:\n", "api:\n  user: satinv\n  password: changeme\n", 1)
+	yml = strings.Replace(yml, "web: 10.0.1.0/24", "db: 10.0.2.0/24", 1)
+	yml += "valid:\n  exclude_hosts:\n    - web02\n"
+	if err := os.WriteFile(flags.Config, []byte(yml), 0644); err != nil {
+		t.Fatalf("Unable to write config: %v", err)
+	}
+	if err := d.reload(); err != nil {
+		t.Fatalf("reload returned: %v", err)
+	}
+	requests := sat.Requests("/api/v2/hosts")
+	if err := d.refresh(); err != nil {
+		t.Fatalf("refresh returned: %v", err)
+	}
+	if sat.Requests("/api/v2/hosts") != requests {
+		t.Error("Reloading the config should not expire the Satellite data")
+	}
+	checkGroups(t, d.json, map[string]string{"db": "db01", "web": "", "valid": "app02,web01"})
+
+	// An invalid config leaves the running config in place
+	if err := os.WriteFile(flags.Config, []byte(yml+"bogus: true\n"), 0644); err != nil {
+		t.Fatalf("Unable to write config: %v", err)
+	}
+	if err := d.reload(); err == nil || !strings.Contains(err.Error(), "bogus") {
+		t.Errorf("Expected reload to reject an unknown key, got: %v", err)
+	}
+	if cfg.CIDRs["db"] != "10.0.2.0/24" {
+		t.Errorf("Running config should be unchanged, got cidrs: %v", cfg.CIDRs)
+	}
+}
+
+func TestReloadAuth(t *testing.T) {
+	ts := satinvmock.Demo().Start()
+	defer ts.Close()
+	views := "logging:\n  journal: true\n  level: info\nserver:\n  tokens:\n    - admin\n  views:\n    web:\n      groups:\n        - web\n      tokens:\n        - webteam\n"
+	defer setup(t, ts.URL, views)()
+	d := newDaemon()
+	auth, err := newServerAuth(cfg)
+	if err != nil {
+		t.Fatalf("newServerAuth returned: %v", err)
+	}
+	d.auth = auth
+	if err := d.refresh(); err != nil {
+		t.Fatalf("refresh returned: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/inventory", d)
+	mux.HandleFunc("/inventory/", d.serveView)
+	get := func(path, token string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		d.handler(mux).ServeHTTP(w, r)
+		return w.Code
+	}
+	if code := get("/inventory/web", "webteam"); code != http.StatusOK {
+		t.Errorf("Expected the web view to accept its token, got %d", code)
+	}
+
+	// Rotate the view's token and add another view
+	original, err := ioutil.ReadFile(flags.Config)
+	if err != nil {
+		t.Fatalf("Unable to read config: %v", err)
+	}
+	yml := strings.Replace(string(original), "api:\n", "api:\n  user: satinv\n  password: changeme\n", 1)
+	yml = strings.Replace(yml, "- webteam", "- webteam2", 1)
+	yml = strings.Replace(yml, "  views:\n", "  views:\n    db:\n      groups:\n        - db\n      tokens:\n        - dbteam\n", 1)
+	if err := os.WriteFile(flags.Config, []byte(yml), 0644); err != nil {
+		t.Fatalf("Unable to write config: %v", err)
+	}
+	if err := d.reload(); err != nil {
+		t.Fatalf("reload returned: %v", err)
+	}
+	if err := d.refresh(); err != nil {
+		t.Fatalf("refresh returned: %v", err)
+	}
+	tests := []struct {
+		path, token string
+		code        int
+	}{
+		{"/inventory/web", "webteam", http.StatusUnauthorized},
+		{"/inventory/web", "webteam2", http.StatusOK},
+		{"/inventory/db", "dbteam", http.StatusOK},
+		{"/inventory/db", "webteam2", http.StatusUnauthorized},
+		{"/inventory", "dbteam", http.StatusUnauthorized},
+		{"/inventory", "admin", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := get(tt.path, tt.token); code != tt.code {
+			t.Errorf("%s with token %s after reload: Expected %d, got %d", tt.path, tt.token, tt.code, code)
+		}
+	}
+
+	// View tokens without server tokens are refused, leaving the running config in place
+	yml = strings.Replace(yml, "  tokens:\n    - admin\n", "", 1)
+	if err := os.WriteFile(flags.Config, []byte(yml), 0644); err != nil {
+		t.Fatalf("Unable to write config: %v", err)
+	}
+	if err := d.reload(); err == nil || !strings.Contains(err.Error(), "server tokens") {
+		t.Errorf("Expected reload to refuse view tokens without server tokens, got: %v", err)
+	}
+	if code := get("/inventory", ""); code != http.StatusUnauthorized {
+		t.Errorf("Expected the full inventory to still require a token, got %d", code)
+	}
+}
+
+func TestRestartSettings(t *testing.T) {
+	old := &config.Config{}
+	old.Server.Listen = "127.0.0.1:8086"
+	old.Server.Tokens = []string{"admin"}
+	same := *old
+	same.Server.Tokens = []string{"rotated"}
+	if changed := restartSettings(old, &same); len(changed) != 0 {
+		t.Errorf("Authentication should apply without a restart, got: %v", changed)
+	}
+	changed := *old
+	changed.Server.Listen = "127.0.0.1:8087"
+	changed.Server.TLS.CertFile = "/etc/satinv/cert.pem"
+	changed.Logging.LevelStr = "debug"
+	changed.Tracing.Headers = map[string]string{"Authorization": "Bearer x"}
+	if got := strings.Join(restartSettings(old, &changed), ","); got != "server listen,server tls,logging,tracing" {
+		t.Errorf("Unexpected settings requiring a restart: %s", got)
+	}
+}
+
+func TestListen(t *testing.T) {
+	defer setup(t, "http://satellite.fake", "server:\n  socket_mode: \"0660\"\n")()
+	sock := filepath.Join(t.TempDir(), "satinv.sock")
+	// A socket left behind by a previous instance is replaced
+	for i := 0; i < 2; i++ {
+		l, err := listen("unix:" + sock)
+		if err != nil {
+			t.Fatalf("Unable to listen on %s: %v", sock, err)
+		}
+		if i == 0 {
+			// Leave the socket file in place, as if the process had been killed
+			l.(*net.UnixListener).SetUnlinkOnClose(false)
+			l.Close()
+			continue
+		}
+		defer l.Close()
+		fi, err := os.Stat(sock)
+		if err != nil {
+			t.Fatalf("Unable to stat socket: %v", err)
+		}
+		if fi.Mode().Perm() != 0660 {
+			t.Errorf("Unexpected socket mode: %o", fi.Mode().Perm())
+		}
+		go http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{}`))
+		}))
+		client := &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return new(net.Dialer).DialContext(ctx, "unix", sock)
+			},
+		}}
+		resp, err := client.Get("http://satinv/inventory")
+		if err != nil {
+			t.Fatalf("Request over unix socket failed: %v", err)
+		}
+		resp.Body.Close()
+	}
+	// Anything other than a socket is never removed
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0644)
+	if _, err := listen("unix:" + file); err == nil {
+		t.Error("Expected an error listening on a regular file")
+	}
+	os.Setenv("LISTEN_PID", "1")
+	os.Setenv("LISTEN_FDS", "1")
+	if _, err := listen("systemd"); err == nil {
+		t.Error("Expected an error for sockets passed to another process")
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS should be unset")
+	}
+}
+
+func TestCGIHandler(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/inventory", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("inventory"))
+	})
+	os.Setenv("PATH_INFO", "/inventory")
+	defer os.Unsetenv("PATH_INFO")
+	w := httptest.NewRecorder()
+	cgiHandler(mux).ServeHTTP(w, httptest.NewRequest("GET", "/cgi-bin/satinv/inventory", nil))
+	if w.Body.String() != "inventory" {
+		t.Errorf("Expected the request to be routed by PATH_INFO, got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "tokens")
+	os.WriteFile(tokenFile, []byte("# Ops team\nfiletoken\n\n"), 0600)
+	defer setup(t, "http://satellite.fake", "server:\n  tokens:\n    - s3cret\n  token_file: "+tokenFile+"\n  allow:\n    rpc:\n      - 10.0.0.0/8\n      - 127.0.0.1/32\n")()
+	auth, err := newServerAuth(cfg)
+	if err != nil {
+		t.Fatalf("newServerAuth returned: %v", err)
+	}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	tests := []struct {
+		path, remote, token string
+		code                int
+	}{
+		{"/inventory", "192.168.1.1:1234", "s3cret", http.StatusOK},
+		{"/inventory", "192.168.1.1:1234", "filetoken", http.StatusOK},
+		{"/inventory", "192.168.1.1:1234", "wrong", http.StatusUnauthorized},
+		{"/inventory", "192.168.1.1:1234", "", http.StatusUnauthorized},
+		{"/rpc", "10.1.2.3:1234", "s3cret", http.StatusOK},
+		{"/rpc", "192.168.1.1:1234", "s3cret", http.StatusForbidden},
+		// A client without an IP address, e.g. over a unix socket, isn't in any allowlist
+		{"/rpc", "@", "s3cret", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.RemoteAddr = tt.remote
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		auth.handler(ok).ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s from %s with token %q: Expected %d, got %d", tt.path, tt.remote, tt.token, tt.code, w.Code)
+		}
+	}
+}
+
+func TestViews(t *testing.T) {
+	ts := satinvmock.Demo().Start()
+	defer ts.Close()
+	defer setup(t, ts.URL, "server:\n  tokens:\n    - admin\n  views:\n    web:\n      groups:\n        - web\n      tokens:\n        - webteam\n    sca:\n      organizations:\n        - \"2\"\n      groups:\n        - valid\n")()
+	d := newDaemon()
+	if err := d.refresh(); err != nil {
+		t.Fatalf("refresh returned: %v", err)
+	}
+	web := d.views["web"]
+	if n := hostCount(web); n != 2 {
+		t.Errorf("Expected 2 hosts in the web view, got %d", n)
+	}
+	checkGroups(t, web, map[string]string{"web": "web01,web02", "valid": "web01,web02", "db": ""})
+	if all := gjson.Get(web, "all.children").String(); strings.Contains(all, `"stale"`) || !strings.Contains(all, `"web_servers"`) {
+		t.Errorf("Unexpected children of all: %s", all)
+	}
+	if !strings.Contains(gjson.Get(d.json, "all.children").String(), `"stale"`) {
+		t.Error("Expected stale to be a child of all in the full inventory")
+	}
+	sca := d.views["sca"]
+	if n := hostCount(sca); n != 1 || !gjson.Get(sca, "_meta.hostvars.app02").Exists() {
+		t.Errorf("Expected only app02 in the sca view, got: %s", gjson.Get(sca, "_meta.hostvars").Raw)
+	}
+
+	auth, err := newServerAuth(cfg)
+	if err != nil {
+		t.Fatalf("newServerAuth returned: %v", err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/inventory", d)
+	mux.HandleFunc("/inventory/", d.serveView)
+	tests := []struct {
+		path, token string
+		code        int
+	}{
+		{"/inventory/web", "webteam", http.StatusOK},
+		{"/inventory/web", "admin", http.StatusOK},
+		{"/inventory/sca", "webteam", http.StatusUnauthorized},
+		{"/inventory", "webteam", http.StatusUnauthorized},
+		{"/inventory/unknown", "admin", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		r.Header.Set("Authorization", "Bearer "+tt.token)
+		w := httptest.NewRecorder()
+		auth.handler(mux).ServeHTTP(w, r)
+		if w.Code != tt.code {
+			t.Errorf("%s with token %s: Expected %d, got %d", tt.path, tt.token, tt.code, w.Code)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshsigNamespace is the namespace of inventory signatures, as given to ssh-keygen -Y verify -n
+const sshsigNamespace = "satinv"
+
+// sshsigMagic begins both an SSH signature and the blob it signs (see PROTOCOL.sshsig in OpenSSH)
+const sshsigMagic = "SSHSIG"
+
+// sshsigHash is the hash algorithm of the signed message
+const sshsigHash = "sha512"
+
+// sshsigBlob is the data signed by an SSH signature
+type sshsigBlob struct {
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Hash      string
+}
+
+// sshsig is the wire format of an SSH signature, less its magic preamble
+type sshsig struct {
+	Version   uint32
+	PublicKey string
+	Namespace string
+	Reserved  string
+	HashAlg   string
+	Signature string
+}
+
+// signatureFile returns the file containing the detached signature of a file: <file>.sig for ssh or <file>.asc for
+// gpg.
+func signatureFile(filename string) string {
+	if cfg.Output.Signing.Method == "gpg" {
+		return filename + ".asc"
+	}
+	return filename + ".sig"
+}
+
+// signedBlob returns the data an SSH signature of a message signs.
+func signedBlob(message []byte) []byte {
+	h := sha512.Sum512(message)
+	blob := ssh.Marshal(sshsigBlob{Namespace: sshsigNamespace, HashAlg: sshsigHash, Hash: string(h[:])})
+	return append([]byte(sshsigMagic), blob...)
+}
+
+// sshSign returns an armored SSH signature of a message, compatible with ssh-keygen -Y sign.  RSA keys sign with
+// SHA-512, as OpenSSH refuses SHA-1 signatures.
+func sshSign(keyFile string, message []byte) ([]byte, error) {
+	pem, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", keyFile, err)
+	}
+	data := signedBlob(message)
+	var sig *ssh.Signature
+	if as, ok := signer.(ssh.AlgorithmSigner); ok && signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		sig, err = as.SignWithAlgorithm(rand.Reader, data, ssh.KeyAlgoRSASHA512)
+	} else {
+		sig, err = signer.Sign(rand.Reader, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	wire := ssh.Marshal(sshsig{
+		Version:   1,
+		PublicKey: string(signer.PublicKey().Marshal()),
+		Namespace: sshsigNamespace,
+		HashAlg:   sshsigHash,
+		Signature: string(ssh.Marshal(sig)),
+	})
+	encoded := base64.StdEncoding.EncodeToString(append([]byte(sshsigMagic), wire...))
+	var armored strings.Builder
+	armored.WriteString("-----BEGIN SSH SIGNATURE-----\n")
+	for len(encoded) > 70 {
+		armored.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	armored.WriteString(encoded + "\n-----END SSH SIGNATURE-----\n")
+	return []byte(armored.String()), nil
+}
+
+// sshVerify checks an armored SSH signature of a message was made by one of the keys in an authorized_keys file.
+func sshVerify(keysFile string, message, armored []byte) error {
+	body := strings.TrimSpace(string(armored))
+	if !strings.HasPrefix(body, "-----BEGIN SSH SIGNATURE-----") || !strings.HasSuffix(body, "-----END SSH SIGNATURE-----") {
+		return errors.New("not an SSH signature")
+	}
+	body = strings.TrimSuffix(strings.TrimPrefix(body, "-----BEGIN SSH SIGNATURE-----"), "-----END SSH SIGNATURE-----")
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(body), ""))
+	if err != nil || !bytes.HasPrefix(raw, []byte(sshsigMagic)) {
+		return errors.New("malformed SSH signature")
+	}
+	var s sshsig
+	if err := ssh.Unmarshal(raw[len(sshsigMagic):], &s); err != nil {
+		return fmt.Errorf("malformed SSH signature: %v", err)
+	}
+	if s.Version != 1 || s.Namespace != sshsigNamespace || s.HashAlg != sshsigHash {
+		return fmt.Errorf("unsupported SSH signature (version %d, namespace %q, hash %s)", s.Version, s.Namespace, s.HashAlg)
+	}
+	key, err := ssh.ParsePublicKey([]byte(s.PublicKey))
+	if err != nil {
+		return fmt.Errorf("malformed SSH signature key: %v", err)
+	}
+	trusted, err := trustedKey(keysFile, key)
+	if err != nil {
+		return err
+	}
+	if !trusted {
+		return fmt.Errorf("signed by an untrusted key: %s", ssh.FingerprintSHA256(key))
+	}
+	var sig ssh.Signature
+	if err := ssh.Unmarshal([]byte(s.Signature), &sig); err != nil {
+		return fmt.Errorf("malformed SSH signature: %v", err)
+	}
+	if err := key.Verify(signedBlob(message), &sig); err != nil {
+		return fmt.Errorf("bad signature by %s: %v", ssh.FingerprintSHA256(key), err)
+	}
+	log.Debugf("Good signature by %s", ssh.FingerprintSHA256(key))
+	return nil
+}
+
+// trustedKey returns true if a public key is listed in an authorized_keys file.
+func trustedKey(keysFile string, key ssh.PublicKey) (bool, error) {
+	rest, err := os.ReadFile(keysFile)
+	if err != nil {
+		return false, err
+	}
+	for len(bytes.TrimSpace(rest)) > 0 {
+		var k ssh.PublicKey
+		k, _, _, rest, err = ssh.ParseAuthorizedKey(rest)
+		if err != nil {
+			return false, fmt.Errorf("unable to parse %s: %v", keysFile, err)
+		}
+		if bytes.Equal(k.Marshal(), key.Marshal()) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// gpgCommand runs gpg with stdin as its input, returning its output, or its error output as the error if it fails.
+func gpgCommand(stdin []byte, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("gpg", append([]string{"--batch", "--yes"}, args...)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("gpg: %v: %s", err, msg)
+		}
+		return nil, fmt.Errorf("gpg: %v", err)
+	}
+	return out, nil
+}
+
+// sign returns a detached signature of content, using the configured output signing method.  gpg signs with a key in
+// the user's keyring.
+func sign(content []byte) ([]byte, error) {
+	s := cfg.Output.Signing
+	switch s.Method {
+	case "ssh":
+		return sshSign(s.Key, content)
+	case "gpg":
+		return gpgCommand(content, "--armor", "--detach-sign", "--local-user", s.Key, "--output", "-")
+	}
+	return nil, errors.New("output signing is not configured")
+}
+
+// verifyFile checks a file's detached signature was made by a trusted key: One listed in the signing public_key, an
+// authorized_keys file for ssh or a keyring for gpg (which defaults to the user's own keyring).
+func verifyFile(filename string) error {
+	s := cfg.Output.Signing
+	sigFile := signatureFile(filename)
+	switch s.Method {
+	case "ssh":
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		sig, err := os.ReadFile(sigFile)
+		if err != nil {
+			return err
+		}
+		return sshVerify(s.PublicKey, content, sig)
+	case "gpg":
+		args := []string{"--verify", sigFile, filename}
+		if s.PublicKey != "" {
+			args = append([]string{"--no-default-keyring", "--keyring", s.PublicKey}, args...)
+		}
+		_, err := gpgCommand(nil, args...)
+		return err
+	}
+	return errors.New("output signing is not configured")
+}
+
+// signedFiles returns the files written by output that are signed: The output file and, if the hostvars are output
+// separately, the hostvars_file.
+func signedFiles() []string {
+	var files []string
+	if filename := outputFile(); filename != "" {
+		files = append(files, filename)
+	}
+	if cfg.Output.Hostvars == "file" {
+		files = append(files, cfg.Output.HostvarsFile)
+	}
+	return files
+}
+
+// verifyCommand checks the signatures of the output files, or of the files given as arguments.
+func verifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	files := fs.Args()
+	if len(files) == 0 {
+		files = signedFiles()
+	}
+	if len(files) == 0 {
+		return errors.New("verify requires a file, or an output file to be configured")
+	}
+	failed := 0
+	for _, f := range files {
+		if err := verifyFile(f); err != nil {
+			fmt.Printf("FAIL: %s: %v\n", f, err)
+			failed++
+			continue
+		}
+		fmt.Printf("OK: %s\n", f)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d signatures could not be verified", failed, len(files))
+	}
+	return nil
+}
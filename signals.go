@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/Masterminds/log-go"
+)
+
+// appCtx is cancelled when satinv is asked to stop.  API requests, enrichment and inventory builds derive their
+// Contexts from it so that work in progress is abandoned cleanly.
+var appCtx = context.Background()
+
+// handleSignals cancels appCtx on receipt of SIGINT or SIGTERM.  A second signal ends the process immediately.  The
+// returned function stops signal handling.
+func handleSignals() func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	appCtx = ctx
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig, ok := <-sigs
+		if !ok {
+			return
+		}
+		log.Warnf("Received %s, cancelling outstanding work", sig)
+		cancel()
+		if sig, ok = <-sigs; ok {
+			log.Errorf("Received %s again, exiting immediately", sig)
+			os.Exit(exitCancelled)
+		}
+	}()
+	return func() {
+		signal.Stop(sigs)
+		close(sigs)
+		cancel()
+	}
+}
+
+// enterPhase records the start of a new phase of the inventory build.  If the build has been cancelled, or the previous
+// phase failed to update the inventory, an error is returned rather than continuing with incomplete data, so a partial
+// inventory is never written.
+func (inv *inventory) enterPhase(phase string) error {
+	inv.budget.enter(phase)
+	// Requests made during the phase are traced as its children
+	inv.cache.SetContext(inv.run.enter(phase))
+	if inv.jsonErr != nil {
+		return inv.jsonErr
+	}
+	if err := inv.ctx.Err(); err != nil {
+		return &exitError{code: exitCancelled, err: fmt.Errorf("inventory build cancelled before the %s phase: %v", phase, err)}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/config"
+	"github.com/tidwall/gjson"
+)
+
+// sourceURL returns the URL of a custom source.  URLs beginning with a slash are relative to the Satellite API.
+func sourceURL(s config.CustomSource) string {
+	if strings.HasPrefix(s.URL, "/") {
+		return cfg.API.BaseURL + s.URL
+	}
+	return s.URL
+}
+
+// registerSources adds the custom sources to the cache.
+func (inv *inventory) registerSources() {
+	for _, s := range cfg.CustomSources {
+		validity := s.Validity
+		if validity == 0 {
+			validity = cfg.Cache.ValidityDefault
+		}
+		inv.cache.AddURL(sourceURL(s), fmt.Sprintf("custom_%s.json", s.Name), validity)
+	}
+}
+
+// sourcePairs returns the group and host pairs selected by a custom source's path.  Each element of the selected array
+// is either an object with group and host fields or a two element array of group and host.  The host may also be an
+// array of hosts.
+func sourcePairs(response gjson.Result, path string) (pairs [][2]string) {
+	for _, e := range response.Get(path).Array() {
+		var group, hosts gjson.Result
+		if e.IsArray() {
+			group, hosts = e.Get("0"), e.Get("1")
+		} else {
+			group, hosts = e.Get("group"), e.Get("host")
+		}
+		if group.String() == "" {
+			continue
+		}
+		// Array returns a single element for a host that isn't an array
+		for _, h := range hosts.Array() {
+			if h.String() != "" {
+				pairs = append(pairs, [2]string{group.String(), h.String()})
+			}
+		}
+	}
+	return
+}
+
+// hgSources adds the groups of each custom source.  Only hosts in the inventory are added and group names are converted
+// in the same way as Host Collection names.  A source that can't be read is skipped.
+func (inv *inventory) hgSources() {
+	if len(cfg.CustomSources) == 0 || !cfg.GroupEnabled(config.GroupSources) {
+		return
+	}
+	defer timeTrack(time.Now(), "hgSources")
+	known := make(map[string]bool)
+	gjson.Get(inv.json, "_meta.hostvars").ForEach(func(k, _ gjson.Result) bool {
+		known[k.String()] = true
+		return true
+	})
+	for _, s := range cfg.CustomSources {
+		response, err := inv.cache.GetURL(sourceURL(s))
+		if err != nil {
+			log.Warnf("Unable to read custom source %s: %v", s.Name, err)
+			continue
+		}
+		inv.checkTruncated("custom source "+s.Name, response)
+		pairs := sourcePairs(response, s.Path)
+		added := 0
+		for _, p := range pairs {
+			host := inv.hostname(inventoryHostname(p[1]))
+			if !known[host] {
+				log.Debugf("Custom source %s: Ignoring unknown host %s", s.Name, p[1])
+				continue
+			}
+			group := mkInventoryName(config.GroupSources, p[0])
+			inv.addChild(group)
+			inv.addHost(group, host)
+			added++
+		}
+		log.Debugf("Custom source %s: %d of %d memberships added", s.Name, added, len(pairs))
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/config"
+	"github.com/tidwall/gjson"
+)
+
+// proxyJumps returns the jump host for each inventory host, based on its membership of the CIDR groups listed in the
+// ssh_config proxy_jump option.  If a host is in several such groups, the CIDR whose name sorts first takes
+// precedence.
+func proxyJumps(invJSON string) map[string]string {
+	var cidrNames []string
+	for name := range cfg.SSHConfig.ProxyJump {
+		cidrNames = append(cidrNames, name)
+	}
+	sort.Strings(cidrNames)
+	jumps := make(map[string]string)
+	for _, name := range cidrNames {
+		jump := cfg.SSHConfig.ProxyJump[name]
+		for _, h := range gjson.Get(invJSON, mkInventoryName(config.GroupCIDRs, name)+".hosts").Array() {
+			if existing, ok := jumps[h.String()]; ok {
+				if existing != jump {
+					log.Warnf("%s is in multiple proxy_jump CIDRs; using %s", h.String(), existing)
+				}
+				continue
+			}
+			jumps[h.String()] = jump
+		}
+	}
+	return jumps
+}
+
+// sshConfigHost returns an OpenSSH client config Host block for an inventory host.
+func sshConfigHost(h exportHost, hostname, jump string) string {
+	patterns := h.name
+	if h.fqdn != "" && h.fqdn != h.name {
+		patterns += " " + h.fqdn
+	}
+	addr := h.fqdn
+	if hostname == "ip" && h.ip != "" {
+		addr = h.ip
+	}
+	if addr == "" {
+		addr = h.name
+	}
+	block := fmt.Sprintf("Host %s\n    HostName %s\n", patterns, addr)
+	if cfg.SSHConfig.User != "" {
+		block += fmt.Sprintf("    User %s\n", cfg.SSHConfig.User)
+	}
+	if jump != "" {
+		block += fmt.Sprintf("    ProxyJump %s\n", jump)
+	}
+	return block
+}
+
+// exportSSHConfig writes an OpenSSH client config snippet containing a Host block for each host in an inventory group
+// (by default, the valid group).  Hosts in CIDRs with a configured jump host are reached via ProxyJump.
+func exportSSHConfig(args []string) error {
+	fs := flag.NewFlagSet("ssh-config", flag.ContinueOnError)
+	output := fs.String("output", "", "File to write (default stdout)")
+	group := fs.String("group", "", "Inventory group to include (default the valid group)")
+	hostname := fs.String("hostname", "ip", "Connect to hosts by ip or fqdn")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *hostname != "ip" && *hostname != "fqdn" {
+		return fmt.Errorf("hostname must be one of ip or fqdn, not %q", *hostname)
+	}
+	if *group == "" {
+		*group = mkInventoryName(config.GroupValid, "valid")
+	}
+	inv, err := newInventory()
+	if err != nil {
+		return err
+	}
+	defer inv.close()
+	if err := inv.load(); err != nil {
+		return err
+	}
+	if !gjson.Get(inv.json, *group).Exists() {
+		return fmt.Errorf("group %s is not in the inventory", *group)
+	}
+	hosts := exportHosts(inv.json, *group)
+	jumps := proxyJumps(inv.json)
+	w, err := exportWriter(*output)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if _, err := fmt.Fprintf(w, "# Generated by satinv from the %s inventory group\n", *group); err != nil {
+		return err
+	}
+	for _, h := range hosts {
+		if _, err := fmt.Fprintf(w, "\n%s", sshConfigHost(h, *hostname, jumps[h.name])); err != nil {
+			return err
+		}
+	}
+	log.Infof("Exported ssh config for %d hosts", len(hosts))
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/rules"
+	"github.com/crooks/satinv/staticinv"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// mergeStatic merges the groups and hostvars of the static inventory in merge.inventory_file into the generated
+// inventory.  Group names are used as they appear in the file, without the inventory_prefix.  Where both define the
+// same hostvar or group var, merge.precedence decides which value is retained.
+func (inv *inventory) mergeStatic() error {
+	if cfg.Merge.InventoryFile == "" {
+		return nil
+	}
+	defer timeTrack(time.Now(), "mergeStatic")
+	static, err := staticinv.Read(cfg.Merge.InventoryFile)
+	if err != nil {
+		return &exitError{code: exitConfig, err: fmt.Errorf("unable to read static inventory: %v", err)}
+	}
+	fileWins := cfg.Merge.Precedence == "file"
+	for _, h := range static.HostOrder {
+		inv.mergeVars(hostvarsPath(h), gjson.Parse(static.Hostvars[h]), fileWins)
+	}
+	for _, name := range static.GroupOrder {
+		g := static.Groups[name]
+		for _, k := range g.VarOrder {
+			path := fmt.Sprintf("%s.vars.%s", rules.Escape(name), rules.Escape(k))
+			if fileWins || !gjson.Get(inv.json, path).Exists() {
+				inv.setRaw(path, g.Vars[k])
+			}
+		}
+		switch name {
+		case "all":
+			// Children of all are top-level groups and hosts directly in all are ungrouped
+			for _, c := range g.Children {
+				inv.addChild(c)
+			}
+			continue
+		case "ungrouped":
+			continue
+		}
+		inv.addChild(name)
+		for _, h := range g.Hosts {
+			inv.addHost(name, h)
+		}
+		for _, c := range g.Children {
+			inv.addGroupChild(name, c)
+		}
+	}
+	log.Infof("Merged %d hosts and %d groups from %s", len(static.HostOrder), len(static.GroupOrder), cfg.Merge.InventoryFile)
+	return nil
+}
+
+// mergeVars merges the fields of a JSON object into the object at a path in the inventory, creating it if it doesn't
+// exist.  Fields present in both are only replaced if fileWins is true.
+func (inv *inventory) mergeVars(path string, vars gjson.Result, fileWins bool) {
+	if !gjson.Get(inv.json, path).Exists() {
+		inv.setRaw(path, vars.Raw)
+		return
+	}
+	vars.ForEach(func(k, v gjson.Result) bool {
+		field := path + "." + rules.Escape(k.String())
+		if fileWins || !gjson.Get(inv.json, field).Exists() {
+			inv.setRaw(field, v.Raw)
+		}
+		return true
+	})
+}
+
+// addGroupChild adds a group to the children of another group, unless it's already one of them.
+func (inv *inventory) addGroupChild(group, child string) {
+	path := rules.Escape(group) + ".children"
+	for _, c := range gjson.Get(inv.json, path).Array() {
+		if c.String() == child {
+			return
+		}
+	}
+	var err error
+	inv.json, err = sjson.Set(inv.json, path+".-1", child)
+	if err != nil {
+		inv.jsonFailed(path, err)
+	}
+}
+
+// setRaw sets the raw JSON value at a path in the inventory.
+func (inv *inventory) setRaw(path, raw string) {
+	var err error
+	inv.json, err = sjson.SetRaw(inv.json, path, raw)
+	if err != nil {
+		inv.jsonFailed(path, err)
+	}
+}
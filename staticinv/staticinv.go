@@ -0,0 +1,243 @@
+// staticinv reads static Ansible inventories, in either the YAML inventory format or the JSON format produced by
+// dynamic inventory scripts, so that their groups and hostvars can be merged into another inventory.
+package staticinv
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"gopkg.in/yaml.v2"
+)
+
+// Group is an inventory group
+type Group struct {
+	Hosts    []string
+	Children []string
+	Vars     map[string]string // Raw JSON values, keyed by variable name
+	VarOrder []string          // Variable names, in the order they appear in the file
+}
+
+// Inventory is the content of a static inventory.  Groups and hosts are listed in the order of their first appearance
+// in the file.
+type Inventory struct {
+	Groups     map[string]*Group
+	GroupOrder []string
+	Hostvars   map[string]string // A raw JSON object for each host
+	HostOrder  []string
+}
+
+func newInventory() *Inventory {
+	return &Inventory{Groups: make(map[string]*Group), Hostvars: make(map[string]string)}
+}
+
+// group returns the named group, creating it if it doesn't exist.
+func (inv *Inventory) group(name string) *Group {
+	g, ok := inv.Groups[name]
+	if !ok {
+		g = &Group{Vars: make(map[string]string)}
+		inv.Groups[name] = g
+		inv.GroupOrder = append(inv.GroupOrder, name)
+	}
+	return g
+}
+
+// addHost records a host and merges its vars with any from previous appearances in the file.  Later values win.
+func (inv *Inventory) addHost(name string, vars gjson.Result) {
+	hv, ok := inv.Hostvars[name]
+	if !ok {
+		hv = "{}"
+		inv.HostOrder = append(inv.HostOrder, name)
+	}
+	if vars.IsObject() {
+		hv = mergeObjects(hv, vars.Raw)
+	}
+	inv.Hostvars[name] = hv
+}
+
+// mergeObjects returns a JSON object containing the fields of a and b.  Those of b take precedence.
+func mergeObjects(a, b string) string {
+	fields := make(map[string]json.RawMessage)
+	var order []string
+	for _, obj := range []string{a, b} {
+		gjson.Parse(obj).ForEach(func(k, v gjson.Result) bool {
+			if _, ok := fields[k.String()]; !ok {
+				order = append(order, k.String())
+			}
+			fields[k.String()] = json.RawMessage(v.Raw)
+			return true
+		})
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range order {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(fields[k])
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+// setVars adds variables to a group.  Later values win.
+func (g *Group) setVars(vars gjson.Result) {
+	vars.ForEach(func(k, v gjson.Result) bool {
+		if _, ok := g.Vars[k.String()]; !ok {
+			g.VarOrder = append(g.VarOrder, k.String())
+		}
+		g.Vars[k.String()] = v.Raw
+		return true
+	})
+}
+
+// addMember appends a name to a list, unless it's already present.
+func addMember(list []string, name string) []string {
+	for _, s := range list {
+		if s == name {
+			return list
+		}
+	}
+	return append(list, name)
+}
+
+// Read parses a static inventory file.  Files with a .json extension are read as JSON; anything else as YAML.
+func Read(filename string) (*Inventory, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(filename)) != ".json" {
+		var content yaml.MapSlice
+		if err := yaml.Unmarshal(b, &content); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		if b, err = toJSON(content); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	if !gjson.ValidBytes(b) {
+		return nil, fmt.Errorf("%s: invalid JSON", filename)
+	}
+	return Parse(gjson.ParseBytes(b))
+}
+
+// Parse reads a static inventory from its JSON form.  The JSON produced by dynamic inventory scripts is recognised
+// by its _meta key; otherwise the structure of the YAML inventory format is expected.
+func Parse(content gjson.Result) (*Inventory, error) {
+	if !content.IsObject() {
+		return nil, fmt.Errorf("inventory must be an object, not %s", content.Type)
+	}
+	inv := newInventory()
+	if content.Get("_meta").Exists() {
+		return inv, inv.parseScript(content)
+	}
+	var err error
+	content.ForEach(func(name, g gjson.Result) bool {
+		err = inv.parseGroup(name.String(), g)
+		return err == nil
+	})
+	return inv, err
+}
+
+// parseScript reads the format produced by dynamic inventory scripts, where groups list their hosts and every host's
+// vars are in _meta.hostvars.
+func (inv *Inventory) parseScript(content gjson.Result) error {
+	content.ForEach(func(name, g gjson.Result) bool {
+		if name.String() == "_meta" {
+			return true
+		}
+		group := inv.group(name.String())
+		if g.IsArray() {
+			// A group may be given as a plain list of hosts
+			g = gjson.Parse(fmt.Sprintf(`{"hosts":%s}`, g.Raw))
+		}
+		for _, h := range g.Get("hosts").Array() {
+			group.Hosts = addMember(group.Hosts, h.String())
+			inv.addHost(h.String(), gjson.Result{})
+		}
+		for _, c := range g.Get("children").Array() {
+			group.Children = addMember(group.Children, c.String())
+		}
+		group.setVars(g.Get("vars"))
+		return true
+	})
+	content.Get("_meta.hostvars").ForEach(func(h, vars gjson.Result) bool {
+		inv.addHost(h.String(), vars)
+		return true
+	})
+	return nil
+}
+
+// parseGroup reads a group in the YAML inventory format, where hosts are keys mapped to their vars and children are
+// nested groups.
+func (inv *Inventory) parseGroup(name string, g gjson.Result) error {
+	if g.Exists() && g.Type != gjson.Null && !g.IsObject() {
+		return fmt.Errorf("group %s must be a mapping", name)
+	}
+	group := inv.group(name)
+	g.Get("hosts").ForEach(func(h, vars gjson.Result) bool {
+		group.Hosts = addMember(group.Hosts, h.String())
+		inv.addHost(h.String(), vars)
+		return true
+	})
+	group.setVars(g.Get("vars"))
+	var err error
+	g.Get("children").ForEach(func(c, child gjson.Result) bool {
+		group.Children = addMember(group.Children, c.String())
+		err = inv.parseGroup(c.String(), child)
+		return err == nil
+	})
+	return err
+}
+
+// toJSON converts YAML content, decoded with ordered mappings, to JSON.  The order of mapping keys is retained.
+func toJSON(v interface{}) ([]byte, error) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		var buf bytes.Buffer
+		buf.WriteByte('{')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, err := json.Marshal(fmt.Sprint(item.Key))
+			if err != nil {
+				return nil, err
+			}
+			value, err := toJSON(item.Value)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(key)
+			buf.WriteByte(':')
+			buf.Write(value)
+		}
+		buf.WriteByte('}')
+		return buf.Bytes(), nil
+	case []interface{}:
+		var buf bytes.Buffer
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			value, err := toJSON(item)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(value)
+		}
+		buf.WriteByte(']')
+		return buf.Bytes(), nil
+	default:
+		return json.Marshal(v)
+	}
+}
@@ -0,0 +1,100 @@
+package staticinv
+
+import (
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func writeTemp(t *testing.T, name, content string) string {
+	t.Helper()
+	filename := path.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatalf("Unable to write %s: %v", filename, err)
+	}
+	return filename
+}
+
+func TestReadYAML(t *testing.T) {
+	filename := writeTemp(t, "static.yml", `all:
+  hosts:
+    switch1.example.com:
+      ansible_host: 10.9.0.1
+  vars:
+    ntp_server: ntp.example.com
+  children:
+    network:
+      hosts:
+        switch1.example.com:
+          ansible_network_os: ios
+        fw1:
+      vars:
+        ansible_connection: network_cli
+      children:
+        firewalls:
+          hosts:
+            fw1:
+`)
+	inv, err := Read(filename)
+	if err != nil {
+		t.Fatalf("Read returned: %v", err)
+	}
+	if got := strings.Join(inv.GroupOrder, ","); got != "all,network,firewalls" {
+		t.Errorf("Unexpected groups: %s", got)
+	}
+	if got := strings.Join(inv.HostOrder, ","); got != "switch1.example.com,fw1" {
+		t.Errorf("Unexpected hosts: %s", got)
+	}
+	network := inv.Groups["network"]
+	if strings.Join(network.Hosts, ",") != "switch1.example.com,fw1" || strings.Join(network.Children, ",") != "firewalls" {
+		t.Errorf("Unexpected network group: %+v", network)
+	}
+	if network.Vars["ansible_connection"] != `"network_cli"` || inv.Groups["all"].Vars["ntp_server"] != `"ntp.example.com"` {
+		t.Errorf("Unexpected group vars: %v, %v", network.Vars, inv.Groups["all"].Vars)
+	}
+	// Host vars from each appearance of a host are merged
+	if want := `{"ansible_host":"10.9.0.1","ansible_network_os":"ios"}`; inv.Hostvars["switch1.example.com"] != want {
+		t.Errorf("Unexpected hostvars: Expected=%s, Got=%s", want, inv.Hostvars["switch1.example.com"])
+	}
+	if inv.Hostvars["fw1"] != "{}" {
+		t.Errorf("A host without vars should have empty hostvars, got: %s", inv.Hostvars["fw1"])
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	filename := writeTemp(t, "static.json", `{
+	"network": {"hosts": ["switch1"], "children": ["firewalls"], "vars": {"ansible_connection": "network_cli"}},
+	"firewalls": ["fw1"],
+	"_meta": {"hostvars": {"switch1": {"ansible_host": "10.9.0.1"}}}
+}`)
+	inv, err := Read(filename)
+	if err != nil {
+		t.Fatalf("Read returned: %v", err)
+	}
+	if got := strings.Join(inv.GroupOrder, ","); got != "network,firewalls" {
+		t.Errorf("Unexpected groups: %s", got)
+	}
+	if strings.Join(inv.Groups["firewalls"].Hosts, ",") != "fw1" || strings.Join(inv.Groups["network"].Children, ",") != "firewalls" {
+		t.Errorf("Unexpected groups: %+v, %+v", inv.Groups["network"], inv.Groups["firewalls"])
+	}
+	if inv.Hostvars["switch1"] != `{"ansible_host":"10.9.0.1"}` || inv.Hostvars["fw1"] != "{}" {
+		t.Errorf("Unexpected hostvars: %v", inv.Hostvars)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	for name, content := range map[string]string{
+		"list.yml":    "- foo\n- bar\n",
+		"invalid.yml": "all: [\n",
+		"group.yml":   "all:\n  children:\n    network: [foo]\n",
+		"bad.json":    "{",
+	} {
+		if _, err := Read(writeTemp(t, name, content)); err == nil {
+			t.Errorf("%s: Expected an error", name)
+		}
+	}
+	if _, err := Read(path.Join(t.TempDir(), "missing.yml")); err == nil {
+		t.Error("Expected an error for a missing file")
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/cidrs"
+)
+
+// subnetsURL returns the Satellite API URL for subnets.
+func subnetsURL() string {
+	return fmt.Sprintf("%s/api/v2/subnets?per_page=1000", cfg.API.BaseURL)
+}
+
+// loadSubnets adds a CIDR for each IPv4 subnet defined in Satellite, named by its (prefixed) subnet name.  In replace
+// mode, the subnets are used instead of the cidrs option.  In merge mode, a CIDR in the cidrs option takes precedence
+// over a subnet of the same name.
+func (inv *inventory) loadSubnets() {
+	inv.subnets = make(map[string]string)
+	if cfg.Subnets.Mode == "off" {
+		return
+	}
+	if hostsFile() != "" {
+		log.Warn("Satellite subnets can't be read when reading hosts from a file; using the cidrs option")
+		return
+	}
+	subnets, err := inv.cache.GetURL(subnetsURL())
+	if err != nil {
+		log.Warnf("Unable to read Satellite subnets: %v", err)
+		return
+	}
+	inv.checkTruncated("subnets", subnets)
+	for _, s := range subnets.Get("results").Array() {
+		if t := s.Get("network_type").String(); t != "" && t != "IPv4" {
+			continue
+		}
+		name := cfg.Subnets.Prefix + s.Get("name").String()
+		network := s.Get("network_address").String()
+		if network == "" {
+			network = fmt.Sprintf("%s/%d", s.Get("network").String(), s.Get("cidr").Int())
+		}
+		if _, ok := inv.subnets[name]; ok {
+			log.Warnf("Ignoring subnet %s (%s).  Another subnet has the same name.", name, network)
+			continue
+		}
+		inv.subnets[name] = network
+		log.Debugf("Subnet %s: network=%s, vlanid=%s", name, network, s.Get("vlanid").String())
+	}
+	cidr := make(cidrs.Cidrs)
+	if cfg.Subnets.Mode == "merge" {
+		// The cidrs option was validated when the inventory was initialised
+		if err := cidr.AddCIDRMap(cfg.CIDRs); err != nil {
+			log.Warnf("Unable to import CIDRs: %v", err)
+		}
+	}
+	var names []string
+	for name := range inv.subnets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, ok := cfg.CIDRs[name]; ok && cfg.Subnets.Mode == "merge" {
+			log.Debugf("Subnet %s is overridden by the cidrs option", name)
+			continue
+		}
+		if err := cidr.AddCIDR(name, inv.subnets[name]); err != nil {
+			log.Warnf("Ignoring subnet: %v", err)
+		}
+	}
+	inv.cidrs = cidr
+}
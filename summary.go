@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/tidwall/gjson"
+)
+
+// groupCounts returns the number of hosts in each group of an inventory.
+func groupCounts(invJSON string) map[string]int {
+	counts := make(map[string]int)
+	gjson.Parse(invJSON).ForEach(func(k, v gjson.Result) bool {
+		name := k.String()
+		if name == "_meta" || name == "all" || name == metaGroup {
+			return true
+		}
+		counts[name] = len(v.Get("hosts").Array())
+		return true
+	})
+	return counts
+}
+
+// printSummary writes the number of hosts and the membership count of every group in an inventory to stdout.
+func printSummary(invJSON string) {
+	counts := groupCounts(invJSON)
+	groups := make([]string, 0, len(counts))
+	for g := range counts {
+		groups = append(groups, g)
+	}
+	sort.Strings(groups)
+	hostCount := len(gjson.Get(invJSON, "_meta.hostvars").Map())
+	fmt.Printf("Hosts: %d\nGroups: %d\n\n", hostCount, len(groups))
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tHOSTS")
+	for _, g := range groups {
+		fmt.Fprintf(w, "%s\t%d\n", g, counts[g])
+	}
+	w.Flush()
+}
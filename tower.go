@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// towerMode returns true if the inventory should be adapted for consumption by AWX/Tower.
+func towerMode() bool {
+	return flags.Tower || cfg.Tower.Enabled
+}
+
+// towerInventory adapts an inventory for AWX/Tower.  Group names are restricted to those Ansible accepts without
+// transformation, every children list is de-duplicated and sorted and there is no trailing newline.
+func towerInventory(invJSON string) (string, error) {
+	out := "{}"
+	var err error
+	// Renaming groups can cause two groups to merge, so hosts and children are accumulated before being written.
+	hosts := make(map[string][]string)
+	children := make(map[string][]string)
+	var order []string
+	gjson.Parse(invJSON).ForEach(func(key, group gjson.Result) bool {
+		name := key.String()
+		if name == "_meta" {
+			out, err = sjson.SetRaw(out, "_meta", group.Raw)
+			return err == nil
+		}
+		valid := forceValidGroupName(name)
+		if valid != name {
+			log.Warnf("Tower: renaming group %s to %s", name, valid)
+		}
+		if _, ok := hosts[valid]; !ok {
+			order = append(order, valid)
+			hosts[valid] = nil
+		}
+		for _, h := range group.Get("hosts").Array() {
+			hosts[valid] = append(hosts[valid], h.String())
+		}
+		for _, c := range group.Get("children").Array() {
+			children[valid] = append(children[valid], forceValidGroupName(c.String()))
+		}
+		if vars := group.Get("vars"); vars.Exists() {
+			out, err = sjson.SetRaw(out, valid+".vars", vars.Raw)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, g := range order {
+		if h := uniqueOrdered(hosts[g]); len(h) > 0 {
+			if out, err = sjson.Set(out, g+".hosts", h); err != nil {
+				return "", err
+			}
+		}
+		if c := uniqueOrdered(children[g]); len(c) > 0 {
+			sort.Strings(c)
+			if out, err = sjson.Set(out, g+".children", c); err != nil {
+				return "", err
+			}
+		}
+	}
+	return strings.TrimRight(out, "\n"), nil
+}
+
+// uniqueOrdered returns the strings in a slice with duplicates removed, retaining their original order.
+func uniqueOrdered(strs []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, s := range strs {
+		if !seen[s] {
+			seen[s] = true
+			unique = append(unique, s)
+		}
+	}
+	return unique
+}
+
+// towerUpdate requests that AWX/Tower updates an inventory source, causing it to import the newly refreshed inventory.
+func towerUpdate() error {
+	url := fmt.Sprintf("%s/api/v2/inventory_sources/%d/update/", strings.TrimSuffix(cfg.Tower.URL, "/"), cfg.Tower.InventorySourceID)
+	req, err := http.NewRequest("POST", url, bytes.NewReader([]byte("{}")))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+cfg.Tower.Token)
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned: %s", url, resp.Status)
+	}
+	log.Infof("Tower: requested update of inventory source %d", cfg.Tower.InventorySourceID)
+	return nil
+}
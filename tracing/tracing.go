@@ -0,0 +1,323 @@
+// tracing records OpenTelemetry spans and exports them to a collector using OTLP over HTTP, with the JSON encoding.  It
+// implements only what satinv needs: Spans are started from a Context, which carries the parent span, and ended spans
+// are held until Flush sends them.  Until Configure is called with an endpoint, no spans are recorded.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxPending is the maximum number of ended spans held for export.  Once reached, further spans are dropped until the
+// next Flush.
+const maxPending = 10000
+
+// Kind describes the relationship of a span to its parent and children, as defined by OpenTelemetry
+type Kind int
+
+// Span kinds, numbered as in the OTLP protocol
+const (
+	KindInternal Kind = 1 // An internal operation
+	KindClient   Kind = 3 // A request to a remote service
+)
+
+// Options configure the export of spans
+type Options struct {
+	Endpoint    string            // OTLP/HTTP traces URL, e.g. http://127.0.0.1:4318/v1/traces
+	ServiceName string            // Reported as the service.name resource attribute
+	Headers     map[string]string // Added to every export request, e.g. for authentication
+	Timeout     time.Duration     // Maximum duration of an export request
+}
+
+var (
+	mu      sync.Mutex
+	opts    Options
+	enabled bool
+	pending []*Span
+	dropped int
+	client  = &http.Client{}
+)
+
+// Configure enables tracing with the given options.  An empty endpoint disables it.
+func Configure(o Options) {
+	mu.Lock()
+	defer mu.Unlock()
+	opts = o
+	enabled = o.Endpoint != ""
+	pending = nil
+	dropped = 0
+}
+
+// Enabled reports whether spans are being recorded.
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return enabled
+}
+
+type attribute struct {
+	key   string
+	value interface{}
+}
+
+// Span is a single timed operation.  A nil Span, as returned when tracing is disabled, ignores all method calls.
+type Span struct {
+	mu       sync.Mutex
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     Kind
+	start    time.Time
+	end      time.Time
+	attrs    []attribute
+	err      string
+	failed   bool
+	ended    bool
+}
+
+type spanKey struct{}
+
+// FromContext returns the span carried by a Context, or nil if there isn't one.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start begins a span.  If the Context carries a span, the new span is its child; otherwise it begins a new trace.  The
+// returned Context carries the new span.
+func Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+	s := &Span{name: name, kind: kind, start: time.Now()}
+	if parent := FromContext(ctx); parent != nil {
+		s.traceID = parent.traceID
+		s.parentID = parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttribute records an attribute of the span.  Values may be strings, bools, ints, int64s or float64s; anything
+// else is recorded as its string form.
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attrs = append(s.attrs, attribute{key, value})
+}
+
+// SetError marks the span as failed.  A nil error is ignored.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failed = true
+	s.err = err.Error()
+}
+
+// End completes the span and queues it for export.  Subsequent calls have no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+	mu.Lock()
+	defer mu.Unlock()
+	if !enabled {
+		return
+	}
+	if len(pending) >= maxPending {
+		dropped++
+		return
+	}
+	pending = append(pending, s)
+}
+
+// Inject adds a W3C traceparent header, identifying the span carried by a Context, to the headers of an outgoing
+// request.  This allows the request to be correlated with the remote service's own traces and logs.
+func Inject(ctx context.Context, h http.Header) {
+	s := FromContext(ctx)
+	if s == nil {
+		return
+	}
+	h.Set("traceparent", fmt.Sprintf("00-%s-%s-01", hex.EncodeToString(s.traceID[:]), hex.EncodeToString(s.spanID[:])))
+}
+
+// Flush exports the ended spans.  They're discarded whether or not the export succeeds.  It returns the number of
+// spans exported.
+func Flush(ctx context.Context) (int, error) {
+	mu.Lock()
+	spans := pending
+	o := opts
+	lost := dropped
+	pending = nil
+	dropped = 0
+	mu.Unlock()
+	if len(spans) == 0 {
+		return 0, nil
+	}
+	body, err := json.Marshal(exportRequest(o.ServiceName, spans))
+	if err != nil {
+		return 0, err
+	}
+	if o.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", o.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range o.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return 0, fmt.Errorf("collector returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if lost > 0 {
+		return len(spans), fmt.Errorf("dropped %d spans in excess of the export limit", lost)
+	}
+	return len(spans), nil
+}
+
+// The following types are the OTLP JSON encoding of an ExportTraceServiceRequest.  IDs are hex encoded and 64-bit
+// integers are strings.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              Kind           `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"` // 0 is unset, 2 is an error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// keyValue encodes an attribute.
+func keyValue(key string, value interface{}) otlpKeyValue {
+	var v otlpValue
+	switch value := value.(type) {
+	case string:
+		v.StringValue = &value
+	case bool:
+		v.BoolValue = &value
+	case int:
+		s := strconv.Itoa(value)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &value
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+	return otlpKeyValue{Key: key, Value: v}
+}
+
+// exportRequest encodes spans for export.
+func exportRequest(service string, spans []*Span) otlpRequest {
+	var encoded []otlpSpan
+	var zero [8]byte
+	for _, s := range spans {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != zero {
+			span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attrs {
+			span.Attributes = append(span.Attributes, keyValue(a.key, a.value))
+		}
+		if s.failed {
+			span.Status = otlpStatus{Code: 2, Message: s.err}
+		}
+		s.mu.Unlock()
+		encoded = append(encoded, span)
+	}
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpKeyValue{keyValue("service.name", service)}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "github.com/crooks/satinv"}, Spans: encoded}},
+	}}}
+}
@@ -0,0 +1,98 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestDisabled(t *testing.T) {
+	Configure(Options{})
+	ctx, s := Start(context.Background(), "noop", KindInternal)
+	if s != nil || FromContext(ctx) != nil {
+		t.Error("Expected no span when tracing is disabled")
+	}
+	// A nil span ignores method calls
+	s.SetAttribute("key", "value")
+	s.SetError(errors.New("failed"))
+	s.End()
+	if n, err := Flush(context.Background()); n != 0 || err != nil {
+		t.Errorf("Expected nothing to flush, got %d, %v", n, err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	var body []byte
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		auth = r.Header.Get("Authorization")
+	}))
+	defer ts.Close()
+	Configure(Options{Endpoint: ts.URL, ServiceName: "satinv", Headers: map[string]string{"Authorization": "Bearer token"}})
+	defer Configure(Options{})
+
+	ctx, root := Start(context.Background(), "refresh", KindInternal)
+	cctx, child := Start(ctx, "GET", KindClient)
+	child.SetAttribute("http.status_code", 500)
+	child.SetAttribute("cache.hit", false)
+	child.SetError(errors.New("Status error"))
+	h := make(http.Header)
+	Inject(cctx, h)
+	child.End()
+	root.End()
+	root.End()
+
+	n, err := Flush(context.Background())
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 spans exported, got %d, %v", n, err)
+	}
+	if auth != "Bearer token" {
+		t.Errorf("Expected the configured headers, got Authorization=%q", auth)
+	}
+	rs := gjson.GetBytes(body, "resourceSpans.0")
+	if rs.Get("resource.attributes.0.value.stringValue").String() != "satinv" {
+		t.Errorf("Unexpected resource: %s", rs.Get("resource").Raw)
+	}
+	spans := rs.Get("scopeSpans.0.spans").Array()
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got: %s", rs.Raw)
+	}
+	c, r := spans[0], spans[1]
+	if c.Get("traceId").String() != r.Get("traceId").String() || c.Get("parentSpanId").String() != r.Get("spanId").String() {
+		t.Errorf("GET should be a child of refresh: %s, %s", c.Raw, r.Raw)
+	}
+	if r.Get("parentSpanId").Exists() || c.Get("kind").Int() != 3 || c.Get("status.code").Int() != 2 {
+		t.Errorf("Unexpected spans: %s, %s", c.Raw, r.Raw)
+	}
+	if c.Get(`attributes.#(key=="http.status_code").value.intValue`).String() != "500" {
+		t.Errorf("Unexpected attributes: %s", c.Get("attributes").Raw)
+	}
+	want := "00-" + c.Get("traceId").String() + "-" + c.Get("spanId").String() + "-01"
+	if h.Get("traceparent") != want {
+		t.Errorf("Unexpected traceparent: Expected=%s, Got=%s", want, h.Get("traceparent"))
+	}
+	if n, _ := Flush(context.Background()); n != 0 {
+		t.Errorf("Spans should only be exported once, got %d", n)
+	}
+}
+
+func TestExportError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unauthorised", http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+	Configure(Options{Endpoint: ts.URL})
+	defer Configure(Options{})
+	_, s := Start(context.Background(), "refresh", KindInternal)
+	s.End()
+	if _, err := Flush(context.Background()); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Errorf("Expected a 401 error, got: %v", err)
+	}
+}
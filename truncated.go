@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/notifier"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// truncation compares the number of results in a Satellite API response with the number it claims to contain.  The
+// subtotal (the number of records matching any search) is preferred over the total.  It returns a description of the
+// discrepancy, or an empty string if the response is complete.
+func truncation(gj gjson.Result) string {
+	results := gj.Get("results")
+	if !results.IsArray() {
+		return ""
+	}
+	expected := gj.Get("subtotal")
+	if !expected.Exists() {
+		expected = gj.Get("total")
+	}
+	if !expected.Exists() {
+		return ""
+	}
+	got := len(results.Array())
+	if int64(got) == expected.Int() {
+		return ""
+	}
+	return fmt.Sprintf("%d of %d results returned", got, expected.Int())
+}
+
+// checkTruncated records a Satellite API response that contains fewer results than it claims.
+func (inv *inventory) checkTruncated(name string, gj gjson.Result) {
+	if problem := truncation(gj); problem != "" {
+		log.Warnf("Satellite response for %s is truncated: %s", name, problem)
+		inv.truncated = append(inv.truncated, fmt.Sprintf("%s: %s", name, problem))
+	}
+}
+
+// handleTruncated acts on any truncated API responses according to the on_truncation option.  Either the inventory is
+// refused, by returning an error, or the truncated responses are listed in _meta.truncated so consumers can decide for
+// themselves.
+func (inv *inventory) handleTruncated() error {
+	if len(inv.truncated) == 0 {
+		return nil
+	}
+	inv.notify(notifier.KindAlert, "truncated Satellite responses", strings.Join(inv.truncated, "\n"))
+	if cfg.OnTruncation == "error" {
+		return &exitError{code: exitRefused, err: fmt.Errorf("refusing to publish an inventory built from %d truncated Satellite responses", len(inv.truncated))}
+	}
+	var err error
+	inv.json, err = sjson.Set(inv.json, "_meta.truncated", inv.truncated)
+	if err != nil {
+		return &exitError{code: exitOutput, err: fmt.Errorf("unable to list the truncated responses: %v", err)}
+	}
+	return nil
+}
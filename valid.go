@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/Masterminds/log-go"
+	"github.com/crooks/satinv/config"
+	"github.com/crooks/satinv/multire"
+	"github.com/tidwall/gjson"
+)
+
+// The conditions a host must satisfy to be a member of the valid group
+const (
+	checkIncluded       string = "include"
+	checkExcludedHost   string = "exclude_hosts"
+	checkExcludedRegex  string = "exclude_regex"
+	checkExcludedField  string = "exclude_fields"
+	checkExcludedParam  string = "exclude_parameter"
+	checkOS             string = "operating_system"
+	checkSubscription   string = "subscription_status"
+	checkCheckinPresent string = "last_checkin"
+	checkCheckinAge     string = "checkin_age"
+)
+
+// fieldAliases are the shorthand names that exclude_fields accepts in place of a gjson path
+var fieldAliases = map[string]string{
+	"fqdn":     "name",
+	"location": "location_name",
+}
+
+// fieldRegex is a compiled exclude_fields entry
+type fieldRegex struct {
+	field string // The configured field name
+	path  string // gjson path of the field within the host record
+	re    *regexp.Regexp
+}
+
+// validRules contains the conditions for membership of a single valid group
+type validRules struct {
+	group         string // Name of the inventory group
+	primary       bool   // The principal valid group (as opposed to a variant)
+	cfg           config.Valid
+	allowlist     bool // Only hosts matching include_hosts or include_regex are valid
+	includeRE     multire.MultiRE
+	excludeRE     multire.MultiRE
+	excludeFields []fieldRegex
+	oldest        time.Time // Hosts that last checked in before this time are invalid
+}
+
+// newValidRules compiles the conditions for a valid group.
+func newValidRules(group string, v config.Valid) (validRules, error) {
+	includeRE, err := multire.InitRegex(v.IncludeRegex)
+	if err != nil {
+		return validRules{}, fmt.Errorf("%s: %v", group, err)
+	}
+	excludeRE, err := multire.InitRegex(v.ExcludeRegex)
+	if err != nil {
+		return validRules{}, fmt.Errorf("%s: %v", group, err)
+	}
+	var excludeFields []fieldRegex
+	for _, f := range v.ExcludeFields {
+		if f.Field == "" {
+			return validRules{}, fmt.Errorf("%s: exclude_fields regex %q has no field", group, f.Regex)
+		}
+		re, err := regexp.Compile(f.Regex)
+		if err != nil {
+			return validRules{}, fmt.Errorf("%s: %v", group, err)
+		}
+		path := f.Field
+		if alias, ok := fieldAliases[f.Field]; ok {
+			path = alias
+		}
+		excludeFields = append(excludeFields, fieldRegex{field: f.Field, path: path, re: re})
+	}
+	rules := validRules{
+		group:         group,
+		cfg:           v,
+		allowlist:     len(v.IncludeHosts) > 0 || len(v.IncludeRegex) > 0,
+		includeRE:     includeRE,
+		excludeRE:     excludeRE,
+		excludeFields: excludeFields,
+		// An age in hours beyond which hosts will be considered invalid
+		oldest: time.Now().Add(-time.Hour * time.Duration(v.Hours)),
+	}
+	log.Debugf("%s: Hosts older then %s will be deemed invalid", group, rules.oldest.Format(shortDate))
+	return rules, nil
+}
+
+// allValidRules returns the conditions for the principal valid group followed by each of the configured variants
+// (sorted by name).  Variants are emitted as groups named valid_<variant>.
+func allValidRules() ([]validRules, error) {
+	primary, err := newValidRules(mkInventoryName(config.GroupValid, "valid"), cfg.Valid)
+	if err != nil {
+		return nil, err
+	}
+	primary.primary = true
+	all := []validRules{primary}
+	var names []string
+	for name := range cfg.ValidVariants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rules, err := newValidRules(mkInventoryName(config.GroupValid, "valid_"+name), cfg.ValidVariants[name])
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, rules)
+	}
+	return all, nil
+}
+
+// withOverride returns a copy of the rules with the conditions of a valid_overrides entry applied.
+func (rules validRules) withOverride(o config.ValidOverride) validRules {
+	if o.Hours > 0 {
+		rules.cfg.Hours = o.Hours
+		rules.oldest = time.Now().Add(-time.Hour * time.Duration(o.Hours))
+	}
+	if o.Unlicensed != nil {
+		rules.cfg.Unlicensed = *o.Unlicensed
+	}
+	return rules
+}
+
+// hostRules returns the rules of the principal valid group as overridden for a host, and true, if the host is a
+// member of a Host Collection or CIDR with a valid_overrides entry.  When several entries apply, the first in
+// lexical order of name is used.  Valid variants are never overridden.
+func (inv *inventory) hostRules(rules validRules, hostNameShort string, cidrGroups []string) (validRules, bool) {
+	if !rules.primary || len(cfg.ValidOverrides) == 0 {
+		return rules, false
+	}
+	var names []string
+	for name := range cfg.ValidOverrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if containsStr(name, cidrGroups) || containsStr(name, inv.memberOf[hostNameShort]) {
+			log.Debugf("%s: Applying valid_overrides %s to %s", rules.group, name, hostNameShort)
+			return rules.withOverride(cfg.ValidOverrides[name]), true
+		}
+	}
+	return rules, false
+}
+
+// validCheck is the outcome of testing a host against a single condition of the valid group
+type validCheck struct {
+	name   string // The condition tested
+	passed bool
+	detail string // Human readable explanation of the outcome
+	warn   bool   // Failure was caused by missing or malformed Satellite data
+}
+
+// validChecks tests a host against every condition required for membership of the valid group.  All the conditions
+// are evaluated, even after a failure, so the complete picture is available to explain a host's status.
+func (inv *inventory) validChecks(host gjson.Result, hostNameShort string, rules validRules) []validCheck {
+	checks := append(inv.validStaticChecks(host, hostNameShort, rules), inv.validParameterCheck(hostNameShort))
+	return append(checks, validCheckinChecks(host, hostNameShort, rules)...)
+}
+
+// checkAdder returns a function that appends the outcome of a condition to a slice of checks.
+func checkAdder(checks *[]validCheck) func(string, bool, bool, string, ...interface{}) {
+	return func(name string, passed, warn bool, format string, args ...interface{}) {
+		*checks = append(*checks, validCheck{name: name, passed: passed, warn: warn, detail: fmt.Sprintf(format, args...)})
+	}
+}
+
+// validStaticChecks tests the conditions of the valid group that depend only on the host's Satellite record and the
+// configuration.  Their outcome only changes when the host is updated, so they can be cached between runs.
+func (inv *inventory) validStaticChecks(host gjson.Result, hostNameShort string, rules validRules) []validCheck {
+	var checks []validCheck
+	add := checkAdder(&checks)
+	// When an allowlist is configured, only the hosts it matches can be valid
+	switch {
+	case !rules.allowlist:
+		add(checkIncluded, true, false, "No include_hosts or include_regex are configured")
+	case containsStr(hostNameShort, rules.cfg.IncludeHosts):
+		add(checkIncluded, true, false, "Host %s is listed in include_hosts", hostNameShort)
+	case rules.includeRE.Match(hostNameShort):
+		add(checkIncluded, true, false, "Host %s matches an include_regex", hostNameShort)
+	default:
+		add(checkIncluded, false, false, "Host %s is not matched by include_hosts or include_regex", hostNameShort)
+	}
+	// Test if the host is excluded in the Config file
+	if containsStr(hostNameShort, rules.cfg.ExcludeHosts) {
+		add(checkExcludedHost, false, false, "Host %s is excluded by exclude_hosts", hostNameShort)
+	} else {
+		add(checkExcludedHost, true, false, "Host %s is not listed in exclude_hosts", hostNameShort)
+	}
+	// Test if the host is excluded by regex matching the hostname
+	if rules.excludeRE.Match(hostNameShort) {
+		add(checkExcludedRegex, false, false, "Host %s is excluded by Regular Expression match", hostNameShort)
+	} else {
+		add(checkExcludedRegex, true, false, "Host %s does not match any exclude_regex", hostNameShort)
+	}
+	// Test if the host is excluded by regex matching other fields of its record
+	if f := excludedField(host, rules.excludeFields); f != nil {
+		add(checkExcludedField, false, false, "Host %s is excluded by exclude_fields: %s %q matches %s", hostNameShort, f.field, host.Get(f.path).String(), f.re)
+	} else {
+		add(checkExcludedField, true, false, "Host %s does not match any exclude_fields", hostNameShort)
+	}
+	// Check the host has a valid Operating System installed
+	osid := host.Get("operatingsystem_id")
+	if !osid.Exists() || osid.Int() == 0 {
+		add(checkOS, false, false, "No valid OS found for %s", hostNameShort)
+	} else {
+		add(checkOS, true, false, "Operating System: %s", host.Get("operatingsystem_name").String())
+	}
+	// Ensure the host has a valid subscription
+	subStatus := host.Get("subscription_status")
+	if inv.hostSCA(host) {
+		add(checkSubscription, true, false, "Organization %s uses Simple Content Access", host.Get("organization_name").String())
+	} else if !subStatus.Exists() {
+		add(checkSubscription, false, true, "subscription_status not found for %s", hostNameShort)
+	} else if subStatus.Int() != 0 && !rules.cfg.Unlicensed {
+		add(checkSubscription, false, false, "Invalid subscription status (%d) for %s", subStatus.Int(), hostNameShort)
+	} else {
+		add(checkSubscription, true, false, "Subscription status: %d", subStatus.Int())
+	}
+	return checks
+}
+
+// validCheckinChecks tests the host's last checkin time.  These conditions are time dependent, so they're evaluated
+// on every run.
+func validCheckinChecks(host gjson.Result, hostNameShort string, rules validRules) []validCheck {
+	var checks []validCheck
+	add := checkAdder(&checks)
+	// Check last_checkin date
+	checkin := host.Get("subscription_facet_attributes.last_checkin")
+	if !checkin.Exists() {
+		add(checkCheckinPresent, false, true, "subscription_facet_attributes.last_checkin not found for %s", hostNameShort)
+		return checks
+	}
+	satTime, err := satTimestamp(checkin.String())
+	if err != nil {
+		// consider the host to be invalid
+		add(checkCheckinPresent, false, true, "Cannot parse date/time string %s for host %s", checkin.String(), hostNameShort)
+		return checks
+	}
+	add(checkCheckinPresent, true, false, "Last checkin: %s", satTime.Format(shortDate))
+	age := time.Since(satTime).Round(time.Minute)
+	if satTime.Before(rules.oldest) {
+		add(checkCheckinAge, false, false, "Last checkin for %s is too old (%s ago, limit is %d hours)", hostNameShort, age, rules.cfg.Hours)
+	} else {
+		add(checkCheckinAge, true, false, "Last checkin was %s ago (limit is %d hours)", age, rules.cfg.Hours)
+	}
+	return checks
+}
+
+// excludedField returns the first exclude_fields entry that matches a host, or nil if none of them do.  Fields that
+// are absent from the host's record never match.
+func excludedField(host gjson.Result, fields []fieldRegex) *fieldRegex {
+	for i, f := range fields {
+		value := host.Get(f.path)
+		if value.Exists() && f.re.MatchString(value.String()) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// firstFailure returns the first failed check, or nil if all the checks passed.
+func firstFailure(checks []validCheck) *validCheck {
+	for i := range checks {
+		if !checks[i].passed {
+			return &checks[i]
+		}
+	}
+	return nil
+}
+
+// hgValid creates an inventory group of hosts that meet "valid" conditions.  The outcome of the static checks is
+// provided by the caller (as it may have been cached) and only the checkin checks are evaluated here.
+func (inv *inventory) hgValid(b *hostBuild, host gjson.Result, rules validRules, static []validCheck) {
+	// The parameter may be inherited, so its outcome isn't cached with the static checks
+	checks := append(static, inv.validParameterCheck(inventoryHostname(host.Get("name").String())))
+	failed := firstFailure(append(checks, validCheckinChecks(host, b.name, rules)...))
+	if rules.primary {
+		inv.run.host(failed)
+	}
+	if failed == nil {
+		// All the conditions passed; this is a valid host.
+		if cfg.GroupEnabled(config.GroupValid) {
+			b.addGroup(rules.group, false)
+		}
+		return
+	}
+	switch {
+	case failed.warn && rules.primary:
+		// Missing data is only worth warning about once per host, not for every variant
+		log.Warnf("%s: %s", rules.group, failed.detail)
+	case failed.name == checkOS || !rules.primary:
+		log.Debugf("%s: %s", rules.group, failed.detail)
+	default:
+		log.Infof("%s: %s", rules.group, failed.detail)
+	}
+	if failed.name == checkCheckinAge && rules.primary && cfg.GroupEnabled(config.GroupStale) {
+		// Hosts that only fail because they've not checked in recently are grouped to provide a target for remediation.
+		b.addGroup(mkInventoryName(config.GroupStale, "stale"), true)
+	}
+}
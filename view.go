@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/crooks/satinv/config"
+	"github.com/crooks/satinv/rules"
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// viewHosts returns the hosts of an inventory that are in a view: Members of any of its groups and of any of its
+// organizations.
+func viewHosts(invJSON string, v config.View) map[string]bool {
+	members := groupMembers(invJSON)
+	hosts := make(map[string]bool)
+	gjson.Get(invJSON, "_meta.hostvars").ForEach(func(k, vars gjson.Result) bool {
+		name := k.String()
+		if len(v.Groups) > 0 {
+			inGroup := false
+			for _, g := range v.Groups {
+				inGroup = inGroup || members[g][name]
+			}
+			if !inGroup {
+				return true
+			}
+		}
+		if len(v.Organizations) > 0 {
+			org := vars.Get("organization_name").String()
+			id := vars.Get("organization_id").String()
+			if !containsStr(org, v.Organizations) && (id == "" || !containsStr(id, v.Organizations)) {
+				return true
+			}
+		}
+		hosts[name] = true
+		return true
+	})
+	return hosts
+}
+
+// viewInventory returns the subset of an inventory that's in a view.  Groups without any of the view's hosts are
+// omitted, unless one of their children remains; the all group is always retained.
+func viewInventory(invJSON string, v config.View) (string, error) {
+	hosts := viewHosts(invJSON, v)
+	inv := gjson.Parse(invJSON)
+	kept := map[string]bool{"all": true, metaGroup: true}
+	inv.ForEach(func(k, g gjson.Result) bool {
+		for _, h := range g.Get("hosts").Array() {
+			if hosts[h.String()] {
+				kept[k.String()] = true
+				break
+			}
+		}
+		return true
+	})
+	// Retain the parents of retained groups, however deeply they're nested
+	for changed := true; changed; {
+		changed = false
+		inv.ForEach(func(k, g gjson.Result) bool {
+			if kept[k.String()] {
+				return true
+			}
+			for _, c := range g.Get("children").Array() {
+				if kept[c.String()] {
+					kept[k.String()] = true
+					changed = true
+					break
+				}
+			}
+			return true
+		})
+	}
+	out := "{}"
+	var err error
+	inv.ForEach(func(k, g gjson.Result) bool {
+		name := k.String()
+		if name == "_meta" || !kept[name] {
+			return true
+		}
+		raw := g.Raw
+		if g.Get("hosts").Exists() {
+			raw, err = sjson.Set(raw, "hosts", filterStrings(g.Get("hosts"), hosts))
+		}
+		if err == nil && g.Get("children").Exists() {
+			raw, err = sjson.Set(raw, "children", filterStrings(g.Get("children"), kept))
+		}
+		if err == nil {
+			out, err = sjson.SetRaw(out, rules.Escape(name), raw)
+		}
+		return err == nil
+	})
+	if err == nil {
+		out, err = sjson.SetRaw(out, "_meta.hostvars", viewHostvars(inv.Get("_meta.hostvars"), hosts))
+	}
+	if err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// filterStrings returns the elements of an array that are in a set.
+func filterStrings(array gjson.Result, set map[string]bool) []string {
+	filtered := []string{}
+	for _, e := range array.Array() {
+		if set[e.String()] {
+			filtered = append(filtered, e.String())
+		}
+	}
+	return filtered
+}
+
+// viewHostvars returns the hostvars object of the hosts in a view, in their original order.
+func viewHostvars(hostvars gjson.Result, hosts map[string]bool) string {
+	var sb strings.Builder
+	sb.WriteByte('{')
+	first := true
+	hostvars.ForEach(func(k, v gjson.Result) bool {
+		if hosts[k.String()] {
+			if !first {
+				sb.WriteByte(',')
+			}
+			first = false
+			key, _ := json.Marshal(k.String())
+			sb.Write(key)
+			sb.WriteByte(':')
+			sb.WriteString(v.Raw)
+		}
+		return true
+	})
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// viewNames returns the names of the configured views, sorted.
+func viewNames() []string {
+	var names []string
+	for name := range cfg.Server.Views {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// serveView returns the inventory of the view named by the request path, /inventory/<view>.
+func (d *daemon) serveView(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/inventory/")
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	view, ok := d.views[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(view))
+}